@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	jsonenc "encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	offline      bool
+	resultFormat string
+	modules      []string
+
+	// Definition of the apply subcommand
+	applyCmd = &cobra.Command{
+		Use:   "apply [file|url|-]",
+		Short: "Apply alpine-data to the system, or an alternate root",
+		Long: `Apply provisions the system with the given alpine-data (YAML or JSON, in any of
+the supported formats), read from a file, url or stdin ('-' or no argument),
+instead of fetching it from the datasources. With --offline no vendor-data,
+kernel boot parameter overrides or phone_home are used, and with --root an
+image being built is provisioned. The result is printed when done; with
+--result json as JSON on stdout, while logging goes to stderr.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if resultFormat != "text" && resultFormat != "json" {
+				fmt.Fprintf(os.Stderr, "Unknown result format: %s\n", resultFormat)
+				os.Exit(1)
+			}
+			setupLogging()
+			if resultFormat == "json" {
+				// stdout only contains the result
+				lift.SetOutput(os.Stderr)
+			}
+
+			source := "-"
+			if len(args) > 0 {
+				source = args[0]
+			}
+			var data []byte
+			var err error
+			if source == "-" {
+				data, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				data, err = lift.LoadAlpineData(source, nil)
+			}
+			if err != nil {
+				log.Errorf("Error reading %s: %v", source, err)
+				os.Exit(1)
+			}
+
+			l, err := newLift()
+			if err != nil {
+				log.Error(err)
+				log.Error("Lift aborted")
+				os.Exit(1)
+			}
+			if source != "-" {
+				l.DataURL = source
+			}
+			l.Offline = offline
+			l.Modules = modules
+
+			err = l.Apply(data)
+			status := l.Status(err)
+			if resultFormat == "json" {
+				out, _ := jsonenc.MarshalIndent(status, "", "  ")
+				fmt.Println(string(out))
+			} else {
+				printStatus(status)
+			}
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	applyCmd.Flags().BoolVar(&offline, "offline", false, "don't use vendor-data, kernel boot parameter overrides or phone_home")
+	applyCmd.Flags().StringVar(&resultFormat, "result", "text", "format of the printed result (text or json)")
+	applyCmd.Flags().StringSliceVar(&modules, "modules", nil, "only run these modules (default all)")
+	RootCmd.AddCommand(applyCmd)
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	dhcpOption int
+
+	// Definition of the dhcp-hook subcommand
+	dhcpHookCmd = &cobra.Command{
+		Use:   "dhcp-hook",
+		Short: "Install the udhcpc hook that records the alpine-data url from DHCP",
+		Long: `Dhcp-hook installs a udhcpc hook, which records the DHCP option with the
+alpine-data url whenever a lease is bound or renewed, for the dhcp datasource.
+With --root it's installed in an image being built. For udhcpc to request the
+option, add 'udhcpc_opts -O <option>' to the DHCP interfaces in
+/etc/network/interfaces; without the hook, lift requests the option itself.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := lift.InstallDHCPHook(viper.GetString("root"), dhcpOption); err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	dhcpHookCmd.Flags().IntVar(&dhcpOption, "option", lift.DefaultDHCPOption, "DHCP option with the alpine-data url")
+	RootCmd.AddCommand(dhcpHookCmd)
+}
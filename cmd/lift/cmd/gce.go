@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	watchKeys bool
+
+	// Definition of the gce-sync-keys subcommand
+	gceSyncKeysCmd = &cobra.Command{
+		Use:   "gce-sync-keys",
+		Short: "Sync the ssh keys from the GCE metadata into authorized_keys",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := lift.SyncGCEKeys(watchKeys); err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	gceSyncKeysCmd.Flags().BoolVarP(&watchKeys, "watch", "w", false, "keep running, and sync again whenever the metadata changes")
+	RootCmd.AddCommand(gceSyncKeysCmd)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/bjwschaap/alpine-lift/pkg/lift"
 	homedir "github.com/mitchellh/go-homedir"
@@ -21,37 +22,8 @@ var (
 		Long:    `Lift performs initial OS configuration on first boot.`,
 		Run: func(cmd *cobra.Command, args []string) {
 
-			if viper.GetBool("debug") {
-				log.SetLevel(log.DebugLevel)
-			}
-
-			if viper.GetBool("no-color") {
-				logFormat = log.TextFormatter{
-					ForceColors:     false,
-					DisableColors:   true,
-					FullTimestamp:   true,
-					TimestampFormat: "2006-01-02T15:04:05.999999999",
-				}
-			}
-
-			if viper.GetBool("json") {
-				log.SetFormatter(&log.JSONFormatter{})
-			}
-
-			headers := make(map[string][]string)
-			for _, h := range viper.GetStringSlice("request-headers") {
-				words := strings.SplitN(h, ":", 2)
-				key := strings.TrimSpace(words[0])
-				value := strings.TrimSpace(words[1])
-				if key == "" || value == "" {
-					log.Errorf("Invalid request header: %s", h)
-					log.Error("Lift aborted")
-					os.Exit(1)
-				}
-				headers[key] = append(headers[key], value)
-			}
-
-			lift, err := lift.New(viper.GetString("alpine-data-url"), headers)
+			setupLogging()
+			lift, err := newLift()
 			if err != nil {
 				log.Error(err)
 				log.Error("Lift aborted")
@@ -66,25 +38,47 @@ var (
 		},
 	}
 
-	logFormat = log.TextFormatter{
+	textFormat = log.TextFormatter{
 		ForceColors:     true,
 		DisableColors:   false,
 		FullTimestamp:   true,
 		TimestampFormat: "2006-01-02T15:04:05.999999999",
 	}
 
-	cfgFile string
-	dataURL string
-	headers []string
-	debug   bool
-	json    bool
-	nocolor bool
+	cfgFile     string
+	dataURL     string
+	vendorURL   string
+	headers     []string
+	datasources []string
+	debug       bool
+	json        bool
+	nocolor     bool
+	logLevel    string
+	logFormat   string
+	logFile     string
+	retries     int
+	backoff     time.Duration
+	timeout     time.Duration
+	caCert      string
+	clientCert  string
+	clientKey   string
+	insecure    bool
+	rootDir     string
+	vaultAddr   string
+	vaultToken  string
+	ageKey      string
+	signingKey  string
+	sigURL      string
+	dhcpOpt     int
+	progressOut string
+	strict      bool
+	strictParse bool
 )
 
 func init() {
 	// Default logging settings
 	log.SetOutput(os.Stdout)
-	log.SetFormatter(&logFormat)
+	log.SetFormatter(&textFormat)
 	log.SetLevel(log.InfoLevel)
 
 	// Flags & Config
@@ -93,13 +87,57 @@ func init() {
 	RootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "enable debug logging")
 	RootCmd.PersistentFlags().BoolVar(&nocolor, "no-color", false, "disable colors in logging")
 	RootCmd.PersistentFlags().BoolVarP(&json, "json", "j", false, "Log output in JSON format")
+	RootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level (trace, debug, info, warn, error)")
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format (text or json)")
+	RootCmd.PersistentFlags().StringVar(&logFile, "log-file", lift.DefaultLogFile, "file to log to, besides the console (empty to disable)")
 	RootCmd.PersistentFlags().StringVarP(&dataURL, "alpine-data-url", "s", "", "URL to download alpine-data")
+	RootCmd.PersistentFlags().StringVar(&vendorURL, "vendor-data-url", "", "URL to download vendor-data")
 	RootCmd.PersistentFlags().StringArrayVarP(&headers, "request-header", "H", nil, "HTTP header(s) to include in request, akin to curl's -H")
+	RootCmd.PersistentFlags().StringSliceVar(&datasources, "datasource", nil, fmt.Sprintf("datasource(s) to probe in order (default %s)", strings.Join(lift.DefaultDatasources, ",")))
+	RootCmd.PersistentFlags().IntVar(&retries, "fetch-retries", 0, "number of retries downloading alpine-data, -1 to disable (default 5)")
+	RootCmd.PersistentFlags().DurationVar(&backoff, "fetch-backoff", 0, "initial delay between retries, doubled after each retry (default 1s)")
+	RootCmd.PersistentFlags().DurationVar(&timeout, "fetch-timeout", 0, "overall timeout downloading alpine-data (default 2m)")
+	RootCmd.PersistentFlags().StringVar(&caCert, "ca-cert", "", "path or url of a CA bundle to trust for https downloads")
+	RootCmd.PersistentFlags().StringVar(&clientCert, "client-cert", "", "path of a client certificate for https downloads (mTLS)")
+	RootCmd.PersistentFlags().StringVar(&clientKey, "client-key", "", "path of the key of the client certificate")
+	RootCmd.PersistentFlags().BoolVar(&insecure, "insecure", false, "disable TLS certificate verification")
+	RootCmd.PersistentFlags().StringVar(&rootDir, "root", "", "provision the root filesystem at this path (e.g. an image being built) instead of the running system")
+	RootCmd.PersistentFlags().StringVar(&vaultAddr, "vault-addr", "", "address of the Vault server to read vault: secrets from")
+	RootCmd.PersistentFlags().StringVar(&vaultToken, "vault-token", "", "token to read secrets from Vault with")
+	RootCmd.PersistentFlags().StringVar(&ageKey, "age-key", "", "age secret key, tpm:<handle> or path of a key file, to decrypt age or sops encrypted alpine-data (default /etc/lift/age.key)")
+	RootCmd.PersistentFlags().StringVar(&signingKey, "signing-key", "", "public key (path, or base64 DER) the alpine-data must be signed with (default /etc/lift/signing.pub, if present)")
+	RootCmd.PersistentFlags().StringVar(&sigURL, "signature-url", "", "url or path of the detached signature of the alpine-data (default <alpine-data url>.sig)")
+	RootCmd.PersistentFlags().IntVar(&dhcpOpt, "dhcp-option", 0, fmt.Sprintf("DHCP option with the alpine-data url, for the dhcp datasource (default %d)", lift.DefaultDHCPOption))
+	RootCmd.PersistentFlags().StringVar(&progressOut, "progress", "", "print the progress of the provisioning to this device or file (- for stdout, e.g. /dev/ttyS0)")
+	RootCmd.PersistentFlags().BoolVar(&strict, "strict", false, "provision without defaults, and only the modules with a block in the alpine-data (like minimal: true)")
+	RootCmd.PersistentFlags().BoolVar(&strictParse, "strict-parse", false, "refuse alpine-data with unknown keys, instead of warning about them")
 	_ = viper.BindPFlag("debug", RootCmd.PersistentFlags().Lookup("debug"))
 	_ = viper.BindPFlag("alpine-data-url", RootCmd.PersistentFlags().Lookup("alpine-data-url"))
+	_ = viper.BindPFlag("vendor-data-url", RootCmd.PersistentFlags().Lookup("vendor-data-url"))
 	_ = viper.BindPFlag("request-header", RootCmd.PersistentFlags().Lookup("request-header"))
 	_ = viper.BindPFlag("json", RootCmd.PersistentFlags().Lookup("json"))
 	_ = viper.BindPFlag("no-color", RootCmd.PersistentFlags().Lookup("no-color"))
+	_ = viper.BindPFlag("datasource", RootCmd.PersistentFlags().Lookup("datasource"))
+	_ = viper.BindPFlag("log-level", RootCmd.PersistentFlags().Lookup("log-level"))
+	_ = viper.BindPFlag("log-format", RootCmd.PersistentFlags().Lookup("log-format"))
+	_ = viper.BindPFlag("log-file", RootCmd.PersistentFlags().Lookup("log-file"))
+	_ = viper.BindPFlag("fetch-retries", RootCmd.PersistentFlags().Lookup("fetch-retries"))
+	_ = viper.BindPFlag("fetch-backoff", RootCmd.PersistentFlags().Lookup("fetch-backoff"))
+	_ = viper.BindPFlag("fetch-timeout", RootCmd.PersistentFlags().Lookup("fetch-timeout"))
+	_ = viper.BindPFlag("ca-cert", RootCmd.PersistentFlags().Lookup("ca-cert"))
+	_ = viper.BindPFlag("client-cert", RootCmd.PersistentFlags().Lookup("client-cert"))
+	_ = viper.BindPFlag("client-key", RootCmd.PersistentFlags().Lookup("client-key"))
+	_ = viper.BindPFlag("insecure", RootCmd.PersistentFlags().Lookup("insecure"))
+	_ = viper.BindPFlag("root", RootCmd.PersistentFlags().Lookup("root"))
+	_ = viper.BindPFlag("vault-addr", RootCmd.PersistentFlags().Lookup("vault-addr"))
+	_ = viper.BindPFlag("vault-token", RootCmd.PersistentFlags().Lookup("vault-token"))
+	_ = viper.BindPFlag("age-key", RootCmd.PersistentFlags().Lookup("age-key"))
+	_ = viper.BindPFlag("signing-key", RootCmd.PersistentFlags().Lookup("signing-key"))
+	_ = viper.BindPFlag("signature-url", RootCmd.PersistentFlags().Lookup("signature-url"))
+	_ = viper.BindPFlag("dhcp-option", RootCmd.PersistentFlags().Lookup("dhcp-option"))
+	_ = viper.BindPFlag("progress", RootCmd.PersistentFlags().Lookup("progress"))
+	_ = viper.BindPFlag("strict", RootCmd.PersistentFlags().Lookup("strict"))
+	_ = viper.BindPFlag("strict-parse", RootCmd.PersistentFlags().Lookup("strict-parse"))
 }
 
 func initConfig() {
@@ -140,3 +178,75 @@ func Execute() {
 		os.Exit(-1)
 	}
 }
+
+// sets up logging according to the flags
+func setupLogging() {
+	if viper.GetBool("no-color") {
+		textFormat = log.TextFormatter{
+			ForceColors:     false,
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02T15:04:05.999999999",
+		}
+	}
+
+	// --debug and --json are shorthands for --log-level and --log-format
+	level := viper.GetString("log-level")
+	if viper.GetBool("debug") {
+		level = "debug"
+	}
+	format := viper.GetString("log-format")
+	if viper.GetBool("json") {
+		format = "json"
+	}
+	if err := lift.SetupLogging(level, format, viper.GetString("log-file")); err != nil {
+		log.Error(err)
+		log.Error("Lift aborted")
+		os.Exit(1)
+	}
+}
+
+// returns a Lift configured according to the flags
+func newLift() (*lift.Lift, error) {
+	// viper turns an empty string array flag into "[]", so the flag values
+	// are used
+	requestHeaders := make(map[string][]string)
+	for _, h := range headers {
+		key, value, err := lift.ParseHeader(h)
+		if err != nil {
+			return nil, err
+		}
+		requestHeaders[key] = append(requestHeaders[key], value)
+	}
+
+	l, err := lift.New(viper.GetString("alpine-data-url"), requestHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	l.VendorDataURL = viper.GetString("vendor-data-url")
+	l.Datasources = viper.GetStringSlice("datasource")
+	l.FetchPolicy.Retries = viper.GetInt("fetch-retries")
+	l.FetchPolicy.Backoff = viper.GetDuration("fetch-backoff")
+	l.FetchPolicy.Timeout = viper.GetDuration("fetch-timeout")
+	l.TLS.CACert = viper.GetString("ca-cert")
+	l.TLS.ClientCert = viper.GetString("client-cert")
+	l.TLS.ClientKey = viper.GetString("client-key")
+	l.TLS.Insecure = viper.GetBool("insecure")
+	l.Root = viper.GetString("root")
+	l.Secrets.VaultAddr = viper.GetString("vault-addr")
+	l.Secrets.VaultToken = viper.GetString("vault-token")
+	l.Secrets.AgeKey = viper.GetString("age-key")
+	l.Signature.Key = viper.GetString("signing-key")
+	l.Signature.SignatureURL = viper.GetString("signature-url")
+	l.DHCPOption = viper.GetInt("dhcp-option")
+	l.Version = version
+	l.Strict = viper.GetBool("strict")
+	l.StrictParse = viper.GetBool("strict-parse")
+	if p := viper.GetString("progress"); p != "" {
+		if l.Progress, err = lift.OpenProgress(p); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	jsonenc "encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	statusFile string
+
+	// Definition of the status subcommand
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of the last lift run",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			status, err := lift.ReadStatus(statusFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading status: %v\n", err)
+				os.Exit(1)
+			}
+			if viper.GetBool("json") {
+				data, _ := jsonenc.MarshalIndent(status, "", "  ")
+				fmt.Println(string(data))
+			} else {
+				printStatus(status)
+			}
+			if status.Status == "failed" {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	statusCmd.Flags().StringVar(&statusFile, "file", lift.StatusFile, "status file")
+	RootCmd.AddCommand(statusCmd)
+}
+
+func printStatus(status *lift.Status) {
+	fmt.Printf("Status:     %s\n", status.Status)
+	if status.Error != "" {
+		fmt.Printf("Error:      %s\n", status.Error)
+	}
+	if status.InstanceID != "" {
+		fmt.Printf("Instance:   %s\n", status.InstanceID)
+	}
+	if status.Datasource != "" {
+		fmt.Printf("Datasource: %s\n", status.Datasource)
+	}
+	fmt.Printf("Started:    %s\n", status.Started.Format(time.RFC3339))
+	if status.Finished != nil {
+		fmt.Printf("Finished:   %s\n", status.Finished.Format(time.RFC3339))
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tSTATUS\tDURATION\tERROR")
+	for _, m := range status.Modules {
+		fmt.Fprintf(w, "%s\t%s\t%.1fs\t%s\n", m.Name, m.Status, m.Duration, m.Error)
+	}
+	w.Flush()
+}
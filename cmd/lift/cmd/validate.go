@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// Definition of the validate subcommand
+	validateCmd = &cobra.Command{
+		Use:   "validate <file|url>",
+		Short: "Validate an alpine-data file",
+		Long: `Validate strictly parses an alpine-data file, rejecting unknown keys and
+values of the wrong type, and checks the values of the configuration.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			data, err := lift.LoadAlpineData(args[0], nil)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", args[0], err)
+				os.Exit(1)
+			}
+			errs := lift.Validate(data)
+			for _, e := range errs {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], e)
+			}
+			if len(errs) > 0 {
+				os.Exit(1)
+			}
+			fmt.Printf("%s: OK\n", args[0])
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(validateCmd)
+}
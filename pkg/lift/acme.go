@@ -0,0 +1,140 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// where lego keeps its account and certificates
+	acmeDir             = "/etc/lego"
+	acmeScriptFile      = "/etc/lego/lift-renew"
+	acmeCredentialsFile = "/etc/lego/credentials"
+	// a certificate is renewed when it expires within this many days, by
+	// default
+	defaultACMERenewDays = 30
+	// when the renewal job runs, by default
+	defaultACMERenewSchedule = "0 3 * * *"
+)
+
+// the data of the acme script template
+type acmeScriptData struct {
+	Domains     []string
+	Args        string
+	Certificate string
+	Credentials string
+	RenewDays   int
+	Reload      []string
+}
+
+// installs lego and a script that obtains or renews the certificate, runs
+// it to obtain the certificate and adds a cron job to renew it
+func (l *Lift) acmeSetup() error {
+	ac := l.Data.ACME
+	if ac == nil || len(ac.Domains) == 0 {
+		return nil
+	}
+	logger.Debug("Installing lego")
+	if err := apkCommand("add", "lego").Run(); err != nil {
+		return fmt.Errorf("Error installing lego: %s", err)
+	}
+	if err := os.MkdirAll(acmeDir, 0700); err != nil {
+		return err
+	}
+
+	data := acmeScriptData{
+		Domains:     ac.Domains,
+		Args:        strings.Join(acmeArgs(ac), " "),
+		Certificate: acmeCertificate(ac.Domains[0]),
+		RenewDays:   ac.RenewDays,
+		Reload:      ac.Reload,
+	}
+	if data.RenewDays == 0 {
+		data.RenewDays = defaultACMERenewDays
+	}
+	// the credentials of the dns provider are only readable by root
+	if len(ac.Credentials) > 0 {
+		keys := make([]string, 0, len(ac.Credentials))
+		for k := range ac.Credentials {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var env strings.Builder
+		for _, k := range keys {
+			fmt.Fprintf(&env, "%s=%s\n", k, shellQuote(ac.Credentials[k]))
+		}
+		logger.Debugf("Writing ACME credentials to %s", acmeCredentialsFile)
+		if err := ioutil.WriteFile(acmeCredentialsFile, []byte(env.String()), 0600); err != nil {
+			return err
+		}
+		data.Credentials = acmeCredentialsFile
+	}
+	script, err := generateFileFromTemplate(*acmeScript, data)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Installing ACME script %s", acmeScriptFile)
+	if err = exec.Command("mv", script, acmeScriptFile).Run(); err != nil {
+		return err
+	}
+	if err = os.Chmod(acmeScriptFile, 0700); err != nil {
+		return err
+	}
+
+	if ac.Challenge != "dns" {
+		if err = l.openFirewallPorts("lift-acme", "ACME http challenge", []int{80}); err != nil {
+			return err
+		}
+	}
+	schedule := ac.RenewSchedule
+	if schedule == "" {
+		schedule = defaultACMERenewSchedule
+	}
+	if err = addCrontabEntry(CronJob{Schedule: schedule, Command: acmeScriptFile}); err != nil {
+		return err
+	}
+	if err = enableCrond(); err != nil {
+		return err
+	}
+	// the certificate is obtained when the renewal job first runs
+	if inAltRoot() {
+		return nil
+	}
+
+	logger.WithField("domains", ac.Domains).Info("Obtaining ACME certificate")
+	if out, err := exec.Command(acmeScriptFile).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error obtaining certificate for %s: %s: %s", ac.Domains[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// returns the (shell quoted) lego options for the certificate
+func acmeArgs(ac *ACMEConfig) []string {
+	args := []string{"--accept-tos", "--path", acmeDir, "--email", shellQuote(ac.Email)}
+	if ac.Server != "" {
+		args = append(args, "--server", shellQuote(ac.Server))
+	}
+	for _, d := range ac.Domains {
+		args = append(args, "--domains", shellQuote(d))
+	}
+	switch {
+	case ac.Challenge == "dns":
+		args = append(args, "--dns", shellQuote(ac.Provider))
+	case ac.Webroot != "":
+		args = append(args, "--http", "--http.webroot", shellQuote(ac.Webroot))
+	default:
+		args = append(args, "--http")
+	}
+	return args
+}
+
+// returns the path of the certificate lego obtains for a domain; the key is
+// next to it, with the .key extension
+func acmeCertificate(domain string) string {
+	return filepath.Join(acmeDir, "certificates", strings.Replace(domain, "*", "_", -1)+".crt")
+}
@@ -0,0 +1,227 @@
+package lift
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// where the binaries of agents are installed, by default
+	agentBinDir = "/usr/local/bin"
+)
+
+// installs the agents: their packages and binaries, configuration files and
+// services. The binaries are downloaded concurrently beforehand.
+func (l *Lift) agentsSetup() error {
+	var requests []downloadRequest
+	for _, a := range l.Data.Agents {
+		if _, err := os.Stat(agentPath(a)); a.URL != "" && os.IsNotExist(err) {
+			requests = append(requests, downloadRequest{url: a.URL, headers: l.contentHeaders(a.URL)})
+		}
+	}
+	if len(requests) > 0 {
+		l.downloads().prefetch(requests)
+	}
+	for _, a := range l.Data.Agents {
+		if err := l.agentSetup(a); err != nil {
+			return fmt.Errorf("Error installing agent %s: %s", a.Name, err)
+		}
+	}
+	return nil
+}
+
+// installs an agent
+func (l *Lift) agentSetup(a Agent) error {
+	entry := logger.WithField("agent", a.Name)
+	entry.Info("Installing agent")
+	if len(a.Packages) > 0 {
+		entry.Debugf("apk add %s", strings.Join(a.Packages, " "))
+		if out, err := apkCommand(append([]string{"add"}, a.Packages...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	if a.URL != "" {
+		// agents run as root, so they must be verified
+		if a.SHA256 == "" {
+			return fmt.Errorf("Refusing to install %s without a sha256 checksum", a.URL)
+		}
+		binary := a.Binary
+		if binary == "" {
+			binary = a.Name
+		}
+		if err := l.installBinary(a.URL, a.SHA256, binary, agentPath(a)); err != nil {
+			return err
+		}
+	}
+	for _, wf := range a.Config {
+		if err := l.writeFile(wf); err != nil {
+			return err
+		}
+	}
+	if !a.Service.Enabled {
+		return nil
+	}
+	return installAgentService(a)
+}
+
+// returns the path the binary of an agent is installed at
+func agentPath(a Agent) string {
+	if a.Path != "" {
+		return a.Path
+	}
+	return filepath.Join(agentBinDir, a.Name)
+}
+
+// downloads a binary, unless it's installed already, verifies its sha256
+// checksum (if given) and installs it at dest. When the download is an
+// archive (.tar, .tar.gz, .tgz or .zip), the binary is the file in it with
+// that path or name.
+func (l *Lift) installBinary(url, sha256, binary, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		logger.WithField("path", dest).Debug("Binary is installed already")
+		return nil
+	}
+	logger.WithField("url", url).Debug("Downloading binary")
+	data, err := l.downloads().get(url, l.contentHeaders(url))
+	if err != nil {
+		return fmt.Errorf("Error downloading %s: %s", url, err)
+	}
+	if err = verifyChecksum(data, sha256, ""); err != nil {
+		return fmt.Errorf("Error verifying %s: %s", url, err)
+	}
+	if data, err = extractBinary(url, data, binary); err != nil {
+		return fmt.Errorf("Error extracting %s from %s: %s", binary, url, err)
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	logger.Debugf("Saving %s to %s", binary, dest)
+	return ioutil.WriteFile(dest, data, 0755)
+}
+
+// returns the binary from a downloaded archive, or the download itself if
+// it's not an archive
+func extractBinary(url string, data []byte, binary string) ([]byte, error) {
+	name := strings.ToLower(path.Base(strings.SplitN(url, "?", 2)[0]))
+	// the binary is given by its path in the archive, or its name
+	matches := func(file string) bool {
+		file = strings.TrimPrefix(path.Clean(file), "./")
+		return file == binary || path.Base(file) == binary
+	}
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().Mode().IsRegular() && matches(f.Name) {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return ioutil.ReadAll(rc)
+			}
+		}
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".tar"):
+		var r io.Reader = bytes.NewReader(data)
+		if !strings.HasSuffix(name, ".tar") {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg && matches(hdr.Name) {
+				return ioutil.ReadAll(tr)
+			}
+		}
+	default:
+		return data, nil
+	}
+	return nil, errors.New("not found in the archive")
+}
+
+// creates the OpenRC service of an agent, enables it and (re)starts it, so
+// it uses the configuration written by lift
+func installAgentService(a Agent) error {
+	s := a.Service
+	name := s.Name
+	if name == "" {
+		name = a.Name
+	}
+	svc := openrcService{
+		Description: fmt.Sprintf("%s agent", a.Name),
+		Command:     s.Command,
+		Args:        strings.Replace(s.Args, `"`, `\"`, -1),
+		User:        s.User,
+		Directory:   s.Directory,
+		NeedNet:     true,
+	}
+	if svc.Command == "" {
+		svc.Command = agentPath(a)
+	}
+	keys := make([]string, 0, len(s.Env))
+	for k := range s.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		svc.Environment = append(svc.Environment, k+"="+shellQuote(s.Env[k]))
+	}
+
+	initScript := filepath.Join("/etc/init.d", name)
+	if _, err := os.Stat(initScript); err == nil && s.Command == "" && a.URL == "" {
+		// the service of a package
+		logger.WithField("service", name).Debug("Using service of agent package")
+	} else {
+		script, err := generateFileFromTemplate(*openrcUnit, svc)
+		if err != nil {
+			return err
+		}
+		logger.WithField("service", name).Debugf("Creating %s", initScript)
+		if err = exec.Command("mv", script, initScript).Run(); err != nil {
+			return err
+		}
+		if err = os.Chmod(initScript, 0755); err != nil {
+			return err
+		}
+	}
+	runlevel := s.Runlevel
+	if runlevel == "" {
+		runlevel = defaultRunlevel
+	}
+	entry := logger.WithFields(log.Fields{"service": name, "runlevel": runlevel})
+	entry.Debug("Enabling agent service")
+	if out, err := exec.Command("rc-update", "add", name, runlevel).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error enabling %s: %s: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	if err := doService(name, RESTART); err != nil {
+		return fmt.Errorf("Error starting %s: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package lift
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	caCertsDir = "/usr/local/share/ca-certificates"
+	// where TLS certificates and keys are installed, by default
+	tlsCertsDir = "/etc/ssl/certs"
+	tlsKeysDir  = "/etc/ssl/private"
+)
+
+// installs the trusted CA certificates and updates the system CA bundle.
+// The certificates are also trusted by lift itself for all subsequent
+// downloads, since the system bundle is only read once per process.
+func (l *Lift) caCertsSetup() error {
+	if len(l.Data.CACerts) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(caCertsDir, 0755)
+	if err != nil {
+		return err
+	}
+	for i, c := range l.Data.CACerts {
+		name := c.Name
+		if name == "" && c.URL != "" {
+			name = path.Base(c.URL)
+		}
+		if name == "" || name == "." || name == "/" {
+			name = fmt.Sprintf("lift-%d", i)
+		}
+		if filepath.Ext(name) != ".crt" {
+			name = strings.TrimSuffix(name, filepath.Ext(name)) + ".crt"
+		}
+
+		data := []byte(c.Content)
+		if c.URL != "" {
+			logger.WithField("url", c.URL).Debug("Downloading CA certificate")
+			if data, err = downloadFile(c.URL, nil); err != nil {
+				return err
+			}
+			if err = verifyChecksum(data, c.SHA256, ""); err != nil {
+				return fmt.Errorf("Error verifying %s: %s", c.URL, err)
+			}
+		}
+		if !trustPEM(data) {
+			return errors.New("No valid PEM certificate found in CA certificate " + name)
+		}
+
+		certFile := filepath.Join(caCertsDir, filepath.Base(name))
+		logger.Debugf("Installing CA certificate %s", certFile)
+		if err = ioutil.WriteFile(certFile, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err = exec.LookPath("update-ca-certificates"); err != nil {
+		logger.Debug("Installing ca-certificates")
+		if err = apkCommand("add", "--no-cache", "ca-certificates").Run(); err != nil {
+			return fmt.Errorf("Error installing ca-certificates: %s", err)
+		}
+	}
+	if out, err := exec.Command("update-ca-certificates").CombinedOutput(); err != nil {
+		return fmt.Errorf("Error updating CA certificates: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// a file of a TLS certificate to install
+type certificateFile struct {
+	path string
+	data []byte
+	perm os.FileMode
+}
+
+// installs the TLS certificates, after checking that their keys and chains
+// match, and reloads the services using them when they changed
+func (l *Lift) certificatesSetup() error {
+	for _, c := range l.Data.Certificates {
+		if err := checkCertificate(c.Cert, c.Key, c.Chain); err != nil {
+			return fmt.Errorf("Invalid certificate %s: %s", c.Name, err)
+		}
+		changed, err := installCertificate(c)
+		if err != nil {
+			return fmt.Errorf("Error installing certificate %s: %s", c.Name, err)
+		}
+		if !changed {
+			logger.WithField("certificate", c.Name).Debug("Certificate is up to date")
+			continue
+		}
+		for _, service := range c.Reload {
+			if err = reloadService(service); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writes the files of a certificate, and returns true if any of them changed
+func installCertificate(c Certificate) (bool, error) {
+	certPath, keyPath, chainPath := c.CertPath, c.KeyPath, c.ChainPath
+	if certPath == "" {
+		certPath = filepath.Join(tlsCertsDir, c.Name+".crt")
+	}
+	if keyPath == "" {
+		keyPath = filepath.Join(tlsKeysDir, c.Name+".key")
+	}
+	if chainPath == "" {
+		chainPath = filepath.Join(tlsCertsDir, c.Name+".chain.crt")
+	}
+	// the group of the owner can read the key as well
+	keyPerm := os.FileMode(0600)
+	if strings.Contains(c.Owner, ":") {
+		keyPerm = 0640
+	}
+	cert := pemData(c.Cert)
+	files := []certificateFile{
+		{path: keyPath, data: pemData(c.Key), perm: keyPerm},
+		{path: certPath, data: cert, perm: 0644},
+	}
+	if c.Chain != "" {
+		chain := pemData(c.Chain)
+		ext := filepath.Ext(certPath)
+		files = append(files,
+			certificateFile{path: chainPath, data: chain, perm: 0644},
+			certificateFile{path: strings.TrimSuffix(certPath, ext) + ".fullchain" + ext, data: append(append([]byte{}, cert...), chain...), perm: 0644},
+		)
+	}
+
+	changed := false
+	for _, f := range files {
+		if existing, err := ioutil.ReadFile(f.path); err == nil && bytes.Equal(existing, f.data) {
+			// the owner or permissions may have changed nonetheless
+			if err = os.Chmod(f.path, f.perm); err != nil {
+				return false, err
+			}
+			if c.Owner != "" {
+				if out, err := exec.Command("chown", c.Owner, f.path).CombinedOutput(); err != nil {
+					return false, fmt.Errorf("Error changing owner of %s to %s: %s: %s", f.path, c.Owner, err, strings.TrimSpace(string(out)))
+				}
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return false, err
+		}
+		logger.WithField("certificate", c.Name).Debugf("Installing %s", f.path)
+		if err := writeFileAtomic(f.path, f.data, f.perm, c.Owner); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// returns PEM data with a single trailing newline
+func pemData(s string) []byte {
+	return []byte(strings.TrimSpace(s) + "\n")
+}
+
+// returns true if s is PEM data, rather than e.g. a secret reference
+func isPEM(s string) bool {
+	block, _ := pem.Decode([]byte(s))
+	return block != nil
+}
+
+// checks that a certificate and its key (in PEM format) match, and that the
+// chain (if any) contains the certificate that issued it
+func checkCertificate(cert, key, chain string) error {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return err
+	}
+	if chain == "" {
+		return nil
+	}
+	var issuers []*x509.Certificate
+	rest := []byte(chain)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid chain: %s", err)
+		}
+		issuers = append(issuers, c)
+	}
+	if len(issuers) == 0 {
+		return errors.New("no certificate found in chain")
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if err = leaf.CheckSignatureFrom(issuers[0]); err != nil {
+		return fmt.Errorf("certificate is not issued by the first certificate of the chain: %s", err)
+	}
+	return nil
+}
+
+// reloads a service, if it's started
+func reloadService(name string) error {
+	if inAltRoot() {
+		logger.WithField("service", name).Debug("Not reloading service in alternate root")
+		return nil
+	}
+	logger.WithField("service", name).Debug("Reloading service")
+	if out, err := exec.Command("rc-service", "--ifstarted", name, "reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("Error reloading %s: %s: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
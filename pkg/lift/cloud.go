@@ -0,0 +1,515 @@
+package lift
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	dmiVendorFile = "/sys/class/dmi/id/sys_vendor"
+	sysClassNet   = "/sys/class/net"
+
+	hetznerURL      = "http://169.254.169.254/hetzner/v1"
+	digitalOceanURL = "http://169.254.169.254/metadata/v1"
+	scalewayURL     = "http://169.254.42.42"
+)
+
+// fetches alpine-data from the Hetzner Cloud metadata service
+type hetznerDatasource struct {
+	vendorData []byte
+}
+
+func (d *hetznerDatasource) Name() string { return "hetzner" }
+
+func (d *hetznerDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	if err := requireVendor("Hetzner"); err != nil {
+		return nil, nil, err
+	}
+	client := httpClient(imdsTimeout)
+	raw, err := httpGet(client, hetznerURL+"/metadata")
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta struct {
+		Hostname         string        `yaml:"hostname"`
+		InstanceID       int64         `yaml:"instance-id"`
+		PublicIPv4       string        `yaml:"public-ipv4"`
+		Region           string        `yaml:"region"`
+		AvailabilityZone string        `yaml:"availability-zone"`
+		PublicKeys       []string      `yaml:"public-keys"`
+		NetworkConfig    networkConfig `yaml:"network-config"`
+	}
+	if err = yaml.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing Hetzner metadata: %s", err)
+	}
+	data, err := httpGet(client, hetznerURL+"/userdata")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pc := meta.NetworkConfig.platformConfig()
+	pc.Hostname, pc.Keys = meta.Hostname, meta.PublicKeys
+	if d.vendorData, err = pc.alpineData(); err != nil {
+		return nil, nil, err
+	}
+	return data, &InstanceMetadata{
+		InstanceID:       strconv.FormatInt(meta.InstanceID, 10),
+		Region:           meta.Region,
+		AvailabilityZone: meta.AvailabilityZone,
+		Hostname:         meta.Hostname,
+	}, nil
+}
+
+// VendorData returns the alpine-data generated from the Hetzner metadata
+func (d *hetznerDatasource) VendorData(l *Lift) ([]byte, error) {
+	return d.vendorData, nil
+}
+
+// fetches alpine-data from the DigitalOcean metadata service
+type digitalOceanDatasource struct {
+	vendorData []byte
+}
+
+func (d *digitalOceanDatasource) Name() string { return "digitalocean" }
+
+func (d *digitalOceanDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	if err := requireVendor("DigitalOcean"); err != nil {
+		return nil, nil, err
+	}
+	raw, err := httpGet(httpClient(imdsTimeout), digitalOceanURL+".json")
+	if err != nil {
+		return nil, nil, err
+	}
+	type doInterface struct {
+		MAC  string `json:"mac"`
+		IPv4 *struct {
+			Address string `json:"ip_address"`
+			Netmask string `json:"netmask"`
+			Gateway string `json:"gateway"`
+		} `json:"ipv4"`
+		IPv6 *struct {
+			Address string `json:"ip_address"`
+			CIDR    int    `json:"cidr"`
+			Gateway string `json:"gateway"`
+		} `json:"ipv6"`
+	}
+	var meta struct {
+		DropletID  int64    `json:"droplet_id"`
+		Hostname   string   `json:"hostname"`
+		UserData   string   `json:"user_data"`
+		Region     string   `json:"region"`
+		PublicKeys []string `json:"public_keys"`
+		Interfaces struct {
+			Public  []doInterface `json:"public"`
+			Private []doInterface `json:"private"`
+		} `json:"interfaces"`
+		DNS struct {
+			Nameservers []string `json:"nameservers"`
+		} `json:"dns"`
+	}
+	if err = json.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing DigitalOcean metadata: %s", err)
+	}
+
+	macs := interfacesByMAC()
+	var ifaces, nameservers []interface{}
+	for i, iface := range append(meta.Interfaces.Public, meta.Interfaces.Private...) {
+		spec := map[interface{}]interface{}{"name": fmt.Sprintf("eth%d", i)}
+		if name, ok := macs[strings.ToLower(iface.MAC)]; ok {
+			spec["name"] = name
+		}
+		if v4 := iface.IPv4; v4 != nil {
+			setStaticAddress(spec, v4.Address, v4.Netmask, v4.Gateway)
+		}
+		if v6 := iface.IPv6; v6 != nil {
+			setStaticAddress(spec, v6.Address, strconv.Itoa(v6.CIDR), v6.Gateway)
+		}
+		ifaces = append(ifaces, spec)
+	}
+	for _, ns := range meta.DNS.Nameservers {
+		nameservers = append(nameservers, ns)
+	}
+	pc := platformConfig{Hostname: meta.Hostname, Keys: meta.PublicKeys, Interfaces: ifaces, Nameservers: nameservers}
+	if d.vendorData, err = pc.alpineData(); err != nil {
+		return nil, nil, err
+	}
+	return []byte(meta.UserData), &InstanceMetadata{
+		InstanceID: strconv.FormatInt(meta.DropletID, 10),
+		Region:     meta.Region,
+		Hostname:   meta.Hostname,
+	}, nil
+}
+
+// VendorData returns the alpine-data generated from the DigitalOcean metadata
+func (d *digitalOceanDatasource) VendorData(l *Lift) ([]byte, error) {
+	return d.vendorData, nil
+}
+
+// fetches alpine-data from the Scaleway metadata service. The user-data is
+// only served to requests from a privileged source port.
+type scalewayDatasource struct {
+	vendorData []byte
+}
+
+func (d *scalewayDatasource) Name() string { return "scaleway" }
+
+func (d *scalewayDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	if err := requireVendor("Scaleway"); err != nil {
+		return nil, nil, err
+	}
+	raw, err := httpGet(httpClient(imdsTimeout), scalewayURL+"/conf?format=json")
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta struct {
+		ID            string `json:"id"`
+		Hostname      string `json:"hostname"`
+		SSHPublicKeys []struct {
+			Key string `json:"key"`
+		} `json:"ssh_public_keys"`
+		Location struct {
+			ZoneID string `json:"zone_id"`
+		} `json:"location"`
+		IPv6 *struct {
+			Address string `json:"address"`
+			Netmask string `json:"netmask"`
+			Gateway string `json:"gateway"`
+		} `json:"ipv6"`
+	}
+	if err = json.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing Scaleway metadata: %s", err)
+	}
+	data, err := httpGet(privilegedPortClient(), scalewayURL+"/user_data/cloud-init")
+	if err != nil {
+		// the user-data is not set
+		logger.Debugf("No Scaleway user-data: %v", err)
+		data = []byte{}
+	}
+
+	var keys []string
+	for _, k := range meta.SSHPublicKeys {
+		keys = append(keys, k.Key)
+	}
+	spec := map[interface{}]interface{}{"name": "eth0", "dhcp": true}
+	if v6 := meta.IPv6; v6 != nil {
+		setStaticAddress(spec, v6.Address, v6.Netmask, v6.Gateway)
+	}
+	pc := platformConfig{Hostname: meta.Hostname, Keys: keys, Interfaces: []interface{}{spec}}
+	if d.vendorData, err = pc.alpineData(); err != nil {
+		return nil, nil, err
+	}
+	return data, &InstanceMetadata{
+		InstanceID:       meta.ID,
+		AvailabilityZone: meta.Location.ZoneID,
+		Hostname:         meta.Hostname,
+	}, nil
+}
+
+// VendorData returns the alpine-data generated from the Scaleway metadata
+func (d *scalewayDatasource) VendorData(l *Lift) ([]byte, error) {
+	return d.vendorData, nil
+}
+
+// returns an error unless the system vendor (as reported by DMI) contains
+// the given vendor, so datasources of other platforms fail fast
+func requireVendor(vendor string) error {
+	sysVendor, err := ioutil.ReadFile(dmiVendorFile)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(strings.ToLower(string(sysVendor)), strings.ToLower(vendor)) {
+		return fmt.Errorf("not running on %s", vendor)
+	}
+	return nil
+}
+
+// executes a GET request against a metadata service, and returns the body
+func httpGet(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return imdsDo(client, req)
+}
+
+// returns a http client that connects from a privileged (< 1024) source port
+func privilegedPortClient() *http.Client {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var err error
+		for port := 1023; port > 0; port-- {
+			d := net.Dialer{LocalAddr: &net.TCPAddr{Port: port}, Timeout: imdsTimeout}
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, addr); err == nil {
+				return conn, nil
+			}
+			if !errors.Is(err, syscall.EADDRINUSE) {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{DialContext: dial, DisableKeepAlives: true},
+		Timeout:   imdsTimeout,
+	}
+}
+
+// platformConfig is the configuration of an instance provided by a platform
+// (e.g. by its metadata service), besides the user's alpine-data
+type platformConfig struct {
+	Hostname      string
+	Keys          []string
+	Interfaces    []interface{}
+	Nameservers   []interface{}
+	SearchDomains []interface{}
+}
+
+// returns the alpine-data for the platform configuration, to be merged
+// beneath the user's alpine-data
+func (pc platformConfig) alpineData() ([]byte, error) {
+	doc := make(map[interface{}]interface{})
+	if pc.Hostname != "" {
+		setPath(doc, []string{"network", "hostname"}, pc.Hostname)
+	}
+	var authorizedKeys []interface{}
+	for _, k := range pc.Keys {
+		if k = strings.TrimSpace(k); k != "" {
+			authorizedKeys = append(authorizedKeys, k)
+		}
+	}
+	if len(authorizedKeys) > 0 {
+		setPath(doc, []string{"sshd", "authorized_keys"}, authorizedKeys)
+	}
+	if len(pc.Interfaces) > 0 {
+		setPath(doc, []string{"network", "interfaces"}, pc.Interfaces)
+	}
+	if len(pc.Nameservers) > 0 {
+		setPath(doc, []string{"network", "resolv_conf", "nameservers"}, pc.Nameservers)
+	}
+	if len(pc.SearchDomains) > 0 {
+		setPath(doc, []string{"network", "resolv_conf", "search_domains"}, pc.SearchDomains)
+	}
+	return yaml.Marshal(doc)
+}
+
+// networkConfig is a cloud-init style network configuration, as provided by
+// e.g. NoCloud seed volumes and Hetzner; either version 1 (a list of config
+// entries) or version 2 (ethernets)
+type networkConfig struct {
+	Version int `yaml:"version"`
+	Config  []struct {
+		Type    string      `yaml:"type"`
+		Name    string      `yaml:"name"`
+		MAC     string      `yaml:"mac_address"`
+		MTU     int         `yaml:"mtu"`
+		Address MultiString `yaml:"address"`
+		Search  MultiString `yaml:"search"`
+		Subnets []struct {
+			Type        string      `yaml:"type"`
+			Address     string      `yaml:"address"`
+			Netmask     string      `yaml:"netmask"`
+			Gateway     string      `yaml:"gateway"`
+			Nameservers MultiString `yaml:"dns_nameservers"`
+			Search      MultiString `yaml:"dns_search"`
+		} `yaml:"subnets"`
+	} `yaml:"config"`
+	Ethernets map[string]struct {
+		Match struct {
+			MAC string `yaml:"macaddress"`
+		} `yaml:"match"`
+		SetName     string   `yaml:"set-name"`
+		DHCP4       bool     `yaml:"dhcp4"`
+		DHCP6       bool     `yaml:"dhcp6"`
+		Addresses   []string `yaml:"addresses"`
+		Gateway4    string   `yaml:"gateway4"`
+		Gateway6    string   `yaml:"gateway6"`
+		MTU         int      `yaml:"mtu"`
+		Nameservers struct {
+			Addresses []string `yaml:"addresses"`
+			Search    []string `yaml:"search"`
+		} `yaml:"nameservers"`
+	} `yaml:"ethernets"`
+}
+
+// parses a cloud-init network configuration, which may be wrapped in a
+// `network` key
+func parseNetworkConfig(data []byte) (*networkConfig, error) {
+	var wrapped struct {
+		Network *networkConfig `yaml:"network"`
+	}
+	if err := yaml.Unmarshal(data, &wrapped); err == nil && wrapped.Network != nil {
+		return wrapped.Network, nil
+	}
+	nc := &networkConfig{}
+	if err := yaml.Unmarshal(data, nc); err != nil {
+		return nil, fmt.Errorf("Error parsing network configuration: %s", err)
+	}
+	return nc, nil
+}
+
+// returns the interfaces, nameservers and search domains of the network
+// configuration
+func (nc *networkConfig) platformConfig() platformConfig {
+	var pc platformConfig
+	addNameservers := func(nameservers, search []string) {
+		for _, ns := range nameservers {
+			if !containsValue(pc.Nameservers, ns) {
+				pc.Nameservers = append(pc.Nameservers, ns)
+			}
+		}
+		for _, s := range search {
+			if !containsValue(pc.SearchDomains, s) {
+				pc.SearchDomains = append(pc.SearchDomains, s)
+			}
+		}
+	}
+
+	macs := interfacesByMAC()
+	for _, c := range nc.Config {
+		switch c.Type {
+		case "nameserver":
+			addNameservers(c.Address, c.Search)
+			continue
+		case "physical":
+		default:
+			logger.WithField("type", c.Type).Debug("Ignoring network config entry of unsupported type")
+			continue
+		}
+		spec := map[interface{}]interface{}{"name": c.Name}
+		if name, ok := macs[strings.ToLower(c.MAC)]; ok {
+			spec["name"] = name
+		}
+		if c.MTU > 0 {
+			spec["mtu"] = c.MTU
+		}
+		for _, s := range c.Subnets {
+			switch s.Type {
+			case "dhcp", "dhcp4":
+				spec["dhcp"] = true
+			case "dhcp6", "ipv6_dhcpv6-stateful", "ipv6_dhcpv6-stateless":
+				spec["ipv6"] = map[interface{}]interface{}{"mode": "dhcp"}
+			case "ipv6_slaac":
+				spec["ipv6"] = map[interface{}]interface{}{"mode": "slaac"}
+			case "static", "static6":
+				setStaticAddress(spec, s.Address, s.Netmask, s.Gateway)
+			}
+			addNameservers(s.Nameservers, s.Search)
+		}
+		pc.Interfaces = append(pc.Interfaces, spec)
+	}
+
+	names := make([]string, 0, len(nc.Ethernets))
+	for name := range nc.Ethernets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, id := range names {
+		eth := nc.Ethernets[id]
+		spec := map[interface{}]interface{}{"name": id}
+		if name, ok := macs[strings.ToLower(eth.Match.MAC)]; ok {
+			spec["name"] = name
+		} else if eth.SetName != "" {
+			spec["name"] = eth.SetName
+		}
+		if eth.MTU > 0 {
+			spec["mtu"] = eth.MTU
+		}
+		if eth.DHCP4 {
+			spec["dhcp"] = true
+		}
+		if eth.DHCP6 {
+			spec["ipv6"] = map[interface{}]interface{}{"mode": "dhcp"}
+		}
+		for _, a := range eth.Addresses {
+			gateway := eth.Gateway4
+			if strings.Contains(a, ":") {
+				gateway = eth.Gateway6
+			}
+			setStaticAddress(spec, a, "", gateway)
+		}
+		addNameservers(eth.Nameservers.Addresses, eth.Nameservers.Search)
+		pc.Interfaces = append(pc.Interfaces, spec)
+	}
+	return pc
+}
+
+// sets the static address of an interface specification. The address may be
+// in CIDR notation, else the netmask is either a netmask or a prefix length.
+// IPv6 addresses are set in the ipv6 block.
+func setStaticAddress(spec map[interface{}]interface{}, address, netmask, gateway string) {
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		ip = net.ParseIP(address)
+	}
+	if ip == nil {
+		logger.WithField("address", address).Warn("Ignoring invalid address")
+		return
+	}
+	prefix := -1
+	if ipnet != nil {
+		prefix, _ = ipnet.Mask.Size()
+	} else if n, err := strconv.Atoi(netmask); err == nil {
+		prefix = n
+	} else if mask := net.ParseIP(netmask); mask != nil {
+		if mask.To4() != nil {
+			mask = mask.To4()
+		}
+		prefix, _ = net.IPMask(mask).Size()
+	}
+
+	if ip.To4() != nil {
+		spec["address"] = ip.String()
+		if prefix >= 0 {
+			spec["netmask"] = net.IP(net.CIDRMask(prefix, 32)).String()
+		}
+		if gateway != "" {
+			spec["gateway"] = gateway
+		}
+		return
+	}
+	ipv6 := map[interface{}]interface{}{"mode": "static", "address": ip.String()}
+	if prefix >= 0 {
+		ipv6["netmask"] = prefix
+	}
+	if gateway != "" {
+		ipv6["gateway"] = gateway
+	}
+	spec["ipv6"] = ipv6
+}
+
+// returns the names of the physical network interfaces by their MAC address
+func interfacesByMAC() map[string]string {
+	macs := make(map[string]string)
+	entries, err := ioutil.ReadDir(sysClassNet)
+	if err != nil {
+		return macs
+	}
+	for _, e := range entries {
+		// virtual interfaces (bonds, bridges, vlans) may share the address
+		// of a physical interface
+		if _, err := os.Stat(filepath.Join(sysClassNet, e.Name(), "device")); err != nil {
+			continue
+		}
+		addr, err := ioutil.ReadFile(filepath.Join(sysClassNet, e.Name(), "address"))
+		if err != nil {
+			continue
+		}
+		if mac := strings.ToLower(strings.TrimSpace(string(addr))); mac != "" {
+			macs[mac] = e.Name()
+		}
+	}
+	return macs
+}
@@ -0,0 +1,409 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	cloudConfigHeader = "#cloud-config"
+)
+
+// returns true if data is a cloud-config document
+func isCloudConfig(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(cloudConfigHeader))
+}
+
+// translates a cloud-config document, as emitted by existing tooling or
+// generated by e.g. the Proxmox VE cloud-init drive, into alpine-data. The
+// supported subset is hostname, fqdn, manage_etc_hosts, ntp, user, users,
+// groups, password, chpasswd, ssh_authorized_keys, ssh_pwauth,
+// disable_root, packages, package_update, package_upgrade, write_files,
+// bootcmd, runcmd, timezone, locale, ca_certs, mounts, swap and phone_home;
+// keys that alpine-data doesn't know are ignored with a warning.
+func fromCloudConfig(data []byte) ([]byte, error) {
+	doc := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Error parsing cloud-config: %s", err)
+	}
+	move := func(from string, to ...string) {
+		if v, ok := doc[from]; ok {
+			delete(doc, from)
+			setPath(doc, to, v)
+		}
+	}
+	move("hostname", "network", "hostname")
+	move("fqdn", "network", "fqdn")
+	if v, ok := doc["manage_etc_hosts"]; ok {
+		// cloud-init also accepts `localhost` and `template`
+		enabled, isBool := v.(bool)
+		delete(doc, "manage_etc_hosts")
+		setPath(doc, []string{"network", "manage_etc_hosts"}, enabled || !isBool)
+	}
+	if ntp, ok := doc["ntp"].(map[interface{}]interface{}); ok {
+		delete(doc, "ntp")
+		for _, k := range []string{"servers", "pools"} {
+			if v, ok := ntp[k]; ok {
+				setPath(doc, []string{"network", "ntp", k}, v)
+			}
+		}
+	}
+
+	// the users list may contain `default`, the user set by `user`
+	var users []interface{}
+	if list, ok := doc["users"].([]interface{}); ok {
+		for _, u := range list {
+			if m, ok := u.(map[interface{}]interface{}); ok {
+				users = append(users, cloudConfigUser(m))
+			}
+		}
+	}
+	keys, _ := doc["ssh_authorized_keys"].([]interface{})
+	delete(doc, "ssh_authorized_keys")
+	expire := false
+	if chpasswd, ok := doc["chpasswd"].(map[interface{}]interface{}); ok {
+		expire, _ = chpasswd["expire"].(bool)
+		delete(doc, "chpasswd")
+	}
+
+	var defaultUser map[interface{}]interface{}
+	switch u := doc["user"].(type) {
+	case string:
+		defaultUser = map[interface{}]interface{}{"name": u}
+	case map[interface{}]interface{}:
+		defaultUser = cloudConfigUser(u)
+	}
+	delete(doc, "user")
+	if name, _ := defaultUser["name"].(string); name != "" && name != "root" {
+		// the default user gets root access, like with cloud-init
+		if _, ok := defaultUser["doas"]; !ok {
+			defaultUser["doas"] = []interface{}{fmt.Sprintf("permit nopass %s as root", name)}
+		}
+		if passwd, ok := doc["password"]; ok {
+			defaultUser["passwd"] = passwd
+		}
+		if len(keys) > 0 {
+			defaultUser["ssh_authorized_keys"] = append(keys, listValue(defaultUser["ssh_authorized_keys"])...)
+		}
+		if expire {
+			defaultUser["expire"] = true
+		}
+		users = append([]interface{}{defaultUser}, users...)
+		delete(doc, "password")
+	} else if len(keys) > 0 {
+		setPath(doc, []string{"sshd", "authorized_keys"}, keys)
+	}
+	if len(users) > 0 {
+		doc["users"] = users
+	} else {
+		delete(doc, "users")
+	}
+	if list, ok := doc["groups"].([]interface{}); ok {
+		doc["groups"] = cloudConfigGroups(list)
+	}
+
+	if v, ok := doc["ssh_pwauth"]; ok {
+		delete(doc, "ssh_pwauth")
+		// `unchanged` leaves the default
+		if enabled, ok := yamlBool(v); ok {
+			setPath(doc, []string{"sshd", "password_authentication"}, enabled)
+		}
+	}
+	if v, ok := doc["disable_root"].(bool); ok {
+		delete(doc, "disable_root")
+		setPath(doc, []string{"sshd", "permit_root_login"}, !v)
+	}
+
+	if list, ok := doc["packages"].([]interface{}); ok {
+		doc["packages"] = map[interface{}]interface{}{"install": cloudConfigPackages(list)}
+	}
+	for from, to := range map[string]string{"package_update": "update", "package_upgrade": "upgrade"} {
+		if v, ok := doc[from]; ok {
+			delete(doc, from)
+			setPath(doc, []string{"packages", to}, v)
+		}
+	}
+	if list, ok := doc["write_files"].([]interface{}); ok {
+		for _, f := range list {
+			if m, ok := f.(map[interface{}]interface{}); ok {
+				cloudConfigFile(m)
+			}
+		}
+	}
+	for _, section := range []string{"bootcmd", "runcmd"} {
+		if list, ok := doc[section].([]interface{}); ok {
+			doc[section] = cloudConfigCommands(list)
+		}
+	}
+
+	// keys that alpine-data has as well, but with another schema
+	move("ca-certs", "ca_certs")
+	convert := map[string]func(interface{}) interface{}{
+		"ca_certs":   cloudConfigCACerts,
+		"mounts":     cloudConfigMounts,
+		"swap":       cloudConfigSwap,
+		"phone_home": cloudConfigPhoneHome,
+	}
+	for key, f := range convert {
+		if v, ok := doc[key]; ok {
+			if v = f(v); v != nil {
+				doc[key] = v
+			} else {
+				delete(doc, key)
+			}
+		}
+	}
+
+	dropUnknownKeys("cloud-config", doc, reflect.TypeOf(AlpineData{}))
+	return yaml.Marshal(doc)
+}
+
+// translates the cloud-config ca_certs, whose trusted certificates are
+// PEM strings
+func cloudConfigCACerts(v interface{}) interface{} {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	if remove, _ := yamlBool(m["remove_defaults"]); remove {
+		logger.Warn("Ignoring unsupported cloud-config ca_certs.remove_defaults")
+	}
+	if trusted := listValue(m["trusted"]); len(trusted) > 0 {
+		return trusted
+	}
+	return nil
+}
+
+// translates the cloud-config mounts, which are fstab entries as lists:
+// source, target, type, options, dump and pass
+func cloudConfigMounts(v interface{}) interface{} {
+	var mounts []interface{}
+	for _, e := range listValue(v) {
+		fields, _ := e.([]interface{})
+		if len(fields) < 2 || fields[1] == nil || fields[1] == "none" || fields[1] == "swap" {
+			// entries without a target remove a mount, or are swap
+			logger.WithField("mount", e).Warn("Ignoring unsupported cloud-config mount")
+			continue
+		}
+		// the defaults of cloud-init
+		mount := map[interface{}]interface{}{"source": fields[0], "target": fields[1], "type": "auto", "mount_options": "defaults,nofail", "dump": 0, "pass": 2}
+		for i, key := range []string{"type", "mount_options", "dump", "pass"} {
+			if len(fields) > i+2 && fields[i+2] != nil {
+				mount[key] = fields[i+2]
+			}
+		}
+		for _, key := range []string{"dump", "pass"} {
+			if s, ok := mount[key].(string); ok {
+				n, _ := strconv.Atoi(s)
+				mount[key] = n
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	if len(mounts) == 0 {
+		return nil
+	}
+	return mounts
+}
+
+// translates the cloud-config swap, a swap file with a size in bytes or
+// with a unit
+func cloudConfigSwap(v interface{}) interface{} {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	swap := map[interface{}]interface{}{"file": "/swap.img"}
+	if f, ok := m["filename"]; ok {
+		swap["file"] = f
+	}
+	switch size := m["size"].(type) {
+	case int:
+		swap["size"] = fmt.Sprintf("%dM", size/(1024*1024))
+	case string:
+		if size == "auto" {
+			logger.Warn("Ignoring unsupported cloud-config swap size auto")
+			return nil
+		}
+		swap["size"] = size
+	default:
+		return nil
+	}
+	return swap
+}
+
+// translates the cloud-config phone_home; the report lift posts is its own,
+// so only the url and number of tries are used
+func cloudConfigPhoneHome(v interface{}) interface{} {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || m["url"] == nil {
+		return nil
+	}
+	ph := map[interface{}]interface{}{"url": m["url"]}
+	if tries, ok := m["tries"].(int); ok && tries > 1 {
+		ph["retries"] = tries - 1
+	}
+	return ph
+}
+
+// translates a cloud-config user into an alpine-data user
+func cloudConfigUser(u map[interface{}]interface{}) map[interface{}]interface{} {
+	for from, to := range map[string]string{"hashed_passwd": "passwd", "plain_text_passwd": "passwd", "no_create_home": "no_create_homedir"} {
+		if v, ok := u[from]; ok {
+			delete(u, from)
+			u[to] = v
+		}
+	}
+	if groups, ok := u["groups"].(string); ok {
+		// cloud-init accepts a comma separated list
+		var list []interface{}
+		for _, g := range strings.Split(groups, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				list = append(list, g)
+			}
+		}
+		u["groups"] = list
+	}
+	if sudo, ok := u["sudo"].(bool); ok && !sudo {
+		delete(u, "sudo")
+	}
+	if _, ok := u["lock_passwd"]; !ok {
+		// like with cloud-init, password login is disabled by default
+		u["lock_passwd"] = true
+	}
+	if ids, ok := u["ssh_import_id"]; ok {
+		delete(u, "ssh_import_id")
+		keys := listValue(u["ssh_authorized_keys"])
+		for _, id := range listValue(ids) {
+			if s, _ := id.(string); strings.HasPrefix(s, "gh:") {
+				keys = append(keys, s)
+			} else {
+				logger.WithField("user", u["name"]).Warnf("Ignoring unsupported ssh_import_id %v", id)
+			}
+		}
+		u["ssh_authorized_keys"] = keys
+	}
+	dropUnknownKeys("cloud-config user", u, reflect.TypeOf(User{}))
+	return u
+}
+
+// translates the cloud-config groups, which are the names of groups or a
+// map from a group name to its members
+func cloudConfigGroups(list []interface{}) []interface{} {
+	var groups []interface{}
+	for _, g := range list {
+		switch v := g.(type) {
+		case string:
+			groups = append(groups, map[interface{}]interface{}{"name": v})
+		case map[interface{}]interface{}:
+			for name, members := range v {
+				groups = append(groups, map[interface{}]interface{}{"name": name, "members": members})
+			}
+		}
+	}
+	return groups
+}
+
+// translates the cloud-config packages, which are names or [name, version]
+// pairs, into apk syntax
+func cloudConfigPackages(list []interface{}) []interface{} {
+	var pkgs []interface{}
+	for _, p := range list {
+		if pair, ok := p.([]interface{}); ok && len(pair) == 2 {
+			pkgs = append(pkgs, fmt.Sprintf("%v=%v", pair[0], pair[1]))
+			continue
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs
+}
+
+// translates a cloud-config file, whose content can come from a source uri
+// and whose permissions can be an (octal) number
+func cloudConfigFile(f map[interface{}]interface{}) {
+	if source, ok := f["source"].(map[interface{}]interface{}); ok {
+		delete(f, "source")
+		f["content-url"] = source["uri"]
+		if headers, ok := source["headers"]; ok {
+			f["headers"] = headers
+		}
+	}
+	if perms, ok := f["permissions"].(int); ok {
+		f["permissions"] = fmt.Sprintf("%#o", perms)
+	}
+	dropUnknownKeys("cloud-config write_files", f, reflect.TypeOf(WriteFile{}))
+}
+
+// translates cloud-config commands; a list is executed as arguments (not
+// by the shell), so it's quoted into a single command
+func cloudConfigCommands(list []interface{}) []interface{} {
+	var cmds []interface{}
+	for _, c := range list {
+		args, ok := c.([]interface{})
+		if !ok {
+			cmds = append(cmds, c)
+			continue
+		}
+		quoted := make([]string, 0, len(args))
+		for _, a := range args {
+			quoted = append(quoted, shellQuote(fmt.Sprintf("%v", a)))
+		}
+		cmds = append(cmds, strings.Join(quoted, " "))
+	}
+	return cmds
+}
+
+// quotes a string for the shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// removes the keys that don't map to a field of the given struct type,
+// warning about each of them
+func dropUnknownKeys(what string, m map[interface{}]interface{}, t reflect.Type) {
+	known := map[string]bool{mergeKey: true}
+	for i := 0; i < t.NumField(); i++ {
+		if tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; tag != "" {
+			known[tag] = true
+		}
+	}
+	for k := range m {
+		if key, _ := k.(string); !known[key] {
+			logger.WithField("key", k).Warnf("Ignoring unsupported %s key", what)
+			delete(m, k)
+		}
+	}
+}
+
+// returns a yaml value as a list; a single value becomes a list of one
+func listValue(v interface{}) []interface{} {
+	switch l := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return l
+	default:
+		return []interface{}{l}
+	}
+}
+
+// returns the boolean of a yaml value that is a bool or a yes/no string
+func yamlBool(v interface{}) (bool, bool) {
+	switch b := v.(type) {
+	case bool:
+		return b, true
+	case string:
+		switch strings.ToLower(b) {
+		case "yes", "true", "on":
+			return true, true
+		case "no", "false", "off":
+			return false, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,228 @@
+package lift
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// translates a cloud-config document and decodes the result as alpine-data
+func decodeCloudConfig(t *testing.T, doc string) *AlpineData {
+	t.Helper()
+	data, err := fromCloudConfig([]byte("#cloud-config\n" + doc))
+	if err != nil {
+		t.Fatalf("fromCloudConfig: %v", err)
+	}
+	ad := &AlpineData{}
+	if err = yaml.UnmarshalStrict(data, ad); err != nil {
+		t.Fatalf("decoding translated alpine-data: %v\n%s", err, data)
+	}
+	return ad
+}
+
+func TestCloudConfigCACerts(t *testing.T) {
+	pem := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	trusted := "  trusted:\n    - |\n      -----BEGIN CERTIFICATE-----\n      MIIB\n      -----END CERTIFICATE-----\n"
+	tests := []struct {
+		name string
+		doc  string
+		want []CACert
+	}{
+		{"trusted", "ca_certs:\n  remove_defaults: true\n" + trusted, []CACert{{Content: pem}}},
+		{"hyphenated key", "ca-certs:\n" + trusted, []CACert{{Content: pem}}},
+		{"no trusted certificates", "ca_certs:\n  remove_defaults: false\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeCloudConfig(t, tt.doc).CACerts; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudConfigMounts(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want []Mount
+	}{
+		{
+			"all fields",
+			"mounts:\n  - [/dev/sdb1, /data, xfs, noatime, \"1\", \"0\"]\n",
+			[]Mount{{Source: "/dev/sdb1", Target: "/data", Type: "xfs", MountOptions: "noatime", Dump: 1, Pass: 0}},
+		},
+		{
+			"defaults",
+			"mounts:\n  - [ephemeral0, /mnt]\n",
+			[]Mount{{Source: "ephemeral0", Target: "/mnt", Type: "auto", MountOptions: "defaults,nofail", Dump: 0, Pass: 2}},
+		},
+		{
+			"swap and removed mounts",
+			"mounts:\n  - [swap, none, swap, sw, \"0\", \"0\"]\n  - [ephemeral0, null]\n",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeCloudConfig(t, tt.doc).Mounts; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudConfigSwap(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want *SwapConfig
+	}{
+		{"size in bytes", "swap:\n  filename: /swapfile\n  size: 2147483648\n", &SwapConfig{File: "/swapfile", Size: "2048M"}},
+		{"size with unit", "swap:\n  size: 1G\n  maxsize: 2G\n", &SwapConfig{File: "/swap.img", Size: "1G"}},
+		{"automatic size", "swap:\n  size: auto\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeCloudConfig(t, tt.doc).Swap; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudConfigPhoneHome(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want *PhoneHomeConfig
+	}{
+		{"url and tries", "phone_home:\n  url: http://example.com/$INSTANCE_ID/\n  post: all\n  tries: 5\n", &PhoneHomeConfig{URL: "http://example.com/$INSTANCE_ID/", Retries: 4}},
+		{"single try", "phone_home:\n  url: http://example.com/\n  tries: 1\n", &PhoneHomeConfig{URL: "http://example.com/"}},
+		{"no url", "phone_home:\n  post: [pub_key_rsa]\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeCloudConfig(t, tt.doc).PhoneHome; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudConfigNetwork(t *testing.T) {
+	doc := "hostname: alpine\nfqdn: alpine.example.com\nmanage_etc_hosts: localhost\nntp:\n  servers: [ntp.example.com]\n  enabled: true\n"
+	n := decodeCloudConfig(t, doc).Network
+	if n == nil || n.HostName != "alpine" || n.FQDN != "alpine.example.com" || !n.ManageEtcHosts {
+		t.Fatalf("got network %+v", n)
+	}
+	if n.NTP == nil || !reflect.DeepEqual(n.NTP.Servers, MultiString{"ntp.example.com"}) {
+		t.Errorf("got ntp %+v", n.NTP)
+	}
+}
+
+func TestCloudConfigUsers(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		want     []User
+		wantKeys []string
+	}{
+		{
+			"default user",
+			"user: alpine\npassword: secret\nchpasswd:\n  expire: true\nssh_authorized_keys: [ssh-ed25519 AAAA]\n",
+			[]User{{
+				Name: "alpine", Password: "secret", Expire: true,
+				SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA"},
+				Doas:              MultiString{"permit nopass alpine as root"},
+			}},
+			nil,
+		},
+		{
+			"root keys",
+			"ssh_authorized_keys: [ssh-ed25519 AAAA]\n",
+			nil,
+			[]string{"ssh-ed25519 AAAA"},
+		},
+		{
+			"users",
+			"users:\n  - default\n  - name: ops\n    groups: wheel, adm\n    hashed_passwd: $6$ops\n    lock_passwd: false\n    sudo: false\n    ssh_import_id: [gh:ops, lp:ops]\n",
+			[]User{{
+				Name: "ops", Groups: MultiString{"wheel", "adm"}, Password: "$6$ops",
+				SSHAuthorizedKeys: []string{"gh:ops"},
+			}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ad := decodeCloudConfig(t, tt.doc)
+			if !reflect.DeepEqual(ad.Users, tt.want) {
+				t.Errorf("got users %+v, want %+v", ad.Users, tt.want)
+			}
+			var keys []string
+			if ad.SSHDConfig != nil {
+				keys = ad.SSHDConfig.AuthorizedKeys
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("got authorized keys %q, want %q", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestCloudConfigGroups(t *testing.T) {
+	doc := "groups:\n  - ops\n  - admins: [alpine, ops]\n"
+	want := GroupList{{Name: "ops"}, {Name: "admins", Members: MultiString{"alpine", "ops"}}}
+	if got := decodeCloudConfig(t, doc).Groups; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCloudConfigSSHD(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       string
+		password  string
+		rootLogin string
+	}{
+		{"password auth", "ssh_pwauth: true\ndisable_root: false\n", "true", "true"},
+		{"yaml string", "ssh_pwauth: \"yes\"\n", "true", "unset"},
+		{"disabled", "ssh_pwauth: false\ndisable_root: true\n", "false", "false"},
+	}
+	value := func(b *bool) string {
+		if b == nil {
+			return "unset"
+		}
+		return strconv.FormatBool(*b)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := decodeCloudConfig(t, tt.doc).SSHDConfig
+			if s == nil || value(s.PasswordAuthentication) != tt.password || value(s.PermitRootLogin) != tt.rootLogin {
+				t.Errorf("got %+v, want password_authentication %s, permit_root_login %s", s, tt.password, tt.rootLogin)
+			}
+		})
+	}
+}
+
+func TestCloudConfigPackages(t *testing.T) {
+	doc := "packages:\n  - curl\n  - [jq, 1.6-r1]\npackage_update: true\npackage_upgrade: true\n"
+	p := decodeCloudConfig(t, doc).Packages
+	if p == nil || !p.Update || !p.Upgrade {
+		t.Fatalf("got packages %+v", p)
+	}
+	want := PackageList{{Name: "curl"}, {Name: "jq", Version: "=1.6-r1"}}
+	if !reflect.DeepEqual(p.Install, want) {
+		t.Errorf("got install %+v, want %+v", p.Install, want)
+	}
+}
+
+func TestCloudConfigUnknownKeys(t *testing.T) {
+	ad := decodeCloudConfig(t, "apt:\n  preserve_sources_list: true\ntimezone: Europe/Amsterdam\n")
+	if ad.TimeZone != "Europe/Amsterdam" {
+		t.Errorf("got timezone %q", ad.TimeZone)
+	}
+}
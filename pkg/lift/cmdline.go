@@ -0,0 +1,153 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	cmdlinePrefix = "lift."
+)
+
+var (
+	// shorthands of lift.* kernel boot parameters, and the alpine-data path
+	// they set. Their values are taken as plain strings.
+	cmdlineShorthands = map[string]string{
+		"hostname": "network.hostname",
+		"fqdn":     "network.fqdn",
+		"password": "password",
+	}
+)
+
+// returns the alpine-data overrides from the lift.* kernel boot parameters,
+// to be merged over the alpine-data. Besides the shorthands, the ssh_key,
+// ip and dns parameters, lift.<path>=<value> sets any value by its dotted
+// path (e.g. lift.network.ntp.pools=[pool.ntp.org]), the value being
+// parsed as YAML.
+func cmdlineOverrides() (map[interface{}]interface{}, error) {
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return nil, nil
+	}
+	return parseCmdlineOverrides(splitCmdline(string(cmdline)))
+}
+
+func parseCmdlineOverrides(params []string) (map[interface{}]interface{}, error) {
+	doc := make(map[interface{}]interface{})
+	var keys, ifaces, nameservers []interface{}
+	for _, p := range params {
+		if !strings.HasPrefix(p, cmdlinePrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(p, cmdlinePrefix), "=", 2)
+		key, value := kv[0], "true"
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "":
+			return nil, fmt.Errorf("invalid kernel boot parameter %s", p)
+		case "data_url", "vendor_data_url", "dhcp_option":
+			// used by the datasources
+		case "vault_addr", "vault_token", "age_key":
+			// used to resolve secrets
+		case "signing_key", "signature_url":
+			// used to verify the alpine-data
+		case "progress":
+			// used to print the progress
+		case "ssh_key":
+			keys = append(keys, value)
+		case "ip":
+			iface, err := parseIPParam(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid kernel boot parameter %s: %s", p, err)
+			}
+			ifaces = append(ifaces, iface)
+		case "dns":
+			for _, ns := range strings.Split(value, ",") {
+				nameservers = append(nameservers, ns)
+			}
+		default:
+			if path, ok := cmdlineShorthands[key]; ok {
+				setPath(doc, strings.Split(path, "."), value)
+			} else {
+				setPath(doc, strings.Split(key, "."), parseCmdlineValue(value))
+			}
+		}
+	}
+	if len(keys) > 0 {
+		// keys from the kernel boot parameters are added to the configured keys
+		setPath(doc, []string{"sshd", "authorized_keys"}, keys)
+		setPath(doc, []string{"sshd", mergeKey, "authorized_keys"}, MergeUniqueAppend)
+	}
+	if len(ifaces) > 0 {
+		setPath(doc, []string{"network", "interfaces"}, ifaces)
+	}
+	if len(nameservers) > 0 {
+		setPath(doc, []string{"network", "resolv_conf", "nameservers"}, nameservers)
+	}
+	return doc, nil
+}
+
+// parses the value of a lift.ip kernel boot parameter; either `dhcp`,
+// `<interface>,dhcp` or `<interface>,<address>/<prefix>[,<gateway>]`
+func parseIPParam(value string) (map[interface{}]interface{}, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) == 1 && fields[0] == "dhcp" {
+		return map[interface{}]interface{}{"name": "eth0", "dhcp": true}, nil
+	}
+	if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+		return nil, fmt.Errorf("expected dhcp, <interface>,dhcp or <interface>,<address>/<prefix>[,<gateway>]")
+	}
+	iface := map[interface{}]interface{}{"name": fields[0]}
+	if fields[1] == "dhcp" {
+		iface["dhcp"] = true
+		return iface, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		prefix, _ := ipnet.Mask.Size()
+		ipv6 := map[interface{}]interface{}{"mode": "static", "address": ip.String(), "netmask": prefix}
+		if len(fields) == 3 {
+			ipv6["gateway"] = fields[2]
+		}
+		iface["ipv6"] = ipv6
+		return iface, nil
+	}
+	iface["address"] = ip.String()
+	iface["netmask"] = net.IP(ipnet.Mask).String()
+	if len(fields) == 3 {
+		iface["gateway"] = fields[2]
+	}
+	return iface, nil
+}
+
+// parses a kernel boot parameter value as YAML, falling back to the
+// plain string
+func parseCmdlineValue(value string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(value), &v); err != nil || v == nil {
+		return value
+	}
+	return v
+}
+
+// sets a value in a document by its path, creating the maps on the way
+func setPath(doc map[interface{}]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[interface{}]interface{})
+		if !ok {
+			next = make(map[interface{}]interface{})
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[path[len(path)-1]] = value
+}
@@ -0,0 +1,284 @@
+package lift
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	localeProfileFile = "/etc/profile.d/locale.sh"
+	consoleFontConf   = "/etc/conf.d/consolefont"
+	consoleFontsDir   = "/usr/share/consolefonts"
+	keymapsDir        = "/usr/share/bkeymaps"
+	keymapConfDir     = "/etc/keymap"
+	loadkmapConf      = "/etc/conf.d/loadkmap"
+	zoneinfoDir       = "/usr/share/zoneinfo"
+	localtimeFile     = "/etc/localtime"
+	timezoneFile      = "/etc/timezone"
+)
+
+var (
+	// a TZif file of UTC: the version and reserved bytes, the counts (no
+	// transitions, one local time type and 4 bytes of abbreviations), the
+	// type (offset 0, no daylight saving) and its abbreviation
+	utcZoneInfo = []byte("TZif" + strings.Repeat("\x00", 16) +
+		strings.Repeat("\x00", 16) + "\x00\x00\x00\x01\x00\x00\x00\x04" +
+		strings.Repeat("\x00", 6) + "UTC\x00")
+)
+
+// sets the default locale (e.g. en_US.UTF-8) of login shells, installing
+// musl-locales for the locales (and the translations) besides C.UTF-8.
+// Commands lift runs later (e.g. runcmd) use the locale as well.
+func (l *Lift) localeSetup() error {
+	locale := l.Data.Locale
+	if locale == "" {
+		return nil
+	}
+	logger.Debug("apk add musl-locales")
+	if out, err := apkCommand("add", "--no-cache", "musl-locales").CombinedOutput(); err != nil {
+		return fmt.Errorf("Error installing musl-locales: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	profile := fmt.Sprintf("# set by lift\nexport LANG=%s\n", shellQuote(locale))
+	if charset := localeCharset(locale); charset != "" {
+		profile += fmt.Sprintf("export CHARSET=%s\n", shellQuote(charset))
+	}
+	logger.WithField("file", localeProfileFile).Debug("Writing locale profile")
+	if err := ioutil.WriteFile(localeProfileFile, []byte(profile), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", localeProfileFile, err)
+	}
+	return os.Setenv("LANG", locale)
+}
+
+// returns the charset of a locale, e.g. UTF-8 for en_US.UTF-8
+func localeCharset(locale string) string {
+	i := strings.Index(locale, ".")
+	if i < 0 {
+		return ""
+	}
+	return strings.SplitN(locale[i+1:], "@", 2)[0]
+}
+
+// configures the console font that the consolefont service loads on boot,
+// installing the terminus fonts for ter-* fonts, and loads it immediately
+func (l *Lift) consoleFontSetup() error {
+	font := l.Data.ConsoleFont
+	if font == "" {
+		return nil
+	}
+	pkgs := []string{"kbd"}
+	if strings.HasPrefix(font, "ter-") {
+		pkgs = append(pkgs, "font-terminus")
+	}
+	logger.Debugf("apk add %s", strings.Join(pkgs, " "))
+	if out, err := apkCommand(append([]string{"add", "--no-cache"}, pkgs...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error installing %s: %s: %s", strings.Join(pkgs, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	file, err := consoleFontFile(font)
+	if err != nil {
+		return err
+	}
+	logger.WithField("file", consoleFontConf).Debug("Writing console font configuration")
+	conf := fmt.Sprintf("# set by lift\nconsolefont=\"%s\"\n", file)
+	if err = ioutil.WriteFile(consoleFontConf, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", consoleFontConf, err)
+	}
+	if err = exec.Command("rc-update", "add", "consolefont", "boot").Run(); err != nil {
+		logger.Debugf("Error adding consolefont service to boot runlevel: %v", err)
+	}
+	return doService("consolefont", RESTART)
+}
+
+// returns the file name of a console font, given by its name (e.g.
+// ter-v16n) or file name
+func consoleFontFile(font string) (string, error) {
+	for _, name := range []string{font, font + ".psf.gz", font + ".psfu.gz", font + ".psf"} {
+		if _, err := os.Stat(filepath.Join(consoleFontsDir, name)); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Console font %s not found in %s", font, consoleFontsDir)
+}
+
+// sets the keymap of the consoles like setup-keymap does, persisting it for
+// the loadkmap service on boot, and loads it immediately
+func (l *Lift) keymapSetup() error {
+	layout, variant := parseKeymap(l.Data.Keymap)
+	if layout == "" {
+		return nil
+	}
+	if _, err := os.Stat(keymapsDir); os.IsNotExist(err) {
+		logger.Debug("apk add kbd-bkeymaps")
+		if out, err := apkCommand("add", "--no-cache", "kbd-bkeymaps").CombinedOutput(); err != nil {
+			return fmt.Errorf("Error installing kbd-bkeymaps: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	src, err := keymapFile(layout, variant)
+	if err != nil {
+		return fmt.Errorf("Error setting keymap: %s", err)
+	}
+
+	dest := filepath.Join(keymapConfDir, filepath.Base(src))
+	logger.WithField("file", dest).Debug("Writing keymap")
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("Error reading keymap %s: %s", src, err)
+	}
+	if err = os.MkdirAll(keymapConfDir, 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(dest, data, 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", dest, err)
+	}
+	conf := fmt.Sprintf("# set by lift\nKEYMAP=%s\n", dest)
+	if err = ioutil.WriteFile(loadkmapConf, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", loadkmapConf, err)
+	}
+	if err = exec.Command("rc-update", "add", "loadkmap", "boot").Run(); err != nil {
+		logger.Debugf("Error adding loadkmap service to boot runlevel: %v", err)
+	}
+	if inAltRoot() {
+		return nil
+	}
+	// without a console (e.g. in a container) there is nothing to load the
+	// keymap into
+	if err = loadKeymap(dest); err != nil {
+		logger.WithField("keymap", dest).Warnf("Error loading keymap: %v", err)
+	}
+	return nil
+}
+
+// returns the layout and variant of a keymap given as "<layout> <variant>"
+// or just "<layout>", where the variant is the same as the layout
+func parseKeymap(keymap string) (string, string) {
+	fields := strings.Fields(keymap)
+	switch len(fields) {
+	case 0:
+		return "", ""
+	case 1:
+		return fields[0], fields[0]
+	default:
+		return fields[0], fields[1]
+	}
+}
+
+// returns the keymap as setup-keymap takes it: the layout and the variant
+func keymapOpts(keymap string) string {
+	layout, variant := parseKeymap(keymap)
+	if layout == "" {
+		return ""
+	}
+	return layout + " " + variant
+}
+
+// returns the path of the (binary) keymap of a layout and variant, listing
+// the available variants of the layout if it has no such variant
+func keymapFile(layout, variant string) (string, error) {
+	path := filepath.Join(keymapsDir, layout, variant+".bmap.gz")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	variants, _ := filepath.Glob(filepath.Join(keymapsDir, layout, "*.bmap.gz"))
+	if len(variants) == 0 {
+		return "", fmt.Errorf("layout %s not found in %s", layout, keymapsDir)
+	}
+	for i, v := range variants {
+		variants[i] = strings.TrimSuffix(filepath.Base(v), ".bmap.gz")
+	}
+	return "", fmt.Errorf("layout %s has no variant %s; available: %s", layout, variant, strings.Join(variants, ", "))
+}
+
+// loads a gzipped binary keymap into the console with loadkmap
+func loadKeymap(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("loadkmap")
+	cmd.Stdin = zr
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sets the timezone, installing tzdata when the zone isn't available, and
+// restarts the running services that log or schedule in local time. UTC
+// (the default) doesn't need tzdata, so it's set offline as well.
+func (l *Lift) timezoneSetup() error {
+	tz := l.Data.TimeZone
+	if tz == "" {
+		return nil
+	}
+	zone := filepath.Join(zoneinfoDir, tz)
+	_, err := os.Stat(zone)
+	if os.IsNotExist(err) && (tz == "UTC" || tz == "Etc/UTC") {
+		return setUTC()
+	}
+	if os.IsNotExist(err) {
+		logger.Debug("apk add tzdata")
+		if out, err := apkCommand("add", "--no-cache", "tzdata").CombinedOutput(); err != nil {
+			return fmt.Errorf("Error installing tzdata: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := checkTimezone(tz); err != nil {
+		return fmt.Errorf("Error setting timezone: %s", err)
+	}
+
+	logger.WithField("timezone", tz).Debugf("Linking %s", localtimeFile)
+	if err := os.Remove(localtimeFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing %s: %s", localtimeFile, err)
+	}
+	if err := os.Symlink(zone, localtimeFile); err != nil {
+		return fmt.Errorf("Error linking %s: %s", localtimeFile, err)
+	}
+	if err := ioutil.WriteFile(timezoneFile, []byte(tz+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", timezoneFile, err)
+	}
+	if inAltRoot() {
+		return nil
+	}
+	for _, service := range []string{"crond", "syslog", "rsyslog"} {
+		// --ifstarted leaves stopped services alone
+		_ = exec.Command("rc-service", "--ifstarted", service, RESTART).Run()
+	}
+	return nil
+}
+
+// sets the timezone to UTC without tzdata, with a plain /etc/localtime
+func setUTC() error {
+	logger.WithField("timezone", "UTC").Debugf("Writing %s", localtimeFile)
+	if err := os.Remove(localtimeFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing %s: %s", localtimeFile, err)
+	}
+	if err := ioutil.WriteFile(localtimeFile, utcZoneInfo, 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", localtimeFile, err)
+	}
+	if err := ioutil.WriteFile(timezoneFile, []byte("UTC\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", timezoneFile, err)
+	}
+	return nil
+}
+
+// checks if tz is a zone in the zoneinfo database
+func checkTimezone(tz string) error {
+	if strings.HasPrefix(tz, "/") || strings.Contains(tz, "..") {
+		return fmt.Errorf("invalid timezone %s", tz)
+	}
+	fi, err := os.Stat(filepath.Join(zoneinfoDir, tz))
+	if err != nil || fi.IsDir() {
+		return fmt.Errorf("unknown timezone %s, not found in %s", tz, zoneinfoDir)
+	}
+	return nil
+}
@@ -1,27 +1,66 @@
 package lift
 
 import (
+	"fmt"
+	"net"
 	"strconv"
+	"strings"
 )
 
-// AlpineData is the main alpine-data yaml specification
+// AlpineData is the main alpine-data yaml specification. Minimal disables
+// the defaults, and the modules without a block in the alpine-data.
 type AlpineData struct {
-	RootPasswd  string            `yaml:"password"`
-	MOTD        string            `yaml:"motd"`
-	Network     *NetworkSettings  `yaml:"network"`
-	Packages    *PackagesConfig   `yaml:"packages"`
-	DRP         *DRProvision      `yaml:"dr_provision"`
-	SSHDConfig  *SSHD             `yaml:"sshd"`
-	Groups      MultiString       `yaml:"groups"`
-	Users       []User            `yaml:"users"`
-	RunCMD      []MultiString     `yaml:"runcmd"`
-	WriteFiles  []WriteFile       `yaml:"write_files"`
-	TimeZone    string            `yaml:"timezone"`
-	Keymap      string            `yaml:"keymap"`
-	UnLift      bool              `yaml:"unlift"`
-	ScratchDisk string            `yaml:"scratch_disk"`
-	Disks       []Disk            `yaml:"disks"`
-	MTA         *MTAConfiguration `yaml:"mta"`
+	Version      int               `yaml:"version"`
+	RootPasswd   string            `yaml:"password"`
+	Root         *RootConfig       `yaml:"root"`
+	MOTD         MOTDConfig        `yaml:"motd"`
+	Template     bool              `yaml:"template"`
+	Minimal      bool              `yaml:"minimal"`
+	Network      *NetworkSettings  `yaml:"network"`
+	Packages     *PackagesConfig   `yaml:"packages"`
+	DRP          *DRProvision      `yaml:"dr_provision"`
+	Agents       []Agent           `yaml:"agents"`
+	Monitoring   *MonitoringConfig `yaml:"monitoring"`
+	ACME         *ACMEConfig       `yaml:"acme"`
+	SSHDConfig   *SSHD             `yaml:"sshd"`
+	SSHKeys      *SSHHostKeys      `yaml:"ssh_keys"`
+	Groups       GroupList         `yaml:"groups"`
+	Doas         *DoasConfig       `yaml:"doas"`
+	Users        []User            `yaml:"users"`
+	BootCMD      []Command         `yaml:"bootcmd"`
+	RunCMD       []Command         `yaml:"runcmd"`
+	WriteFiles   []WriteFile       `yaml:"write_files"`
+	Downloads    *DownloadSettings `yaml:"downloads"`
+	TimeZone     string            `yaml:"timezone"`
+	Keymap       string            `yaml:"keymap"`
+	Locale       string            `yaml:"locale"`
+	ConsoleFont  string            `yaml:"consolefont"`
+	UnLift       UnLiftLevel       `yaml:"unlift"`
+	LiftUpdate   *LiftUpdate       `yaml:"lift_update"`
+	ScratchDisk  string            `yaml:"scratch_disk"`
+	ResizeRootFS bool              `yaml:"resize_rootfs"`
+	RAID         []RAIDArray       `yaml:"raid"`
+	Disks        []Disk            `yaml:"disks"`
+	ISCSI        *ISCSIConfig      `yaml:"iscsi"`
+	LVM          *LVMConfig        `yaml:"lvm"`
+	Swap         *SwapConfig       `yaml:"swap"`
+	Mounts       []Mount           `yaml:"mounts"`
+	NFS          []NFSMount        `yaml:"nfs"`
+	MTA          *MTAConfiguration `yaml:"mta"`
+	Services     []Service         `yaml:"services"`
+	Sysctl       map[string]string `yaml:"sysctl"`
+	Syslog       *SyslogConfig     `yaml:"syslog"`
+	Modules      ModuleSettings    `yaml:"modules"`
+	Cron         *CronConfig       `yaml:"cron"`
+	CACerts      []CACert          `yaml:"ca_certs"`
+	Certificates []Certificate     `yaml:"certificates"`
+	WireGuard    *WireGuardConfig  `yaml:"wireguard"`
+	Firewall     *FirewallConfig   `yaml:"firewall"`
+	Docker       *DockerConfig     `yaml:"docker"`
+	K3S          *K3SConfig        `yaml:"k3s"`
+	PhoneHome    *PhoneHomeConfig  `yaml:"phone_home"`
+	Frequency    map[string]string `yaml:"frequency"`
+	Include      MultiString       `yaml:"include"`
 }
 
 // User specifies a specific OS user
@@ -36,16 +75,157 @@ type User struct {
 	System            bool        `yaml:"system"`
 	SSHAuthorizedKeys []string    `yaml:"ssh_authorized_keys"`
 	Password          string      `yaml:"passwd"`
+	LockPasswd        bool        `yaml:"lock_passwd"`
+	Expire            bool        `yaml:"expire"`
+	Sudo              MultiString `yaml:"sudo"`
+	Doas              MultiString `yaml:"doas"`
+	Dotfiles          string      `yaml:"dotfiles"`
+	Files             []WriteFile `yaml:"files"`
+	GenerateSSHKey    SSHKeyGen   `yaml:"generate_ssh_key"`
+}
+
+// SSHKeyGen specifies the SSH keypair to generate for a user, of Type
+// ed25519 (the default), ecdsa or rsa, optionally with the number of Bits.
+// With PhoneHome the public key is included in the phone_home report. It
+// can also be specified as boolean only.
+type SSHKeyGen struct {
+	Enabled   bool   `yaml:"enabled"`
+	Type      string `yaml:"type"`
+	Bits      int    `yaml:"bits"`
+	PhoneHome bool   `yaml:"phone_home"`
+}
+
+// LiftUpdate specifies the lift binary to update to before provisioning, by
+// URL or by Version (a release). When both are given, the binary at URL is
+// version Version, and lift only updates when it's running another version.
+// The binary is verified with the SHA256 checksum and/or the signature at
+// SignatureURL (by default <url>.sig). It can also be specified as url or
+// version only.
+type LiftUpdate struct {
+	URL          string `yaml:"url"`
+	Version      string `yaml:"version"`
+	SHA256       string `yaml:"sha256"`
+	SignatureURL string `yaml:"signature_url"`
+}
+
+// RootConfig specifies the root account. Password takes precedence over the
+// top-level password. LockPasswd disables password logins of root, and
+// LockAfterFirstBoot only on the next boot, so the password can only be used
+// during the first boot (e.g. on the console). Shell restricts the login
+// shell of root (e.g. /sbin/nologin). Weak passwords are refused, unless
+// AllowWeakPassword is set.
+type RootConfig struct {
+	Password           string `yaml:"password"`
+	LockPasswd         bool   `yaml:"lock_passwd"`
+	LockAfterFirstBoot bool   `yaml:"lock_after_first_boot"`
+	Shell              string `yaml:"shell"`
+	AllowWeakPassword  bool   `yaml:"allow_weak_password"`
+}
+
+// MOTDConfig specifies the MOTD/login banner. With Template the content is
+// rendered as template, with the system facts. Dynamic installs a profile.d
+// script that shows the current facts at every login. The MOTD can also be
+// specified by its content only.
+type MOTDConfig struct {
+	Content  string `yaml:"content"`
+	Template bool   `yaml:"template"`
+	Dynamic  bool   `yaml:"dynamic"`
+}
+
+// Group specifies an OS group, optionally with an explicit GID and members.
+// A group can also be specified by its name only.
+type Group struct {
+	Name    string      `yaml:"name"`
+	GID     int         `yaml:"gid"`
+	System  bool        `yaml:"system"`
+	Members MultiString `yaml:"members"`
+}
+
+// GroupList is a list of groups, needed for unmarshalling
+type GroupList []Group
+
+// Service specifies an OpenRC service. Enabled adds (true) or deletes (false)
+// the service to/from its runlevel, which defaults to `default`. State is one
+// of started, stopped or restarted. A service can also be specified by its
+// name only, which enables and starts it.
+type Service struct {
+	Name     string `yaml:"name"`
+	Enabled  *bool  `yaml:"enabled"`
+	Runlevel string `yaml:"runlevel"`
+	State    string `yaml:"state"`
+}
+
+// ModuleSettings enables, disables, reorders and parallelizes the lift
+// modules, and lists the kernel modules to load. A plain list specifies the
+// kernel modules only.
+type ModuleSettings struct {
+	Enable   []string            `yaml:"enable"`
+	Disable  []string            `yaml:"disable"`
+	Order    []string            `yaml:"order"`
+	Parallel int                 `yaml:"parallel"`
+	After    map[string][]string `yaml:"after"`
+	Kernel   []KernelModule      `yaml:"kernel"`
+}
+
+// KernelModule specifies a kernel module to load on boot, optionally with
+// module parameters (e.g. `max_part=8`). A module can also be specified by
+// its name only.
+type KernelModule struct {
+	Name    string `yaml:"name"`
+	Options string `yaml:"options"`
+}
+
+// CronConfig specifies crontab entries, and scripts to install in the
+// /etc/periodic/{15min,hourly,daily,weekly,monthly} directories
+type CronConfig struct {
+	Jobs     []CronJob                   `yaml:"jobs"`
+	Periodic map[string][]PeriodicScript `yaml:"periodic"`
+}
+
+// CronJob specifies a crontab entry. User defaults to root.
+type CronJob struct {
+	User     string `yaml:"user"`
+	Schedule string `yaml:"schedule"`
+	Command  string `yaml:"command"`
+}
+
+// PeriodicScript specifies a script run by one of the periodic jobs
+type PeriodicScript struct {
+	Name    string `yaml:"name"`
+	Content string `yaml:"content"`
 }
 
 // SSHD specifies the `sshd` entry
 type SSHD struct {
-	Port                   int      `yaml:"port"`
-	ListenAddress          string   `yaml:"listen_address"`
-	AuthorizedKeys         []string `yaml:"authorized_keys"`
-	PermitRootLogin        bool     `yaml:"permit_root_login"`
-	PermitEmptyPasswords   bool     `yaml:"permit_empty_passwords"`
-	PasswordAuthentication bool     `yaml:"password_authentication"`
+	Port                   int               `yaml:"port"`
+	ListenAddress          string            `yaml:"listen_address"`
+	AuthorizedKeys         []string          `yaml:"authorized_keys"`
+	PermitRootLogin        *bool             `yaml:"permit_root_login"`
+	PermitEmptyPasswords   *bool             `yaml:"permit_empty_passwords"`
+	PasswordAuthentication *bool             `yaml:"password_authentication"`
+	AllowUsers             MultiString       `yaml:"allow_users"`
+	AllowGroups            MultiString       `yaml:"allow_groups"`
+	Ciphers                MultiString       `yaml:"ciphers"`
+	Subsystem              string            `yaml:"subsystem"`
+	UseDNS                 *bool             `yaml:"use_dns"`
+	MaxAuthTries           int               `yaml:"max_auth_tries"`
+	ExtraOptions           map[string]string `yaml:"extra_options"`
+}
+
+// SSHHostKeys specifies the SSH host keys. Keys contains pre-generated
+// keys by type (e.g. rsa, ecdsa, ed25519). If Types is set, host keys of
+// other types are deleted, and missing host keys of these types are
+// generated. With Regenerate all existing host keys are replaced.
+type SSHHostKeys struct {
+	Keys       map[string]SSHKeyPair `yaml:"keys"`
+	Types      MultiString           `yaml:"types"`
+	Regenerate bool                  `yaml:"regenerate"`
+}
+
+// SSHKeyPair contains a private and public key
+type SSHKeyPair struct {
+	Private string `yaml:"private"`
+	Public  string `yaml:"public"`
 }
 
 // DRProvision is used for installing and configuring drpcli
@@ -55,15 +235,167 @@ type DRProvision struct {
 	Token         string `yaml:"token"`
 	Endpoint      string `yaml:"endpoint"`
 	UUID          string `yaml:"uuid"`
+	RunnerSHA256  string `yaml:"runner_sha256"`
+	// RegisterTimeout is how long the runner gets to register the machine
+	// with dr-provision (default 2m)
+	RegisterTimeout string `yaml:"register_timeout"`
+}
+
+// Agent specifies an agent (e.g. for monitoring, security or remote access)
+// to install: its binary, downloaded from a url (a binary or an archive
+// containing it), and/or its packages, its configuration files and an OpenRC
+// service running it
+type Agent struct {
+	Name     string       `yaml:"name"`
+	URL      string       `yaml:"url"`
+	SHA256   string       `yaml:"sha256"`
+	Binary   string       `yaml:"binary"`
+	Path     string       `yaml:"path"`
+	Packages []string     `yaml:"packages"`
+	Config   []WriteFile  `yaml:"config"`
+	Service  AgentService `yaml:"service"`
+}
+
+// AgentService specifies the OpenRC service of an agent, which by default
+// runs the binary of the agent. As a boolean it only enables the service.
+type AgentService struct {
+	Enabled   bool              `yaml:"enabled"`
+	Name      string            `yaml:"name"`
+	Command   string            `yaml:"command"`
+	Args      string            `yaml:"args"`
+	User      string            `yaml:"user"`
+	Directory string            `yaml:"directory"`
+	Env       map[string]string `yaml:"env"`
+	Runlevel  string            `yaml:"runlevel"`
+}
+
+// MonitoringConfig specifies the Prometheus node_exporter: the address and
+// port it listens on, and the collectors to enable and disable besides its
+// default collectors; and optionally cadvisor, for the metrics of
+// containers. Their ports are opened in the firewall set up by lift, unless
+// OpenFirewall is false.
+type MonitoringConfig struct {
+	ListenAddress      string         `yaml:"listen_address"`
+	Port               int            `yaml:"port"`
+	Collectors         []string       `yaml:"collectors"`
+	DisabledCollectors []string       `yaml:"disabled_collectors"`
+	CAdvisor           CAdvisorConfig `yaml:"cadvisor"`
+	OpenFirewall       *bool          `yaml:"open_firewall"`
+}
+
+// CAdvisorConfig specifies the address and port cadvisor listens on. As a
+// boolean it only enables cadvisor.
+type CAdvisorConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	ListenAddress string `yaml:"listen_address"`
+	Port          int    `yaml:"port"`
+}
+
+// ACMEConfig specifies a certificate for the Domains, obtained with lego from
+// an ACME server (Let's Encrypt by default) with the http (standalone, or in
+// the Webroot of a web server) or dns Challenge. The dns Provider reads its
+// Credentials from environment variables. The certificate is renewed by a
+// cron job, after which the Reload services are reloaded.
+type ACMEConfig struct {
+	Domains       []string          `yaml:"domains"`
+	Email         string            `yaml:"email"`
+	Server        string            `yaml:"server"`
+	Challenge     string            `yaml:"challenge"`
+	Webroot       string            `yaml:"webroot"`
+	Provider      string            `yaml:"provider"`
+	Credentials   map[string]string `yaml:"credentials"`
+	RenewDays     int               `yaml:"renew_days"`
+	RenewSchedule string            `yaml:"renew_schedule"`
+	Reload        []string          `yaml:"reload"`
 }
 
 // NetworkSettings contains all network settings lift should apply
 type NetworkSettings struct {
-	HostName      string               `yaml:"hostname"`
-	InterfaceOpts string               `yaml:"interfaces"`
-	ResolvConf    *ResolvConfiguration `yaml:"resolv_conf"`
-	Proxy         string               `yaml:"proxy"`
-	NTP           *NTPConfiguration    `yaml:"ntp"`
+	HostName       string                 `yaml:"hostname"`
+	FQDN           string                 `yaml:"fqdn"`
+	ManageEtcHosts bool                   `yaml:"manage_etc_hosts"`
+	Hosts          map[string]MultiString `yaml:"hosts"`
+	InterfaceOpts  NetworkInterfaces      `yaml:"interfaces"`
+	ResolvConf     *ResolvConfiguration   `yaml:"resolv_conf"`
+	Proxy          ProxyConfig            `yaml:"proxy"`
+	NTP            *NTPConfiguration      `yaml:"ntp"`
+}
+
+// ProxyConfig specifies the proxy for http and https requests. HTTPS
+// defaults to the HTTP proxy. Hosts and domains in NoProxy are accessed
+// directly. The proxy can also be specified as a single url.
+type ProxyConfig struct {
+	HTTP    string      `yaml:"http"`
+	HTTPS   string      `yaml:"https"`
+	NoProxy MultiString `yaml:"no_proxy"`
+}
+
+// returns the proxy for https requests
+func (p ProxyConfig) httpsProxy() string {
+	if p.HTTPS != "" {
+		return p.HTTPS
+	}
+	return p.HTTP
+}
+
+// returns the fully qualified hostname; the `fqdn` if set, else the hostname
+func (n *NetworkSettings) fqdn() string {
+	if n.FQDN != "" {
+		return n.FQDN
+	}
+	return n.HostName
+}
+
+// returns the short hostname, without domain
+func (n *NetworkSettings) shortHostname() string {
+	if n.HostName != "" {
+		return strings.Split(n.HostName, ".")[0]
+	}
+	return strings.Split(n.FQDN, ".")[0]
+}
+
+// NetworkInterfaces contains the `interfaces` entry, which is either the raw
+// contents of /etc/network/interfaces, or a list of interface specifications
+type NetworkInterfaces struct {
+	Raw   string
+	Specs []NetworkInterface
+}
+
+// NetworkInterface specifies the configuration of a single interface
+type NetworkInterface struct {
+	Name    string  `yaml:"name"`
+	DHCP    bool    `yaml:"dhcp"`
+	Address string  `yaml:"address"`
+	Netmask string  `yaml:"netmask"`
+	Gateway string  `yaml:"gateway"`
+	MTU     int     `yaml:"mtu"`
+	VLAN    int     `yaml:"vlan"`
+	IPv6    *IPv6   `yaml:"ipv6"`
+	Bridge  *Bridge `yaml:"bridge"`
+	Bond    *Bond   `yaml:"bond"`
+}
+
+// Bridge specifies the ports of a linux bridge interface
+type Bridge struct {
+	Ports MultiString `yaml:"ports"`
+	STP   bool        `yaml:"stp"`
+}
+
+// Bond specifies the slaves and options of a bonding interface
+type Bond struct {
+	Slaves  MultiString `yaml:"slaves"`
+	Mode    string      `yaml:"mode"`
+	MIIMon  int         `yaml:"miimon"`
+	Primary string      `yaml:"primary"`
+}
+
+// IPv6 specifies the IPv6 configuration of an interface. Mode is
+// either `static`, `slaac` or `dhcp` (DHCPv6).
+type IPv6 struct {
+	Mode    string `yaml:"mode"`
+	Address string `yaml:"address"`
+	Netmask int    `yaml:"netmask"`
+	Gateway string `yaml:"gateway"`
 }
 
 // ResolvConfiguration contains the DNS spec
@@ -75,50 +407,429 @@ type ResolvConfiguration struct {
 
 // NTPConfiguration is used for configuring chronyd
 type NTPConfiguration struct {
+	Daemon  string      `yaml:"daemon"`
 	Pools   MultiString `yaml:"pools"`
 	Servers MultiString `yaml:"servers"`
 }
 
 // MTAConfiguration contains all information for setting up a
-// mail transfer agent (mail forwarding)
+// mail transfer agent (mail forwarding). Backend is ssmtp (the default),
+// msmtp or busybox (sendmail). Aliases maps local names to the addresses
+// their mail is forwarded to; TestMail is the address a test mail is sent
+// to, once lift has finished.
 type MTAConfiguration struct {
-	Root             string `yaml:"root"`
-	Server           string `yaml:"server"`
-	UseTLS           bool   `yaml:"use_tls"`
-	UseSTARTTLS      bool   `yaml:"use_starttls"`
-	User             string `yaml:"user"`
-	Password         string `yaml:"password"`
-	AuthMethod       string `yaml:"authmethod"`
-	RewriteDomain    string `yaml:"rewrite_domain"`
-	FromLineOverride bool   `yaml:"fromline_override"`
+	Backend          string                 `yaml:"backend"`
+	Root             string                 `yaml:"root"`
+	Server           string                 `yaml:"server"`
+	UseTLS           bool                   `yaml:"use_tls"`
+	UseSTARTTLS      bool                   `yaml:"use_starttls"`
+	User             string                 `yaml:"user"`
+	Password         string                 `yaml:"password"`
+	AuthMethod       string                 `yaml:"authmethod"`
+	RewriteDomain    string                 `yaml:"rewrite_domain"`
+	FromLineOverride bool                   `yaml:"fromline_override"`
+	Aliases          map[string]MultiString `yaml:"aliases"`
+	TestMail         string                 `yaml:"test_mail"`
+}
+
+// DoasConfig specifies the doas rules for groups of users, and additional
+// rules in the doas.conf(5) format
+type DoasConfig struct {
+	Groups []DoasGroup `yaml:"groups"`
+	Rules  MultiString `yaml:"rules"`
+}
+
+// DoasGroup permits the members of a group to execute commands as another
+// user (root by default), optionally only Cmd. A group can also be
+// specified by its name only.
+type DoasGroup struct {
+	Name    string `yaml:"name"`
+	Persist bool   `yaml:"persist"`
+	NoPass  bool   `yaml:"nopass"`
+	KeepEnv bool   `yaml:"keepenv"`
+	As      string `yaml:"as"`
+	Cmd     string `yaml:"cmd"`
+}
+
+// SyslogConfig specifies the syslog daemon, busybox syslogd (the default) or
+// rsyslog, the remote hosts to forward the logs to, and the size (e.g. 10M)
+// and number of the rotated log files
+type SyslogConfig struct {
+	Daemon     string         `yaml:"daemon"`
+	Remote     []SyslogRemote `yaml:"remote"`
+	RotateSize string         `yaml:"rotate_size"`
+	Rotate     int            `yaml:"rotate"`
+}
+
+// SyslogRemote is a remote syslog host, receiving the logs over udp (the
+// default) or tcp on port 514 by default
+type SyslogRemote struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Protocol string `yaml:"protocol"`
+}
+
+// Address returns the host and port of the remote, with an IPv6 host in
+// brackets
+func (r SyslogRemote) Address() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
 }
 
 // PackagesConfig contains specification for the `packages:` block.
 type PackagesConfig struct {
-	Repositories MultiString `yaml:"repositories"`
-	Update       bool        `yaml:"update"`
-	Upgrade      bool        `yaml:"upgrade"`
-	Install      MultiString `yaml:"install"`
-	Uninstall    MultiString `yaml:"uninstall"`
+	Release            string                 `yaml:"release"`
+	Repositories       MultiString            `yaml:"repositories"`
+	TaggedRepositories map[string]MultiString `yaml:"tagged_repositories"`
+	Keys               []PackageKey           `yaml:"keys"`
+	Update             bool                   `yaml:"update"`
+	Upgrade            bool                   `yaml:"upgrade"`
+	Install            PackageList            `yaml:"install"`
+	World              bool                   `yaml:"world"`
+	Uninstall          MultiString            `yaml:"uninstall"`
+}
+
+// PackageKey specifies a public key for verifying packages of a (custom)
+// repository. The key is either downloaded from URL or given inline as
+// Content. Name is the file name in /etc/apk/keys, which must match the
+// name of the key used for signing; for URLs it defaults to the base name
+// of the url. A key can also be specified by its URL only.
+type PackageKey struct {
+	Name    string `yaml:"name"`
+	URL     string `yaml:"url"`
+	Content string `yaml:"content"`
+	SHA256  string `yaml:"sha256"`
+}
+
+// WireGuardConfig contains the WireGuard interfaces
+type WireGuardConfig struct {
+	Interfaces []WireGuardInterface `yaml:"interfaces"`
+}
+
+// WireGuardInterface specifies a WireGuard interface. The private key is
+// given inline, downloaded from PrivateKeyURL, or generated if neither
+// is set.
+type WireGuardInterface struct {
+	Name          string          `yaml:"name"`
+	Address       MultiString     `yaml:"address"`
+	ListenPort    int             `yaml:"listen_port"`
+	PrivateKey    string          `yaml:"private_key"`
+	PrivateKeyURL string          `yaml:"private_key_url"`
+	MTU           int             `yaml:"mtu"`
+	Peers         []WireGuardPeer `yaml:"peers"`
+}
+
+// WireGuardPeer specifies a peer of a WireGuard interface
+type WireGuardPeer struct {
+	PublicKey           string      `yaml:"public_key"`
+	PresharedKey        string      `yaml:"preshared_key"`
+	Endpoint            string      `yaml:"endpoint"`
+	AllowedIPs          MultiString `yaml:"allowed_ips"`
+	PersistentKeepalive int         `yaml:"persistent_keepalive"`
+}
+
+// FirewallConfig specifies the firewall, either as awall Policies (by name,
+// in the awall policy format) or as a raw nftables ruleset. The backend
+// defaults to awall when policies are given, and nftables otherwise.
+type FirewallConfig struct {
+	Backend  string                 `yaml:"backend"`
+	Policies map[string]interface{} `yaml:"policies"`
+	Rules    string                 `yaml:"rules"`
+}
+
+// DockerConfig specifies the docker installation and daemon configuration.
+// Options contains additional daemon.json settings, which take precedence.
+type DockerConfig struct {
+	RegistryMirrors    MultiString            `yaml:"registry_mirrors"`
+	InsecureRegistries MultiString            `yaml:"insecure_registries"`
+	LogDriver          string                 `yaml:"log_driver"`
+	LogOpts            map[string]string      `yaml:"log_opts"`
+	DataRoot           string                 `yaml:"data_root"`
+	Users              MultiString            `yaml:"users"`
+	Options            map[string]interface{} `yaml:"options"`
+}
+
+// K3SConfig specifies a k3s server or agent to install. Agents (and servers
+// joining an existing cluster) need the Server url and Token.
+type K3SConfig struct {
+	Role               string      `yaml:"role"`
+	Version            string      `yaml:"version"`
+	Token              string      `yaml:"token"`
+	Server             string      `yaml:"server"`
+	Args               MultiString `yaml:"args"`
+	InstallURL         string      `yaml:"install_url"`
+	InstallSHA256      string      `yaml:"install_sha256"`
+	AirgapImagesURL    string      `yaml:"airgap_images_url"`
+	AirgapImagesSHA256 string      `yaml:"airgap_images_sha256"`
+}
+
+// PhoneHomeConfig specifies the url to POST the provisioning report to when
+// lift finishes, with optional request headers (e.g. for authentication).
+type PhoneHomeConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Retries int               `yaml:"retries"`
+}
+
+// CACert specifies a trusted CA certificate in PEM format, either given
+// inline as Content or downloaded from URL (optionally verified with SHA256).
+// Name is the name of the certificate file, and defaults to the basename of
+// the URL.
+type CACert struct {
+	Name    string `yaml:"name"`
+	URL     string `yaml:"url"`
+	Content string `yaml:"content"`
+	SHA256  string `yaml:"sha256"`
+}
+
+// Certificate specifies a TLS certificate (Cert), its Key and intermediate
+// certificates (Chain) in PEM format; installed as /etc/ssl/certs/<name>.crt,
+// /etc/ssl/private/<name>.key and /etc/ssl/certs/<name>.chain.crt by default.
+// With a chain the certificate and chain are also installed together, as
+// <name>.fullchain.crt next to the certificate. The key is only readable by
+// its Owner (root by default), and its group if the owner has one. The
+// Reload services are reloaded when the files change.
+type Certificate struct {
+	Name      string   `yaml:"name"`
+	Cert      string   `yaml:"cert"`
+	Key       string   `yaml:"key"`
+	Chain     string   `yaml:"chain"`
+	CertPath  string   `yaml:"cert_path"`
+	KeyPath   string   `yaml:"key_path"`
+	ChainPath string   `yaml:"chain_path"`
+	Owner     string   `yaml:"owner"`
+	Reload    []string `yaml:"reload"`
+}
+
+// Package specifies a package to install, optionally pinned to a version
+// (e.g. `1.24.0-r1`, or with an operator like `~1.24` or `>=1.24`) and/or
+// a tagged repository. A package can also be specified in apk syntax,
+// e.g. `nginx=1.24.0-r1` or `nginx@edge`.
+type Package struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	Tag     string `yaml:"tag"`
+}
+
+// PackageList is a list of packages, needed for unmarshalling
+type PackageList []Package
+
+// Command is a shell command for `bootcmd` and `runcmd`. It's either a plain
+// string (or list of strings), or a structure with per-command options.
+type Command struct {
+	Cmd          MultiString       `yaml:"cmd"`
+	Shell        string            `yaml:"shell"`
+	User         string            `yaml:"user"`
+	Env          map[string]string `yaml:"env"`
+	Cwd          string            `yaml:"cwd"`
+	IgnoreErrors bool              `yaml:"ignore_errors"`
+	Timeout      string            `yaml:"timeout"`
+	Frequency    string            `yaml:"frequency"`
+}
+
+// DownloadSettings specifies how the content-urls of the files and the
+// dr-provision assets are downloaded: how many at the same time, how often a
+// failed download is retried (resuming where it stopped) and how long all
+// downloads may take together
+type DownloadSettings struct {
+	Parallel int    `yaml:"parallel"`
+	Retries  int    `yaml:"retries"`
+	Budget   string `yaml:"budget"`
 }
 
 // WriteFile allows for specifying files and their content
 // that should be created on first boot.
 type WriteFile struct {
-	Encoding    string `yaml:"encoding"`
-	Content     string `yaml:"content"`
-	ContentURL  string `yaml:"content-url"`
-	Path        string `yaml:"path"`
-	Owner       string `yaml:"owner"`
-	Permissions string `yaml:"permissions"`
+	Encoding    string            `yaml:"encoding"`
+	Content     string            `yaml:"content"`
+	ContentURL  string            `yaml:"content-url"`
+	Headers     map[string]string `yaml:"headers"`
+	Path        string            `yaml:"path"`
+	Owner       string            `yaml:"owner"`
+	Permissions string            `yaml:"permissions"`
+	SHA256      string            `yaml:"sha256"`
+	MD5         string            `yaml:"md5"`
+	Template    bool              `yaml:"template"`
+	Append      bool              `yaml:"append"`
+	Defer       bool              `yaml:"defer"`
 }
 
 // Disk specifies a disk that should be formatted and mounted
-// (without partitioning, LUKS encrypted).
+// (optionally LUKS encrypted), or partitioned. A disk that contains a
+// partition table or filesystem already is only set up when Wipe is set.
 type Disk struct {
-	Device         string `yaml:"device"`
-	FileSystemType string `yaml:"filesystem"`
-	MountPoint     string `yaml:"mountpoint"`
+	Device         string      `yaml:"device"`
+	Encrypt        *Encryption `yaml:"encrypt"`
+	PartitionTable string      `yaml:"partition_table"`
+	Partitions     []Partition `yaml:"partitions"`
+	Wipe           bool        `yaml:"wipe"`
+
+	Filesystem `yaml:",inline"`
+}
+
+// Partition specifies a partition on a disk. Size is either absolute
+// (e.g. 512M, 10G) or a percentage of the disk. Without size, the
+// partition takes all remaining space.
+type Partition struct {
+	Size    string      `yaml:"size"`
+	Encrypt *Encryption `yaml:"encrypt"`
+
+	Filesystem `yaml:",inline"`
+}
+
+// Filesystem specifies the filesystem that should be created on a disk,
+// partition or logical volume, and where and how it should be mounted.
+// Mounted filesystems are added to /etc/fstab. Btrfs filesystems can have
+// Subvolumes; a zfs filesystem is a Pool with Datasets, which zfs mounts
+// itself. Compress is the compression algorithm of btrfs and zfs.
+type Filesystem struct {
+	FileSystemType string      `yaml:"filesystem"`
+	MountPoint     string      `yaml:"mountpoint"`
+	Label          string      `yaml:"label"`
+	MountOptions   string      `yaml:"mount_options"`
+	Dump           int         `yaml:"dump"`
+	Pass           int         `yaml:"pass"`
+	Compress       string      `yaml:"compress"`
+	Subvolumes     []Subvolume `yaml:"subvolumes"`
+	Pool           string      `yaml:"pool"`
+	Datasets       []Dataset   `yaml:"datasets"`
+}
+
+// Subvolume specifies a btrfs subvolume, and where it's mounted
+type Subvolume struct {
+	Name         string `yaml:"name"`
+	MountPoint   string `yaml:"mountpoint"`
+	MountOptions string `yaml:"mount_options"`
+}
+
+// Dataset specifies a zfs dataset of a pool, with its zfs properties
+type Dataset struct {
+	Name       string            `yaml:"name"`
+	MountPoint string            `yaml:"mountpoint"`
+	Properties map[string]string `yaml:"properties"`
+}
+
+// Mount specifies an additional mount (e.g. nfs, tmpfs or bind mount)
+// that should be added to /etc/fstab and mounted
+type Mount struct {
+	Source       string `yaml:"source"`
+	Target       string `yaml:"target"`
+	Type         string `yaml:"type"`
+	MountOptions string `yaml:"mount_options"`
+	Dump         int    `yaml:"dump"`
+	Pass         int    `yaml:"pass"`
+}
+
+// NFSMount specifies an NFS export of a server to mount at Target; on boot,
+// or when it's accessed (with autofs) if Automount is set. Version is the
+// NFS version (e.g. 3, 4 or 4.2); by default it's negotiated with the
+// server.
+type NFSMount struct {
+	Server    string `yaml:"server"`
+	Export    string `yaml:"export"`
+	Target    string `yaml:"target"`
+	Version   string `yaml:"version"`
+	Options   string `yaml:"options"`
+	Automount bool   `yaml:"automount"`
+}
+
+// Encryption specifies the LUKS (dm-crypt) setup of a disk or partition.
+// Without passphrase, key file or key url a random key file is generated.
+type Encryption struct {
+	Name       string `yaml:"name"`
+	Passphrase string `yaml:"passphrase"`
+	KeyFile    string `yaml:"key_file"`
+	KeyURL     string `yaml:"key_url"`
+	KeySHA256  string `yaml:"key_sha256"`
+	Cipher     string `yaml:"cipher"`
+}
+
+// RAIDArray specifies an md RAID array of the given level (0, 1, 4, 5, 6 or
+// 10), created from (or assembled from) the Devices and Spares. The array is
+// /dev/md/<name>, which can be used as the device of a disk or an LVM
+// physical volume. Devices that contain a partition table or filesystem are
+// refused, unless Wipe is set.
+type RAIDArray struct {
+	Name    string      `yaml:"name"`
+	Level   string      `yaml:"level"`
+	Devices MultiString `yaml:"devices"`
+	Spares  MultiString `yaml:"spares"`
+	Wipe    bool        `yaml:"wipe"`
+}
+
+// ISCSIConfig specifies the iSCSI initiator: its name (generated when not
+// given), and the targets to log into, on boot as well. The disks on the
+// targets are given as `iscsi:<target iqn>[/<lun>]`.
+type ISCSIConfig struct {
+	InitiatorName string        `yaml:"initiator_name"`
+	Targets       []ISCSITarget `yaml:"targets"`
+}
+
+// ISCSITarget specifies an iSCSI target by its portal (`<host>[:<port>]`)
+// and IQN, optionally with CHAP authentication. Without IQN, all targets
+// the portal reports are logged into.
+type ISCSITarget struct {
+	Portal string     `yaml:"portal"`
+	IQN    string     `yaml:"iqn"`
+	CHAP   *ISCSICHAP `yaml:"chap"`
+}
+
+// ISCSICHAP specifies the CHAP credentials of the initiator, and of the
+// target for mutual authentication
+type ISCSICHAP struct {
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+	MutualUsername string `yaml:"mutual_username"`
+	MutualPassword string `yaml:"mutual_password"`
+}
+
+// LVMConfig contains the `lvm` block, specifying volume groups that
+// should be created
+type LVMConfig struct {
+	VolumeGroups []VolumeGroup `yaml:"volume_groups"`
+}
+
+// VolumeGroup specifies an LVM volume group, its physical volumes
+// and the logical volumes that should be created in it. Physical volumes
+// that contain a partition table or filesystem are refused, unless Wipe is
+// set.
+type VolumeGroup struct {
+	Name            string          `yaml:"name"`
+	PhysicalVolumes MultiString     `yaml:"physical_volumes"`
+	LogicalVolumes  []LogicalVolume `yaml:"logical_volumes"`
+	Wipe            bool            `yaml:"wipe"`
+}
+
+// LogicalVolume specifies an LVM logical volume. Size is either absolute
+// (e.g. 10G) or relative in lvcreate extents notation (e.g. 50%VG, 100%FREE).
+// Without size, the logical volume takes all free space in the volume group.
+type LogicalVolume struct {
+	Name string `yaml:"name"`
+	Size string `yaml:"size"`
+
+	Filesystem `yaml:",inline"`
+}
+
+// SwapConfig contains the `swap` block. Swap is set up on a device,
+// a swap file of the given size, and/or zram.
+type SwapConfig struct {
+	Device string      `yaml:"device"`
+	File   string      `yaml:"file"`
+	Size   string      `yaml:"size"`
+	ZRAM   *ZRAMConfig `yaml:"zram"`
+}
+
+// ZRAMConfig specifies a compressed swap device in RAM
+type ZRAMConfig struct {
+	Size      string `yaml:"size"`
+	Algorithm string `yaml:"algorithm"`
+}
+
+// SizeMiB returns the zram size in MiB (defaults to 256MiB)
+func (z ZRAMConfig) SizeMiB() uint64 {
+	if size, err := parseSize(z.Size, 0); err == nil && size > 0 {
+		return size
+	}
+	return 256
 }
 
 // MultiString is a type alias, needed for unmarshalling
@@ -143,12 +854,369 @@ func (ms *MultiString) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-var silent bool
+// UnmarshalYAML is a custom unmarshalling function for commands, which are either
+// a string or list of strings, or a command specification. Errors of commands in
+// the plain form are ignored (logged only), like before.
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ms MultiString
+	if err := unmarshal(&ms); err == nil {
+		*c = Command{Cmd: ms, IgnoreErrors: true}
+		return nil
+	}
+	type command Command
+	return unmarshal((*command)(c))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for services, which are
+// either a service specification or the name of a service to enable and start
+func (sv *Service) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		enabled := true
+		*sv = Service{Name: name, Enabled: &enabled, State: "started"}
+		return nil
+	}
+	type service Service
+	return unmarshal((*service)(sv))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for the MOTD, which is
+// either the MOTD settings or its content
+func (m *MOTDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var content string
+	if err := unmarshal(&content); err == nil {
+		*m = MOTDConfig{Content: content}
+		return nil
+	}
+	type motdConfig MOTDConfig
+	return unmarshal((*motdConfig)(m))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for the module settings,
+// which are either the settings or a list of kernel modules
+func (ms *ModuleSettings) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if _, isList := raw.([]interface{}); isList {
+		*ms = ModuleSettings{}
+		return unmarshal(&ms.Kernel)
+	}
+	type moduleSettings ModuleSettings
+	return unmarshal((*moduleSettings)(ms))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for the lift update,
+// which is either the update specification or the url or version of lift
+func (lu *LiftUpdate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*lu = LiftUpdate{Version: s}
+		if isURL(s) {
+			*lu = LiftUpdate{URL: s}
+		}
+		return nil
+	}
+	type liftUpdate LiftUpdate
+	return unmarshal((*liftUpdate)(lu))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for SSH key generation,
+// which is either the key settings or a boolean
+func (kg *SSHKeyGen) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*kg = SSHKeyGen{Enabled: enabled}
+		return nil
+	}
+	type sshKeyGen SSHKeyGen
+	settings := sshKeyGen{Enabled: true}
+	if err := unmarshal(&settings); err != nil {
+		return err
+	}
+	*kg = SSHKeyGen(settings)
+	return nil
+}
+
+// UnmarshalYAML is a custom unmarshalling function for the service of an
+// agent, which is either the service specification or a boolean
+func (as *AgentService) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*as = AgentService{Enabled: enabled}
+		return nil
+	}
+	type agentService AgentService
+	settings := agentService{Enabled: true}
+	if err := unmarshal(&settings); err != nil {
+		return err
+	}
+	*as = AgentService(settings)
+	return nil
+}
+
+// UnmarshalYAML is a custom unmarshalling function for cadvisor, which is
+// either a boolean or its settings (which enable it)
+func (cc *CAdvisorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*cc = CAdvisorConfig{Enabled: enabled}
+		return nil
+	}
+	type cadvisorConfig CAdvisorConfig
+	settings := cadvisorConfig{Enabled: true}
+	if err := unmarshal(&settings); err != nil {
+		return err
+	}
+	*cc = CAdvisorConfig(settings)
+	return nil
+}
+
+// UnmarshalYAML is a custom unmarshalling function for remote syslog hosts,
+// which are either a remote specification or `<host>[:<port>]`
+func (sr *SyslogRemote) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		*sr = SyslogRemote{Host: addr}
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			sr.Host = host
+			sr.Port, _ = strconv.Atoi(port)
+		}
+		return nil
+	}
+	type syslogRemote SyslogRemote
+	return unmarshal((*syslogRemote)(sr))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for kernel modules, which
+// are either a module specification or the name of the module
+func (km *KernelModule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*km = KernelModule{Name: name}
+		return nil
+	}
+	type module KernelModule
+	return unmarshal((*module)(km))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for the proxy, which is
+// either a proxy specification or the url of the proxy
+func (p *ProxyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*p = ProxyConfig{HTTP: url}
+		return nil
+	}
+	type proxy ProxyConfig
+	return unmarshal((*proxy)(p))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for packages, which are
+// either a package specification or a string in apk syntax
+func (p *Package) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*p = parsePackage(s)
+		return nil
+	}
+	type pkg Package
+	return unmarshal((*pkg)(p))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for package keys,
+// which are either a key specification or the url of the key
+func (pk *PackageKey) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*pk = PackageKey{URL: url}
+		return nil
+	}
+	type key PackageKey
+	return unmarshal((*key)(pk))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for CA certificates,
+// which are either a certificate specification, an inline PEM certificate
+// or the url of a certificate
+func (c *CACert) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		if strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN") {
+			*c = CACert{Content: s}
+		} else {
+			*c = CACert{URL: s}
+		}
+		return nil
+	}
+	type cert CACert
+	return unmarshal((*cert)(c))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for package lists,
+// which are either a single package or a list of packages
+func (pl *PackageList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if isSequence(unmarshal) {
+		return unmarshal((*[]Package)(pl))
+	}
+	var p Package
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	*pl = []Package{p}
+	return nil
+}
+
+// returns true if the value being unmarshalled is a yaml sequence, so errors
+// of the list elements can be reported instead of the error of the single form
+func isSequence(unmarshal func(interface{}) error) bool {
+	var seq []interface{}
+	return unmarshal(&seq) == nil
+}
+
+// parses a package in apk syntax (name[@tag][<op>version])
+func parsePackage(s string) Package {
+	p := Package{Name: s}
+	if i := strings.IndexAny(p.Name, "=<>~"); i > 0 {
+		p.Name, p.Version = p.Name[:i], p.Name[i:]
+	}
+	if i := strings.Index(p.Name, "@"); i > 0 {
+		p.Name, p.Tag = p.Name[:i], p.Name[i+1:]
+	}
+	return p
+}
+
+// String returns the package in apk syntax
+func (p Package) String() string {
+	s := p.Name
+	if p.Tag != "" {
+		s += "@" + p.Tag
+	}
+	if p.Version != "" {
+		if strings.ContainsAny(p.Version[:1], "=<>~") {
+			s += p.Version
+		} else {
+			s += "=" + p.Version
+		}
+	}
+	return s
+}
+
+// UnmarshalYAML is a custom unmarshalling function for groups, which are either
+// a group specification or only the name of the group
+func (g *Group) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*g = Group{Name: name}
+		return nil
+	}
+	type group Group
+	return unmarshal((*group)(g))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for doas groups, which
+// are either a group specification or the name of the group
+func (dg *DoasGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*dg = DoasGroup{Name: name}
+		return nil
+	}
+	type doasGroup DoasGroup
+	return unmarshal((*doasGroup)(dg))
+}
+
+// UnmarshalYAML is a custom unmarshalling function for the `groups` entry,
+// which is either a single group or a list of groups
+func (gl *GroupList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if isSequence(unmarshal) {
+		return unmarshal((*[]Group)(gl))
+	}
+	var g Group
+	if err := unmarshal(&g); err != nil {
+		return err
+	}
+	*gl = []Group{g}
+	return nil
+}
+
+// UnmarshalYAML is a custom unmarshalling function for the `interfaces` entry, which
+// is either a string (raw interfaces file) or a list of interface specifications
+func (ni *NetworkInterfaces) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		ni.Raw = s
+		return nil
+	}
+	return unmarshal(&ni.Specs)
+}
+
+// IsEmpty returns true if neither raw nor structured interfaces are specified
+func (ni NetworkInterfaces) IsEmpty() bool {
+	return ni.Raw == "" && len(ni.Specs) == 0
+}
+
+// Device returns the name of the (vlan sub-)interface
+func (ni NetworkInterface) Device() string {
+	if ni.VLAN > 0 {
+		return fmt.Sprintf("%s.%d", ni.Name, ni.VLAN)
+	}
+	return ni.Name
+}
+
+// HasIPv4 returns true if an IPv4 stanza should be generated for the interface.
+// Interfaces without IPv4 settings, but with IPv6 settings, are IPv6-only.
+func (ni NetworkInterface) HasIPv4() bool {
+	return ni.DHCP || ni.Address != "" || ni.IPv6 == nil
+}
+
+// the ifupdown inet6 methods of the IPv6 modes
+var ipv6Methods = map[string]string{
+	"static": "static",
+	"slaac":  "auto",
+	"auto":   "auto",
+	"dhcp":   "dhcp",
+	"dhcpv6": "dhcp",
+}
+
+// Method returns the ifupdown inet6 method for the IPv6 mode
+func (v6 IPv6) Method() string {
+	if m, ok := ipv6Methods[strings.ToLower(v6.Mode)]; ok {
+		return m
+	}
+	return "static"
+}
+
+// returns the packages needed for the vlan, bridge and bond interfaces
+func (ni NetworkInterfaces) requiredPackages() []string {
+	var pkgs []string
+	need := map[string]bool{}
+	for _, spec := range ni.Specs {
+		if spec.VLAN > 0 {
+			need["vlan"] = true
+		}
+		if spec.Bridge != nil {
+			need["bridge"] = true
+		}
+		if spec.Bond != nil {
+			need["bonding"] = true
+		}
+	}
+	for _, p := range []string{"vlan", "bridge", "bonding"} {
+		if need[p] {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs
+}
 
 // InitAlpineData initializes alpine-data with sane defaults
 func InitAlpineData() *AlpineData {
+	// separate values, the alpine-data is unmarshalled into them
+	permitRootLogin, permitEmptyPasswords, passwordAuthentication := true, false, false
 	return &AlpineData{
-		UnLift:   true,
+		UnLift:   UnLiftBinary,
 		TimeZone: "UTC",
 		Keymap:   "us us",
 		Network: &NetworkSettings{
@@ -157,31 +1225,72 @@ func InitAlpineData() *AlpineData {
 		SSHDConfig: &SSHD{
 			Port:                   22,
 			ListenAddress:          "0.0.0.0",
-			PermitRootLogin:        true,
-			PermitEmptyPasswords:   false,
-			PasswordAuthentication: false,
+			PermitRootLogin:        &permitRootLogin,
+			PermitEmptyPasswords:   &permitEmptyPasswords,
+			PasswordAuthentication: &passwordAuthentication,
 		},
 		DRP: &DRProvision{
 			InstallRunner: true,
 		},
-		Packages: &PackagesConfig{
-			Repositories: []string{
-				"http://dl-cdn.alpinelinux.org/alpine/v3.8/main",
-				"http://dl-cdn.alpinelinux.org/alpine/v3.8/community",
-			},
-		},
+		Packages: &PackagesConfig{},
+	}
+}
+
+// minimalAlpineData returns the alpine-data of strict (minimal) mode, which
+// has no defaults: nothing is changed that the alpine-data doesn't specify
+func minimalAlpineData() *AlpineData {
+	return &AlpineData{
+		Minimal:  true,
+		UnLift:   UnLiftNone,
+		Network:  &NetworkSettings{},
+		Packages: &PackagesConfig{},
 	}
 }
 
 // Returns a key-value map with SSH settings from alpine-data
 func (l *Lift) getSSHDKVMap() map[string]string {
-	return map[string]string{
-		"Port":                   strconv.Itoa(l.Data.SSHDConfig.Port),
-		"ListenAddress":          l.Data.SSHDConfig.ListenAddress,
-		"PermitRootLogin":        boolToYesNo(l.Data.SSHDConfig.PermitRootLogin),
-		"PermitEmptyPasswords":   boolToYesNo(l.Data.SSHDConfig.PermitEmptyPasswords),
-		"PasswordAuthentication": boolToYesNo(l.Data.SSHDConfig.PasswordAuthentication),
+	sshd := l.Data.SSHDConfig
+	kv := map[string]string{}
+	// without defaults (in strict mode), sshd keeps its port, address and
+	// authentication settings
+	for key, b := range map[string]*bool{
+		"PermitRootLogin":        sshd.PermitRootLogin,
+		"PermitEmptyPasswords":   sshd.PermitEmptyPasswords,
+		"PasswordAuthentication": sshd.PasswordAuthentication,
+	} {
+		if b != nil {
+			kv[key] = boolToYesNo(*b)
+		}
+	}
+	if sshd.Port > 0 {
+		kv["Port"] = strconv.Itoa(sshd.Port)
+	}
+	if sshd.ListenAddress != "" {
+		kv["ListenAddress"] = sshd.ListenAddress
+	}
+	if len(sshd.AllowUsers) > 0 {
+		kv["AllowUsers"] = strings.Join(sshd.AllowUsers, " ")
+	}
+	if len(sshd.AllowGroups) > 0 {
+		kv["AllowGroups"] = strings.Join(sshd.AllowGroups, " ")
+	}
+	if len(sshd.Ciphers) > 0 {
+		kv["Ciphers"] = strings.Join(sshd.Ciphers, ",")
+	}
+	if sshd.Subsystem != "" {
+		kv["Subsystem"] = sshd.Subsystem
+	}
+	if sshd.UseDNS != nil {
+		kv["UseDNS"] = boolToYesNo(*sshd.UseDNS)
+	}
+	if sshd.MaxAuthTries > 0 {
+		kv["MaxAuthTries"] = strconv.Itoa(sshd.MaxAuthTries)
+	}
+	// extra options take precedence over the fields above
+	for k, v := range sshd.ExtraOptions {
+		kv[k] = v
 	}
+	return kv
 }
 
 // Converts bool values to either "yes" or "no"
@@ -0,0 +1,53 @@
+package lift
+
+import (
+	"reflect"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestGetSSHDKVMap(t *testing.T) {
+	tests := []struct {
+		name string
+		data *AlpineData
+		doc  string
+		want map[string]string
+	}{
+		{
+			"defaults",
+			InitAlpineData(),
+			"{}",
+			map[string]string{"Port": "22", "ListenAddress": "0.0.0.0", "PermitRootLogin": "yes", "PermitEmptyPasswords": "no", "PasswordAuthentication": "no"},
+		},
+		{
+			"overridden defaults",
+			InitAlpineData(),
+			"sshd:\n  permit_root_login: false\n  password_authentication: true\n",
+			map[string]string{"Port": "22", "ListenAddress": "0.0.0.0", "PermitRootLogin": "no", "PermitEmptyPasswords": "no", "PasswordAuthentication": "yes"},
+		},
+		{
+			"strict port only",
+			minimalAlpineData(),
+			"sshd:\n  port: 2222\n",
+			map[string]string{"Port": "2222"},
+		},
+		{
+			"strict password authentication",
+			minimalAlpineData(),
+			"sshd:\n  password_authentication: false\n",
+			map[string]string{"PasswordAuthentication": "no"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := yaml.Unmarshal([]byte(tt.doc), tt.data); err != nil {
+				t.Fatalf("yaml.Unmarshal: %v", err)
+			}
+			l := &Lift{Data: tt.data}
+			if got := l.getSSHDKVMap(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
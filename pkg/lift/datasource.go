@@ -0,0 +1,535 @@
+package lift
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	localDataFile  = "/etc/lift/alpine-data.yml"
+	vendorDataFile = "/etc/lift/vendor-data.yml"
+	headersFile    = "/etc/lift/headers"
+	noCloudLabel   = "cidata"
+	imdsURL        = "http://169.254.169.254/latest"
+	imdsTokenTTL   = "21600"
+	imdsTimeout    = 2 * time.Second
+
+	defaultFetchRetries = 5
+	defaultFetchBackoff = time.Second
+	defaultFetchTimeout = 2 * time.Minute
+	maxFetchBackoff     = 30 * time.Second
+)
+
+var (
+	// files looked for (in order) on a NoCloud seed volume
+	noCloudDataFiles = []string{"alpine-data.yml", "alpine-data", "user-data"}
+	// vendor-data files looked for (in order) on a NoCloud seed volume
+	noCloudVendorDataFiles = []string{"vendor-data.yml", "vendor-data"}
+
+	// DefaultDatasources is the order in which datasources are probed,
+	// when no explicit datasource(s) are selected. The dhcp datasource has
+	// to be selected explicitly, as any DHCP server on the network could
+	// answer.
+	DefaultDatasources = []string{"url", "smbios", "nocloud", "openstack", "hetzner", "digitalocean", "scaleway", "gce", "ec2", "file"}
+
+	datasources = map[string]Datasource{
+		"url":          &urlDatasource{},
+		"smbios":       &smbiosDatasource{},
+		"nocloud":      &noCloudDatasource{},
+		"openstack":    &configDriveDatasource{},
+		"hetzner":      &hetznerDatasource{},
+		"digitalocean": &digitalOceanDatasource{},
+		"scaleway":     &scalewayDatasource{},
+		"gce":          &gceDatasource{},
+		"ec2":          &imdsDatasource{},
+		"dhcp":         &dhcpDatasource{},
+		"file":         &fileDatasource{},
+	}
+)
+
+// Datasource is a source from which alpine-data can be fetched
+type Datasource interface {
+	// Name returns the name by which the datasource can be selected
+	Name() string
+	// Fetch returns the raw alpine-data, and the instance metadata if
+	// the datasource provides it. An error is returned if the datasource
+	// is not available.
+	Fetch(l *Lift) ([]byte, *InstanceMetadata, error)
+}
+
+// VendorDataSource is implemented by datasources that also provide
+// vendor-data; the configuration of the platform operator, that the
+// alpine-data is merged onto
+type VendorDataSource interface {
+	// VendorData returns the raw vendor-data, or nil if there is none
+	VendorData(l *Lift) ([]byte, error)
+}
+
+// a raw vendor-data document, with its url or path (used to resolve its
+// includes)
+type vendorDocument struct {
+	data   []byte
+	source string
+}
+
+// fetches the raw vendor-data documents, in the order they are merged: the
+// vendor-data of the datasource alpine-data was fetched from, or else the
+// local vendor-data file; and on top of that the vendor-data downloaded from
+// the url passed in by flag or the `alpine-vendor-data` (or
+// `lift.vendor_data_url`) kernel boot parameter. Returns nil if there is no
+// vendor-data.
+func (l *Lift) fetchVendorData() ([]vendorDocument, error) {
+	var docs []vendorDocument
+	if ds, ok := datasources[l.Metadata.Datasource].(VendorDataSource); ok {
+		data, err := ds.VendorData(l)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching vendor-data: %s", err)
+		}
+		if data != nil {
+			logger.WithField("datasource", l.Metadata.Datasource).Info("Fetched vendor-data")
+			// platforms can't sign vendor-data, so it's refused with a
+			// signing key
+			if err = l.verifySignature("vendor-data", data, "", "", nil); err != nil {
+				return nil, err
+			}
+			docs = append(docs, vendorDocument{data: data})
+		}
+	}
+	if len(docs) == 0 {
+		if data, err := ioutil.ReadFile(vendorDataFile); err == nil {
+			logger.WithField("file", vendorDataFile).Info("Read vendor-data")
+			if err = l.verifySignature("vendor-data", data, vendorDataFile, "", nil); err != nil {
+				return nil, err
+			}
+			docs = append(docs, vendorDocument{data, vendorDataFile})
+		}
+	}
+
+	if l.VendorDataURL == "" {
+		l.VendorDataURL, _ = getKernelBootParam("alpine-vendor-data")
+	}
+	if l.VendorDataURL == "" {
+		l.VendorDataURL, _ = getKernelBootParam("lift.vendor_data_url")
+	}
+	if l.VendorDataURL != "" {
+		logger.WithField("url", l.VendorDataURL).Info("downloading vendor-data file")
+		data, err := l.fetchPolicy().download(l.VendorDataURL, l.contentHeaders(l.VendorDataURL))
+		if err != nil {
+			return nil, fmt.Errorf("Error downloading vendor-data: %s", err)
+		}
+		if err = l.verifySignature("vendor-data", data, l.VendorDataURL, "", nil); err != nil {
+			return nil, err
+		}
+		docs = append(docs, vendorDocument{data, l.VendorDataURL})
+	}
+	return docs, nil
+}
+
+// fetches alpine-data from the url passed in by flag, or the
+// `alpine-data` (or `lift.data_url`) kernel boot parameter
+type urlDatasource struct{}
+
+func (d *urlDatasource) Name() string { return "url" }
+
+func (d *urlDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	if l.DataURL == "" {
+		var err error
+		if l.DataURL, err = getKernelBootParam("alpine-data"); err != nil {
+			return nil, nil, err
+		}
+		if l.DataURL == "" {
+			l.DataURL, _ = getKernelBootParam("lift.data_url")
+		}
+		if l.DataURL == "" {
+			return nil, nil, errors.New("alpine-data URL not set")
+		}
+	}
+	logger.WithField("url", l.DataURL).Info("downloading alpine-data file")
+	data, err := l.fetchPolicy().download(l.DataURL, l.RequestHeaders)
+	return data, nil, err
+}
+
+// adds the request headers for the alpine-data download from the kernel boot
+// parameters (alpine-data-header="Key: Value", may be repeated) and the
+// headers file (one "Key: Value" per line)
+func (l *Lift) loadRequestHeaders() error {
+	headers, err := getKernelBootParams("alpine-data-header")
+	if err != nil {
+		logger.Debugf("Unable to read kernel boot parameters: %v", err)
+	}
+	if data, err := ioutil.ReadFile(headersFile); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				headers = append(headers, line)
+			}
+		}
+	}
+	if len(headers) > 0 && l.RequestHeaders == nil {
+		l.RequestHeaders = make(http.Header)
+	}
+	for _, h := range headers {
+		key, value, err := ParseHeader(h)
+		if err != nil {
+			return err
+		}
+		l.RequestHeaders.Add(key, value)
+	}
+	return nil
+}
+
+// ParseHeader parses a http header in the "Key: Value" form
+func ParseHeader(h string) (string, string, error) {
+	words := strings.SplitN(h, ":", 2)
+	if len(words) != 2 || strings.TrimSpace(words[0]) == "" || strings.TrimSpace(words[1]) == "" {
+		// don't include the header in the error, it probably contains a secret
+		return "", "", errors.New("invalid request header, expected \"Key: Value\"")
+	}
+	return strings.TrimSpace(words[0]), strings.TrimSpace(words[1]), nil
+}
+
+// returns the request headers to use for downloading content from url. The
+// alpine-data request headers are only sent to the host alpine-data was
+// downloaded from, so credentials don't leak to other servers.
+func (l *Lift) contentHeaders(contentURL string) http.Header {
+	if l.DataURL == "" || len(l.RequestHeaders) == 0 {
+		return nil
+	}
+	data, err := url.Parse(l.DataURL)
+	if err != nil {
+		return nil
+	}
+	content, err := url.Parse(contentURL)
+	if err != nil || content.Scheme != data.Scheme || content.Host != data.Host {
+		return nil
+	}
+	return l.RequestHeaders
+}
+
+// returns the fetch policy for the alpine-data download, completed with
+// the kernel boot parameters and the defaults
+func (l *Lift) fetchPolicy() FetchPolicy {
+	p := l.FetchPolicy
+	if p.Retries == 0 {
+		p.Retries = defaultFetchRetries
+		if s, _ := getKernelBootParam("alpine-data-retries"); s != "" {
+			if n, err := strconv.Atoi(s); err == nil {
+				p.Retries = n
+			}
+		}
+	}
+	if p.Retries < 0 {
+		p.Retries = 0
+	}
+	if p.Backoff == 0 {
+		p.Backoff = defaultFetchBackoff
+		if s, _ := getKernelBootParam("alpine-data-backoff"); s != "" {
+			if d, err := time.ParseDuration(s); err == nil {
+				p.Backoff = d
+			}
+		}
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultFetchTimeout
+		if s, _ := getKernelBootParam("alpine-data-timeout"); s != "" {
+			if d, err := time.ParseDuration(s); err == nil {
+				p.Timeout = d
+			}
+		}
+	}
+	return p
+}
+
+// downloads a file, retrying with exponential backoff when the request fails
+// or returns a non-2xx status, until the retries or the timeout are exhausted
+func (p FetchPolicy) download(url string, headers http.Header) ([]byte, error) {
+	deadline := time.Now().Add(p.Timeout)
+	backoff := p.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("timeout downloading %s: %v", url, err)
+		}
+		var data []byte
+		if data, err = requestWithRetry("GET", url, headers, nil, 0, remaining); err == nil {
+			return data, nil
+		}
+		if attempt >= p.Retries {
+			return nil, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		logger.WithField("url", url).Warnf("Download failed, retrying in %s (%d/%d): %v", backoff, attempt+1, p.Retries, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxFetchBackoff {
+			backoff = maxFetchBackoff
+		}
+	}
+}
+
+// fetches alpine-data from a NoCloud seed volume / config drive
+type noCloudDatasource struct {
+	vendorData []byte
+}
+
+func (d *noCloudDatasource) Name() string { return "nocloud" }
+
+func (d *noCloudDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	seed, err := fetchNoCloud()
+	if err != nil {
+		return nil, nil, err
+	}
+	md := &InstanceMetadata{}
+	var meta struct {
+		InstanceID    string `yaml:"instance-id"`
+		LocalHostname string `yaml:"local-hostname"`
+	}
+	if err = yaml.Unmarshal(seed.metaData, &meta); err != nil {
+		logger.Debugf("Error parsing meta-data: %v", err)
+	}
+	md.InstanceID, md.Hostname = meta.InstanceID, meta.LocalHostname
+
+	// the network configuration (e.g. generated by Proxmox VE) is merged
+	// beneath the vendor-data
+	d.vendorData = seed.vendorData
+	if seed.networkConfig != nil {
+		nc, err := parseNetworkConfig(seed.networkConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		pc := nc.platformConfig()
+		pc.Hostname = meta.LocalHostname
+		network, err := pc.alpineData()
+		if err != nil {
+			return nil, nil, err
+		}
+		if d.vendorData == nil {
+			d.vendorData = network
+		} else if merged, err := mergeDocuments(network, d.vendorData); err == nil {
+			d.vendorData = merged
+		} else {
+			logger.Warnf("Ignoring network-config, unable to merge it with the vendor-data: %v", err)
+		}
+	}
+	l.dataSignature = seed.signature
+	return seed.data, md, nil
+}
+
+// VendorData returns the vendor-data read from the seed volume
+func (d *noCloudDatasource) VendorData(l *Lift) ([]byte, error) {
+	return d.vendorData, nil
+}
+
+// fetches alpine-data from the EC2 instance metadata service
+type imdsDatasource struct{}
+
+func (d *imdsDatasource) Name() string { return "ec2" }
+
+func (d *imdsDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	return fetchIMDS()
+}
+
+// reads alpine-data from a file on the local filesystem
+type fileDatasource struct{}
+
+func (d *fileDatasource) Name() string { return "file" }
+
+func (d *fileDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	data, err := ioutil.ReadFile(localDataFile)
+	if err == nil {
+		l.dataSignature, _ = ioutil.ReadFile(localDataFile + signatureSuffix)
+	}
+	return data, nil, err
+}
+
+// probes the given datasources in order, and returns the raw alpine-data
+// of the first one that is available
+func probeDatasources(l *Lift, names []string) ([]byte, error) {
+	for _, name := range names {
+		ds, ok := datasources[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown datasource: %s", name)
+		}
+		logger.WithField("datasource", ds.Name()).Info("Probing datasource")
+		data, md, err := ds.Fetch(l)
+		if err != nil {
+			logger.WithField("datasource", ds.Name()).Debugf("Datasource not available: %v", err)
+			continue
+		}
+		logger.WithField("datasource", ds.Name()).Info("Fetched alpine-data")
+		if md != nil {
+			l.Metadata = md
+		}
+		l.Metadata.Datasource = ds.Name()
+		return data, nil
+	}
+	return nil, errors.New("no alpine-data found in any datasource")
+}
+
+// noCloudSeed contains the files read from a NoCloud seed volume
+type noCloudSeed struct {
+	data          []byte
+	signature     []byte
+	vendorData    []byte
+	metaData      []byte
+	networkConfig []byte
+}
+
+// fetches alpine-data from a NoCloud style seed volume (ISO or vfat)
+// labeled `cidata`, and the vendor-data, meta-data and network-config if
+// present
+func fetchNoCloud() (*noCloudSeed, error) {
+	seed := &noCloudSeed{}
+	err := withVolume(noCloudLabel, func(mnt string) error {
+		var err error
+		for _, f := range noCloudVendorDataFiles {
+			if seed.vendorData, err = ioutil.ReadFile(filepath.Join(mnt, f)); err == nil {
+				logger.WithField("file", f).Debug("Read vendor-data from seed volume")
+				break
+			}
+		}
+		if seed.metaData, err = ioutil.ReadFile(filepath.Join(mnt, "meta-data")); err == nil {
+			logger.Debug("Read meta-data from seed volume")
+		}
+		if seed.networkConfig, err = ioutil.ReadFile(filepath.Join(mnt, "network-config")); err == nil {
+			logger.Debug("Read network-config from seed volume")
+		}
+		for _, f := range noCloudDataFiles {
+			if seed.data, err = ioutil.ReadFile(filepath.Join(mnt, f)); err == nil {
+				logger.WithField("file", f).Debug("Read alpine-data from seed volume")
+				seed.signature, _ = ioutil.ReadFile(filepath.Join(mnt, f+signatureSuffix))
+				return nil
+			}
+		}
+		return errors.New("no alpine-data found on seed volume")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// mounts the volume with the given filesystem label read-only on a
+// temporary mountpoint, calls fn with the mountpoint, and unmounts the
+// volume again
+func withVolume(label string, fn func(mnt string) error) error {
+	dev, err := findDeviceByLabel(label)
+	if err != nil {
+		return err
+	}
+	logger.WithField("device", dev).Debugf("Found volume labeled %s", label)
+
+	mnt, err := ioutil.TempDir("", "lift-seed-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+
+	logger.Debugf("Mounting %s on %s (read-only)", dev, mnt)
+	if err = exec.Command("mount", "-o", "ro", dev, mnt).Run(); err != nil {
+		return err
+	}
+	defer func() {
+		_ = exec.Command("umount", mnt).Run()
+	}()
+	return fn(mnt)
+}
+
+// InstanceMetadata contains information about the instance, as reported
+// by the datasource alpine-data was fetched from (if it provides any)
+type InstanceMetadata struct {
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	Region           string `json:"region"`
+	AvailabilityZone string `json:"availabilityZone"`
+	LocalIPv4        string `json:"privateIp"`
+	Hostname         string `json:"-"`
+	Datasource       string `json:"-"`
+}
+
+// fetches user-data and the instance identity from the EC2 instance
+// metadata service, using an IMDSv2 session token.
+func fetchIMDS() ([]byte, *InstanceMetadata, error) {
+	client := httpClient(imdsTimeout)
+
+	req, err := http.NewRequest("PUT", imdsURL+"/api/token", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", imdsTokenTTL)
+	token, err := imdsDo(client, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", imdsURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return imdsDo(client, req)
+	}
+
+	md := &InstanceMetadata{}
+	if doc, err := get("/dynamic/instance-identity/document"); err == nil {
+		if err = json.Unmarshal(doc, md); err != nil {
+			logger.Debugf("Error parsing instance identity document: %v", err)
+		}
+	} else {
+		logger.Debugf("Error fetching instance identity document: %v", err)
+	}
+	if h, err := get("/meta-data/local-hostname"); err == nil {
+		md.Hostname = strings.TrimSpace(string(h))
+	}
+
+	data, err := get("/user-data")
+	if err != nil {
+		return nil, md, err
+	}
+	return data, md, nil
+}
+
+// executes a request against the IMDS, and returns the body
+// if the request was successful
+func imdsDo(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("IMDS %s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// tries to find a block device by its filesystem label. Both the lower-
+// and uppercase form of the label are tried, since vfat labels are usually
+// stored in uppercase.
+func findDeviceByLabel(label string) (string, error) {
+	for _, lbl := range []string{label, strings.ToUpper(label)} {
+		if out, err := exec.Command("findfs", "LABEL="+lbl).Output(); err == nil {
+			if dev := strings.TrimSpace(string(out)); dev != "" {
+				return dev, nil
+			}
+		}
+		if dev, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-label", lbl)); err == nil {
+			return dev, nil
+		}
+	}
+	return "", errors.New("no device found with label " + label)
+}
@@ -0,0 +1,295 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/mount"
+)
+
+const (
+	sysBlockDir = "/sys/block"
+	swapsFile   = "/proc/swaps"
+)
+
+var (
+	// the kernel devices that are not disks
+	nonDiskRegex = regexp.MustCompile(`^(loop|ram|zram|dm-|md|sr|fd|nbd)`)
+
+	// the decimal units of disk sizes, as disks are sold, in bytes
+	decimalUnits = map[string]float64{
+		"MB": 1e6,
+		"GB": 1e9,
+		"TB": 1e12,
+	}
+)
+
+const (
+	// the difference (in percent) between the size of a disk and the size
+	// of `size=`, with which the disk still matches
+	sizeTolerance = 2
+)
+
+// a property a disk must have, to be selected: serial:<serial>,
+// wwn:<wwn>, model~<regular expression>, or size>, size< or size= a size
+// (within sizeTolerance)
+type diskCriterion struct {
+	key   string
+	op    string
+	value string
+	model *regexp.Regexp
+	size  uint64
+}
+
+// a disk, with the properties it can be selected by
+type blockDisk struct {
+	device string
+	serial string
+	wwn    string
+	model  string
+	// in MiB
+	size uint64
+}
+
+// returns true if the device of a disk is given by a selector, rather than
+// its path
+func isDeviceSelector(device string) bool {
+	return device != "" && !strings.HasPrefix(device, "/dev/") && !isISCSIDevice(device)
+}
+
+// parses a selector: criteria separated by commas, which all have to match
+func parseDeviceSelector(selector string) ([]diskCriterion, error) {
+	var criteria []diskCriterion
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.IndexAny(part, ":~<>=")
+		if i <= 0 || i == len(part)-1 {
+			return nil, fmt.Errorf("invalid device %q, must be a path in /dev or a selector", part)
+		}
+		c := diskCriterion{key: part[:i], op: part[i : i+1], value: part[i+1:]}
+		var err error
+		switch c.key + c.op {
+		case "serial:", "wwn:":
+		case "model~":
+			if c.model, err = regexp.Compile("(?i)" + c.value); err != nil {
+				return nil, fmt.Errorf("invalid model in device selector %q: %s", part, err)
+			}
+		case "size>", "size<", "size=":
+			if c.size, err = parseDiskSize(c.value); err != nil {
+				return nil, fmt.Errorf("invalid size in device selector %q", part)
+			}
+		default:
+			return nil, fmt.Errorf("invalid device selector %q, must be serial:, wwn:, model~, size>, size< or size=", part)
+		}
+		criteria = append(criteria, c)
+	}
+	return criteria, nil
+}
+
+// parses the size of a disk in MiB: a partition size (e.g. 500G, in GiB) or
+// a size in decimal units (e.g. 500GB), as disks are sold
+func parseDiskSize(size string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if len(s) > 2 {
+		if mult, ok := decimalUnits[s[len(s)-2:]]; ok && decimalRegex.MatchString(s[:len(s)-2]) {
+			n, err := strconv.ParseFloat(s[:len(s)-2], 64)
+			if err == nil && n*mult >= 1<<20 {
+				return uint64(n * mult / (1 << 20)), nil
+			}
+		}
+	}
+	if strings.HasSuffix(s, "%") {
+		return 0, fmt.Errorf("invalid disk size: %s", size)
+	}
+	return parseSize(size, 0)
+}
+
+// returns true if the disk has the property
+func (c diskCriterion) matches(d blockDisk) bool {
+	switch c.key {
+	case "serial":
+		return d.serial != "" && d.serial == c.value
+	case "wwn":
+		return d.wwn != "" && normalizeWWN(d.wwn) == normalizeWWN(c.value)
+	case "model":
+		return c.model.MatchString(d.model)
+	case "size":
+		switch c.op {
+		case ">":
+			return d.size > c.size
+		case "<":
+			return d.size < c.size
+		default:
+			// sizes of disks are never exactly the size they're sold as
+			diff := d.size - c.size
+			if d.size < c.size {
+				diff = c.size - d.size
+			}
+			return diff*100 <= c.size*sizeTolerance
+		}
+	}
+	return false
+}
+
+// returns the device of the one disk that matches the selector, and that
+// isn't mounted or selected already. Selecting more than one disk is an
+// error, so the wrong disk is never formatted.
+func resolveDeviceSelector(selector string, selected map[string]bool) (string, error) {
+	criteria, err := parseDeviceSelector(selector)
+	if err != nil {
+		return "", err
+	}
+	disks, err := listDisks()
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, d := range disks {
+		if selected[d.device] {
+			continue
+		}
+		match := true
+		for _, c := range criteria {
+			match = match && c.matches(d)
+		}
+		if match {
+			matches = append(matches, d.device)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no disk found for %q", selector)
+	case 1:
+		logger.WithField("selector", selector).Infof("Selected disk %s", matches[0])
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%q matches %d disks (%s), refusing to choose", selector, len(matches), strings.Join(matches, ", "))
+	}
+}
+
+// resolves the selectors in a list of devices, e.g. the devices of a RAID
+// array, to the disks they select
+func resolveDevices(devices []string, selected map[string]bool) ([]string, error) {
+	resolved := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		if isDeviceSelector(dev) {
+			var err error
+			if dev, err = resolveDeviceSelector(dev, selected); err != nil {
+				return nil, err
+			}
+			selected[dev] = true
+		}
+		resolved = append(resolved, dev)
+	}
+	return resolved, nil
+}
+
+// returns the disks of the system that aren't (partly) in use, with their
+// properties from sysfs. A disk is in use when it or one of its partitions
+// is mounted, used as swap, or held by another device (e.g. it's an LVM
+// physical volume, an md RAID member or a LUKS container).
+func listDisks() ([]blockDisk, error) {
+	entries, err := ioutil.ReadDir(sysBlockDir)
+	if err != nil {
+		return nil, err
+	}
+	mounted := make(map[string]bool)
+	if mnts, err := mount.GetMounts(); err == nil {
+		for _, mnt := range mnts {
+			mounted[fmt.Sprintf("%d:%d", mnt.Major, mnt.Minor)] = true
+		}
+	}
+	swaps := activeSwaps()
+	var disks []blockDisk
+	for _, e := range entries {
+		name := e.Name()
+		if nonDiskRegex.MatchString(name) {
+			continue
+		}
+		dir := filepath.Join(sysBlockDir, name)
+		// the disk and its partitions
+		devDirs, _ := filepath.Glob(filepath.Join(dir, name+"*"))
+		devDirs = append(devDirs, dir)
+		reason := ""
+		for _, devDir := range devDirs {
+			holders, _ := ioutil.ReadDir(filepath.Join(devDir, "holders"))
+			switch {
+			case mounted[sysfsValue(filepath.Join(devDir, "dev"))]:
+				reason = "it's mounted"
+			case swaps[filepath.Base(devDir)]:
+				reason = "it's used as swap"
+			case len(holders) > 0:
+				reason = "it's used by " + holders[0].Name()
+			}
+			if reason != "" {
+				break
+			}
+		}
+		if reason != "" {
+			logger.Debugf("Not selecting disk %s, %s", name, reason)
+			continue
+		}
+		sectors, _ := strconv.ParseUint(sysfsValue(filepath.Join(dir, "size")), 10, 64)
+		disks = append(disks, blockDisk{
+			device: "/dev/" + name,
+			serial: firstSysfsValue(filepath.Join(dir, "serial"), filepath.Join(dir, "device", "serial")),
+			wwn:    firstSysfsValue(filepath.Join(dir, "wwid"), filepath.Join(dir, "device", "wwid")),
+			model:  sysfsValue(filepath.Join(dir, "device", "model")),
+			size:   sectors * 512 / (1024 * 1024),
+		})
+		// SCSI disks report their serial in the unit serial number page
+		if d := &disks[len(disks)-1]; d.serial == "" {
+			if page, err := ioutil.ReadFile(filepath.Join(dir, "device", "vpd_pg80")); err == nil && len(page) > 4 {
+				d.serial = strings.TrimSpace(string(page[4:]))
+			}
+		}
+	}
+	return disks, nil
+}
+
+// returns the names of the devices (e.g. sda2) that are used as swap
+func activeSwaps() map[string]bool {
+	swaps := make(map[string]bool)
+	data, err := ioutil.ReadFile(swapsFile)
+	if err != nil {
+		return swaps
+	}
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[0], "/dev/") {
+			swaps[filepath.Base(fields[0])] = true
+		}
+	}
+	return swaps
+}
+
+// returns the trimmed content of a sysfs file, or "" if it can't be read
+func sysfsValue(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// returns the first value of the sysfs files that's not empty
+func firstSysfsValue(paths ...string) string {
+	for _, path := range paths {
+		if v := sysfsValue(path); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// returns a WWN without its type prefix (e.g. naa. or 0x), in lower case
+func normalizeWWN(wwn string) string {
+	wwn = strings.ToLower(strings.TrimSpace(wwn))
+	for _, prefix := range []string{"naa.", "eui.", "t10.", "0x"} {
+		wwn = strings.TrimPrefix(wwn, prefix)
+	}
+	return wwn
+}
@@ -0,0 +1,102 @@
+package lift
+
+import "testing"
+
+func TestParseDeviceSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     []diskCriterion
+		wantErr  bool
+	}{
+		{"serial:S3Z1NB0K", []diskCriterion{{key: "serial", op: ":", value: "S3Z1NB0K"}}, false},
+		{"wwn:0x5002538e40a1b2c3, size>100G", []diskCriterion{
+			{key: "wwn", op: ":", value: "0x5002538e40a1b2c3"},
+			{key: "size", op: ">", value: "100G", size: 102400},
+		}, false},
+		{"size=1.5T", []diskCriterion{{key: "size", op: "=", value: "1.5T", size: 1572864}}, false},
+		{"size=500GB", []diskCriterion{{key: "size", op: "=", value: "500GB", size: 476837}}, false},
+		{"size<2tb", []diskCriterion{{key: "size", op: "<", value: "2tb", size: 1907348}}, false},
+		{"size>512GiB", []diskCriterion{{key: "size", op: ">", value: "512GiB", size: 524288}}, false},
+		{"model~samsung", []diskCriterion{{key: "model", op: "~", value: "samsung"}}, false},
+		{"sda", nil, true},
+		{"serial:", nil, true},
+		{":S3Z1NB0K", nil, true},
+		{"vendor:ATA", nil, true},
+		{"serial~S3Z1", nil, true},
+		{"model~(", nil, true},
+		{"size>50%", nil, true},
+		{"size<large", nil, true},
+		{"size=0.5MB", nil, true},
+		{"size=NaNGB", nil, true},
+		{"serial:S3Z1NB0K,", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, err := parseDeviceSelector(tt.selector)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i, c := range got {
+				w := tt.want[i]
+				if c.key != w.key || c.op != w.op || c.value != w.value || c.size != w.size {
+					t.Errorf("criterion %d: got %+v, want %+v", i, c, w)
+				}
+				if (c.model != nil) != (c.key == "model") {
+					t.Errorf("criterion %d: got model %v", i, c.model)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskCriterionMatches(t *testing.T) {
+	disk := blockDisk{
+		device: "/dev/sda",
+		serial: "S3Z1NB0K",
+		wwn:    "naa.5002538E40A1B2C3",
+		model:  "Samsung SSD 860",
+		size:   476940, // 500 GB
+	}
+	tests := []struct {
+		selector string
+		disk     blockDisk
+		want     bool
+	}{
+		{"serial:S3Z1NB0K", disk, true},
+		{"serial:S3Z1NB0", disk, false},
+		{"serial:S3Z1NB0K", blockDisk{device: "/dev/sdb"}, false},
+		{"wwn:0x5002538e40a1b2c3", disk, true},
+		{"wwn:5002538e40a1b2c4", disk, false},
+		{"model~^samsung", disk, true},
+		{"model~860 evo", disk, false},
+		{"size>400G", disk, true},
+		{"size>500G", disk, false},
+		{"size<500G", disk, true},
+		{"size=500GB", disk, true},
+		{"size=500G", disk, false},
+		{"size<500GB", disk, false},
+		{"size>500GB", disk, true},
+		{"size=465G", disk, true},
+		{"size=480G", disk, false},
+		{"size=0.5TB", disk, true},
+		{"model~ssd,size>1T", disk, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			criteria, err := parseDeviceSelector(tt.selector)
+			if err != nil {
+				t.Fatalf("parseDeviceSelector: %v", err)
+			}
+			got := true
+			for _, c := range criteria {
+				got = got && c.matches(tt.disk)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package lift
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDHCPOption is the DHCP option carrying the alpine-data url, one
+	// of the site-specific options (224-254)
+	DefaultDHCPOption = 224
+
+	dhcpHookFile    = "/etc/udhcpc/post-bound/lift"
+	dhcpRenewFile   = "/etc/udhcpc/post-renew/lift"
+	dhcpOptionsDir  = "/run/lift/dhcp"
+	dhcpQueryScript = "/run/lift/udhcpc.script"
+)
+
+// fetches alpine-data from the url in a DHCP option (224 by default, or the
+// lift.dhcp_option kernel boot parameter). The option is read as recorded by
+// the udhcpc hook (see InstallDHCPHook) when the network came up, or else
+// requested by running udhcpc once on the interfaces that are up, without
+// reconfiguring them.
+type dhcpDatasource struct{}
+
+func (d *dhcpDatasource) Name() string { return "dhcp" }
+
+func (d *dhcpDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	option := l.dhcpOption()
+	dataURL, iface := recordedDHCPOption()
+	if dataURL == "" {
+		var err error
+		if dataURL, iface, err = queryDHCPOption(option); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !isURL(dataURL) {
+		return nil, nil, fmt.Errorf("DHCP option %d is not a url: %s", option, dataURL)
+	}
+	logger.WithFields(log.Fields{"url": dataURL, "interface": iface}).Info("downloading alpine-data file from DHCP provided url")
+	data, err := l.fetchPolicy().download(dataURL, l.RequestHeaders)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.DataURL = dataURL
+	return data, &InstanceMetadata{}, nil
+}
+
+// returns the DHCP option carrying the alpine-data url
+func (l *Lift) dhcpOption() int {
+	if l.DHCPOption != 0 {
+		return l.DHCPOption
+	}
+	if s, _ := getKernelBootParam("lift.dhcp_option"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+		logger.Warnf("Ignoring invalid lift.dhcp_option %s", s)
+	}
+	return DefaultDHCPOption
+}
+
+// returns the option value recorded by the udhcpc hook, and its interface
+func recordedDHCPOption() (string, string) {
+	files, _ := filepath.Glob(filepath.Join(dhcpOptionsDir, "*"))
+	sort.Strings(files)
+	for _, f := range files {
+		if data, err := ioutil.ReadFile(f); err == nil {
+			if value := decodeDHCPOption(strings.TrimSpace(string(data))); value != "" {
+				return value, filepath.Base(f)
+			}
+		}
+	}
+	return "", ""
+}
+
+// requests the option with udhcpc on each interface that is up, until a
+// DHCP server provides it, and returns its value and interface. udhcpc runs
+// with the hook as its script, which only records the option.
+func queryDHCPOption(option int) (string, string, error) {
+	if _, err := exec.LookPath("udhcpc"); err != nil {
+		return "", "", errors.New("udhcpc not found")
+	}
+	if err := writeDHCPHook(dhcpQueryScript, option); err != nil {
+		return "", "", err
+	}
+	defer os.Remove(dhcpQueryScript)
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		logger.WithField("interface", iface.Name).Debugf("Requesting DHCP option %d", option)
+		cmd := exec.Command("udhcpc", "-i", iface.Name, "-f", "-q", "-n", "-t", "3", "-T", "2",
+			"-O", strconv.Itoa(option), "-s", dhcpQueryScript)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logger.WithField("interface", iface.Name).Debugf("udhcpc failed: %v: %s", err, strings.TrimSpace(string(out)))
+			continue
+		}
+		if value, recorded := recordedDHCPOption(); value != "" {
+			return value, recorded, nil
+		}
+	}
+	return "", "", fmt.Errorf("no DHCP server provided option %d", option)
+}
+
+// decodes an option value as passed to udhcpc scripts; options it doesn't
+// know are hex encoded
+func decodeDHCPOption(value string) string {
+	if decoded, err := hex.DecodeString(value); err == nil && len(decoded) > 0 {
+		s := strings.TrimRight(string(decoded), "\x00")
+		printable := true
+		for _, r := range s {
+			if !unicode.IsPrint(r) {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return s
+		}
+	}
+	return value
+}
+
+// writes the udhcpc hook script, recording the given option, to path
+func writeDHCPHook(path string, option int) error {
+	sfile, err := generateFileFromTemplate(*dhcpHook, struct {
+		Option int
+		Dir    string
+	}{
+		Option: option,
+		Dir:    dhcpOptionsDir,
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = exec.Command("mv", sfile, path).Run(); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0755)
+}
+
+// InstallDHCPHook installs the udhcpc hook that records the DHCP option with
+// the alpine-data url (see the dhcp datasource) whenever a lease is bound or
+// renewed, in the root filesystem at root (e.g. an image being built). For
+// udhcpc to request the option, the DHCP interfaces need
+// `udhcpc_opts -O <option>` in /etc/network/interfaces.
+func InstallDHCPHook(root string, option int) error {
+	if option == 0 {
+		option = DefaultDHCPOption
+	}
+	for _, f := range []string{dhcpHookFile, dhcpRenewFile} {
+		path := filepath.Join(root, f)
+		logger.WithField("file", path).Info("Installing udhcpc hook")
+		if err := writeDHCPHook(path, option); err != nil {
+			return fmt.Errorf("Error installing udhcpc hook %s: %s", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,785 @@
+package lift
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/docker/docker/pkg/mount"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	crypttabFile    = "/etc/crypttab"
+	dmcryptConfFile = "/etc/conf.d/dmcrypt"
+	luksKeyDir      = "/etc/luks"
+	fstabFile       = "/etc/fstab"
+	zramConfFile    = "/etc/conf.d/zram-init"
+)
+
+var (
+	fsPackage = map[string]string{
+		"xfs":   "xfsprogs",
+		"btrfs": "btrfs-progs",
+		"ext2":  "e2fsprogs",
+		"ext3":  "e2fsprogs",
+		"ext4":  "e2fsprogs",
+		"jfs":   "jfsutils",
+		"ntfs":  "ntfs-3g-progs",
+		"vfat":  "dosfstools",
+	}
+
+	// multipliers (to MiB) for partition size suffixes
+	sizeUnits = map[string]uint64{
+		"M": 1,
+		"G": 1024,
+		"T": 1024 * 1024,
+	}
+	// the number of a partition size
+	decimalRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+// Encrypt, Format and mount other disks if configured
+func (l *Lift) diskSetup() error {
+	if l.Data.Disks == nil {
+		logger.Debug("No additional disks")
+		return nil
+	}
+	// a selector never selects a disk that's configured by its path, or by
+	// an earlier selector
+	selected := make(map[string]bool)
+	for _, disk := range l.Data.Disks {
+		selected[disk.Device] = true
+	}
+	for i, disk := range l.Data.Disks {
+		// the iscsi module sets these up, once it's logged into the targets
+		if isISCSIDevice(disk.Device) {
+			logger.WithField("device", disk.Device).Debug("Disk is set up after iSCSI login")
+			continue
+		}
+		if isDeviceSelector(disk.Device) {
+			dev, err := resolveDeviceSelector(disk.Device, selected)
+			if err != nil {
+				return fmt.Errorf("Error selecting disk %d: %s", i, err)
+			}
+			selected[dev] = true
+			disk.Device = dev
+		}
+		if err := setupDisk(i, disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitions, encrypts, formats and mounts the ith disk
+func setupDisk(i int, disk Disk) error {
+	if disk.Device == "" {
+		return fmt.Errorf("Error setting up disk %d: no device given", i)
+	}
+	var err error
+	if err = checkWipe(disk); err != nil {
+		return err
+	}
+	if len(disk.Partitions) > 0 {
+		if err = partitionDisk(disk); err != nil {
+			return err
+		}
+		for n, part := range disk.Partitions {
+			dev := partitionDevice(disk.Device, n+1)
+			// a new partition may start where an old filesystem did
+			if disk.Wipe {
+				if err = wipeDevice(dev); err != nil {
+					return err
+				}
+			}
+			if part.Encrypt != nil {
+				if dev, err = encryptDevice(dev, part.Encrypt, fmt.Sprintf("crypt%dp%d", i, n+1)); err != nil {
+					return err
+				}
+			}
+			if part.FileSystemType == "" {
+				continue
+			}
+			if err = formatAndMount(dev, part.Filesystem); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dev := disk.Device
+	if disk.Encrypt != nil {
+		if dev, err = encryptDevice(dev, disk.Encrypt, fmt.Sprintf("crypt%d", i)); err != nil {
+			return err
+		}
+	}
+	return formatAndMount(dev, disk.Filesystem)
+}
+
+// refuses to set up a disk that contains data, i.e. a partition table or a
+// filesystem, unless wipe is set, in which case they are erased
+func checkWipe(disk Disk) error {
+	// an existing pool is used rather than created
+	if strings.ToLower(disk.FileSystemType) == "zfs" && exec.Command("zpool", "list", disk.Pool).Run() == nil {
+		return nil
+	}
+	return checkDeviceWipe(disk.Device, disk.Wipe, "format")
+}
+
+// refuses to use a device that contains data for what (e.g. "format"), unless
+// wipe is set, in which case the data is erased
+func checkDeviceWipe(device string, wipe bool, what string) error {
+	found, err := deviceSignatures(device)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	if !wipe {
+		return fmt.Errorf("refusing to %s %s, it contains %s (set wipe: true to erase it)", what, device, strings.Join(found, ", "))
+	}
+	logger.WithField("device", device).Warnf("Wiping %s", strings.Join(found, ", "))
+	return wipeDevice(device)
+}
+
+// returns the partition table and filesystem signatures blkid finds on the
+// device, e.g. "gpt partition table" or "xfs"
+func deviceSignatures(device string) ([]string, error) {
+	// busybox' blkid can't probe devices
+	if err := apkCommand("add", "--no-cache", "blkid", "wipefs").Run(); err != nil {
+		return nil, fmt.Errorf("Error installing blkid and wipefs: %s", err)
+	}
+	out, err := exec.Command("blkid", "-p", "-o", "export", device).Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		switch ee.ExitCode() {
+		case 2:
+			// nothing found
+			return nil, nil
+		case 8:
+			return []string{"ambivalent signatures"}, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error probing %s: %s", device, err)
+	}
+	var found []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "PTTYPE=") {
+			found = append(found, strings.TrimPrefix(line, "PTTYPE=")+" partition table")
+		} else if strings.HasPrefix(line, "TYPE=") {
+			found = append(found, strings.TrimPrefix(line, "TYPE="))
+		}
+	}
+	return found, nil
+}
+
+// erases the partition table and filesystem signatures of the device
+func wipeDevice(device string) error {
+	logger.Debugf("Wiping signatures of %s", device)
+	if out, err := exec.Command("wipefs", "-a", device).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error wiping %s: %s: %s", device, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sets up LUKS encryption on the device, opens it, and registers it in
+// /etc/crypttab and the dmcrypt service so it's opened again at boot.
+// Returns the path to the opened (mapped) device.
+func encryptDevice(device string, enc *Encryption, defaultName string) (string, error) {
+	name := enc.Name
+	if name == "" {
+		name = defaultName
+	}
+
+	logger.Debug("Installing cryptsetup package")
+	if err := apkCommand("add", "--no-cache", "cryptsetup").Run(); err != nil {
+		return "", err
+	}
+
+	// Determine the key: a passphrase is passed on stdin, all other
+	// key types end up in a key file that is also used at boot.
+	keyFile := enc.KeyFile
+	if enc.Passphrase == "" {
+		if keyFile == "" {
+			keyFile = filepath.Join(luksKeyDir, name+".key")
+		}
+		if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+			var key []byte
+			if enc.KeyURL != "" {
+				logger.WithField("url", enc.KeyURL).Debug("Downloading LUKS key")
+				if key, err = downloadFile(enc.KeyURL, nil); err != nil {
+					return "", err
+				}
+				if err = verifyChecksum(key, enc.KeySHA256, ""); err != nil {
+					return "", fmt.Errorf("Error verifying %s: %s", enc.KeyURL, err)
+				}
+			} else {
+				logger.Debug("Generating random LUKS key")
+				key = make([]byte, 64)
+				if _, err = crand.Read(key); err != nil {
+					return "", err
+				}
+			}
+			if err = os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+				return "", err
+			}
+			if err = ioutil.WriteFile(keyFile, key, 0400); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	keyArgs := []string{"--key-file", keyFile}
+	if enc.Passphrase != "" {
+		keyArgs = []string{"--key-file", "-"}
+	}
+
+	args := []string{"luksFormat", "--batch-mode"}
+	if enc.Cipher != "" {
+		args = append(args, "--cipher", enc.Cipher)
+	}
+	logger.Debugf("Encrypting %s (LUKS)", device)
+	if err := runCryptsetup(enc.Passphrase, append(append(args, keyArgs...), device)...); err != nil {
+		return "", err
+	}
+
+	if logger.GetLevel() == log.DebugLevel {
+		dumpCmd := exec.Command("cryptsetup", "luksDump", device)
+		dumpCmd.Stdout = os.Stdout
+		_ = dumpCmd.Run()
+	}
+
+	logger.Debugf("Opening %s as %s", device, name)
+	if err := runCryptsetup(enc.Passphrase, append(append([]string{"luksOpen"}, keyArgs...), device, name)...); err != nil {
+		return "", err
+	}
+
+	out, err := exec.Command("cryptsetup", "luksUUID", device).Output()
+	if err != nil {
+		return "", err
+	}
+	uuid := strings.TrimSpace(string(out))
+
+	key := keyFile
+	if enc.Passphrase != "" {
+		key = "none"
+	}
+	logger.Debugf("Adding %s to %s", name, crypttabFile)
+	if err = setTableEntry(crypttabFile, 0, fmt.Sprintf("%s\tUUID=%s\t%s\tluks\n", name, uuid, key)); err != nil {
+		return "", err
+	}
+	dmcrypt := fmt.Sprintf("\ntarget=%s\nsource=UUID=\"%s\"\n", name, uuid)
+	if enc.Passphrase == "" {
+		dmcrypt += fmt.Sprintf("key=%s\n", keyFile)
+	}
+	if err = removeDmcryptTarget(name); err != nil {
+		return "", err
+	}
+	if err = appendToFile(dmcryptConfFile, dmcrypt); err != nil {
+		return "", err
+	}
+	_ = exec.Command("rc-update", "add", "dmcrypt", "boot").Run()
+
+	return fmt.Sprintf("/dev/mapper/%s", name), nil
+}
+
+// removes the settings of a target from the dmcrypt configuration, e.g. of
+// an earlier run, so the target is configured once
+func removeDmcryptTarget(name string) error {
+	data, err := ioutil.ReadFile(dmcryptConfFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var kept []string
+	skip, removed := false, false
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		// the settings of a target end at the next target, or a blank line
+		if strings.HasPrefix(trimmed, "target=") {
+			skip = trimmed == "target="+name
+		} else if trimmed == "" {
+			skip = false
+		}
+		if skip {
+			removed = true
+		} else {
+			kept = append(kept, line)
+		}
+	}
+	if !removed {
+		return nil
+	}
+	// the settings are appended after a blank line
+	updated := strings.TrimRight(strings.Join(kept, "\n"), "\n") + "\n"
+	return writeFileAtomic(dmcryptConfFile, []byte(updated), 0644, "")
+}
+
+// runs cryptsetup, passing the passphrase (if any) on stdin
+func runCryptsetup(passphrase string, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	if passphrase != "" {
+		cmd.Stdin = strings.NewReader(passphrase)
+	}
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// creates a filesystem on the device, and mounts it (if a mountpoint is given)
+func formatAndMount(device string, fs Filesystem) error {
+	fsType := strings.ToLower(fs.FileSystemType)
+	if fsType == "zfs" {
+		return createZFSPool(device, fs)
+	}
+
+	// Check filesystem support and kernel modules. Ignore exit codes..
+	logger.Debugf("Checking filesystem prerequisites")
+	_ = apkCommand("add", "--no-cache", fsPackage[fsType]).Run()
+	_ = exec.Command("modprobe", fsType).Run()
+
+	var args []string
+	if fs.Label != "" {
+		if fsType == "vfat" {
+			args = append(args, "-n", fs.Label)
+		} else {
+			args = append(args, "-L", fs.Label)
+		}
+	}
+	args = append(args, device)
+
+	logger.Debugf("Creating %s filesystem on %s", fsType, device)
+	cmd := exec.Command(fmt.Sprintf("mkfs.%s", fsType), args...)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if fsType == "btrfs" {
+		return mountBtrfs(device, fs)
+	}
+
+	if fs.MountPoint == "" {
+		return nil
+	}
+	return mountFilesystem(Mount{
+		Source:       fstabSource(device),
+		Target:       fs.MountPoint,
+		Type:         fsType,
+		MountOptions: fs.MountOptions,
+		Dump:         fs.Dump,
+		Pass:         fs.Pass,
+	})
+}
+
+// returns the source of a device in fstab. The filesystem UUID is preferred,
+// since device names aren't stable.
+func fstabSource(device string) string {
+	if out, err := exec.Command("blkid", "-s", "UUID", "-o", "value", device).Output(); err == nil {
+		if uuid := strings.TrimSpace(string(out)); uuid != "" && !strings.HasPrefix(device, "/dev/mapper/") {
+			return "UUID=" + uuid
+		}
+	}
+	return device
+}
+
+// adds the additional mounts to fstab, and mounts them
+func (l *Lift) mountsSetup() error {
+	for _, m := range l.Data.Mounts {
+		if m.Type == "nfs" || m.Type == "nfs4" {
+			logger.Debug("Installing nfs-utils package")
+			_ = apkCommand("add", "--no-cache", "nfs-utils").Run()
+		}
+		if err := mountFilesystem(m); err != nil {
+			return err
+		}
+	}
+	if len(l.Data.Mounts) > 0 {
+		_ = exec.Command("rc-update", "add", "netmount", "default").Run()
+	}
+	return nil
+}
+
+// creates the mountpoint, adds the mount to fstab and mounts it
+func mountFilesystem(m Mount) error {
+	fsType := m.Type
+	opts := m.MountOptions
+	if fsType == "bind" {
+		fsType = "none"
+		opts = strings.Trim("bind,"+opts, ",")
+	}
+	if opts == "" {
+		opts = "defaults"
+	}
+
+	logger.Debugf("Creating mountpoint %s", m.Target)
+	if err := os.MkdirAll(m.Target, 0755); err != nil {
+		return err
+	}
+
+	logger.Debugf("Adding %s to %s", m.Target, fstabFile)
+	entry := fmt.Sprintf("%s\t%s\t%s\t%s\t%d %d\n", m.Source, m.Target, fsType, opts, m.Dump, m.Pass)
+	if err := setTableEntry(fstabFile, 1, entry); err != nil {
+		return err
+	}
+
+	if inAltRoot() {
+		return nil
+	}
+	logger.Debugf("Mounting %s on %s as %s", m.Source, m.Target, fsType)
+	if err := exec.Command("mount", m.Target).Run(); err != nil {
+		return fmt.Errorf("Error mounting %s: %s", m.Target, err)
+	}
+	return nil
+}
+
+// creates a partition table and the partitions on the disk with parted
+func partitionDisk(disk Disk) error {
+	logger.Debug("Installing parted package")
+	_ = apkCommand("add", "--no-cache", "parted").Run()
+
+	out, err := exec.Command("blockdev", "--getsize64", disk.Device).Output()
+	if err != nil {
+		return fmt.Errorf("Error reading size of %s: %s", disk.Device, err)
+	}
+	bytes, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return err
+	}
+	diskSize := bytes / (1024 * 1024)
+	if diskSize < 3 {
+		return fmt.Errorf("%s is too small to partition", disk.Device)
+	}
+
+	table, err := partitionTable(disk.PartitionTable)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-s", "-a", "optimal", disk.Device, "mklabel", table}
+	// the partitions start after the first MiB, and leave the last MiB free
+	// for the GPT backup header; percentages are of the space in between
+	var start uint64 = 1
+	last := diskSize - 1
+	for n, part := range disk.Partitions {
+		end := last
+		if part.Size != "" {
+			size, err := parseSize(part.Size, last-1)
+			if err != nil {
+				return err
+			}
+			if start+size > last {
+				return fmt.Errorf("partition %d (%s) doesn't fit on %s", n+1, part.Size, disk.Device)
+			}
+			end = start + size
+		}
+		if start >= end {
+			return fmt.Errorf("no space left on %s for partition %d", disk.Device, n+1)
+		}
+		name := "primary"
+		if table == "gpt" && part.Label != "" {
+			name = part.Label
+		}
+		args = append(args, "mkpart", name, fmt.Sprintf("%dMiB", start), fmt.Sprintf("%dMiB", end))
+		start = end
+	}
+
+	logger.WithField("device", disk.Device).Debugf("parted %s", strings.Join(args, " "))
+	if err := exec.Command("parted", args...).Run(); err != nil {
+		return fmt.Errorf("Error partitioning %s: %s", disk.Device, err)
+	}
+	// Give the kernel/udev some time to create the partition device nodes
+	_ = exec.Command("partprobe", disk.Device).Run()
+	_ = exec.Command("mdev", "-s").Run()
+	return nil
+}
+
+// returns the parted label of a partition table (gpt by default): gpt, or
+// msdos for mbr (also given as msdos or dos)
+func partitionTable(table string) (string, error) {
+	switch strings.ToLower(table) {
+	case "", "gpt":
+		return "gpt", nil
+	case "mbr", "msdos", "dos":
+		return "msdos", nil
+	}
+	return "", fmt.Errorf("unsupported partition table: %s", table)
+}
+
+// parses a partition size (e.g. 512M, 1.5G or 25% of diskSize) and returns
+// it in MiB. Absolute sizes of less than a MiB are invalid.
+func parseSize(size string, diskSize uint64) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if strings.HasSuffix(s, "%") {
+		s = strings.TrimSuffix(s, "%")
+		pct, err := strconv.ParseFloat(s, 64)
+		if !decimalRegex.MatchString(s) || err != nil || pct <= 0 || pct > 100 {
+			return 0, fmt.Errorf("invalid partition size: %s", size)
+		}
+		return uint64(float64(diskSize) * pct / 100), nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid partition size: %s", size)
+	}
+	mult, ok := sizeUnits[s[len(s)-1:]]
+	if !ok {
+		return 0, fmt.Errorf("invalid partition size: %s", size)
+	}
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if !decimalRegex.MatchString(s[:len(s)-1]) || err != nil || uint64(n*float64(mult)) == 0 {
+		return 0, fmt.Errorf("invalid partition size: %s", size)
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+// returns the device name of the nth partition on a disk. Disks ending
+// with a digit (e.g. nvme0n1, mmcblk0) use a `p` separator.
+func partitionDevice(device string, n int) string {
+	if device != "" && unicode.IsDigit(rune(device[len(device)-1])) {
+		return fmt.Sprintf("%sp%d", device, n)
+	}
+	return fmt.Sprintf("%s%d", device, n)
+}
+
+// creates the LVM physical volumes, volume groups and logical volumes, and
+// formats and mounts the logical volumes. Existing volumes are left untouched.
+func (l *Lift) lvmSetup() error {
+	if l.Data.LVM == nil || len(l.Data.LVM.VolumeGroups) == 0 {
+		logger.Debug("No LVM volume groups")
+		return nil
+	}
+
+	logger.Debug("Installing lvm2 package")
+	if err := apkCommand("add", "--no-cache", "lvm2").Run(); err != nil {
+		return err
+	}
+	_ = exec.Command("rc-update", "add", "lvm", "boot").Run()
+
+	selected := make(map[string]bool)
+	for _, vg := range l.Data.LVM.VolumeGroups {
+		for _, pv := range vg.PhysicalVolumes {
+			selected[pv] = true
+		}
+	}
+	for _, vg := range l.Data.LVM.VolumeGroups {
+		if exec.Command("vgs", vg.Name).Run() == nil {
+			logger.Debugf("Volume group %s already exists", vg.Name)
+		} else if err := createVolumeGroup(vg, selected); err != nil {
+			return err
+		}
+
+		for _, lv := range vg.LogicalVolumes {
+			path := fmt.Sprintf("%s/%s", vg.Name, lv.Name)
+			if exec.Command("lvs", path).Run() == nil {
+				logger.Debugf("Logical volume %s already exists", path)
+				continue
+			}
+			args := []string{"-y", "-n", lv.Name}
+			switch {
+			case lv.Size == "":
+				args = append(args, "-l", "100%FREE")
+			case strings.Contains(lv.Size, "%"):
+				args = append(args, "-l", lv.Size)
+			default:
+				args = append(args, "-L", lv.Size)
+			}
+			logger.Debugf("Creating logical volume %s", path)
+			if err := exec.Command("lvcreate", append(args, vg.Name)...).Run(); err != nil {
+				return fmt.Errorf("Error creating logical volume %s: %s", path, err)
+			}
+			if lv.FileSystemType == "" {
+				continue
+			}
+			if err := formatAndMount(fmt.Sprintf("/dev/%s", path), lv.Filesystem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// creates the physical volumes of a volume group that don't exist yet, and
+// the volume group on them
+func createVolumeGroup(vg VolumeGroup, selected map[string]bool) error {
+	pvs, err := resolveDevices(vg.PhysicalVolumes, selected)
+	if err != nil {
+		return fmt.Errorf("Error selecting physical volumes of %s: %s", vg.Name, err)
+	}
+	for _, pv := range pvs {
+		if exec.Command("pvs", pv).Run() == nil {
+			logger.Debugf("Physical volume %s already exists", pv)
+			continue
+		}
+		if err = checkDeviceWipe(pv, vg.Wipe, "create a physical volume on"); err != nil {
+			return err
+		}
+		args := []string{pv}
+		if vg.Wipe {
+			args = append([]string{"-y"}, args...)
+		}
+		logger.Debugf("Creating physical volume %s", pv)
+		if err = exec.Command("pvcreate", args...).Run(); err != nil {
+			return fmt.Errorf("Error creating physical volume %s: %s", pv, err)
+		}
+	}
+
+	logger.Debugf("Creating volume group %s", vg.Name)
+	if err = exec.Command("vgcreate", append([]string{vg.Name}, pvs...)...).Run(); err != nil {
+		return fmt.Errorf("Error creating volume group %s: %s", vg.Name, err)
+	}
+	return nil
+}
+
+// sets up swap on a device, a swap file and/or zram
+func (l *Lift) swapSetup() error {
+	swap := l.Data.Swap
+	if swap == nil {
+		logger.Debug("No swap configured")
+		return nil
+	}
+
+	if swap.File != "" {
+		if swap.Size == "" {
+			return fmt.Errorf("no size specified for swap file %s", swap.File)
+		}
+		size, err := parseSize(swap.Size, 0)
+		if err != nil {
+			return err
+		}
+		logger.Debugf("Creating %dMiB swap file %s", size, swap.File)
+		if err = os.MkdirAll(filepath.Dir(swap.File), 0755); err != nil {
+			return err
+		}
+		cmd := exec.Command("dd", "if=/dev/zero", "of="+swap.File, "bs=1M", fmt.Sprintf("count=%d", size))
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("Error creating swap file %s: %s", swap.File, err)
+		}
+		if err = os.Chmod(swap.File, 0600); err != nil {
+			return err
+		}
+		if err = enableSwap(swap.File); err != nil {
+			return err
+		}
+	}
+
+	if swap.Device != "" {
+		if err := enableSwap(swap.Device); err != nil {
+			return err
+		}
+	}
+
+	if swap.File != "" || swap.Device != "" {
+		_ = exec.Command("rc-update", "add", "swap", "boot").Run()
+	}
+
+	if swap.ZRAM != nil {
+		logger.Debug("Installing zram-init package")
+		if err := apkCommand("add", "--no-cache", "zram-init").Run(); err != nil {
+			return err
+		}
+		logger.Debug("Generating zram-init configuration")
+		zram, err := generateFileFromTemplate(*zramConf, swap.ZRAM)
+		if err != nil {
+			return err
+		}
+		logger.Debugf("Copying zram-init configuration to %s", zramConfFile)
+		if err = exec.Command("mv", zram, zramConfFile).Run(); err != nil {
+			return err
+		}
+		_ = exec.Command("rc-update", "add", "zram-init", "boot").Run()
+		if err = doService("zram-init", RESTART); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formats a device or file as swap, enables it and adds it to fstab
+func enableSwap(path string) error {
+	logger.Debugf("Creating swap on %s", path)
+	if err := exec.Command("mkswap", path).Run(); err != nil {
+		return fmt.Errorf("Error creating swap on %s: %s", path, err)
+	}
+	if !inAltRoot() {
+		if err := exec.Command("swapon", path).Run(); err != nil {
+			return fmt.Errorf("Error enabling swap on %s: %s", path, err)
+		}
+	}
+	return setTableEntry(fstabFile, 0, fmt.Sprintf("%s\tnone\tswap\tsw\t0 0\n", path))
+}
+
+// grows the root partition and filesystem to fill the whole disk
+func (l *Lift) resizeRootFS() error {
+	if !l.Data.ResizeRootFS {
+		return nil
+	}
+
+	mnts, err := mount.GetMounts()
+	if err != nil {
+		return err
+	}
+	var root *mount.Info
+	for _, mnt := range mnts {
+		if mnt.Mountpoint == "/" {
+			root = mnt
+		}
+	}
+	if root == nil {
+		return errors.New("unable to find root filesystem")
+	}
+
+	// Resolve partition and parent disk through sysfs, since the mount
+	// source may be a generic name like /dev/root
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", root.Major, root.Minor))
+	if err != nil {
+		return err
+	}
+	partNum, err := ioutil.ReadFile(filepath.Join(sysPath, "partition"))
+	if err != nil {
+		return fmt.Errorf("root filesystem is not on a partition: %s", err)
+	}
+	disk := "/dev/" + filepath.Base(filepath.Dir(sysPath))
+	part := "/dev/" + filepath.Base(sysPath)
+	fsType := strings.ToLower(root.Fstype)
+
+	logger.Debug("Installing growpart")
+	pkgs := []string{"cloud-utils-growpart"}
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		pkgs = append(pkgs, "e2fsprogs-extra")
+	case "xfs":
+		pkgs = append(pkgs, "xfsprogs-extra")
+	default:
+		return fmt.Errorf("resizing %s root filesystem is not supported", fsType)
+	}
+	if err = apkCommand(append([]string{"add", "--no-cache"}, pkgs...)...).Run(); err != nil {
+		return err
+	}
+
+	n := strings.TrimSpace(string(partNum))
+	logger.Debugf("Growing partition %s of %s", n, disk)
+	out, err := exec.Command("growpart", disk, n).CombinedOutput()
+	if err != nil {
+		// growpart exits with 1 when the partition can't be grown any further
+		if strings.Contains(string(out), "NOCHANGE") {
+			logger.Debug("Root partition already fills the disk")
+			return nil
+		}
+		return fmt.Errorf("Error growing %s: %s", part, strings.TrimSpace(string(out)))
+	}
+
+	logger.Debugf("Resizing %s filesystem on %s", fsType, part)
+	if fsType == "xfs" {
+		return exec.Command("xfs_growfs", "/").Run()
+	}
+	return exec.Command("resize2fs", part).Run()
+}
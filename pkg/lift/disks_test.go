@@ -0,0 +1,47 @@
+package lift
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		diskSize uint64
+		want     uint64
+		wantErr  bool
+	}{
+		{"512M", 0, 512, false},
+		{"512MB", 0, 512, false},
+		{"2G", 0, 2048, false},
+		{"2GiB", 0, 2048, false},
+		{"1.5g", 0, 1536, false},
+		{" 1T ", 0, 1048576, false},
+		{"25%", 10000, 2500, false},
+		{"12.5%", 10000, 1250, false},
+		{"100%", 10000, 10000, false},
+		{"0M", 0, 0, true},
+		{"0.5M", 0, 0, true},
+		{"0%", 10000, 0, true},
+		{"101%", 10000, 0, true},
+		{"-1G", 0, 0, true},
+		{"NaNG", 0, 0, true},
+		{"InfG", 0, 0, true},
+		{"1e3M", 0, 0, true},
+		{"1.G", 0, 0, true},
+		{"512", 0, 0, true},
+		{"512K", 0, 0, true},
+		{"G", 0, 0, true},
+		{"%", 10000, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := parseSize(tt.size, tt.diskSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
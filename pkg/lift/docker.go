@@ -0,0 +1,76 @@
+package lift
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	dockerDaemonFile = "/etc/docker/daemon.json"
+)
+
+// installs docker, writes daemon.json, adds the users to the docker group
+// and enables and starts the docker service
+func (l *Lift) dockerSetup() error {
+	if l.Data.Docker == nil {
+		return nil
+	}
+	logger.Debug("Installing docker")
+	if err := apkCommand("add", "docker").Run(); err != nil {
+		return fmt.Errorf("Error installing docker: %s", err)
+	}
+
+	if daemon := l.Data.Docker.daemonConfig(); len(daemon) > 0 {
+		data, err := json.MarshalIndent(daemon, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Error marshalling %s: %s", dockerDaemonFile, err)
+		}
+		logger.WithField("file", dockerDaemonFile).Debug("Writing docker daemon configuration")
+		if err = os.MkdirAll(filepath.Dir(dockerDaemonFile), 0755); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(dockerDaemonFile, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range l.Data.Docker.Users {
+		logger.WithField("user", u).Debug("Adding user to docker group")
+		if err := exec.Command("addgroup", u, "docker").Run(); err != nil {
+			logger.Warnf("Error adding %s to docker group: %v", u, err)
+		}
+	}
+
+	if err := exec.Command("rc-update", "add", "docker", defaultRunlevel).Run(); err != nil {
+		return fmt.Errorf("Error enabling docker: %s", err)
+	}
+	return doService("docker", START)
+}
+
+// returns the contents of daemon.json
+func (d *DockerConfig) daemonConfig() map[string]interface{} {
+	daemon := make(map[string]interface{})
+	if len(d.RegistryMirrors) > 0 {
+		daemon["registry-mirrors"] = d.RegistryMirrors
+	}
+	if len(d.InsecureRegistries) > 0 {
+		daemon["insecure-registries"] = d.InsecureRegistries
+	}
+	if d.LogDriver != "" {
+		daemon["log-driver"] = d.LogDriver
+	}
+	if len(d.LogOpts) > 0 {
+		daemon["log-opts"] = d.LogOpts
+	}
+	if d.DataRoot != "" {
+		daemon["data-root"] = d.DataRoot
+	}
+	for k, v := range d.Options {
+		daemon[k] = jsonCompatible(v)
+	}
+	return daemon
+}
@@ -1,10 +1,39 @@
 package lift
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+var (
+	// the transport of all of lift's http clients, with lift's TLS and proxy
+	// configuration. http.DefaultTransport is left alone, it's shared with
+	// the program lift is part of.
+	transport = newTransport()
+)
+
+// returns a transport like http.DefaultTransport, using lift's TLS
+// configuration
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	return t
+}
+
+// returns an http client with lift's transport
+func httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
 // DownloadFile returns a file from http(s)
 func downloadFile(url string, headers http.Header) ([]byte, error) {
 	req, err := http.NewRequest("GET", url, nil)
@@ -12,7 +41,7 @@ func downloadFile(url string, headers http.Header) ([]byte, error) {
 		return nil, err
 	}
 	req.Header = headers
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient(0).Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -23,3 +52,104 @@ func downloadFile(url string, headers http.Header) ([]byte, error) {
 	}
 	return data, nil
 }
+
+// downloads a file from http(s), retrying the given number of times when the
+// request fails or returns a non-2xx status. Each attempt has its own timeout.
+func downloadFileWithRetry(url string, headers http.Header, retries int, timeout time.Duration) ([]byte, error) {
+	return requestWithRetry("GET", url, headers, nil, retries, timeout)
+}
+
+// executes a http(s) request, retrying the given number of times when the
+// request fails or returns a non-2xx status, and returns the response body
+func requestWithRetry(method, url string, headers http.Header, body []byte, retries int, timeout time.Duration) ([]byte, error) {
+	client := httpClient(timeout)
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			logger.WithField("url", url).Debugf("Retrying request (%d/%d): %v", attempt, retries, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var req *http.Request
+		if req, err = http.NewRequest(method, url, bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+		if headers != nil {
+			req.Header = headers
+		}
+		var resp *http.Response
+		if resp, err = client.Do(req); err != nil {
+			continue
+		}
+		data, rerr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("%s %s: %s", method, url, resp.Status)
+			continue
+		}
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		return data, nil
+	}
+	return nil, err
+}
+
+// verifies downloaded data against the given (hex encoded) sha256
+// and/or md5 checksum. Empty checksums are not verified.
+func verifyChecksum(data []byte, sha256sum, md5sum string) error {
+	if sha256sum != "" {
+		sum := sha256.Sum256(data)
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, strings.TrimSpace(sha256sum)) {
+			return fmt.Errorf("sha256 checksum mismatch: expected %s, got %s", sha256sum, actual)
+		}
+	}
+	if md5sum != "" {
+		sum := md5.Sum(data)
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, strings.TrimSpace(md5sum)) {
+			return fmt.Errorf("md5 checksum mismatch: expected %s, got %s", md5sum, actual)
+		}
+	}
+	return nil
+}
+
+// returns a proxy function for http.Transport, which uses the configured
+// proxies for all hosts not matching the no_proxy list. Entries in no_proxy
+// are hostnames, domains (matching all subdomains), IPs, CIDRs or `*`.
+func (p ProxyConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := p.HTTP
+		if req.URL.Scheme == "https" {
+			proxy = p.httpsProxy()
+		}
+		if proxy == "" || noProxy(req.URL.Hostname(), p.NoProxy) {
+			return nil, nil
+		}
+		return url.Parse(proxy)
+	}
+}
+
+// returns true if host matches one of the no_proxy entries
+func noProxy(host string, entries []string) bool {
+	ip := net.ParseIP(host)
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == "":
+			continue
+		case e == "*":
+			return true
+		case ip != nil && strings.Contains(e, "/"):
+			if _, cidr, err := net.ParseCIDR(e); err == nil && cidr.Contains(ip) {
+				return true
+			}
+		default:
+			e = strings.TrimPrefix(e, "*")
+			h := strings.ToLower(host)
+			if h == strings.TrimPrefix(e, ".") || strings.HasSuffix(h, "."+strings.TrimPrefix(e, ".")) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the number of downloads at the same time, by default
+	defaultDownloadParallel = 4
+	// the number of times a failed download is retried, by default
+	defaultDownloadRetries = 3
+	// the timeout of a single download attempt; a download that takes
+	// longer resumes in the next attempt
+	downloadAttemptTimeout = 10 * time.Minute
+)
+
+// a download, as requested to be prefetched
+type downloadRequest struct {
+	url     string
+	headers http.Header
+}
+
+// a finished download, waiting to be picked up
+type downloadResult struct {
+	data []byte
+	err  error
+}
+
+// downloader downloads the content of files and assets for the modules. It
+// limits the number of downloads at the same time (of all modules together),
+// retries failed downloads where they stopped, and fails downloads once the
+// overall budget is spent.
+type downloader struct {
+	slots    chan struct{}
+	retries  int
+	deadline time.Time
+
+	mu       sync.Mutex
+	finished map[string]downloadResult
+}
+
+// returns the downloader of the run, set up on first use according to the
+// downloads settings of the alpine-data; the budget starts then
+func (l *Lift) downloads() *downloader {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.downloader != nil {
+		return l.downloader
+	}
+	d := &downloader{finished: make(map[string]downloadResult)}
+	parallel, retries := defaultDownloadParallel, defaultDownloadRetries
+	if s := l.Data.Downloads; s != nil {
+		if s.Parallel > 0 {
+			parallel = s.Parallel
+		}
+		if s.Retries != 0 {
+			retries = s.Retries
+		}
+		if budget, err := time.ParseDuration(s.Budget); err == nil && budget > 0 {
+			d.deadline = time.Now().Add(budget)
+		}
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	d.slots = make(chan struct{}, parallel)
+	d.retries = retries
+	l.downloader = d
+	return d
+}
+
+// downloads the urls concurrently (up to the number of parallel downloads),
+// and keeps them until they are picked up with get. Failed downloads don't
+// stop the others; their error is returned by get.
+func (d *downloader) prefetch(requests []downloadRequest) {
+	var wg sync.WaitGroup
+	for _, r := range requests {
+		d.mu.Lock()
+		_, done := d.finished[r.url]
+		d.mu.Unlock()
+		if done {
+			continue
+		}
+		wg.Add(1)
+		go func(r downloadRequest) {
+			defer wg.Done()
+			data, err := d.download(r.url, r.headers)
+			d.mu.Lock()
+			d.finished[r.url] = downloadResult{data, err}
+			d.mu.Unlock()
+		}(r)
+	}
+	wg.Wait()
+}
+
+// returns the content of url; prefetched, or downloaded now
+func (d *downloader) get(url string, headers http.Header) ([]byte, error) {
+	d.mu.Lock()
+	r, ok := d.finished[url]
+	delete(d.finished, url)
+	d.mu.Unlock()
+	if ok {
+		return r.data, r.err
+	}
+	return d.download(url, headers)
+}
+
+// downloads url as soon as there's a free slot, retrying with exponential
+// backoff. A retry resumes the download after the data received so far, when
+// the server supports range requests.
+func (d *downloader) download(url string, headers http.Header) ([]byte, error) {
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+
+	entry := logger.WithField("url", url)
+	entry.Debug("Downloading")
+	backoff := defaultFetchBackoff
+	var data []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		timeout := downloadAttemptTimeout
+		if !d.deadline.IsZero() {
+			remaining := time.Until(d.deadline)
+			if remaining <= 0 {
+				if err == nil {
+					return nil, fmt.Errorf("download budget spent before downloading %s", url)
+				}
+				return nil, fmt.Errorf("download budget spent downloading %s: %v", url, err)
+			}
+			if remaining < timeout {
+				timeout = remaining
+			}
+		}
+		if data, err = downloadResume(url, headers, data, timeout); err == nil {
+			return data, nil
+		}
+		if attempt >= d.retries {
+			return nil, err
+		}
+		entry.Warnf("Download failed after %d bytes, retrying in %s (%d/%d): %v", len(data), backoff, attempt+1, d.retries, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxFetchBackoff {
+			backoff = maxFetchBackoff
+		}
+	}
+}
+
+// downloads url, continuing after the partial data received before. It
+// returns the data received so far, also when the download fails; or nil
+// when the download has to restart from the beginning.
+func downloadResume(url string, headers http.Header, partial []byte, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if len(partial) > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(partial)))
+	}
+	resp, err := httpClient(timeout).Do(req)
+	if err != nil {
+		return partial, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && len(partial) > 0:
+		if start := contentRangeStart(resp.Header.Get("Content-Range")); start != len(partial) {
+			return nil, fmt.Errorf("GET %s: unexpected range %q", url, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		// the server sends the whole file
+		partial = nil
+	default:
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	buf := bytes.NewBuffer(partial)
+	_, err = io.Copy(buf, resp.Body)
+	return buf.Bytes(), err
+}
+
+// returns the first byte of a Content-Range header (bytes 100-199/200), or
+// -1 if it can't be parsed
+func contentRangeStart(header string) int {
+	r := strings.TrimPrefix(header, "bytes ")
+	if i := strings.Index(r, "-"); i > 0 {
+		if start, err := strconv.Atoi(r[:i]); err == nil {
+			return start
+		}
+	}
+	return -1
+}
@@ -0,0 +1,169 @@
+package lift
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	drpcliBin      = "/usr/local/bin/drpcli"
+	drpcliRCFile   = "/etc/init.d/drpcli"
+	drpcliConfFile = "/etc/drpcli"
+	drpcliLogFile  = "/var/log/drpcli.log"
+	// how long the runner gets to register, by default
+	defaultDRPRegisterTimeout = 2 * time.Minute
+	// the number of runner log lines included in errors
+	drpcliLogLines = 10
+)
+
+// downloads drpcli, writes its configuration (endpoint, token and machine
+// uuid) and installs it as a service; then starts the runner and waits
+// until it has registered the machine as runnable with dr-provision
+func (l *Lift) drpSetup() error {
+	drp := l.Data.DRP
+	// the runner may be part of the image already, then there's nothing to download
+	if _, err := os.Stat(drpcliBin); err != nil {
+		url := l.drpcliURL()
+		if url == "" {
+			return fmt.Errorf("Error installing dr-provision runner: %s is missing and dr_provision.assets_url isn't set", drpcliBin)
+		}
+		if err := l.installBinary(url, drp.RunnerSHA256, "drpcli", drpcliBin); err != nil {
+			return err
+		}
+	}
+
+	// the configuration holds the token, so it's only readable by root
+	logger.Debugf("Writing drpcli configuration to %s", drpcliConfFile)
+	if err := installDRPFile(drpcliConf, drp, drpcliConfFile, 0600); err != nil {
+		return err
+	}
+	logger.Debug("Generating drpcli rc service file")
+	if err := installDRPFile(drpcliInit, l.Data, drpcliRCFile, 0755); err != nil {
+		return err
+	}
+	logger.Debug("Add drpcli service to default runlevel")
+	if err := exec.Command("rc-update", "add", "drpcli", defaultRunlevel).Run(); err != nil {
+		return fmt.Errorf("Error enabling drpcli: %s", err)
+	}
+	// the machine registers with dr-provision when it boots
+	if inAltRoot() {
+		return nil
+	}
+
+	logger.Info("Starting dr-provision runner")
+	if err := doService("drpcli", RESTART); err != nil {
+		return fmt.Errorf("Error starting dr-provision runner: %s%s", err, drpcliLog())
+	}
+	timeout := defaultDRPRegisterTimeout
+	if drp.RegisterTimeout != "" {
+		d, err := time.ParseDuration(drp.RegisterTimeout)
+		if err != nil {
+			return fmt.Errorf("Error parsing dr_provision.register_timeout: %s", err)
+		}
+		timeout = d
+	}
+	return drpWaitRegistered(drp, timeout)
+}
+
+// returns whether the runner should be installed: it's requested, and there's
+// something to register with or download it from
+func (d *DRProvision) configured() bool {
+	return d != nil && d.InstallRunner && (d.AssetsURL != "" || d.Endpoint != "")
+}
+
+// returns the url to download the runner from, when the dr_provision module
+// runs and has to download it; or ""
+func (l *Lift) drpcliURL() string {
+	drp := l.Data.DRP
+	if !drp.configured() || drp.AssetsURL == "" || !l.moduleEnabled("dr_provision") {
+		return ""
+	}
+	if _, err := os.Stat(drpcliBin); err == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/drpcli.amd64.linux", drp.AssetsURL)
+}
+
+// renders a drpcli template to dest
+func installDRPFile(t *template.Template, data interface{}, dest string, perm os.FileMode) error {
+	file, err := generateFileFromTemplate(*t, data)
+	if err != nil {
+		return err
+	}
+	if err = exec.Command("mv", file, dest).Run(); err != nil {
+		return err
+	}
+	return os.Chmod(dest, perm)
+}
+
+// waits until dr-provision reports the machine as runnable, which the runner
+// does when it starts, and its service is still running
+func drpWaitRegistered(drp *DRProvision, timeout time.Duration) error {
+	entry := logger.WithField("uuid", drp.UUID)
+	entry.Debugf("Waiting for dr-provision runner to register (%s)", timeout)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := drpRegistered(drp)
+		if err == nil {
+			entry.Info("dr-provision runner registered")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dr-provision runner didn't register within %s: %s%s", timeout, err, drpcliLog())
+		}
+		entry.Debugf("dr-provision runner not registered yet: %v", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// returns nil if the runner is running and the machine is runnable, or the
+// reason it isn't
+func drpRegistered(drp *DRProvision) error {
+	if err := exec.Command("service", "drpcli", "status").Run(); err != nil {
+		return fmt.Errorf("drpcli service is not running")
+	}
+	cmd := exec.Command(drpcliBin, "machines", "show", drp.UUID)
+	cmd.Env = append(os.Environ(), "RS_ENDPOINT="+drp.Endpoint)
+	if drp.Token != "" {
+		cmd.Env = append(cmd.Env, "RS_TOKEN="+drp.Token)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return fmt.Errorf("%s", strings.TrimSpace(string(ee.Stderr)))
+		}
+		return err
+	}
+	var machine struct {
+		Runnable bool
+	}
+	if err = json.Unmarshal(out, &machine); err != nil {
+		return fmt.Errorf("unexpected output of drpcli: %s", err)
+	}
+	if !machine.Runnable {
+		return fmt.Errorf("machine %s is not runnable", drp.UUID)
+	}
+	return nil
+}
+
+// returns the last lines of the runner log, to include in errors
+func drpcliLog() string {
+	data, err := ioutil.ReadFile(drpcliLogFile)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) > drpcliLogLines {
+		lines = lines[len(lines)-drpcliLogLines:]
+	}
+	if len(lines) == 0 || lines[0] == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s: %s)", drpcliLogFile, strings.Join(lines, "; "))
+}
@@ -1,15 +1,22 @@
 package lift
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/docker/docker/pkg/mount"
@@ -18,77 +25,99 @@ import (
 )
 
 const (
-	drpcliBin      = "/usr/local/bin/drpcli"
-	drpcliRCFile   = "/etc/init.d/drpcli"
 	chronyConfFile = "/etc/chrony/chrony.conf"
-	ssmtpConfFile  = "/etc/ssmtp/ssmtp.conf"
+	sshDir         = "/etc/ssh"
+	apkKeysDir     = "/etc/apk/keys"
+
+	alpineReleaseFile = "/etc/alpine-release"
+	apkWorldFile      = "/etc/apk/world"
+	liftPackagesFile  = stateDir + "/packages"
+	apkArchFile       = "/etc/apk/arch"
+	hostsFile         = "/etc/hosts"
+	proxyProfileFile  = "/etc/profile.d/proxy.sh"
+	motdFile          = "/etc/motd"
+	motdProfileFile   = "/etc/profile.d/lift-motd.sh"
+	bootIDFile        = "/proc/sys/kernel/random/boot_id"
+	rootLockScript    = "/etc/local.d/lift-lock-root.start"
+	rootLockBootFile  = stateDir + "/first-boot"
+
+	// seconds apk waits for the lock of the package database, which is
+	// held by another apk when modules run in parallel
+	apkLockWait = "600"
+
+	openntpdConfFile   = "/etc/ntpd.conf"
+	busyboxNTPConfFile = "/etc/conf.d/ntpd"
 )
 
+// ntpDaemon contains the configuration file, template and service of a
+// NTP daemon supported by setup-ntp
+type ntpDaemon struct {
+	confFile string
+	template *template.Template
+	service  string
+}
+
 var (
-	fsPackage = map[string]string{
-		"xfs":   "xfsprogs",
-		"btrfs": "btrfs-progs",
-		"ext2":  "e2fsprogs",
-		"ext3":  "e2fsprogs",
-		"ext4":  "e2fsprogs",
-		"jfs":   "jfsutils",
-		"ntfs":  "ntfs-3g-progs",
+	defaultRepositories = []string{
+		"http://dl-cdn.alpinelinux.org/alpine/%s/main",
+		"http://dl-cdn.alpinelinux.org/alpine/%s/community",
 	}
 )
 
 // executes the `hostname` command, if hostname was provided in alpine-data
 func (l *Lift) setHostname() error {
-	if l.Data.Network.HostName != "" {
-		host := strings.Split(l.Data.Network.HostName, ".")[0]
+	if l.Data.Network.HostName != "" || l.Data.Network.FQDN != "" {
+		host := l.Data.Network.shortHostname()
+		fqdn := l.Data.Network.fqdn()
 
-		cmd := exec.Command("hostname", host)
-		if err := cmd.Run(); err != nil {
-			return err
+		// the running kernel is not the one of an alternate root
+		if !inAltRoot() {
+			if err := exec.Command("hostname", host).Run(); err != nil {
+				return err
+			}
 		}
 
-		cmd = exec.Command("setup-hostname", "-n", host)
+		cmd := exec.Command("setup-hostname", "-n", host)
 		if err := cmd.Run(); err != nil {
 			return err
 		}
 
-		file, err := openOrCreate("/etc/hosts")
+		if l.Data.Network.ManageEtcHosts {
+			return l.etcHostsSetup()
+		}
+
+		file, err := openOrCreate(hostsFile)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
-		if _, err = file.WriteString(fmt.Sprintf("127.0.0.1\t%s %s\n", l.Data.Network.HostName, host)); err != nil {
+		if _, err = file.WriteString(fmt.Sprintf("127.0.0.1\t%s %s\n", fqdn, host)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// mtaSetup installs and configures ssmtp as MTA
-func (l *Lift) mtaSetup() error {
-	if l.Data.MTA == nil {
-		log.Debug("No MTA configured")
-		return nil
-	}
-
-	log.Debug("apk add ssmtp")
-	cmd := exec.Command("apk", "add", "ssmtp")
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-
-	log.Debug("Generating ssmtp.conf")
-	ssmtp, err := generateFileFromTemplate(*ssmtpConf, l.Data)
+// replaces /etc/hosts, so the hostname resolves to 127.0.1.1 and the
+// additional host entries are present
+func (l *Lift) etcHostsSetup() error {
+	hfile, err := generateFileFromTemplate(*hostsConf, struct {
+		FQDN     string
+		Hostname string
+		Hosts    map[string]MultiString
+	}{
+		FQDN:     l.Data.Network.fqdn(),
+		Hostname: l.Data.Network.shortHostname(),
+		Hosts:    l.Data.Network.Hosts,
+	})
 	if err != nil {
 		return err
 	}
-
-	log.Debugf("Copying ssmtp.conf to %s", ssmtpConfFile)
-	cmd = exec.Command("mv", ssmtp, ssmtpConfFile)
-	if err := cmd.Run(); err != nil {
+	logger.WithField("file", hostsFile).Debug("Writing hosts file")
+	if err = exec.Command("mv", hfile, hostsFile).Run(); err != nil {
 		return err
 	}
-
-	return nil
+	return os.Chmod(hostsFile, 0644)
 }
 
 // executes the setup-disk script if scratch disk is set
@@ -97,11 +126,11 @@ func (l *Lift) mtaSetup() error {
 // from being mounted correctly.
 func (l *Lift) scratchDiskSetup() error {
 	if l.Data.ScratchDisk == "" {
-		log.Debug("No Scratch Disk defined")
+		logger.Debug("No Scratch Disk defined")
 		return nil
 	}
 
-	log.Debug("Check if Docker is running")
+	logger.Debug("Check if Docker is running")
 	// Give Docker some time to start
 	time.Sleep(3 * time.Second)
 	dockerPresent := false
@@ -109,17 +138,17 @@ func (l *Lift) scratchDiskSetup() error {
 	if err != nil {
 		return err
 	}
-	log.WithField("numprocs", len(procs)).Debug("Fetch process list")
+	logger.WithField("numprocs", len(procs)).Debug("Fetch process list")
 	for _, p := range procs {
-		log.Debugf("Process: %s", p.Executable())
+		logger.Debugf("Process: %s", p.Executable())
 		if strings.Contains(strings.ToLower(p.Executable()), "docker") {
-			log.Debug("Docker process detected")
+			logger.Debug("Docker process detected")
 			dockerPresent = true
 		}
 	}
 
 	if dockerPresent {
-		log.Info("Stopping Docker...")
+		logger.Info("Stopping Docker...")
 		_ = doService("docker", STOP)
 		// Wait a little bit for Docker to stop
 		time.Sleep(2 * time.Second)
@@ -128,20 +157,18 @@ func (l *Lift) scratchDiskSetup() error {
 	mnts, _ := mount.GetMounts()
 	for _, mnt := range mnts {
 		if strings.Contains(mnt.Mountpoint, "/var") {
-			log.Infof("Unmounting %s", mnt.Mountpoint)
+			logger.Infof("Unmounting %s", mnt.Mountpoint)
 			cmd := exec.Command("umount", mnt.Mountpoint)
 			_ = cmd.Run()
 		}
 	}
 
-	log.WithField("disk", l.Data.ScratchDisk).Debug("Setup Scratch Disk")
+	logger.WithField("disk", l.Data.ScratchDisk).Debug("Setup Scratch Disk")
 	cmd := exec.Command("setup-disk", "-q", "-m", "data", l.Data.ScratchDisk)
 
-	// If not silenced, show setup-alpine output on stdout
-	if !silent {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-	}
+	// Show setup-disk output on the console (unless silenced) and in the log file
+	cmd.Stdout = commandOutput()
+	cmd.Stderr = commandOutput()
 
 	env := append(os.Environ(), "VARFS=xfs")
 	env = append(env, fmt.Sprintf("ERASE_DISKS=%s", l.Data.ScratchDisk))
@@ -154,7 +181,7 @@ func (l *Lift) scratchDiskSetup() error {
 	}
 
 	if dockerPresent {
-		log.Info("Starting Docker...")
+		logger.Info("Starting Docker...")
 		_ = doService("docker", START)
 	}
 
@@ -171,87 +198,43 @@ func (l *Lift) scratchDiskSetup() error {
 	return nil
 }
 
-// Encrypt, Format and mount other disks if configured
-func (l *Lift) diskSetup() error {
-	if l.Data.Disks == nil {
-		log.Debug("No additional disks")
-		return nil
-	}
-	for i, disk := range l.Data.Disks {
-		log.Debug("Installing cryptsetup package")
-		_ = exec.Command("apk", "add", "--no-cache", "cryptsetup").Run()
-		log.Debug("Generating random key")
-		rand.Seed(time.Now().UnixNano())
-		letterRunes := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-		b := make([]rune, 30)
-		for i := range b {
-			b[i] = letterRunes[rand.Intn(len(letterRunes))]
-		}
-		luksPass := string(b)
-		log.Debugf("Encrypting %s (LUKS)", disk.Device)
-		cmdStr := fmt.Sprintf("echo -n '%s' | cryptsetup luksFormat %s -", luksPass, disk.Device)
-		encryptCmd := exec.Command("ash", "-c", cmdStr)
-		encryptCmd.Stdout = os.Stdout
-		if err := encryptCmd.Run(); err != nil {
-			return err
-		}
-
-		if log.GetLevel() == log.DebugLevel {
-			dumpCmd := exec.Command("cryptsetup", "luksDump", disk.Device)
-			dumpCmd.Stdout = os.Stdout
-			_ = dumpCmd.Run()
-		}
-
-		mapper := fmt.Sprintf("crypt%d", i)
-		log.Debugf("Opening %s as %s", disk.Device, mapper)
-		cmdStr = fmt.Sprintf("echo -n '%s' | cryptsetup luksOpen %s %s -d -", luksPass, disk.Device, mapper)
-		openCmd := exec.Command("ash", "-c", cmdStr)
-		openCmd.Stdout = os.Stdout
-		if err := openCmd.Run(); err != nil {
-			return err
-		}
-
-		// Check filesystem support and kernel modules. Ignore exit codes..
-		log.Debugf("Checking filesystem prerequisites")
-		_ = exec.Command("apk", "add", "--no-cache", fsPackage[strings.ToLower(disk.FileSystemType)]).Run()
-		_ = exec.Command("modprobe", strings.ToLower(disk.FileSystemType)).Run()
-
-		mapdevice := fmt.Sprintf("/dev/mapper/%s", mapper)
-		log.Debugf("Creating %s filesystem on %s", disk.FileSystemType, mapdevice)
-		cmd := exec.Command(fmt.Sprintf("mkfs.%s", strings.ToLower(disk.FileSystemType)), mapdevice)
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-		log.Debugf("Creating mountpoint %s", disk.MountPoint)
-		cmd = exec.Command("mkdir", "-p", disk.MountPoint)
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-		log.Debugf("Mounting %s on %s as %s", mapdevice, disk.MountPoint, disk.FileSystemType)
-		cmd = exec.Command("mount", "-t", strings.ToLower(disk.FileSystemType), mapdevice, disk.MountPoint)
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 // configures the network interface(s)
 func (l *Lift) networkSetup() error {
 	var cmd *exec.Cmd
 
-	if l.Data.Network.InterfaceOpts == "" {
+	if l.Data.Network.InterfaceOpts.IsEmpty() {
 		// Do auto config
-		log.Debug("No interface specification defined; auto-config")
+		logger.Debug("No interface specification defined; auto-config")
 		cmd = exec.Command("setup-interfaces", "-a")
 	} else {
-		log.Debug("Apply interface specification")
+		for _, p := range l.Data.Network.InterfaceOpts.requiredPackages() {
+			logger.WithField("package", p).Debug("Executing apk add")
+			if err := apkCommand("add", p).Run(); err != nil {
+				return err
+			}
+		}
+		opts := l.Data.Network.InterfaceOpts.Raw
+		if opts != "" && l.Data.Template {
+			var err error
+			if opts, err = l.renderTemplate("interfaces", opts); err != nil {
+				return err
+			}
+		}
+		if opts == "" {
+			logger.Debug("Generating interfaces from structured specification")
+			var b bytes.Buffer
+			if err := interfaces.Execute(&b, l.Data.Network); err != nil {
+				return err
+			}
+			opts = b.String()
+		}
+		logger.Debug("Apply interface specification")
 		cmd = exec.Command("setup-interfaces", "-i")
 		stdin, err := cmd.StdinPipe()
 		if err != nil {
 			return err
 		}
-		io.WriteString(stdin, l.Data.Network.InterfaceOpts)
+		io.WriteString(stdin, opts)
 		stdin.Close()
 	}
 
@@ -260,7 +243,7 @@ func (l *Lift) networkSetup() error {
 	}
 
 	if err := doService("networking", RESTART); err != nil {
-		log.Infof("%v", err)
+		logger.Infof("%v", err)
 	}
 
 	return nil
@@ -268,29 +251,105 @@ func (l *Lift) networkSetup() error {
 
 // sets the proxy
 func (l *Lift) proxySetup() error {
-	if l.Data.Network.Proxy != "" {
-		log.WithField("proxy", l.Data.Network.Proxy).Debug("Found proxy setting")
-		cmd := exec.Command("setup-proxy", l.Data.Network.Proxy)
-		if err := cmd.Run(); err != nil {
-			return err
+	proxy := l.Data.Network.Proxy
+	if proxy.HTTP == "" && proxy.HTTPS == "" {
+		return nil
+	}
+	logger.WithFields(log.Fields{
+		"http":  proxy.HTTP,
+		"https": proxy.httpsProxy(),
+	}).Debug("Found proxy setting")
+
+	pfile, err := generateFileFromTemplate(*proxyConf, struct {
+		ProxyConfig
+		HTTPSProxy string
+	}{proxy, proxy.httpsProxy()})
+	if err != nil {
+		return err
+	}
+	if err = exec.Command("mv", pfile, proxyProfileFile).Run(); err != nil {
+		return err
+	}
+	if err = os.Chmod(proxyProfileFile, 0644); err != nil {
+		return err
+	}
+
+	// use the proxy for apk and all other commands executed by lift,
+	// and for lift's own downloads
+	env := map[string]string{
+		"http_proxy":  proxy.HTTP,
+		"https_proxy": proxy.httpsProxy(),
+		"no_proxy":    strings.Join(proxy.NoProxy, ","),
+	}
+	for k, v := range env {
+		if v != "" {
+			os.Setenv(k, v)
+			os.Setenv(strings.ToUpper(k), v)
 		}
 	}
+	transport.Proxy = proxy.proxyFunc()
 	return nil
 }
 
-// sets root password if needed
+// sets the root password, and hardens the root account as configured
 func (l *Lift) rootPasswdSetup() error {
+	root := l.Data.Root
+	if root == nil {
+		root = &RootConfig{}
+	}
+	if root.Password != "" {
+		l.Data.RootPasswd = root.Password
+	}
+	generated := l.Data.RootPasswd == randomPassword
+	if generated {
+		passwd, err := l.generatePassword("root")
+		if err != nil {
+			return err
+		}
+		l.Data.RootPasswd = passwd
+	}
+	if l.Data.RootPasswd != "" && !root.AllowWeakPassword && isWeakPassword(l.Data.RootPasswd) {
+		return errors.New("Refusing to set a weak root password, set root.allow_weak_password to allow it")
+	}
+	if err := l.setRootPasswd(); err != nil {
+		return err
+	}
+	if generated {
+		l.reportPassword("root", l.Data.RootPasswd)
+	}
+	if root.LockPasswd {
+		logger.Info("Locking root password")
+		if err := exec.Command("passwd", "-l", "root").Run(); err != nil {
+			return fmt.Errorf("Error locking root password: %s", err)
+		}
+	} else if root.LockAfterFirstBoot {
+		if err := lockRootAfterFirstBoot(); err != nil {
+			return err
+		}
+	}
+	if root.Shell != "" {
+		logger.Infof("Setting login shell of root to %s", root.Shell)
+		if err := setLoginShell("root", root.Shell); err != nil {
+			return fmt.Errorf("Error setting login shell of root: %s", err)
+		}
+	}
+	return nil
+}
+
+// sets root password
+func (l *Lift) setRootPasswd() error {
 	// Always set a password, randomized if empty..
 	if l.Data.RootPasswd == "" {
-		rand.Seed(time.Now().UnixNano())
-		letterRunes := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789&^%$#-_")
-		b := make([]rune, 30)
-		for i := range b {
-			b[i] = letterRunes[rand.Intn(len(letterRunes))]
+		passwd, err := randomString(30)
+		if err != nil {
+			return err
 		}
-		l.Data.RootPasswd = string(b)
+		l.Data.RootPasswd = passwd
 	}
 	chpasswdCmd := exec.Command("chpasswd")
+	if isPasswordHash(l.Data.RootPasswd) {
+		chpasswdCmd = exec.Command("chpasswd", "-e")
+	}
 	reader, writer := io.Pipe()
 	s := []byte(fmt.Sprintf("root:%s\n", l.Data.RootPasswd))
 
@@ -309,23 +368,216 @@ func (l *Lift) rootPasswdSetup() error {
 
 }
 
-// parses sshd_config, writes authorized_keys file and restarts sshd service
+// generates a random password for the user, which is reported once: in
+// the phone_home report, or else on the console
+func (l *Lift) generatePassword(user string) (string, error) {
+	passwd, err := randomString(generatedPasswordLength)
+	if err != nil {
+		return "", fmt.Errorf("Error generating password for %s: %s", user, err)
+	}
+	logger.Infof("Generated a random password for %s", user)
+	return passwd, nil
+}
+
+// records a generated password once it's set, so it's reported
+func (l *Lift) reportPassword(user, passwd string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.passwords == nil {
+		l.passwords = make(map[string]string)
+	}
+	l.passwords[user] = passwd
+}
+
+// prints the generated passwords on the console, but not in the log file.
+// When the console is silenced they're printed on the system console, or
+// else written to a file only root can read, which unlift (data) shreds.
+func (l *Lift) printPasswords() {
+	if len(l.passwords) == 0 {
+		return
+	}
+	users := make([]string, 0, len(l.passwords))
+	for user := range l.passwords {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	var b strings.Builder
+	for _, user := range users {
+		fmt.Fprintf(&b, "Generated password for %s: %s\n", user, l.passwords[user])
+	}
+	if console != ioutil.Discard {
+		fmt.Fprint(console, b.String())
+		return
+	}
+	if dev, err := os.OpenFile(defaultProgressDevice, os.O_WRONLY|os.O_APPEND, 0); err == nil {
+		_, err = fmt.Fprint(dev, b.String())
+		dev.Close()
+		if err == nil {
+			return
+		}
+	}
+	if err := os.MkdirAll(liftConfDir, 0755); err != nil {
+		logger.Errorf("Error writing generated passwords: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(passwordsFile, []byte(b.String()), 0600); err != nil {
+		logger.Errorf("Error writing generated passwords: %v", err)
+		return
+	}
+	logger.Warnf("Generated passwords written to %s", passwordsFile)
+}
+
+// returns true if a plaintext password is too short or well-known
+func isWeakPassword(passwd string) bool {
+	if isPasswordHash(passwd) || passwd == randomPassword {
+		return false
+	}
+	return len(passwd) < minPasswordLength || stringInSlice(strings.ToLower(passwd), weakPasswords)
+}
+
+// installs a local.d script that locks the root password on the next boot.
+// The first boot (this one, or the first boot of an image) is recorded by
+// the script itself.
+func lockRootAfterFirstBoot() error {
+	logger.Info("Locking root password after the first boot")
+	if err := os.MkdirAll(filepath.Dir(rootLockScript), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	if !inAltRoot() {
+		bootID, err := ioutil.ReadFile(bootIDFile)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(rootLockBootFile, bootID, 0644); err != nil {
+			return err
+		}
+	}
+	sfile, err := generateFileFromTemplate(*rootLock, struct {
+		BootIDFile, BootFile string
+	}{bootIDFile, rootLockBootFile})
+	if err != nil {
+		return err
+	}
+	if err = exec.Command("mv", sfile, rootLockScript).Run(); err != nil {
+		return err
+	}
+	if err = os.Chmod(rootLockScript, 0755); err != nil {
+		return err
+	}
+	return exec.Command("rc-update", "add", "local", defaultRunlevel).Run()
+}
+
+// sets the login shell of a user in /etc/passwd
+func setLoginShell(name, shell string) error {
+	data, err := ioutil.ReadFile(passwdFile)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == name {
+			fields[6] = shell
+			lines[i] = strings.Join(fields, ":")
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("user %s not found in %s", name, passwdFile)
+	}
+	return ioutil.WriteFile(passwdFile, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// parses sshd_config, writes authorized_keys file and restarts sshd service;
+// only the authorized_keys file is written when no directives are set (in
+// strict mode)
 func (l *Lift) sshdSetup() error {
 	if l.Data.SSHDConfig == nil {
 		return nil
 	}
-	if err := parseConfigFile("/etc/ssh/sshd_config", " ", l.getSSHDKVMap()); err != nil {
-		return err
+	kv := l.getSSHDKVMap()
+	if len(kv) > 0 {
+		if err := parseConfigFile("/etc/ssh/sshd_config", " ", kv); err != nil {
+			return err
+		}
 	}
 	if err := l.addSSHKeys(); err != nil {
 		return err
 	}
-	if err := doService("sshd", RESTART); err != nil {
+	if len(kv) > 0 {
+		if err := doService("sshd", RESTART); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes pre-generated SSH host keys, deletes unwanted host key
+// types and generates missing host keys of the wanted types
+func (l *Lift) sshHostKeysSetup() error {
+	hk := l.Data.SSHKeys
+	if hk == nil {
+		return nil
+	}
+
+	existing, err := filepath.Glob(filepath.Join(sshDir, "ssh_host_*_key"))
+	if err != nil {
 		return err
 	}
+	wanted := map[string]bool{}
+	for _, t := range hk.Types {
+		wanted[strings.ToLower(t)] = true
+	}
+	for _, key := range existing {
+		t := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(key), "ssh_host_"), "_key")
+		if hk.Regenerate || (len(wanted) > 0 && !wanted[t]) {
+			logger.Debugf("Deleting %s host key", t)
+			_ = os.Remove(key)
+			_ = os.Remove(key + ".pub")
+		}
+	}
+
+	for t, pair := range hk.Keys {
+		key := hostKeyPath(t)
+		logger.Debugf("Writing %s host key", t)
+		if err = ioutil.WriteFile(key, []byte(strings.TrimSpace(pair.Private)+"\n"), 0600); err != nil {
+			return err
+		}
+		if pair.Public != "" {
+			if err = ioutil.WriteFile(key+".pub", []byte(strings.TrimSpace(pair.Public)+"\n"), 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	for t := range wanted {
+		key := hostKeyPath(t)
+		if _, err := os.Stat(key); err == nil {
+			continue
+		}
+		if inAltRoot() {
+			// an image must not contain generated host keys; sshd
+			// generates them on first boot
+			logger.Debugf("Not generating %s host key in alternate root", t)
+			continue
+		}
+		logger.Debugf("Generating %s host key", t)
+		if err = exec.Command("ssh-keygen", "-q", "-N", "", "-t", t, "-f", key).Run(); err != nil {
+			return fmt.Errorf("Error generating %s host key: %s", t, err)
+		}
+	}
 	return nil
 }
 
+// returns the path of the SSH host key of the given type
+func hostKeyPath(keyType string) string {
+	return filepath.Join(sshDir, fmt.Sprintf("ssh_host_%s_key", strings.ToLower(keyType)))
+}
+
 // call setup-dns Alpine setup script for configuring resolv.conf
 func (l *Lift) dnsSetup() error {
 	if l.Data.Network.ResolvConf != nil {
@@ -344,22 +596,35 @@ func (l *Lift) ntpSetup() error {
 	if l.Data.Network.NTP != nil {
 		if (l.Data.Network.NTP.Pools != nil && len(l.Data.Network.NTP.Pools) > 0) ||
 			(l.Data.Network.NTP.Servers != nil && len(l.Data.Network.NTP.Servers) > 0) {
-			cmd := exec.Command("setup-ntp", "-c", "chrony")
+			daemon := l.Data.Network.NTP.Daemon
+			if daemon == "" {
+				daemon = "chrony"
+			}
+			// templates are parsed in init(), so can't be referenced in a package var
+			d, ok := map[string]ntpDaemon{
+				"chrony":   {chronyConfFile, chronyConf, "chronyd"},
+				"openntpd": {openntpdConfFile, openntpdConf, "openntpd"},
+				"busybox":  {busyboxNTPConfFile, busyboxNTPConf, "ntpd"},
+			}[daemon]
+			if !ok {
+				return fmt.Errorf("Unknown NTP daemon: %s", daemon)
+			}
+			cmd := exec.Command("setup-ntp", "-c", daemon)
 			if err := cmd.Run(); err != nil {
 				return err
 			}
-			log.Debug("Generating chrony.conf")
-			chrony, err := generateFileFromTemplate(*chronyConf, l.Data)
+			logger.Debugf("Generating %s configuration", daemon)
+			conf, err := generateFileFromTemplate(*d.template, l.Data)
 			if err != nil {
 				return err
 			}
-			log.Debugf("Copying chrony.conf to %s", chronyConfFile)
-			cmd = exec.Command("mv", chrony, chronyConfFile)
+			logger.Debugf("Copying %s configuration to %s", daemon, d.confFile)
+			cmd = exec.Command("mv", conf, d.confFile)
 			if err := cmd.Run(); err != nil {
 				return err
 			}
-			log.Debug("Restart Chrony")
-			_ = doService("chronyd", RESTART)
+			logger.Debugf("Restart %s", d.service)
+			_ = doService(d.service, RESTART)
 		}
 	}
 	return nil
@@ -374,7 +639,7 @@ func (l *Lift) addSSHKeys() error {
 			return err
 		}
 		defer file.Close()
-		for _, key := range l.Data.SSHDConfig.AuthorizedKeys {
+		for _, key := range resolveSSHKeys(l.Data.SSHDConfig.AuthorizedKeys) {
 			if _, err = file.WriteString(fmt.Sprintf("%s\n", key)); err != nil {
 				return err
 			}
@@ -383,96 +648,128 @@ func (l *Lift) addSSHKeys() error {
 	return nil
 }
 
-// downloads drpcli and installs it as a service
-func (l *Lift) drpSetup() error {
-	// First download drpcli
-	if _, err := os.Stat(drpcliBin); os.IsNotExist(err) {
-		url := fmt.Sprintf("%s/drpcli.amd64.linux", l.Data.DRP.AssetsURL)
-		log.WithField("url", url).Debug("Downloading drpcli")
-		drpcli, err := downloadFile(url, nil)
-		if err != nil {
-			return err
-		}
-		log.Debugf("Saving drpcli to %s", drpcliBin)
-		err = ioutil.WriteFile(drpcliBin, drpcli, 0755)
-		if err != nil {
-			return err
-		}
+var (
+	// guards the record of the packages lift installed
+	liftPackagesMu sync.Mutex
+)
+
+// returns the apk command with the arguments, waiting for the lock of the
+// package database instead of failing when another apk is running. The
+// packages it adds are recorded as installed by lift, so world mode keeps
+// them.
+func apkCommand(args ...string) *exec.Cmd {
+	if len(args) > 0 && args[0] == "add" {
+		recordLiftPackages(args[1:])
 	}
+	return packagesCommand(args...)
+}
 
-	// then check RC file
-	if _, err := os.Stat(drpcliRCFile); os.IsNotExist(err) {
-		log.Debug("Generating drpcli rc service file")
-		rcfile, err := generateFileFromTemplate(*drpcliInit, l.Data)
-		if err != nil {
-			return err
-		}
-		log.Debugf("Copying service file to %s", drpcliRCFile)
-		cmd := exec.Command("mv", rcfile, drpcliRCFile)
-		err = cmd.Run()
-		if err != nil {
-			return err
-		}
-		log.Debug("Setting execute permission")
-		cmd = exec.Command("chmod", "+x", drpcliRCFile)
-		err = cmd.Run()
-		if err != nil {
-			return err
-		}
-		log.Debug("Add drpcli service to default runlevel")
-		cmd = exec.Command("rc-update", "add", "drpcli")
-		err = cmd.Run()
-		if err != nil {
-			return err
+// returns the apk command for the packages of the alpine-data, which
+// aren't recorded
+func packagesCommand(args ...string) *exec.Cmd {
+	return exec.Command("apk", append([]string{"--wait", apkLockWait}, args...)...)
+}
+
+// adds the packages (ignoring options) to the record of the packages lift
+// installed for its modules
+func recordLiftPackages(args []string) {
+	liftPackagesMu.Lock()
+	defer liftPackagesMu.Unlock()
+	recorded := liftPackages()
+	changed := false
+	for _, p := range args {
+		if p = worldPackageName(p); p != "" && !strings.HasPrefix(p, "-") && !stringInSlice(p, recorded) {
+			recorded = append(recorded, p)
+			changed = true
 		}
 	}
+	if !changed {
+		return
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		logger.Debugf("Error recording packages: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(liftPackagesFile, []byte(strings.Join(recorded, "\n")+"\n"), 0644); err != nil {
+		logger.Debugf("Error recording packages: %v", err)
+	}
+}
 
-	log.Info("Starting dr-provision runner")
-	_ = doService("drpcli", START)
-	return nil
+// returns the packages lift installed for its modules
+func liftPackages() []string {
+	data, err := ioutil.ReadFile(liftPackagesFile)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+// returns the name of a package in the world, without its repository tag
+// and version constraint
+func worldPackageName(p string) string {
+	if i := strings.IndexAny(p, "@<>=~"); i >= 0 {
+		return p[:i]
+	}
+	return p
 }
 
 func (l *Lift) setupAPK() error {
 	if l.Data.Packages == nil {
 		return nil
 	}
-	rfile, err := generateFileFromTemplate(*repoFile, l.Data.Packages.Repositories)
+	if err := l.installAPKKeys(); err != nil {
+		return err
+	}
+	if len(l.Data.Packages.Repositories) == 0 {
+		release := alpineRelease(l.Data.Packages.Release)
+		logger.WithField("release", release).Debug("Using default repositories")
+		for _, r := range defaultRepositories {
+			l.Data.Packages.Repositories = append(l.Data.Packages.Repositories, fmt.Sprintf(r, release))
+		}
+	}
+	rfile, err := generateFileFromTemplate(*repoFile, l.Data.Packages)
 	if err != nil {
 		return err
 	}
-	log.Debug("Setting up repositories")
+	logger.Debug("Setting up repositories")
 	cmd := exec.Command("mv", rfile, "/etc/apk/repositories")
 	err = cmd.Run()
 	if err != nil {
 		return err
 	}
 	if l.Data.Packages.Update {
-		log.Debug("Executing apk update")
-		cmd := exec.Command("apk", "update")
+		logger.Debug("Executing apk update")
+		cmd := apkCommand("update")
 		err = cmd.Run()
 		if err != nil {
 			return err
 		}
 	}
 	if l.Data.Packages.Upgrade {
-		log.Debug("Executing apk upgrade")
-		cmd := exec.Command("apk", "upgrade")
+		logger.Debug("Executing apk upgrade")
+		cmd := apkCommand("upgrade")
 		err = cmd.Run()
 		if err != nil {
 			return err
 		}
 	}
+	if l.Data.Packages.World {
+		return l.setupAPKWorld()
+	}
 	for _, p := range l.Data.Packages.Uninstall {
-		log.WithField("package", p).Debug("Executing apk del")
-		cmd := exec.Command("apk", "del", p)
+		logger.WithField("package", p).Debug("Executing apk del")
+		cmd := packagesCommand("del", p)
 		err = cmd.Run()
 		if err != nil {
 			return err
 		}
 	}
 	for _, p := range l.Data.Packages.Install {
-		log.WithField("package", p).Debug("Executing apk add")
-		cmd := exec.Command("apk", "add", p)
+		if p.Tag != "" && len(l.Data.Packages.TaggedRepositories[p.Tag]) == 0 {
+			logger.Warnf("Package %s uses undefined repository tag @%s", p.Name, p.Tag)
+		}
+		logger.WithField("package", p.String()).Debug("Executing apk add")
+		cmd := packagesCommand("add", p.String())
 		err = cmd.Run()
 		if err != nil {
 			return err
@@ -481,55 +778,300 @@ func (l *Lift) setupAPK() error {
 	return nil
 }
 
+// replaces /etc/apk/world with the install list and commits it, so exactly
+// the listed packages (and their dependencies) are installed afterwards,
+// besides the packages lift installed for its modules
+func (l *Lift) setupAPKWorld() error {
+	if len(l.Data.Packages.Uninstall) > 0 {
+		logger.Warn("Ignoring packages.uninstall, world mode removes all unlisted packages")
+	}
+	var world strings.Builder
+	listed := make(map[string]bool)
+	for _, p := range l.Data.Packages.Install {
+		if p.Tag != "" && len(l.Data.Packages.TaggedRepositories[p.Tag]) == 0 {
+			logger.Warnf("Package %s uses undefined repository tag @%s", p.Name, p.Tag)
+		}
+		listed[p.Name] = true
+		world.WriteString(p.String() + "\n")
+	}
+	hasBase := listed["alpine-base"]
+	// only the packages that are still installed are kept, so the world
+	// mode doesn't install packages that failed or were removed since
+	if data, err := ioutil.ReadFile(apkWorldFile); err == nil {
+		liftPackagesMu.Lock()
+		recorded := liftPackages()
+		liftPackagesMu.Unlock()
+		for _, p := range strings.Fields(string(data)) {
+			name := worldPackageName(p)
+			if !listed[name] && stringInSlice(name, recorded) {
+				logger.WithField("package", p).Debug("Keeping package installed by lift")
+				listed[name] = true
+				world.WriteString(p + "\n")
+			}
+		}
+	}
+	if !hasBase {
+		logger.Warn("alpine-base is not in the world package list, it will be removed")
+	}
+	logger.WithField("file", apkWorldFile).Debug("Writing apk world")
+	if err := ioutil.WriteFile(apkWorldFile, []byte(world.String()), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", apkWorldFile, err)
+	}
+	logger.Debug("Executing apk add --no-cache")
+	if out, err := apkCommand("add", "--no-cache").CombinedOutput(); err != nil {
+		return fmt.Errorf("Error committing apk world: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// returns the release (branch) of the Alpine repositories, e.g. v3.19 or edge.
+// If no release is given, it's detected from /etc/alpine-release.
+func alpineRelease(release string) string {
+	if release == "" {
+		data, err := ioutil.ReadFile(alpineReleaseFile)
+		if err != nil {
+			logger.Debugf("Unable to detect Alpine release: %v", err)
+			return "latest-stable"
+		}
+		release = strings.TrimSpace(string(data))
+		// development snapshots (e.g. 3.20.0_alpha20240315) use edge
+		if strings.Contains(release, "_") {
+			return "edge"
+		}
+	}
+	if release == "edge" || release == "latest-stable" {
+		return release
+	}
+	parts := strings.Split(strings.TrimPrefix(release, "v"), ".")
+	if len(parts) < 2 {
+		return "v" + strings.TrimPrefix(release, "v")
+	}
+	return fmt.Sprintf("v%s.%s", parts[0], parts[1])
+}
+
+// installs the public keys of custom repositories into /etc/apk/keys
+func (l *Lift) installAPKKeys() error {
+	for _, k := range l.Data.Packages.Keys {
+		name := k.Name
+		if name == "" && k.URL != "" {
+			name = path.Base(k.URL)
+		}
+		if name == "" || name == "." || name == "/" {
+			return errors.New("apk key without name")
+		}
+
+		data := []byte(k.Content)
+		if k.URL != "" {
+			logger.WithField("url", k.URL).Debug("Downloading apk key")
+			var err error
+			if data, err = downloadFile(k.URL, nil); err != nil {
+				return err
+			}
+			if err = verifyChecksum(data, k.SHA256, ""); err != nil {
+				return fmt.Errorf("Error verifying %s: %s", k.URL, err)
+			}
+		}
+
+		keyFile := filepath.Join(apkKeysDir, filepath.Base(name))
+		logger.Debugf("Installing apk key %s", keyFile)
+		if err := os.MkdirAll(apkKeysDir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(keyFile, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sets the MOTD, rendered as template if enabled, and installs the dynamic
+// MOTD script if enabled
 func (l *Lift) setMOTD() error {
-	if l.Data.MOTD != "" {
-		err := os.Truncate("/etc/motd", 0)
+	motd := l.Data.MOTD
+	if motd.Content != "" {
+		content := motd.Content
+		if l.Data.Template || motd.Template {
+			var err error
+			if content, err = l.renderTemplate("motd", content); err != nil {
+				return err
+			}
+		}
+		err := os.Truncate(motdFile, 0)
 		if err != nil {
 			return err
 		}
-		file, err := os.OpenFile("/etc/motd", os.O_RDWR|os.O_EXCL, 0600)
+		file, err := os.OpenFile(motdFile, os.O_RDWR|os.O_EXCL, 0600)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
-		if _, err = file.WriteString(fmt.Sprintf("%s\n", l.Data.MOTD)); err != nil {
+		if _, err = file.WriteString(fmt.Sprintf("%s\n", content)); err != nil {
 			return err
 		}
 	}
+	if motd.Dynamic {
+		sfile, err := generateFileFromTemplate(*motdScript, l.templateVars())
+		if err != nil {
+			return err
+		}
+		logger.WithField("file", motdProfileFile).Debug("Writing dynamic MOTD script")
+		if err = exec.Command("mv", sfile, motdProfileFile).Run(); err != nil {
+			return err
+		}
+		return os.Chmod(motdProfileFile, 0755)
+	}
 	return nil
 }
 
-func (l *Lift) createFiles() error {
-	for _, wf := range l.Data.WriteFiles {
-		var data []byte
+// writes the files from alpine-data. Deferred files are written after
+// packages have been installed and users have been created, all other
+// files before that.
+func (l *Lift) createFiles(deferred bool) error {
+	var files []WriteFile
+	var requests []downloadRequest
+	for i, wf := range l.Data.WriteFiles {
+		// files owned by a user or group lift creates are written once it
+		// exists
+		if !wf.Defer && !deferred && wf.Owner != "" && !ownerExists(wf.Owner) {
+			logger.WithField("owner", wf.Owner).Infof("Deferring %s until its owner exists", wf.Path)
+			l.Data.WriteFiles[i].Defer = true
+			continue
+		}
+		if wf.Defer != deferred {
+			continue
+		}
+		files = append(files, wf)
+		if wf.ContentURL != "" && existingContent(wf) == nil {
+			requests = append(requests, l.contentRequest(wf))
+		}
+	}
+	// the dr-provision runner is downloaded along with the files, it's
+	// installed later on
+	if url := l.drpcliURL(); !deferred && url != "" {
+		requests = append(requests, downloadRequest{url: url, headers: l.contentHeaders(url)})
+	}
+	// the content is downloaded concurrently beforehand, the files are
+	// written in order
+	if len(requests) > 0 {
+		logger.Debugf("Downloading %d files", len(requests))
+		l.downloads().prefetch(requests)
+	}
+	for _, wf := range files {
+		if err := l.writeFile(wf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		perm, err := strconv.ParseUint(wf.Permissions, 8, 32)
-		if err != nil {
-			return fmt.Errorf("Error reading permissions: %s", err)
+// returns true if the user and group (if any) of an owner, as in
+// user[:group], exist
+func ownerExists(owner string) bool {
+	name, group := owner, ""
+	if i := strings.IndexAny(owner, ":."); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+	isID := func(s string) bool {
+		_, err := strconv.Atoi(s)
+		return err == nil
+	}
+	if name != "" && !isID(name) {
+		if _, err := user.Lookup(name); err != nil {
+			return false
 		}
-		log.Infof("Creating %s", wf.Path)
-		err = os.MkdirAll(filepath.Dir(wf.Path), 0711)
-		if err != nil {
-			return fmt.Errorf("Error creating %s: %s", filepath.Dir(wf.Path), err)
+	}
+	if group != "" && !isID(group) {
+		if _, err := user.LookupGroup(group); err != nil {
+			return false
 		}
-		if wf.Content != "" {
-			data = []byte(wf.Content)
+	}
+	return true
+}
 
-		} else if wf.ContentURL != "" {
-			if data, err = downloadFile(wf.ContentURL, nil); err != nil {
-				return err
+// returns the download of the content-url of a file, with its headers
+func (l *Lift) contentRequest(wf WriteFile) downloadRequest {
+	headers := l.contentHeaders(wf.ContentURL)
+	if len(wf.Headers) > 0 {
+		headers = make(http.Header)
+		for k, v := range l.contentHeaders(wf.ContentURL) {
+			headers[k] = v
+		}
+		for k, v := range wf.Headers {
+			headers.Set(k, v)
+		}
+	}
+	return downloadRequest{url: wf.ContentURL, headers: headers}
+}
+
+// returns the current content of a file that's downloaded, if it is the
+// content to download already (by its sha256 checksum); e.g. when lift runs
+// again after a failure, so the download isn't repeated. Returns nil
+// otherwise.
+func existingContent(wf WriteFile) []byte {
+	if wf.SHA256 == "" || wf.Append || wf.Template || wf.Encoding != "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(wf.Path)
+	if err != nil || verifyChecksum(data, wf.SHA256, wf.MD5) != nil {
+		return nil
+	}
+	return data
+}
+
+// writes a file, with its content given inline or downloaded
+func (l *Lift) writeFile(wf WriteFile) error {
+	var data []byte
+	perm := uint64(0644)
+	var err error
+	if wf.Permissions != "" {
+		if perm, err = strconv.ParseUint(wf.Permissions, 8, 32); err != nil {
+			return fmt.Errorf("Error reading permissions: %s", err)
+		}
+	}
+	logger.Infof("Creating %s", wf.Path)
+	err = os.MkdirAll(filepath.Dir(wf.Path), 0711)
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %s", filepath.Dir(wf.Path), err)
+	}
+	if wf.Content != "" {
+		data = []byte(wf.Content)
+
+	} else if wf.ContentURL != "" {
+		if data = existingContent(wf); data != nil {
+			logger.WithField("url", wf.ContentURL).Debugf("%s is up to date, not downloading it", wf.Path)
+		} else {
+			r := l.contentRequest(wf)
+			if data, err = l.downloads().get(r.url, r.headers); err != nil {
+				return fmt.Errorf("Error downloading %s: %s", wf.ContentURL, err)
+			}
+			if err = verifyChecksum(data, wf.SHA256, wf.MD5); err != nil {
+				return fmt.Errorf("Error verifying %s: %s", wf.ContentURL, err)
 			}
 		}
-		err = ioutil.WriteFile(wf.Path, data, os.FileMode(perm))
+	}
+	if data, err = decodeContent(data, wf.Encoding); err != nil {
+		return fmt.Errorf("Error decoding %s: %s", wf.Path, err)
+	}
+	if wf.Template {
+		content, err := l.renderTemplate(wf.Path, string(data))
 		if err != nil {
-			log.Debugf("error writing file: %s", err)
+			return fmt.Errorf("Error rendering %s: %s", wf.Path, err)
 		}
-		if wf.Owner != "" {
-			cmd := exec.Command("chown", wf.Owner, wf.Path)
-			err = cmd.Run()
-			if err != nil {
-				return err
-			}
+		data = []byte(content)
+	}
+	if wf.Append {
+		err = appendFile(wf.Path, data, os.FileMode(perm))
+	} else {
+		err = ioutil.WriteFile(wf.Path, data, os.FileMode(perm))
+	}
+	if err != nil {
+		logger.Debugf("error writing file: %s", err)
+	}
+	if wf.Owner != "" {
+		cmd := exec.Command("chown", wf.Owner, wf.Path)
+		err = cmd.Run()
+		if err != nil {
+			return err
 		}
 	}
 	return nil
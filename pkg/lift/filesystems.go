@@ -0,0 +1,161 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// creates the subvolumes of a new btrfs filesystem, and mounts the
+// filesystem and its subvolumes with the compression
+func mountBtrfs(device string, fs Filesystem) error {
+	if len(fs.Subvolumes) > 0 {
+		dir, err := ioutil.TempDir("", "lift-btrfs-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dir)
+		if out, err := exec.Command("mount", "-t", "btrfs", device, dir).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error mounting %s: %s: %s", device, err, strings.TrimSpace(string(out)))
+		}
+		for _, sv := range fs.Subvolumes {
+			logger.WithField("device", device).Debugf("Creating btrfs subvolume %s", sv.Name)
+			path := filepath.Join(dir, sv.Name)
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				var out []byte
+				if out, err = exec.Command("btrfs", "subvolume", "create", path).CombinedOutput(); err != nil {
+					err = fmt.Errorf("Error creating btrfs subvolume %s: %s: %s", sv.Name, err, strings.TrimSpace(string(out)))
+				}
+			}
+			if err != nil {
+				_ = exec.Command("umount", dir).Run()
+				return err
+			}
+		}
+		if err = exec.Command("umount", dir).Run(); err != nil {
+			return fmt.Errorf("Error unmounting %s: %s", device, err)
+		}
+	}
+
+	compress := ""
+	if fs.Compress != "" {
+		compress = "compress=" + fs.Compress
+	}
+	source := fstabSource(device)
+	if fs.MountPoint != "" {
+		err := mountFilesystem(Mount{
+			Source:       source,
+			Target:       fs.MountPoint,
+			Type:         "btrfs",
+			MountOptions: strings.Trim(compress+","+fs.MountOptions, ","),
+			Dump:         fs.Dump,
+			Pass:         fs.Pass,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, sv := range fs.Subvolumes {
+		if sv.MountPoint == "" {
+			continue
+		}
+		err := mountFilesystem(Mount{
+			Source:       source,
+			Target:       sv.MountPoint,
+			Type:         "btrfs",
+			MountOptions: strings.Trim("subvol="+sv.Name+","+compress+","+sv.MountOptions, ","),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// creates a zfs pool on the device, unless it exists already, and its
+// datasets; with the zfs kernel module of the running kernel. Pools are
+// imported and their datasets mounted by zfs on boot.
+func createZFSPool(device string, fs Filesystem) error {
+	pkgs := []string{"zfs"}
+	if flavor := kernelFlavor(); flavor != "" {
+		pkgs = append(pkgs, "zfs-"+flavor)
+	}
+	logger.Debugf("Installing %s", strings.Join(pkgs, " "))
+	if err := apkCommand(append([]string{"add", "--no-cache"}, pkgs...)...).Run(); err != nil {
+		return fmt.Errorf("Error installing zfs: %s", err)
+	}
+	if out, err := exec.Command("modprobe", "zfs").CombinedOutput(); err != nil {
+		return fmt.Errorf("Error loading zfs kernel module: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	entry := logger.WithFields(log.Fields{"pool": fs.Pool, "device": device})
+	if exec.Command("zpool", "list", fs.Pool).Run() == nil {
+		entry.Debug("ZFS pool already exists")
+	} else {
+		args := []string{"create"}
+		if fs.MountPoint != "" {
+			args = append(args, "-m", fs.MountPoint)
+		}
+		if fs.Compress != "" {
+			args = append(args, "-O", "compression="+fs.Compress)
+		}
+		entry.Info("Creating ZFS pool")
+		if out, err := exec.Command("zpool", append(args, fs.Pool, device)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error creating zfs pool %s: %s: %s", fs.Pool, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	for _, ds := range fs.Datasets {
+		name := fs.Pool + "/" + ds.Name
+		if exec.Command("zfs", "list", name).Run() == nil {
+			entry.Debugf("ZFS dataset %s already exists", name)
+			continue
+		}
+		props := make(map[string]string, len(ds.Properties)+1)
+		for k, v := range ds.Properties {
+			props[k] = v
+		}
+		if ds.MountPoint != "" {
+			props["mountpoint"] = ds.MountPoint
+		}
+		keys := make([]string, 0, len(props))
+		for k := range props {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		args := []string{"create", "-p"}
+		for _, k := range keys {
+			args = append(args, "-o", k+"="+props[k])
+		}
+		entry.Debugf("Creating ZFS dataset %s", name)
+		if out, err := exec.Command("zfs", append(args, name)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error creating zfs dataset %s: %s: %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	for _, service := range []string{"zfs-import", "zfs-mount"} {
+		if err := exec.Command("rc-update", "add", service, "boot").Run(); err != nil {
+			return fmt.Errorf("Error enabling %s: %s", service, err)
+		}
+	}
+	return nil
+}
+
+// returns the flavor of the running kernel, e.g. lts or virt
+func kernelFlavor() string {
+	out, err := exec.Command("uname", "-r").Output()
+	if err != nil {
+		return ""
+	}
+	release := strings.TrimSpace(string(out))
+	if i := strings.LastIndex(release, "-"); i >= 0 {
+		return release[i+1:]
+	}
+	return ""
+}
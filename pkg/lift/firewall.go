@@ -0,0 +1,252 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	awallPolicyDir = "/etc/awall/optional"
+	nftablesFile   = "/etc/nftables.nft"
+)
+
+var (
+	// the start of a table or chain block of a nftables ruleset
+	nftTableRegex = regexp.MustCompile(`^(?:(?:add|create)\s+)?table\s+(?:(ip|ip6|inet)\s+)?(\S+)\s*\{`)
+	nftChainRegex = regexp.MustCompile(`^chain\s+(\S+)\s*\{`)
+	// a chain added outside of its table block
+	nftAddChainRegex  = regexp.MustCompile(`^(?:add|create)\s+chain\s+(?:(ip|ip6|inet)\s+)?(\S+)\s+(\S+)\s*\{`)
+	nftInputHookRegex = regexp.MustCompile(`\btype\s+filter\s+hook\s+input\b`)
+)
+
+// installs and configures the firewall backend, and enables it
+func (l *Lift) firewallSetup() error {
+	if l.Data.Firewall == nil {
+		return nil
+	}
+	switch backend := l.firewallBackend(); backend {
+	case "awall":
+		return l.awallSetup()
+	case "nftables":
+		return l.nftablesSetup()
+	default:
+		return fmt.Errorf("Unknown firewall backend: %s", backend)
+	}
+}
+
+// returns the firewall backend; awall when awall policies are given, and
+// nftables otherwise
+func (l *Lift) firewallBackend() string {
+	backend := l.Data.Firewall.Backend
+	if backend == "" {
+		backend = "nftables"
+		if len(l.Data.Firewall.Policies) > 0 {
+			backend = "awall"
+		}
+	}
+	return backend
+}
+
+// writes the awall policies, enables and activates them
+func (l *Lift) awallSetup() error {
+	logger.Debug("Installing awall")
+	if err := apkCommand("add", "awall").Run(); err != nil {
+		return fmt.Errorf("Error installing awall: %s", err)
+	}
+	if err := os.MkdirAll(awallPolicyDir, 0755); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(l.Data.Firewall.Policies))
+	for name := range l.Data.Firewall.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// awall reads policies in YAML as well as JSON
+		policy, err := yaml.Marshal(l.Data.Firewall.Policies[name])
+		if err != nil {
+			return fmt.Errorf("Error marshalling awall policy %s: %s", name, err)
+		}
+		policyFile := filepath.Join(awallPolicyDir, name+".yaml")
+		logger.WithField("file", policyFile).Debug("Writing awall policy")
+		if err = ioutil.WriteFile(policyFile, policy, 0644); err != nil {
+			return err
+		}
+		if out, err := exec.Command("awall", "enable", name).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error enabling awall policy %s: %s: %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := awallActivate(); err != nil {
+		return err
+	}
+	for _, service := range []string{"iptables", "ip6tables"} {
+		if err := exec.Command("rc-update", "add", service, defaultRunlevel).Run(); err != nil {
+			logger.Debugf("Error enabling %s: %v", service, err)
+		}
+	}
+	return nil
+}
+
+// activates the enabled awall policies
+func awallActivate() error {
+	// in an alternate root the rules are only generated, and loaded on boot
+	activate := []string{"activate", "-f"}
+	if inAltRoot() {
+		activate = []string{"translate"}
+	}
+	if out, err := exec.Command("awall", activate...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error activating awall: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// writes the nftables ruleset, verifies and loads it
+func (l *Lift) nftablesSetup() error {
+	if l.Data.Firewall.Rules == "" {
+		logger.Debug("No nftables rules configured")
+		return nil
+	}
+	logger.Debug("Installing nftables")
+	if err := apkCommand("add", "nftables").Run(); err != nil {
+		return fmt.Errorf("Error installing nftables: %s", err)
+	}
+	logger.WithField("file", nftablesFile).Debug("Writing nftables ruleset")
+	if err := ioutil.WriteFile(nftablesFile, []byte(l.Data.Firewall.Rules), 0644); err != nil {
+		return err
+	}
+	// checking the ruleset needs the running kernel
+	if !inAltRoot() {
+		if out, err := exec.Command("nft", "-c", "-f", nftablesFile).CombinedOutput(); err != nil {
+			return fmt.Errorf("Invalid nftables ruleset: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := exec.Command("rc-update", "add", "nftables", defaultRunlevel).Run(); err != nil {
+		return fmt.Errorf("Error enabling nftables: %s", err)
+	}
+	return doService("nftables", RESTART)
+}
+
+// opens tcp ports in the firewall set up by lift, if the firewall module
+// runs; as the awall policy name, or as a rule (with name as comment) in
+// the input chain of the nftables ruleset
+func (l *Lift) openFirewallPorts(name, description string, ports []int) error {
+	if l.Data.Firewall == nil || !l.moduleEnabled("firewall") || len(ports) == 0 {
+		return nil
+	}
+	entry := logger.WithFields(log.Fields{"name": name, "ports": ports})
+	switch l.firewallBackend() {
+	case "awall":
+		services := make([]map[string]interface{}, 0, len(ports))
+		for _, port := range ports {
+			services = append(services, map[string]interface{}{"proto": "tcp", "port": port})
+		}
+		policy, err := yaml.Marshal(map[string]interface{}{
+			"description": description,
+			"service":     map[string]interface{}{name: services},
+			"filter":      []map[string]string{{"out": "_fw", "service": name, "action": "accept"}},
+		})
+		if err != nil {
+			return fmt.Errorf("Error marshalling awall policy %s: %s", name, err)
+		}
+		policyFile := filepath.Join(awallPolicyDir, name+".yaml")
+		entry.Debug("Opening ports with awall policy")
+		if err = ioutil.WriteFile(policyFile, policy, 0644); err != nil {
+			return err
+		}
+		if out, err := exec.Command("awall", "enable", name).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error enabling awall policy %s: %s: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		return awallActivate()
+	case "nftables":
+		if l.Data.Firewall.Rules == "" {
+			return nil
+		}
+		rules, err := ioutil.ReadFile(nftablesFile)
+		if err != nil {
+			return err
+		}
+		chain := nftInputChain(string(rules))
+		if chain == "" {
+			entry.Warn("Not opening ports, the nftables ruleset has no input chain")
+			return nil
+		}
+		dports := make([]string, 0, len(ports))
+		for _, port := range ports {
+			dports = append(dports, strconv.Itoa(port))
+		}
+		rule := fmt.Sprintf("insert rule %s tcp dport { %s } accept comment %q\n", chain, strings.Join(dports, ", "), name)
+		if strings.Contains(string(rules), rule) {
+			return nil
+		}
+		if len(rules) > 0 && !bytes.HasSuffix(rules, []byte("\n")) {
+			rules = append(rules, '\n')
+		}
+		entry.Debug("Opening ports in nftables ruleset")
+		if err = ioutil.WriteFile(nftablesFile, append(rules, rule...), 0644); err != nil {
+			return err
+		}
+		if !inAltRoot() {
+			if out, err := exec.Command("nft", "-c", "-f", nftablesFile).CombinedOutput(); err != nil {
+				// keep the ruleset that works
+				if werr := ioutil.WriteFile(nftablesFile, rules, 0644); werr != nil {
+					logger.Warnf("Error restoring %s: %v", nftablesFile, werr)
+				}
+				return fmt.Errorf("Error opening ports in nftables ruleset: %s: %s", err, strings.TrimSpace(string(out)))
+			}
+		}
+		return doService("nftables", RESTART)
+	}
+	return nil
+}
+
+// returns the first chain of a nftables ruleset that filters the input
+// (hooks into input), as "<family> <table> <chain>"; or "" if there's none
+func nftInputChain(rules string) string {
+	var family, table, chain string
+	depth := 0
+	for _, line := range strings.Split(rules, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if m := nftAddChainRegex.FindStringSubmatch(line); m != nil {
+			if nftInputHookRegex.MatchString(line) {
+				return nftChain(m[1], m[2], m[3])
+			}
+		} else if m := nftTableRegex.FindStringSubmatch(line); m != nil && depth == 0 {
+			family, table = m[1], m[2]
+		} else if m := nftChainRegex.FindStringSubmatch(line); m != nil && depth == 1 {
+			chain = m[1]
+		}
+		if chain != "" && nftInputHookRegex.MatchString(line) {
+			return nftChain(family, table, chain)
+		}
+		depth += strings.Count(line, "{") - strings.Count(line, "}")
+		if depth < 2 {
+			chain = ""
+		}
+		if depth < 1 {
+			family, table, depth = "", "", 0
+		}
+	}
+	return ""
+}
+
+// returns the chain as a nft command takes it; the family defaults to ip
+func nftChain(family, table, chain string) string {
+	if family == "" {
+		family = "ip"
+	}
+	return fmt.Sprintf("%s %s %s", family, table, chain)
+}
@@ -0,0 +1,44 @@
+package lift
+
+import "testing"
+
+func TestNftInputChain(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  string
+	}{
+		{
+			"inet filter",
+			"flush ruleset\ntable inet filter {\n\tchain input {\n\t\ttype filter hook input priority 0; policy drop;\n\t}\n}\n",
+			"inet filter input",
+		},
+		{
+			"other names",
+			"table ip fw {\n\tchain fwd {\n\t\ttype filter hook forward priority 0;\n\t}\n\tchain in { # the input\n\t\ttype filter hook input priority 0;\n\t}\n}\n",
+			"ip fw in",
+		},
+		{
+			"added chain",
+			"add table ip6 filter\nadd chain ip6 filter INPUT { type filter hook input priority 0; }\n",
+			"ip6 filter INPUT",
+		},
+		{
+			"regular chain",
+			"table inet filter {\n\tchain input {\n\t\tjump allowed\n\t}\n\tchain output {\n\t\ttype filter hook output priority 0;\n\t}\n}\n",
+			"",
+		},
+		{
+			"comment",
+			"table inet filter {\n\tchain input {\n\t\t# type filter hook input priority 0;\n\t}\n}\n",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nftInputChain(tt.rules); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
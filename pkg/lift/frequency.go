@@ -0,0 +1,109 @@
+package lift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// FrequencyAlways runs a module or command on every run of lift
+	FrequencyAlways = "always"
+	// FrequencyOnce runs a module or command only once per system
+	FrequencyOnce = "once"
+	// FrequencyPerInstance runs a module or command once per instance id
+	FrequencyPerInstance = "per-instance"
+
+	// instance id used when the datasource doesn't provide one
+	defaultInstanceID = "default"
+)
+
+var (
+	// modules that run on every run by default
+	alwaysModules = []string{"bootcmd"}
+)
+
+// returns the frequency of a module; as configured in the `frequency`
+// block, or the default of the module. Commands have their own frequency,
+// so bootcmd and runcmd always run as a whole.
+func (l *Lift) moduleFrequency(name string) string {
+	if name == "bootcmd" || name == "runcmd" {
+		return FrequencyAlways
+	}
+	if f, ok := l.Data.Frequency[name]; ok {
+		return f
+	}
+	if stringInSlice(name, alwaysModules) {
+		return FrequencyAlways
+	}
+	return FrequencyPerInstance
+}
+
+// returns the frequency of a command; its own, else the frequency configured
+// for the section (bootcmd or runcmd), or the default of the section
+func (l *Lift) commandFrequency(section string, c Command) string {
+	if c.Frequency != "" {
+		return c.Frequency
+	}
+	if f, ok := l.Data.Frequency[section]; ok {
+		return f
+	}
+	if stringInSlice(section, alwaysModules) {
+		return FrequencyAlways
+	}
+	return FrequencyPerInstance
+}
+
+// returns a stable name for a command, based on its position in the list
+// and its contents, so the same command given twice runs twice
+func commandName(section string, i int, c Command) string {
+	sum := sha256.Sum256([]byte(strings.Join(c.Cmd, "\x00")))
+	return fmt.Sprintf("%s-%d-%s", section, i, hex.EncodeToString(sum[:6]))
+}
+
+// returns the path of the marker recording that a module or command ran
+// with the given frequency, or an empty string when it always runs. Nothing
+// is recorded in an alternate root, so lift runs again when it boots.
+func (l *Lift) semaphore(name, freq string) string {
+	if inAltRoot() {
+		return ""
+	}
+	switch freq {
+	case FrequencyOnce:
+		return filepath.Join(stateDir, "sem", name+".once")
+	case FrequencyPerInstance:
+		iid := l.Metadata.InstanceID
+		if iid == "" {
+			iid = defaultInstanceID
+		}
+		return filepath.Join(stateDir, "instances", filepath.Base(iid), "sem", name)
+	default:
+		return ""
+	}
+}
+
+// returns true if the module or command already ran
+func (l *Lift) hasRun(name, freq string) bool {
+	sem := l.semaphore(name, freq)
+	if sem == "" {
+		return false
+	}
+	_, err := os.Stat(sem)
+	return err == nil
+}
+
+// records that the module or command ran
+func (l *Lift) markRun(name, freq string) error {
+	sem := l.semaphore(name, freq)
+	if sem == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(sem), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sem, []byte(freq+"\n"), 0644)
+}
@@ -0,0 +1,303 @@
+package lift
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	gceURL          = "http://metadata.google.internal/computeMetadata/v1/"
+	gceWatchTimeout = 60
+	gceUsersFile    = stateDir + "/gce-users"
+
+	gceKeysBegin = "# BEGIN keys managed by lift (GCE metadata)"
+	gceKeysEnd   = "# END keys managed by lift (GCE metadata)"
+)
+
+// fetches alpine-data (the `user-data` attribute) from the Google Compute
+// Engine metadata service. The hostname and the project and instance ssh
+// keys are provided as vendor-data, creating the users of the keys.
+type gceDatasource struct {
+	vendorData []byte
+}
+
+func (d *gceDatasource) Name() string { return "gce" }
+
+func (d *gceDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	if err := requireVendor("Google"); err != nil {
+		return nil, nil, err
+	}
+	meta, _, err := fetchGCEMetadata("", httpClient(imdsTimeout))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	doc := make(map[interface{}]interface{})
+	if meta.Instance.Hostname != "" {
+		setPath(doc, []string{"network", "hostname"}, meta.Instance.Hostname)
+	}
+	var users []interface{}
+	keys := meta.sshKeys()
+	for _, name := range sortedKeys(keys) {
+		var userKeys []interface{}
+		for _, k := range keys[name] {
+			userKeys = append(userKeys, k)
+		}
+		if name == "root" {
+			setPath(doc, []string{"sshd", "authorized_keys"}, userKeys)
+			continue
+		}
+		users = append(users, map[interface{}]interface{}{"name": name, "ssh_authorized_keys": userKeys})
+	}
+	if len(users) > 0 {
+		doc["users"] = users
+	}
+	if d.vendorData, err = yaml.Marshal(doc); err != nil {
+		return nil, nil, err
+	}
+
+	zone := meta.Instance.Zone[strings.LastIndex(meta.Instance.Zone, "/")+1:]
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	return []byte(meta.Instance.Attributes["user-data"]), &InstanceMetadata{
+		InstanceID:       meta.Instance.ID.String(),
+		InstanceType:     meta.Instance.MachineType[strings.LastIndex(meta.Instance.MachineType, "/")+1:],
+		Region:           region,
+		AvailabilityZone: zone,
+		Hostname:         meta.Instance.Hostname,
+	}, nil
+}
+
+// VendorData returns the alpine-data generated from the GCE metadata
+func (d *gceDatasource) VendorData(l *Lift) ([]byte, error) {
+	return d.vendorData, nil
+}
+
+// gceMetadata is the relevant part of the recursive GCE metadata
+type gceMetadata struct {
+	Instance struct {
+		ID          json.Number       `json:"id"`
+		Hostname    string            `json:"hostname"`
+		Zone        string            `json:"zone"`
+		MachineType string            `json:"machineType"`
+		Attributes  map[string]string `json:"attributes"`
+	} `json:"instance"`
+	Project struct {
+		Attributes map[string]string `json:"attributes"`
+	} `json:"project"`
+}
+
+// fetches all GCE metadata. When an etag is given, the request waits until
+// the metadata changes (or the watch times out). The etag of the returned
+// metadata is returned with it.
+func fetchGCEMetadata(etag string, client *http.Client) (*gceMetadata, string, error) {
+	url := gceURL + "?recursive=true&alt=json"
+	if etag != "" {
+		url += fmt.Sprintf("&wait_for_change=true&timeout_sec=%d&last_etag=%s", gceWatchTimeout, etag)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GCE metadata: %s", resp.Status)
+	}
+	meta := &gceMetadata{}
+	if err = json.NewDecoder(resp.Body).Decode(meta); err != nil {
+		return nil, "", fmt.Errorf("Error parsing GCE metadata: %s", err)
+	}
+	return meta, resp.Header.Get("ETag"), nil
+}
+
+// returns the unexpired ssh keys of the instance and (unless blocked) the
+// project, by user
+func (m *gceMetadata) sshKeys() map[string][]string {
+	lines := m.Instance.Attributes["ssh-keys"] + "\n" + m.Instance.Attributes["sshKeys"]
+	if block, _ := strconv.ParseBool(m.Instance.Attributes["block-project-ssh-keys"]); !block {
+		lines += "\n" + m.Project.Attributes["ssh-keys"] + "\n" + m.Project.Attributes["sshKeys"]
+	}
+	keys := make(map[string][]string)
+	for _, line := range strings.Split(lines, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) != 2 || kv[0] == "" || strings.TrimSpace(kv[1]) == "" {
+			continue
+		}
+		name, key := kv[0], strings.TrimSpace(kv[1])
+		if gceKeyExpired(key) {
+			logger.WithField("user", name).Debug("Skipping expired ssh key")
+			continue
+		}
+		if !stringInSlice(key, keys[name]) {
+			keys[name] = append(keys[name], key)
+		}
+	}
+	return keys
+}
+
+// returns true if the key has an expireOn date in the past. Keys added by
+// gcloud have the form `<type> <key> google-ssh {"userName":...,"expireOn":...}`
+func gceKeyExpired(key string) bool {
+	i := strings.Index(key, "google-ssh {")
+	if i < 0 {
+		return false
+	}
+	var info struct {
+		ExpireOn string `json:"expireOn"`
+	}
+	if err := json.Unmarshal([]byte(key[i+len("google-ssh "):]), &info); err != nil || info.ExpireOn == "" {
+		return false
+	}
+	expire, err := time.Parse("2006-01-02T15:04:05-0700", info.ExpireOn)
+	if err != nil {
+		if expire, err = time.Parse(time.RFC3339, info.ExpireOn); err != nil {
+			return false
+		}
+	}
+	return time.Now().After(expire)
+}
+
+// SyncGCEKeys writes the ssh keys from the GCE metadata into the
+// authorized_keys of their users, creating the users that don't exist.
+// Keys are written in a block managed by lift, so other keys are left
+// alone; keys removed from the metadata are removed again. When watch is
+// set, the keys are synced again whenever the metadata changes.
+func SyncGCEKeys(watch bool) error {
+	if err := requireVendor("Google"); err != nil {
+		return err
+	}
+	client := httpClient((gceWatchTimeout + 10) * time.Second)
+	etag := ""
+	for {
+		meta, newEtag, err := fetchGCEMetadata(etag, client)
+		if err != nil {
+			if !watch {
+				return err
+			}
+			logger.Warnf("Error fetching GCE metadata: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if etag == "" || newEtag != etag {
+			if err = syncSSHKeys(meta.sshKeys()); err != nil {
+				if !watch {
+					return err
+				}
+				logger.Warnf("Error syncing ssh keys: %v", err)
+			}
+		}
+		if !watch {
+			return nil
+		}
+		if newEtag == "" {
+			// the metadata service can't be watched without an etag
+			time.Sleep(gceWatchTimeout * time.Second)
+		}
+		etag = newEtag
+	}
+}
+
+// writes the managed keys of all users, and removes the managed keys of
+// users that no longer have keys
+func syncSSHKeys(keys map[string][]string) error {
+	var previous []string
+	if data, err := ioutil.ReadFile(gceUsersFile); err == nil {
+		previous = strings.Fields(string(data))
+	}
+	for _, name := range previous {
+		if _, ok := keys[name]; !ok {
+			if err := writeManagedKeys(name, nil); err != nil {
+				logger.Warnf("Error removing ssh keys of %s: %v", name, err)
+			}
+		}
+	}
+	names := sortedKeys(keys)
+	for _, name := range names {
+		if _, err := user.Lookup(name); err != nil {
+			logger.WithField("user", name).Info("Creating user for GCE ssh keys")
+			if err = createOSUser(User{Name: name}); err != nil {
+				return err
+			}
+		}
+		if err := writeManagedKeys(name, keys[name]); err != nil {
+			return fmt.Errorf("Error writing ssh keys of %s: %s", name, err)
+		}
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(gceUsersFile, []byte(strings.Join(names, "\n")+"\n"), 0644)
+}
+
+// replaces the block of keys managed by lift in the authorized_keys of a user
+func writeManagedKeys(name string, keys []string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	sshDir := filepath.Join(u.HomeDir, ".ssh")
+	path := filepath.Join(sshDir, "authorized_keys")
+
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	managed := false
+	for _, line := range strings.Split(strings.TrimRight(string(existing), "\n"), "\n") {
+		switch {
+		case line == gceKeysBegin:
+			managed = true
+		case line == gceKeysEnd:
+			managed = false
+		case !managed && line != "":
+			lines = append(lines, line)
+		}
+	}
+	if len(keys) > 0 {
+		lines = append(lines, gceKeysBegin)
+		lines = append(lines, keys...)
+		lines = append(lines, gceKeysEnd)
+	}
+
+	if err = os.MkdirAll(sshDir, 0700); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	if err = os.Chown(sshDir, uid, gid); err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// returns the keys of a map in sorted order
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,64 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	hooksDir = "/etc/lift/hooks.d"
+
+	hookPre  = "pre"
+	hookPost = "post"
+)
+
+// runs the executables in hooks.d/<phase>/<module>, in lexical order (like
+// run-parts). The module context is passed in LIFT_* environment variables;
+// post hooks also get the result of the module. An error is returned on the
+// first failing hook.
+func (l *Lift) runHooks(phase, module, freq string, result error) error {
+	dir := filepath.Join(hooksDir, phase, module)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	env := append(os.Environ(),
+		"LIFT_MODULE="+module,
+		"LIFT_PHASE="+phase,
+		"LIFT_FREQUENCY="+freq,
+		"LIFT_INSTANCE_ID="+l.Metadata.InstanceID,
+		"LIFT_DATASOURCE="+l.Metadata.Datasource,
+		"LIFT_HOSTNAME="+l.Metadata.Hostname,
+	)
+	if phase == hookPost {
+		status, msg := "ok", ""
+		if result != nil {
+			status, msg = "failed", result.Error()
+		}
+		env = append(env, "LIFT_STATUS="+status, "LIFT_ERROR="+msg)
+	}
+
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || e.Mode()&0111 == 0 {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		logger.WithField("hook", path).Debug("Executing hook")
+		cmd := exec.Command(path)
+		cmd.Env = env
+		cmd.Stdout = commandOutput()
+		cmd.Stderr = commandOutput()
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Error executing %s hook %s: %s", phase, path, err)
+		}
+	}
+	return nil
+}
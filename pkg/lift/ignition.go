@@ -0,0 +1,475 @@
+package lift
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	openrcInitDir = "/etc/init.d"
+)
+
+// returns true if data is an Ignition v3 config (JSON) or a Butane config
+// (YAML with a variant and version)
+func isIgnition(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(trimmed, []byte("{")) && !bytes.Contains(trimmed, []byte("variant:")) {
+		return false
+	}
+	doc := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(trimmed, &doc); err != nil {
+		return false
+	}
+	if _, ok := doc["variant"].(string); ok {
+		_, ok = doc["version"]
+		return ok
+	}
+	ign, _ := doc["ignition"].(map[interface{}]interface{})
+	version, _ := ign["version"].(string)
+	return strings.HasPrefix(version, "3.")
+}
+
+// converts the supported subset of an Ignition v3 or Butane config into
+// alpine-data: users and groups, files, directories and links, and systemd
+// units, which are mapped to OpenRC services. Units with contents are
+// converted into OpenRC init scripts where feasible. Unsupported parts
+// (e.g. disks and filesystems) are ignored with a warning.
+func fromIgnition(data []byte) ([]byte, error) {
+	raw := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Error parsing Ignition config: %s", err)
+	}
+	// Ignition uses camelCase keys, Butane snake_case
+	cfg := mapValue(snakeCaseKeys(raw))
+
+	doc := make(map[interface{}]interface{})
+	var bootCmds, runCmds, files, services []interface{}
+
+	if c := mapValue(mapValue(cfg["ignition"])["config"]); len(c) > 0 {
+		logger.Warn("Ignoring merged and replaced Ignition configs")
+	}
+	for _, key := range []string{"kernel_arguments", "boot_device"} {
+		if _, ok := cfg[key]; ok {
+			logger.WithField("key", key).Warn("Ignoring unsupported Ignition config key")
+		}
+	}
+
+	passwd := mapValue(cfg["passwd"])
+	var users []interface{}
+	for _, u := range listValue(passwd["users"]) {
+		um := mapValue(u)
+		if um["name"] == "root" {
+			if hash, ok := um["password_hash"]; ok {
+				doc["password"] = hash
+			}
+			if keys := listValue(um["ssh_authorized_keys"]); len(keys) > 0 {
+				setPath(doc, []string{"sshd", "authorized_keys"}, keys)
+			}
+			continue
+		}
+		user := map[interface{}]interface{}{}
+		for from, to := range map[string]string{
+			"name": "name", "password_hash": "passwd", "ssh_authorized_keys": "ssh_authorized_keys",
+			"groups": "groups", "home_dir": "homedir", "shell": "shell", "gecos": "gecos",
+			"no_create_home": "no_create_homedir", "primary_group": "primary_group", "system": "system",
+		} {
+			if v, ok := um[from]; ok {
+				user[to] = v
+			}
+		}
+		if _, ok := um["uid"]; ok {
+			logger.WithField("user", um["name"]).Warn("Ignoring uid of Ignition user")
+		}
+		users = append(users, user)
+	}
+	if len(users) > 0 {
+		doc["users"] = users
+	}
+	var groups []interface{}
+	for _, g := range listValue(passwd["groups"]) {
+		gm := mapValue(g)
+		group := map[interface{}]interface{}{"name": gm["name"]}
+		for _, k := range []string{"gid", "system"} {
+			if v, ok := gm[k]; ok {
+				group[k] = v
+			}
+		}
+		groups = append(groups, group)
+	}
+	if len(groups) > 0 {
+		doc["groups"] = groups
+	}
+
+	storage := mapValue(cfg["storage"])
+	for _, key := range []string{"disks", "raid", "filesystems", "luks", "trees"} {
+		if _, ok := storage[key]; ok {
+			logger.WithField("key", "storage."+key).Warn("Ignoring unsupported Ignition config key")
+		}
+	}
+	for _, f := range listValue(storage["files"]) {
+		fm := mapValue(f)
+		if fm["contents"] != nil || len(listValue(fm["append"])) == 0 {
+			wf, err := ignitionFile(fm, mapValue(fm["contents"]))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, wf)
+		}
+		for _, a := range listValue(fm["append"]) {
+			wf, err := ignitionFile(fm, mapValue(a))
+			if err != nil {
+				return nil, err
+			}
+			wf["append"] = true
+			files = append(files, wf)
+		}
+	}
+	// directories and links are created before anything else, except for
+	// owned directories; their owners don't exist until the users are created
+	for _, d := range listValue(storage["directories"]) {
+		dm := mapValue(d)
+		path, _ := dm["path"].(string)
+		args := []string{"install", "-d"}
+		if mode, ok := dm["mode"].(int); ok {
+			args = append(args, "-m", fmt.Sprintf("%#o", mode))
+		}
+		owner := ignitionOwner(dm)
+		if owner != "" {
+			u := strings.SplitN(owner, ":", 2)
+			if u[0] != "" {
+				args = append(args, "-o", u[0])
+			}
+			if len(u) == 2 {
+				args = append(args, "-g", u[1])
+			}
+		}
+		cmd := strings.Join(args, " ") + " " + shellQuote(path)
+		if owner != "" {
+			runCmds = append(runCmds, cmd)
+		} else {
+			bootCmds = append(bootCmds, cmd)
+		}
+	}
+	for _, ln := range listValue(storage["links"]) {
+		lm := mapValue(ln)
+		path, _ := lm["path"].(string)
+		target, _ := lm["target"].(string)
+		flags := "-sfn"
+		if hard, _ := lm["hard"].(bool); hard {
+			flags = "-f"
+		}
+		bootCmds = append(bootCmds, fmt.Sprintf("mkdir -p %s && ln %s %s %s", shellQuote(filepath.Dir(path)), flags, shellQuote(target), shellQuote(path)))
+	}
+
+	for _, u := range listValue(mapValue(cfg["systemd"])["units"]) {
+		um := mapValue(u)
+		unit, _ := um["name"].(string)
+		name := strings.TrimSuffix(unit, ".service")
+		if name == unit {
+			logger.WithField("unit", unit).Warn("Ignoring systemd unit that isn't a service")
+			continue
+		}
+		if len(listValue(um["dropins"])) > 0 {
+			logger.WithField("unit", unit).Warn("Ignoring drop-ins of systemd unit")
+		}
+		if contents, _ := um["contents"].(string); contents != "" {
+			script, err := openrcScript(unit, contents)
+			if err != nil {
+				logger.WithField("unit", unit).Warnf("Ignoring systemd unit: %v", err)
+				continue
+			}
+			files = append(files, map[interface{}]interface{}{
+				"path":        filepath.Join(openrcInitDir, name),
+				"content":     script,
+				"permissions": "0755",
+			})
+		}
+		if mask, _ := um["mask"].(bool); mask {
+			services = append(services, map[interface{}]interface{}{"name": name, "enabled": false, "state": "stopped"})
+		} else if enabled, ok := um["enabled"].(bool); ok {
+			sv := map[interface{}]interface{}{"name": name, "enabled": enabled}
+			if enabled {
+				sv["state"] = "started"
+			}
+			services = append(services, sv)
+		}
+	}
+
+	if len(bootCmds) > 0 {
+		doc["bootcmd"] = bootCmds
+	}
+	if len(runCmds) > 0 {
+		doc["runcmd"] = runCmds
+	}
+	if len(files) > 0 {
+		doc["write_files"] = files
+	}
+	if len(services) > 0 {
+		doc["services"] = services
+	}
+	return yaml.Marshal(doc)
+}
+
+// converts an Ignition file with the given contents (a source url or, with
+// Butane, inline contents) into an alpine-data file
+func ignitionFile(f, contents map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	path, _ := f["path"].(string)
+	wf := map[interface{}]interface{}{"path": path}
+	if mode, ok := f["mode"].(int); ok {
+		wf["permissions"] = fmt.Sprintf("%#o", mode)
+	}
+	if owner := ignitionOwner(f); owner != "" {
+		// written once the users are created
+		wf["owner"], wf["defer"] = owner, true
+	}
+	compressed := contents["compression"] == "gzip"
+
+	source, _ := contents["source"].(string)
+	switch {
+	case contents["inline"] != nil:
+		wf["content"] = contents["inline"]
+	case strings.HasPrefix(source, "data:"):
+		data, err := decodeDataURL(source)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding contents of %s: %s", path, err)
+		}
+		switch {
+		case compressed:
+			wf["content"], wf["encoding"] = base64.StdEncoding.EncodeToString(data), "gz+b64"
+		case utf8.Valid(data):
+			wf["content"] = string(data)
+		default:
+			wf["content"], wf["encoding"] = base64.StdEncoding.EncodeToString(data), "b64"
+		}
+	case isURL(source):
+		wf["content-url"] = source
+		if compressed {
+			wf["encoding"] = "gz"
+		}
+		headers := map[interface{}]interface{}{}
+		for _, h := range listValue(contents["http_headers"]) {
+			hm := mapValue(h)
+			headers[hm["name"]] = hm["value"]
+		}
+		if len(headers) > 0 {
+			wf["headers"] = headers
+		}
+	case source != "":
+		return nil, fmt.Errorf("unsupported source of %s: %s", path, source)
+	case contents["local"] != nil:
+		return nil, fmt.Errorf("local contents of %s must be embedded with butane --files-dir", path)
+	default:
+		wf["content"] = ""
+	}
+	// only sha256 can be verified
+	if hash, _ := mapValue(contents["verification"])["hash"].(string); strings.HasPrefix(hash, "sha256-") {
+		wf["sha256"] = strings.TrimPrefix(hash, "sha256-")
+	} else if hash != "" {
+		logger.WithField("path", path).Warnf("Ignoring unsupported verification hash %s", hash)
+	}
+	return wf, nil
+}
+
+// returns the owner of an Ignition file or directory as `user:group`
+func ignitionOwner(node map[interface{}]interface{}) string {
+	owner := func(key string) string {
+		m := mapValue(node[key])
+		if name, ok := m["name"]; ok {
+			return fmt.Sprintf("%v", name)
+		}
+		if id, ok := m["id"]; ok {
+			return fmt.Sprintf("%v", id)
+		}
+		return ""
+	}
+	u, g := owner("user"), owner("group")
+	if g != "" {
+		return u + ":" + g
+	}
+	return u
+}
+
+// decodes a data url (RFC 2397), e.g. `data:,hello%20world` or
+// `data:;base64,aGVsbG8=`
+func decodeDataURL(s string) ([]byte, error) {
+	i := strings.Index(s, ",")
+	if i < 0 {
+		return nil, errors.New("invalid data url")
+	}
+	if strings.HasSuffix(s[:i], ";base64") {
+		return base64.StdEncoding.DecodeString(s[i+1:])
+	}
+	data, err := url.PathUnescape(s[i+1:])
+	return []byte(data), err
+}
+
+// openrcService is the data of an OpenRC init script converted from a
+// systemd service unit
+type openrcService struct {
+	Unit        string
+	Description string
+	Directory   string
+	Environment []string
+	Oneshot     bool
+	Commands    []string
+	Command     string
+	Args        string
+	User        string
+	NeedNet     bool
+}
+
+// converts a systemd service unit into an OpenRC init script. Simple (and
+// exec and notify) services are supervised in the background, oneshot
+// services run their commands on start. Other types are not supported.
+func openrcScript(unit, contents string) (string, error) {
+	svc := openrcService{Unit: unit, Description: unit}
+	var execStart []string
+	serviceType := "simple"
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch section + "." + key {
+		case "Unit.Description":
+			svc.Description = strings.Replace(value, `"`, `'`, -1)
+		case "Unit.After", "Unit.Wants", "Unit.Requires":
+			if strings.Contains(value, "network-online.target") || strings.Contains(value, "network.target") {
+				svc.NeedNet = true
+			}
+		case "Service.Type":
+			serviceType = value
+		case "Service.ExecStartPre", "Service.ExecStart":
+			if value = strings.TrimLeft(value, "-@+!:"); value != "" {
+				if key == "ExecStartPre" && serviceType != "oneshot" {
+					return "", errors.New("ExecStartPre is only supported for oneshot services")
+				}
+				execStart = append(execStart, value)
+			}
+		case "Service.User":
+			svc.User = value
+		case "Service.WorkingDirectory":
+			svc.Directory = strings.TrimLeft(value, "-")
+		case "Service.Environment":
+			for _, env := range splitQuoted(value) {
+				if e := strings.SplitN(env, "=", 2); len(e) == 2 {
+					svc.Environment = append(svc.Environment, e[0]+"="+shellQuote(e[1]))
+				}
+			}
+		}
+	}
+	if len(execStart) == 0 {
+		return "", errors.New("no ExecStart")
+	}
+
+	switch serviceType {
+	case "oneshot":
+		svc.Oneshot = true
+		svc.Commands = execStart
+	case "simple", "exec", "notify":
+		if len(execStart) > 1 {
+			return "", errors.New("multiple ExecStart are only supported for oneshot services")
+		}
+		fields := strings.SplitN(execStart[0], " ", 2)
+		svc.Command = fields[0]
+		if len(fields) == 2 {
+			svc.Args = strings.Replace(strings.TrimSpace(fields[1]), `"`, `\"`, -1)
+		}
+	default:
+		return "", fmt.Errorf("unsupported service type %s", serviceType)
+	}
+
+	var script strings.Builder
+	if err := openrcUnit.Execute(&script, svc); err != nil {
+		return "", err
+	}
+	return script.String(), nil
+}
+
+// splits a systemd value into its space separated words, which may be
+// double quoted
+func splitQuoted(s string) []string {
+	var words []string
+	var word strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(r)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// returns a copy of a yaml value, with the camelCase keys of all maps
+// converted to snake_case
+func snakeCaseKeys(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(n))
+		for k, val := range n {
+			if key, ok := k.(string); ok {
+				var b strings.Builder
+				for i, r := range key {
+					if unicode.IsUpper(r) {
+						if i > 0 {
+							b.WriteRune('_')
+						}
+						r = unicode.ToLower(r)
+					}
+					b.WriteRune(r)
+				}
+				k = b.String()
+			}
+			m[k] = snakeCaseKeys(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(n))
+		for i, val := range n {
+			l[i] = snakeCaseKeys(val)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+// returns a yaml value as a map; other values become an empty map
+func mapValue(v interface{}) map[interface{}]interface{} {
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		return m
+	}
+	return map[interface{}]interface{}{}
+}
@@ -0,0 +1,201 @@
+package lift
+
+import (
+	"reflect"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// converts an Ignition or Butane config and decodes the result as
+// alpine-data
+func decodeIgnition(t *testing.T, doc string) *AlpineData {
+	t.Helper()
+	if !isIgnition([]byte(doc)) {
+		t.Fatalf("not detected as Ignition config:\n%s", doc)
+	}
+	data, err := fromIgnition([]byte(doc))
+	if err != nil {
+		t.Fatalf("fromIgnition: %v", err)
+	}
+	ad := &AlpineData{}
+	if err = yaml.UnmarshalStrict(data, ad); err != nil {
+		t.Fatalf("decoding converted alpine-data: %v\n%s", err, data)
+	}
+	return ad
+}
+
+func TestIsIgnition(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"ignition v3", `{"ignition": {"version": "3.3.0"}}`, true},
+		{"ignition v2", `{"ignition": {"version": "2.2.0"}}`, false},
+		{"butane", "variant: fcos\nversion: 1.4.0\n", true},
+		{"butane without version", "variant: fcos\n", false},
+		{"alpine-data", "password: secret\n", false},
+		{"json", `{"password": "secret"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIgnition([]byte(tt.data)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnitionUsers(t *testing.T) {
+	doc := `{
+  "ignition": {"version": "3.3.0"},
+  "passwd": {
+    "users": [
+      {"name": "root", "passwordHash": "$6$root", "sshAuthorizedKeys": ["ssh-ed25519 AAAA root"]},
+      {"name": "core", "sshAuthorizedKeys": ["ssh-ed25519 AAAA core"], "groups": ["wheel"], "homeDir": "/var/home/core", "uid": 1000}
+    ],
+    "groups": [{"name": "ops", "gid": 2000}]
+  }
+}`
+	ad := decodeIgnition(t, doc)
+	if ad.RootPasswd != "$6$root" {
+		t.Errorf("got root password %q", ad.RootPasswd)
+	}
+	if ad.SSHDConfig == nil || !reflect.DeepEqual(ad.SSHDConfig.AuthorizedKeys, []string{"ssh-ed25519 AAAA root"}) {
+		t.Errorf("got sshd %+v", ad.SSHDConfig)
+	}
+	wantUsers := []User{{
+		Name:              "core",
+		HomeDir:           "/var/home/core",
+		Groups:            MultiString{"wheel"},
+		SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA core"},
+	}}
+	if !reflect.DeepEqual(ad.Users, wantUsers) {
+		t.Errorf("got users %+v, want %+v", ad.Users, wantUsers)
+	}
+	wantGroups := GroupList{{Name: "ops", GID: 2000}}
+	if !reflect.DeepEqual(ad.Groups, wantGroups) {
+		t.Errorf("got groups %+v, want %+v", ad.Groups, wantGroups)
+	}
+}
+
+func TestIgnitionFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    []WriteFile
+		wantErr bool
+	}{
+		{
+			"data url",
+			`{"path": "/etc/motd", "mode": 420, "contents": {"source": "data:,hello%20world"}}`,
+			[]WriteFile{{Path: "/etc/motd", Permissions: "0644", Content: "hello world"}},
+			false,
+		},
+		{
+			"base64 data url",
+			`{"path": "/etc/motd", "contents": {"source": "data:;base64,aGVsbG8="}}`,
+			[]WriteFile{{Path: "/etc/motd", Content: "hello"}},
+			false,
+		},
+		{
+			"compressed data url",
+			`{"path": "/etc/motd", "contents": {"source": "data:;base64,aGVsbG8=", "compression": "gzip"}}`,
+			[]WriteFile{{Path: "/etc/motd", Content: "aGVsbG8=", Encoding: "gz+b64"}},
+			false,
+		},
+		{
+			"url with headers and hash",
+			`{"path": "/opt/app", "user": {"name": "core"}, "contents": {"source": "https://example.com/app",
+			  "httpHeaders": [{"name": "Authorization", "value": "Bearer token"}],
+			  "verification": {"hash": "sha256-abc123"}}}`,
+			[]WriteFile{{
+				Path: "/opt/app", Owner: "core", Defer: true, ContentURL: "https://example.com/app",
+				Headers: map[string]string{"Authorization": "Bearer token"}, SHA256: "abc123",
+			}},
+			false,
+		},
+		{
+			"append",
+			`{"path": "/etc/hosts", "append": [{"source": "data:,10.0.0.1%20db%0A"}]}`,
+			[]WriteFile{{Path: "/etc/hosts", Content: "10.0.0.1 db\n", Append: true}},
+			false,
+		},
+		{"unsupported source", `{"path": "/etc/motd", "contents": {"source": "tftp://example.com/motd"}}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := `{"ignition": {"version": "3.3.0"}, "storage": {"files": [` + tt.file + `]}}`
+			if tt.wantErr {
+				if _, err := fromIgnition([]byte(doc)); err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if got := decodeIgnition(t, doc).WriteFiles; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnitionDirectoriesAndLinks(t *testing.T) {
+	doc := `variant: fcos
+version: 1.4.0
+storage:
+  directories:
+    - path: /srv/data
+      mode: 0750
+    - path: /home/core/bin
+      user:
+        name: core
+      group:
+        name: core
+  links:
+    - path: /usr/local/bin/app
+      target: /opt/app/bin/app
+`
+	ad := decodeIgnition(t, doc)
+	commands := func(list []Command) []string {
+		var cmds []string
+		for _, c := range list {
+			cmds = append(cmds, c.Cmd...)
+		}
+		return cmds
+	}
+	wantBoot := []string{
+		"install -d -m 0750 '/srv/data'",
+		"mkdir -p '/usr/local/bin' && ln -sfn '/opt/app/bin/app' '/usr/local/bin/app'",
+	}
+	wantRun := []string{"install -d -o core -g core '/home/core/bin'"}
+	if got := commands(ad.BootCMD); !reflect.DeepEqual(got, wantBoot) {
+		t.Errorf("got bootcmd %q, want %q", got, wantBoot)
+	}
+	if got := commands(ad.RunCMD); !reflect.DeepEqual(got, wantRun) {
+		t.Errorf("got runcmd %q, want %q", got, wantRun)
+	}
+}
+
+func TestIgnitionUnits(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name string
+		unit string
+		want []Service
+	}{
+		{"enabled", `{"name": "docker.service", "enabled": true}`, []Service{{Name: "docker", Enabled: &enabled, State: "started"}}},
+		{"disabled", `{"name": "docker.service", "enabled": false}`, []Service{{Name: "docker", Enabled: &disabled}}},
+		{"masked", `{"name": "docker.service", "mask": true}`, []Service{{Name: "docker", Enabled: &disabled, State: "stopped"}}},
+		{"not a service", `{"name": "docker.socket", "enabled": true}`, nil},
+		{"unchanged", `{"name": "docker.service"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := `{"ignition": {"version": "3.3.0"}, "systemd": {"units": [` + tt.unit + `]}}`
+			if got := decodeIgnition(t, doc).Services; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
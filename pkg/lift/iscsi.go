@@ -0,0 +1,189 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	iscsiInitiatorFile = "/etc/iscsi/initiatorname.iscsi"
+	iscsiSessionsDir   = "/sys/class/iscsi_session"
+	// disks on an iSCSI target are given as iscsi:<target iqn>[/<lun>]
+	iscsiDevicePrefix = "iscsi:"
+	// how long to wait for the devices of the targets, after logging in
+	iscsiDeviceTimeout = 30 * time.Second
+	// the exit code of iscsiadm when the session exists already
+	iscsiErrSessionExists = 15
+)
+
+// returns true if the device of a disk is on an iSCSI target
+func isISCSIDevice(device string) bool {
+	return strings.HasPrefix(device, iscsiDevicePrefix)
+}
+
+// installs open-iscsi, sets the initiator name, logs into the targets (on
+// boot as well), and then sets up the disks on the targets
+func (l *Lift) iscsiSetup() error {
+	ic := l.Data.ISCSI
+	if ic == nil {
+		return nil
+	}
+	logger.Debug("Installing open-iscsi package")
+	if err := apkCommand("add", "--no-cache", "open-iscsi").Run(); err != nil {
+		return fmt.Errorf("Error installing open-iscsi: %s", err)
+	}
+	if err := iscsiInitiatorName(ic.InitiatorName); err != nil {
+		return err
+	}
+	if err := exec.Command("rc-update", "add", "iscsid", defaultRunlevel).Run(); err != nil {
+		return fmt.Errorf("Error enabling iscsid: %s", err)
+	}
+	// the targets are logged into on boot
+	if inAltRoot() {
+		for _, disk := range l.Data.Disks {
+			if isISCSIDevice(disk.Device) {
+				logger.WithField("device", disk.Device).Warn("Not setting up iSCSI disk in an alternate root")
+			}
+		}
+		return nil
+	}
+	if err := doService("iscsid", START); err != nil {
+		return fmt.Errorf("Error starting iscsid: %s", err)
+	}
+	for _, t := range ic.Targets {
+		if err := iscsiLogin(t); err != nil {
+			return err
+		}
+	}
+
+	for i, disk := range l.Data.Disks {
+		if !isISCSIDevice(disk.Device) {
+			continue
+		}
+		dev, err := iscsiDevice(disk.Device)
+		if err != nil {
+			return err
+		}
+		logger.WithField("device", disk.Device).Debugf("Setting up disk %s", dev)
+		disk.Device = dev
+		if err = setupDisk(i, disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes the initiator name; or, without a name, generates one if there is
+// none yet
+func iscsiInitiatorName(name string) error {
+	if name == "" {
+		if _, err := os.Stat(iscsiInitiatorFile); err == nil {
+			return nil
+		}
+		out, err := exec.Command("iscsi-iname").Output()
+		if err != nil {
+			return fmt.Errorf("Error generating iSCSI initiator name: %s", err)
+		}
+		name = strings.TrimSpace(string(out))
+	}
+	logger.WithField("initiator", name).Debugf("Writing %s", iscsiInitiatorFile)
+	if err := os.MkdirAll(filepath.Dir(iscsiInitiatorFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(iscsiInitiatorFile, []byte("InitiatorName="+name+"\n"), 0644)
+}
+
+// adds the node of a target (or, without iqn, discovers the targets of the
+// portal), configures its authentication and logs into it
+func iscsiLogin(t ISCSITarget) error {
+	entry := logger.WithFields(log.Fields{"portal": t.Portal, "iqn": t.IQN})
+	node := []string{"-m", "node", "-p", t.Portal}
+	if t.IQN != "" {
+		node = append(node, "-T", t.IQN)
+		entry.Debug("Adding iSCSI node")
+		if err := iscsiadm(append(node, "-o", "new")...); err != nil {
+			return err
+		}
+	} else {
+		entry.Debug("Discovering iSCSI targets")
+		if err := iscsiadm("-m", "discovery", "-t", "sendtargets", "-p", t.Portal); err != nil {
+			return err
+		}
+	}
+
+	settings := [][2]string{{"node.startup", "automatic"}}
+	if c := t.CHAP; c != nil {
+		settings = append(settings,
+			[2]string{"node.session.auth.authmethod", "CHAP"},
+			[2]string{"node.session.auth.username", c.Username},
+			[2]string{"node.session.auth.password", c.Password},
+		)
+		if c.MutualUsername != "" {
+			settings = append(settings,
+				[2]string{"node.session.auth.username_in", c.MutualUsername},
+				[2]string{"node.session.auth.password_in", c.MutualPassword},
+			)
+		}
+	}
+	for _, s := range settings {
+		if err := iscsiadm(append(node, "-o", "update", "-n", s[0], "-v", s[1])...); err != nil {
+			return fmt.Errorf("Error setting %s: %s", s[0], err)
+		}
+	}
+
+	entry.Info("Logging into iSCSI target")
+	cmd := exec.Command("iscsiadm", append(node, "--login")...)
+	out, err := cmd.CombinedOutput()
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == iscsiErrSessionExists {
+		entry.Debug("Already logged into iSCSI target")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error logging into %s: %s: %s", t.Portal, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runs iscsiadm, returning its output in the error
+func iscsiadm(args ...string) error {
+	if out, err := exec.Command("iscsiadm", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iscsiadm %s: %s: %s", strings.Join(args[:2], " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// returns the block device of a LUN (by default 0) of a target that's
+// logged into, given as iscsi:<target iqn>[/<lun>]; waiting for the device
+// to appear
+func iscsiDevice(device string) (string, error) {
+	iqn := strings.TrimPrefix(device, iscsiDevicePrefix)
+	lun := "0"
+	if i := strings.LastIndex(iqn, "/"); i >= 0 {
+		iqn, lun = iqn[:i], iqn[i+1:]
+	}
+	deadline := time.Now().Add(iscsiDeviceTimeout)
+	for {
+		sessions, _ := filepath.Glob(filepath.Join(iscsiSessionsDir, "session*"))
+		for _, session := range sessions {
+			name, err := ioutil.ReadFile(filepath.Join(session, "targetname"))
+			if err != nil || strings.TrimSpace(string(name)) != iqn {
+				continue
+			}
+			// the SCSI devices of the session are host:channel:target:lun
+			blocks, _ := filepath.Glob(filepath.Join(session, "device", "target*", "*:*:*:"+lun, "block", "*"))
+			if len(blocks) > 0 {
+				return "/dev/" + filepath.Base(blocks[0]), nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no device found for LUN %s of iSCSI target %s", lun, iqn)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,100 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	k3sInstallURL = "https://get.k3s.io"
+	k3sImagesDir  = "/var/lib/rancher/k3s/agent/images"
+)
+
+// installs k3s with the official install script, which also creates and
+// starts the OpenRC service, joining the cluster when a server is given
+func (l *Lift) k3sSetup() error {
+	k := l.Data.K3S
+	if k == nil {
+		return nil
+	}
+	role := k.Role
+	if role == "" {
+		role = "server"
+	}
+	if role != "server" && role != "agent" {
+		return fmt.Errorf("Unknown k3s role: %s", role)
+	}
+	if role == "agent" && (k.Server == "" || k.Token == "") {
+		return fmt.Errorf("k3s agent needs a server and token")
+	}
+
+	if k.AirgapImagesURL != "" {
+		logger.WithField("url", k.AirgapImagesURL).Debug("Downloading k3s airgap images")
+		images, err := downloadFile(k.AirgapImagesURL, nil)
+		if err != nil {
+			return err
+		}
+		if err = verifyChecksum(images, k.AirgapImagesSHA256, ""); err != nil {
+			return fmt.Errorf("Error verifying %s: %s", k.AirgapImagesURL, err)
+		}
+		if err = os.MkdirAll(k3sImagesDir, 0755); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(k3sImagesDir, path.Base(k.AirgapImagesURL)), images, 0644); err != nil {
+			return err
+		}
+	}
+
+	// the script runs as root, so a mirror must be verified
+	installURL := k.InstallURL
+	if installURL == "" {
+		installURL = k3sInstallURL
+	} else if k.InstallSHA256 == "" {
+		return fmt.Errorf("Refusing to run the k3s install script %s without a sha256 checksum", installURL)
+	}
+	logger.WithField("url", installURL).Debug("Downloading k3s install script")
+	script, err := downloadFile(installURL, nil)
+	if err != nil {
+		return err
+	}
+	if err = verifyChecksum(script, k.InstallSHA256, ""); err != nil {
+		return fmt.Errorf("Error verifying %s: %s", installURL, err)
+	}
+	tmpfile, err := ioutil.TempFile("", "lift-k3s-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.Write(script); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	tmpfile.Close()
+
+	cmd := exec.Command("sh", tmpfile.Name())
+	cmd.Env = append(os.Environ(), "INSTALL_K3S_EXEC="+strings.Join(append([]string{role}, k.Args...), " "))
+	if k.Version != "" {
+		cmd.Env = append(cmd.Env, "INSTALL_K3S_VERSION="+k.Version)
+	}
+	if inAltRoot() {
+		cmd.Env = append(cmd.Env, "INSTALL_K3S_SKIP_START=true")
+	}
+	if k.Server != "" {
+		cmd.Env = append(cmd.Env, "K3S_URL="+k.Server)
+	}
+	if k.Token != "" {
+		cmd.Env = append(cmd.Env, "K3S_TOKEN="+k.Token)
+	}
+	logger.WithFields(log.Fields{"role": role, "version": k.Version}).Debug("Installing k3s")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error installing k3s: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package lift
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLogFile is the file lift logs to, besides the console
+	DefaultLogFile = "/var/log/lift.log"
+)
+
+var (
+	// logger is used for all logging, see SetLogger
+	logger = log.StandardLogger()
+
+	// output of executed commands (e.g. setup-disk) is shown on the console,
+	// unless silenced, and written to the log file
+	console io.Writer = os.Stdout
+	logFile *os.File
+)
+
+// fileHook writes all log entries to a file, in its own format
+type fileHook struct {
+	file      io.Writer
+	formatter log.Formatter
+}
+
+func (h *fileHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *fileHook) Fire(entry *log.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.file.Write(line)
+	return err
+}
+
+// SetLogger makes lift log to the given logger, instead of the standard
+// logrus logger. SetupLogging configures the logger that is set.
+func SetLogger(l *log.Logger) {
+	if l == nil {
+		l = log.StandardLogger()
+	}
+	logger = l
+}
+
+// SetupLogging sets the log level (e.g. debug, info, warn) and format (text
+// or json) of the console output, and additionally logs to the given file,
+// unless file is empty.
+func SetupLogging(level, format, file string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(lvl)
+
+	var fileFormatter log.Formatter
+	switch format {
+	case "", "text":
+		fileFormatter = &log.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02T15:04:05.999999999",
+		}
+	case "json":
+		logger.SetFormatter(&log.JSONFormatter{})
+		fileFormatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	if file == "" {
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err == nil {
+		logFile, err = os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	}
+	if err != nil {
+		// not fatal, the console output is still available
+		logger.Warnf("Unable to log to %s: %v", file, err)
+		return nil
+	}
+	logger.AddHook(&fileHook{file: logFile, formatter: fileFormatter})
+	return nil
+}
+
+// SetOutput sets the writer for the console output; both the logging and
+// the output of executed commands
+func SetOutput(w io.Writer) {
+	logger.SetOutput(w)
+	console = w
+}
+
+// silences all console output, the log file is still written
+func silenceConsole() {
+	SetOutput(ioutil.Discard)
+}
+
+// returns the writer for the output of executed commands
+func commandOutput() io.Writer {
+	if logFile == nil {
+		return console
+	}
+	return io.MultiWriter(console, logFile)
+}
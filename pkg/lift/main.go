@@ -1,13 +1,21 @@
 package lift
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
@@ -16,8 +24,77 @@ import (
 // Lift contains all configuration
 type Lift struct {
 	DataURL        string
+	VendorDataURL  string
 	RequestHeaders http.Header
 	Data           *AlpineData
+	Metadata       *InstanceMetadata
+	Datasources    []string
+	Results        []ModuleResult
+	FetchPolicy    FetchPolicy
+	TLS            TLSOptions
+	// Modules, when set, limits provisioning to the named modules (e.g.
+	// users, packages); all modules run otherwise
+	Modules []string
+	// Root, when set, is the root filesystem that is provisioned, instead
+	// of the running system
+	Root string
+	// Offline, when set, provisions without vendor-data, kernel boot
+	// parameter overrides and phoning home
+	Offline bool
+	// Secrets specifies how the secrets referenced by the alpine-data are
+	// resolved
+	Secrets SecretOptions
+	// Signature specifies how the alpine-data is authenticated
+	Signature SignatureOptions
+	// Progress, when set, gets a line for every provisioning step and a
+	// summary, e.g. for the console (see OpenProgress)
+	Progress io.Writer
+	// DHCPOption is the DHCP option with the alpine-data url, for the dhcp
+	// datasource; DefaultDHCPOption if zero
+	DHCPOption int
+	// Version is the version of the running lift (e.g. v0.0.2), so it's
+	// only updated to another version
+	Version string
+	// Strict, when set, provisions like `minimal: true` in the alpine-data:
+	// without defaults, and only the modules with a block in the alpine-data
+	Strict bool
+	// StrictParse, when set, rejects alpine-data (and vendor-data) with
+	// unknown keys; otherwise they are logged as warning
+	StrictParse bool
+
+	ageIdentities  []byte
+	signingKeyData []byte
+	// the passwords generated for root and users (RANDOM), by user
+	passwords map[string]string
+	// the signature of the alpine-data, if read by the datasource
+	dataSignature []byte
+	started       time.Time
+	progress      *progress
+	// downloads the content of files and assets
+	downloader *downloader
+	// guards the results, status file and downloader, as modules can run
+	// in parallel
+	mu sync.Mutex
+}
+
+// FetchPolicy specifies how often, and how long, downloading the alpine-data
+// is retried. Zero values are taken from the kernel boot parameters
+// (alpine-data-retries, alpine-data-backoff and alpine-data-timeout),
+// or the defaults.
+type FetchPolicy struct {
+	Retries int
+	Backoff time.Duration
+	Timeout time.Duration
+}
+
+// ModuleResult contains the outcome of a single provisioning step
+type ModuleResult struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Duration float64   `json:"duration"`
 }
 
 // New returns a new Lift instance with initial configuration
@@ -26,176 +103,473 @@ func New(dataURL string, requestHeaders http.Header) (*Lift, error) {
 		DataURL:        dataURL,
 		RequestHeaders: requestHeaders,
 		Data:           InitAlpineData(),
+		Metadata:       &InstanceMetadata{},
+	}, nil
+}
+
+// NewWithData returns a new Lift instance that provisions the system with
+// the given alpine-data, see Run. Data that isn't based on InitAlpineData
+// lacks its defaults.
+func NewWithData(data *AlpineData) (*Lift, error) {
+	if data == nil {
+		return nil, errors.New("no alpine-data")
+	}
+	return &Lift{
+		Data:     data,
+		Metadata: &InstanceMetadata{},
 	}, nil
 }
 
 // Start contains the main program loop
-func (l *Lift) Start() error {
-	// If alpine-lift-silent kernel boot param is set, silence all logging/output
+func (l *Lift) Start() (err error) {
+	l.started = time.Now()
+	defer func() {
+		if serr := l.writeStatus(err, true); serr != nil {
+			logger.Warnf("Error writing status file: %v", serr)
+		}
+	}()
+
+	// If alpine-lift-silent kernel boot param is set, silence all console logging/output
 	if s, err := getKernelBootParam("alpine-lift-silent"); err == nil && s != "" {
-		log.SetOutput(ioutil.Discard)
-		silent = true
+		silenceConsole()
 	}
 
 	// If alpine-lift-debug-log kernel boot param is set, enable debug logging/output
 	if s, err := getKernelBootParam("alpine-lift-debug-log"); err == nil && s != "" {
-		log.SetLevel(log.DebugLevel)
+		logger.SetLevel(log.DebugLevel)
 	}
 
-	log.Info("Lift starting...")
-	// If url not provided, read it from the kernel boot parameters
-	if l.DataURL == "" {
-		var err error
-		if l.DataURL, err = getKernelBootParam("alpine-data"); err != nil {
-			return err
-		}
-		if l.DataURL == "" {
-			return errors.New("alpine-data URL not set")
-		}
+	logger.Info("Lift starting...")
+	if err = l.TLS.configure(); err != nil {
+		return err
 	}
-	log.WithField("url", l.DataURL).Info("downloading alpine-data file")
-	data, err := downloadFile(l.DataURL, l.RequestHeaders)
-	if err != nil {
+	if err = l.loadRequestHeaders(); err != nil {
 		return err
 	}
 
-	if err = yaml.Unmarshal(data, l.Data); err != nil {
+	data, err := l.fetchAlpineData()
+	if err != nil {
 		return err
 	}
 
-	log.Info("Set root password")
-	if err = l.rootPasswdSetup(); err != nil {
+	if err = l.load(data); err != nil {
 		return err
 	}
 
-	log.Info("Executing setup-disk")
-	if err = l.scratchDiskSetup(); err != nil {
-		return err
+	// Update the lift binary first; it's not part of an alternate root
+	if l.Root == "" {
+		if err = l.selfUpdate(); err != nil {
+			return err
+		}
 	}
 
-	log.Info("Add additional disks")
-	if err = l.diskSetup(); err != nil {
+	if err = l.run(); err != nil {
 		return err
 	}
 
-	if l.Data.Network != nil {
-		log.Info("Setting Hostname")
-		if err = l.setHostname(); err != nil {
+	// Remove lift from the system; it's not part of an alternate root
+	if l.Root == "" {
+		if err = l.unlift(); err != nil {
 			return err
 		}
+	}
 
-		log.Info("Setup Network Interfaces")
-		if err = l.networkSetup(); err != nil {
-			return err
+	logger.Info("Lift successfully completed")
+	return nil
+}
+
+// Apply provisions the system with the given raw alpine-data (in any of
+// the supported formats), instead of fetching it like Start. Unless Offline
+// is set, it's merged with the vendor-data and the overrides in the kernel
+// boot parameters. Like Run, Apply leaves the running binary in place.
+func (l *Lift) Apply(data []byte) (err error) {
+	l.started = time.Now()
+	defer func() {
+		if serr := l.writeStatus(err, true); serr != nil {
+			logger.Warnf("Error writing status file: %v", serr)
 		}
+	}()
 
-		log.Info("Setup DNS")
-		if err = l.dnsSetup(); err != nil {
-			return err
+	logger.Info("Lift applying alpine-data...")
+	if err = l.TLS.configure(); err != nil {
+		return err
+	}
+	if err = l.loadRequestHeaders(); err != nil {
+		return err
+	}
+	if err = l.load(data); err != nil {
+		return err
+	}
+	if err = l.run(); err != nil {
+		return err
+	}
+	logger.Info("Lift successfully completed")
+	return nil
+}
+
+// Run provisions the system with the alpine-data in l.Data, which is not
+// fetched like with Start. It runs the selected Modules (or all modules) on
+// the Root filesystem, if set. Unlike Start, Run leaves the running binary
+// in place.
+func (l *Lift) Run() (err error) {
+	l.started = time.Now()
+	defer func() {
+		if serr := l.writeStatus(err, true); serr != nil {
+			logger.Warnf("Error writing status file: %v", serr)
 		}
+	}()
+	if err = l.run(); err != nil {
+		return err
+	}
+	logger.Info("Lift successfully completed")
+	return nil
+}
 
-		log.Info("Setup Up Network Proxy")
-		if err = l.proxySetup(); err != nil {
+// runs all (selected) modules with the alpine-data in l.Data
+func (l *Lift) run() (err error) {
+	if l.Data == nil {
+		return errors.New("no alpine-data")
+	}
+	if l.Metadata == nil {
+		l.Metadata = &InstanceMetadata{}
+	}
+	// in an alternate root, an interrupted run finishes the running modules
+	// and leaves the root, rather than exiting in it with the filesystems of
+	// the running system still mounted
+	var interrupt chan os.Signal
+	if l.Root != "" {
+		var leave func() error
+		if leave, err = enterRoot(l.Root); err != nil {
 			return err
 		}
+		defer func() {
+			if lerr := leave(); lerr != nil && err == nil {
+				err = lerr
+			}
+		}()
+		interrupt = make(chan os.Signal, 1)
+		signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		defer signal.Stop(interrupt)
+	}
 
-		log.Info("Setup NTP")
-		if err = l.ntpSetup(); err != nil {
-			return err
+	defer func() {
+		// generated passwords are reported once; by phoning home, or else
+		// on the console
+		if l.Offline || l.Data.PhoneHome == nil || l.Data.PhoneHome.URL == "" {
+			l.printPasswords()
+			return
+		}
+		if perr := l.phoneHome(err); perr != nil {
+			logger.Warnf("Error phoning home: %v", perr)
+			l.printPasswords()
+		}
+	}()
+
+	var modules []Module
+	for _, m := range l.orderedModules() {
+		if m.Applies(l) && l.moduleEnabled(m.Name()) {
+			modules = append(modules, m)
 		}
 	}
+	l.progress = &progress{w: l.progressOutput(), total: len(modules)}
+	start := time.Now()
+	defer func() {
+		l.progress.summary(l.Results, err, time.Since(start))
+	}()
 
-	log.Info("Setup APK and Packages")
-	if err = l.setupAPK(); err != nil {
+	if err = l.runModules(modules, l.Data.Modules.Parallel, interrupt); err != nil {
 		return err
 	}
 
-	log.Info("Setup SSHD configuration")
-	if err = l.sshdSetup(); err != nil {
-		return err
+	// Final SSH restart because of added keys etc.
+	if l.Root == "" && l.moduleEnabled("sshd") {
+		_ = doService("sshd", RESTART)
 	}
+	return nil
+}
 
-	log.Info("Creating groups")
-	for _, grp := range l.Data.Groups {
-		cmd := exec.Command("addgroup", grp)
-		log.Infof("Creating group %s", grp)
-		if err = cmd.Run(); err != nil {
-			log.Debugf("Error creating group %s: %v", grp, err)
-		}
+// decodes the raw alpine-data, merges it with the vendor-data (unless
+// offline), includes and overrides, and loads the result into l.Data
+func (l *Lift) load(data []byte) error {
+	if l.Data == nil {
+		l.Data = InitAlpineData()
+	}
+	// nothing is applied unless the alpine-data is authentic
+	signatureURL := l.Signature.SignatureURL
+	if signatureURL == "" {
+		signatureURL, _ = getKernelBootParam("lift.signature_url")
+	}
+	if err := l.verifySignature("alpine-data", data, l.DataURL, signatureURL, l.dataSignature); err != nil {
+		return err
+	}
+	data, err := l.maybeDecryptAge(data)
+	if err != nil {
+		return err
+	}
+	data, scripts, err := decodeAlpineData(data)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(data); err != nil {
+		return fmt.Errorf("Error in alpine-data: %s", err)
+	}
+	if err = l.checkKeys("alpine-data", data); err != nil {
+		return err
 	}
 
-	log.Info("Creating Users")
-	for _, user := range l.Data.Users {
-		log.Infof("Creating user %s", user.Name)
-		if err = createOSUser(user); err != nil {
-			log.Debugf("Error creating user %s: %v", user.Name, err)
+	var vendor []vendorDocument
+	if !l.Offline {
+		if vendor, err = l.fetchVendorData(); err != nil {
+			return err
 		}
 	}
-
-	if l.Data.DRP != nil && l.Data.DRP.InstallRunner {
-		log.Info("Installing dr-provision runner")
-		if err = l.drpSetup(); err != nil {
+	var vendorScripts []Script
+	for i := range vendor {
+		var docScripts []Script
+		vd := &vendor[i]
+		if vd.data, err = l.maybeDecryptAge(vd.data); err != nil {
+			return fmt.Errorf("Error in vendor-data: %s", err)
+		}
+		if vd.data, docScripts, err = decodeAlpineData(vd.data); err != nil {
+			return fmt.Errorf("Error in vendor-data: %s", err)
+		}
+		if err = checkVersion(vd.data); err != nil {
+			return fmt.Errorf("Error in vendor-data: %s", err)
+		}
+		if err = l.checkKeys("vendor-data", vd.data); err != nil {
 			return err
 		}
+		vendorScripts = append(vendorScripts, docScripts...)
 	}
+	scripts = append(vendorScripts, scripts...)
 
-	log.Info("Setup MTA")
-	if err = l.mtaSetup(); err != nil {
+	if data, err = l.mergeAlpineData(vendor, data); err != nil {
+		return err
+	}
+	if data, err = l.resolveSecrets(data); err != nil {
 		return err
 	}
 
-	log.Info("Writing files")
-	if err = l.createFiles(); err != nil {
+	// strict mode has no defaults, so nothing is changed implicitly
+	var minimal struct {
+		Minimal bool `yaml:"minimal"`
+	}
+	_ = yaml.Unmarshal(data, &minimal)
+	if l.Strict || minimal.Minimal {
+		logger.Debug("Strict mode, only running the modules of the alpine-data")
+		l.Data = minimalAlpineData()
+	}
+	if err = yaml.Unmarshal(data, l.Data); err != nil {
 		return err
 	}
 
-	log.Info("Setting MOTD")
-	if err = l.setMOTD(); err != nil {
+	// shell script parts of the alpine-data run after runcmd
+	scriptCmds, err := writeScripts(l.Root, scripts)
+	if err != nil {
 		return err
 	}
+	l.Data.RunCMD = append(l.Data.RunCMD, scriptCmds...)
+	return nil
+}
+
+// warns about the unknown (e.g. misspelled) keys of the document, which
+// are ignored; or, with StrictParse, refuses the document
+func (l *Lift) checkKeys(name string, data []byte) error {
+	unknown := unknownKeys(data)
+	if len(unknown) == 0 {
+		return nil
+	}
+	if l.StrictParse {
+		return fmt.Errorf("Unknown keys in %s: %s", name, strings.Join(unknown, "; "))
+	}
+	for _, u := range unknown {
+		logger.Warnf("Ignoring unknown key in %s: %s", name, u)
+	}
+	return nil
+}
+
+// logs the description of a provisioning step, executes it (with its pre
+// and post hooks) and records its result. Steps that already ran are
+// skipped, according to their frequency.
+func (l *Lift) runModule(name, description string, fn func() error) error {
+	if !l.moduleEnabled(name) {
+		logger.WithField("module", name).Debug("Module not enabled, skipping")
+		return nil
+	}
+	freq := l.moduleFrequency(name)
+	if l.hasRun(name, freq) {
+		logger.WithField("frequency", freq).Infof("%s: already done, skipping", description)
+		l.progress.skip(description)
+		l.record(ModuleResult{Name: description, Status: "skipped"})
+		return nil
+	}
+	logger.Info(description)
+	step := l.progress.start(description)
+	start := time.Now()
+	// hooks are part of the module; when one fails, the module fails
+	err := l.runHooks(hookPre, name, freq, nil)
+	if err == nil {
+		err = fn()
+	}
+	if herr := l.runHooks(hookPost, name, freq, err); herr != nil && err == nil {
+		err = herr
+	}
+	result := ModuleResult{
+		Name:     description,
+		Status:   "ok",
+		Started:  start,
+		Finished: time.Now(),
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+	} else if merr := l.markRun(name, freq); merr != nil {
+		logger.Warnf("Error recording %s as done: %v", name, merr)
+	}
+	l.progress.finish(step, description, err, time.Since(start))
+	l.record(result)
+	return err
+}
 
-	log.Info("Executing post-install commands")
-	for _, c := range l.Data.RunCMD {
-		c = append([]string{"-c"}, c...)
-		cmd := exec.Command("sh", c...)
-		cmd.Env = os.Environ()
-		log.Debugf("exec: sh -c \"%s\"", c[1:])
-		err := cmd.Run()
+// records the result of a module, and updates the status file
+func (l *Lift) record(result ModuleResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Results = append(l.Results, result)
+	if err := l.writeStatus(nil, false); err != nil {
+		logger.Debugf("Error writing status file: %v", err)
+	}
+}
+
+// fetches the raw alpine-data from the selected datasources, or
+// probes the default datasource chain if none were selected
+func (l *Lift) fetchAlpineData() ([]byte, error) {
+	if len(l.Datasources) == 0 {
+		return probeDatasources(l, DefaultDatasources)
+	}
+	return probeDatasources(l, l.Datasources)
+}
+
+// executes the commands in order, subshelled through `sh` (or the
+// command's shell). Returns an error on the first failing command,
+// unless its errors are ignored. Commands that already ran are skipped,
+// according to their frequency.
+func (l *Lift) runCommands(section string, cmds []Command) error {
+	for i, c := range cmds {
+		name := commandName(section, i, c)
+		freq := l.commandFrequency(section, c)
+		if l.hasRun(name, freq) {
+			logger.WithField("frequency", freq).Debugf("Skipping command %q, already done", strings.Join(c.Cmd, " "))
+			continue
+		}
+		err := runCommand(c)
 		if err != nil {
-			log.Debugf("err: %s", err)
+			if !c.IgnoreErrors {
+				return fmt.Errorf("command %q failed: %s", strings.Join(c.Cmd, " "), err)
+			}
+			logger.Debugf("err: %s", err)
+		}
+		if merr := l.markRun(name, freq); merr != nil {
+			logger.Warnf("Error recording command as done: %v", merr)
 		}
 	}
+	return nil
+}
 
-	// Final SSH restart because of added keys etc.
-	_ = doService("sshd", RESTART)
+// executes a single command with its options
+func runCommand(c Command) error {
+	shell := c.Shell
+	if shell == "" {
+		shell = "sh"
+	}
 
-	// Delete the lift binary from the system
-	if l.Data.UnLift {
-		log.Info("Removing lift binary from the system")
-		binPath, err := os.Readlink("/proc/self/exe")
+	ctx := context.Background()
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid timeout: %s", err)
 		}
-		log.WithField("path", binPath).Debug("os.Remove")
-		if err = os.Remove(binPath); err != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	args := append([]string{"-c"}, c.Cmd...)
+	cmd := exec.CommandContext(ctx, shell, args...)
+	cmd.Env = os.Environ()
+	cmd.Dir = c.Cwd
+	for k, v := range c.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	if c.User != "" {
+		u, err := user.Lookup(c.User)
+		if err != nil {
 			return err
 		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+		cmd.Env = append(cmd.Env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+		if cmd.Dir == "" {
+			cmd.Dir = u.HomeDir
+		}
 	}
-
-	log.Info("Lift successfully completed")
-	return nil
+	logger.Debugf("exec: %s -c \"%s\"", shell, c.Cmd)
+	return cmd.Run()
 }
 
 // tries to get the alpine-data parameter from the kernel parameters in /proc/cmdline
 func getKernelBootParam(key string) (string, error) {
+	values, err := getKernelBootParams(key)
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// returns the values of all occurrences of a kernel boot parameter. Values
+// may be double quoted to contain spaces, e.g. key="some value".
+func getKernelBootParams(key string) ([]string, error) {
 	cmdline, err := ioutil.ReadFile("/proc/cmdline")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	for _, a := range strings.Fields(string(cmdline)) {
+	var values []string
+	for _, a := range splitCmdline(string(cmdline)) {
 		if strings.HasPrefix(a, fmt.Sprintf("%s=", key)) {
-			return strings.Split(a, "=")[1], nil
+			values = append(values, strings.SplitN(a, "=", 2)[1])
 		}
 	}
-	return "", nil
+	return values, nil
+}
+
+// splits the kernel command line into parameters, on whitespace outside
+// of double quotes. The quotes are removed.
+func splitCmdline(cmdline string) []string {
+	var params []string
+	var param strings.Builder
+	quoted, inParam := false, false
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inParam = true
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if inParam {
+				params = append(params, param.String())
+				param.Reset()
+				inParam = false
+			}
+		default:
+			param.WriteRune(r)
+			inParam = true
+		}
+	}
+	if inParam {
+		params = append(params, param.String())
+	}
+	return params
 }
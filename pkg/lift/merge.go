@@ -0,0 +1,253 @@
+package lift
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// MergeDeep merges maps recursively and replaces lists; the default
+	MergeDeep = "merge"
+	// MergeReplace replaces a value entirely
+	MergeReplace = "replace"
+	// MergeAppend appends lists, and merges maps recursively
+	MergeAppend = "append"
+	// MergeUniqueAppend appends the list items that aren't present yet, and
+	// merges maps recursively
+	MergeUniqueAppend = "unique-append"
+
+	// key annotating the merge strategy of a map
+	mergeKey        = "x-merge"
+	maxIncludeDepth = 10
+)
+
+// resolves the `include` entries of alpine-data and vendor-data, and returns
+// the merged alpine-data. The vendor-data documents are merged in order, the
+// alpine-data onto the result (if any), and the kernel boot parameter
+// overrides onto that. Included documents are merged in order; later
+// includes take precedence over earlier ones, and the including document
+// takes precedence over all of its includes.
+func (l *Lift) mergeAlpineData(vendor []vendorDocument, data []byte) ([]byte, error) {
+	doc, err := l.resolveIncludes(data, l.DataURL, 0)
+	if err != nil {
+		return nil, err
+	}
+	var base map[interface{}]interface{}
+	for _, vd := range vendor {
+		vdoc, err := l.resolveIncludes(vd.data, vd.source, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Error in vendor-data: %s", err)
+		}
+		if base == nil {
+			base = vdoc
+		} else {
+			base = mergeMaps(base, vdoc, MergeDeep)
+		}
+	}
+	if base != nil {
+		doc = mergeMaps(base, doc, MergeDeep)
+	}
+	var overrides map[interface{}]interface{}
+	if !l.Offline {
+		if overrides, err = cmdlineOverrides(); err != nil {
+			return nil, err
+		}
+	}
+	if len(overrides) > 0 {
+		logger.Info("Applying alpine-data overrides from kernel boot parameters")
+		doc = mergeMaps(doc, overrides, MergeDeep)
+	}
+	stripMergeAnnotations(doc)
+	return yaml.Marshal(doc)
+}
+
+func (l *Lift) resolveIncludes(data []byte, base string, depth int) (map[interface{}]interface{}, error) {
+	data, err := l.maybeDecryptAge(data)
+	if err != nil {
+		return nil, err
+	}
+	if isSops(data) {
+		if data, err = l.decryptSops(data); err != nil {
+			return nil, err
+		}
+	}
+	doc := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	// includes may be of an older version than the including document
+	if err := migrateDocument(base, doc); err != nil {
+		return nil, err
+	}
+	var includes MultiString
+	if inc, ok := doc["include"]; ok {
+		raw, _ := yaml.Marshal(inc)
+		if err := yaml.Unmarshal(raw, &includes); err != nil {
+			return nil, fmt.Errorf("invalid include: %s", err)
+		}
+		delete(doc, "include")
+	}
+	if len(includes) == 0 {
+		return doc, nil
+	}
+	if depth >= maxIncludeDepth {
+		return nil, errors.New("too many nested includes")
+	}
+
+	merged := make(map[interface{}]interface{})
+	for _, inc := range includes {
+		src := resolveReference(base, inc)
+		logger.WithField("include", src).Info("Including alpine-data")
+		incData, err := l.fetchInclude(src)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching include %s: %s", src, err)
+		}
+		incDoc, err := l.resolveIncludes(incData, src, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("Error in include %s: %s", src, err)
+		}
+		merged = mergeMaps(merged, incDoc, MergeDeep)
+	}
+	return mergeMaps(merged, doc, MergeDeep), nil
+}
+
+// resolves an include relative to the url or path of the including document
+func resolveReference(base, ref string) string {
+	if isURL(ref) || filepath.IsAbs(ref) || base == "" {
+		return ref
+	}
+	if isURL(base) {
+		b, err := url.Parse(base)
+		if err != nil {
+			return ref
+		}
+		r, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return b.ResolveReference(r).String()
+	}
+	return filepath.Join(filepath.Dir(base), ref)
+}
+
+// fetches an included document from a url or local file
+func (l *Lift) fetchInclude(src string) ([]byte, error) {
+	if isURL(src) {
+		data, err := l.fetchPolicy().download(src, l.contentHeaders(src))
+		if err != nil {
+			return nil, err
+		}
+		return data, l.verifySignature("include", data, src, "", nil)
+	}
+	return ioutil.ReadFile(src)
+}
+
+// returns true for http(s) urls
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// returns the merge strategy for the keys of a map; as annotated in its
+// `x-merge` key, or the inherited strategy
+func mergeStrategy(m map[interface{}]interface{}, inherited string) func(key interface{}) string {
+	switch a := m[mergeKey].(type) {
+	case string:
+		return func(interface{}) string { return a }
+	case map[interface{}]interface{}:
+		return func(key interface{}) string {
+			if s, ok := a[key].(string); ok {
+				return s
+			}
+			return inherited
+		}
+	}
+	return func(interface{}) string { return inherited }
+}
+
+// deep merges src into dst, and returns the result. By default maps are
+// merged recursively, and other values (including lists) in src replace
+// those in dst. The `x-merge` annotations in src override how its values
+// are merged.
+func mergeMaps(dst, src map[interface{}]interface{}, strategy string) map[interface{}]interface{} {
+	strategyOf := mergeStrategy(src, strategy)
+	result := make(map[interface{}]interface{}, len(dst)+len(src))
+	for k, v := range dst {
+		if k != mergeKey {
+			result[k] = v
+		}
+	}
+	for k, v := range src {
+		if k != mergeKey {
+			result[k] = mergeValues(result[k], v, strategyOf(k))
+		}
+	}
+	return result
+}
+
+// merges value src into dst using the given strategy
+func mergeValues(dst, src interface{}, strategy string) interface{} {
+	switch strategy {
+	case MergeDeep, MergeReplace, MergeAppend, MergeUniqueAppend:
+	default:
+		logger.WithField("strategy", strategy).Warn("Unknown merge strategy, merging")
+		strategy = MergeDeep
+	}
+	if strategy == MergeReplace {
+		return src
+	}
+	switch s := src.(type) {
+	case map[interface{}]interface{}:
+		if d, ok := dst.(map[interface{}]interface{}); ok {
+			return mergeMaps(d, s, strategy)
+		}
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok {
+			break
+		}
+		switch strategy {
+		case MergeAppend:
+			return append(append([]interface{}{}, d...), s...)
+		case MergeUniqueAppend:
+			result := append([]interface{}{}, d...)
+			for _, v := range s {
+				if !containsValue(result, v) {
+					result = append(result, v)
+				}
+			}
+			return result
+		}
+	}
+	return src
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, v := range list {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// removes all `x-merge` annotations from a document
+func stripMergeAnnotations(node interface{}) {
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		delete(n, mergeKey)
+		for _, v := range n {
+			stripMergeAnnotations(v)
+		}
+	case []interface{}:
+		for _, v := range n {
+			stripMergeAnnotations(v)
+		}
+	}
+}
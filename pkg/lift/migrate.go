@@ -0,0 +1,81 @@
+package lift
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// AlpineDataVersion is the version of the alpine-data schema; documents
+	// without a version are version 1
+	AlpineDataVersion = 1
+
+	versionKey = "version"
+)
+
+// a change of the schema; migrate upgrades a parsed document of the
+// previous version
+type migration struct {
+	description string
+	migrate     func(doc map[interface{}]interface{})
+}
+
+// the migrations, in order: migrations[0] upgrades version 1 to 2, etc.
+// AlpineDataVersion is the number of migrations plus one.
+var migrations = []migration{}
+
+// returns the current schema version, the version of the last migration
+func currentVersion() int {
+	return len(migrations) + 1
+}
+
+// returns an error if the version of the document isn't supported. The
+// document itself is migrated once it's parsed, when it's merged.
+func checkVersion(data []byte) error {
+	if isSops(data) {
+		return nil
+	}
+	doc := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// the syntax error is reported when the data is parsed
+		return nil
+	}
+	_, err := documentVersion(doc)
+	return err
+}
+
+// upgrades a parsed document to the current schema, in place
+func migrateDocument(name string, doc map[interface{}]interface{}) error {
+	version, err := documentVersion(doc)
+	if err != nil {
+		return err
+	}
+	if version == currentVersion() {
+		return nil
+	}
+	logger.Infof("Migrating %s from version %d to %d", name, version, currentVersion())
+	for _, m := range migrations[version-1:] {
+		logger.Debugf("Migrating %s: %s", name, m.description)
+		m.migrate(doc)
+	}
+	doc[versionKey] = currentVersion()
+	return nil
+}
+
+// returns the schema version of a document. Documents of a newer version
+// than this lift supports are refused, as they can't be applied correctly.
+func documentVersion(doc map[interface{}]interface{}) (int, error) {
+	v, ok := doc[versionKey]
+	if !ok {
+		return 1, nil
+	}
+	version, ok := v.(int)
+	if !ok || version < 1 {
+		return 0, fmt.Errorf("invalid version %v, must be a positive number", v)
+	}
+	if version > currentVersion() {
+		return 0, fmt.Errorf("version %d is not supported, this lift supports up to version %d", version, currentVersion())
+	}
+	return version, nil
+}
@@ -0,0 +1,100 @@
+package lift
+
+import (
+	"reflect"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMigrateDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    int
+		wantErr bool
+	}{
+		{"no version", "password: secret\n", 0, false},
+		{"current version", "version: 1\n", AlpineDataVersion, false},
+		{"newer version", "version: 2\n", 0, true},
+		{"zero", "version: 0\n", 0, true},
+		{"negative", "version: -1\n", 0, true},
+		{"not a number", "version: latest\n", 0, true},
+		{"decimal", "version: 1.5\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := make(map[interface{}]interface{})
+			if err := yaml.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatalf("yaml.Unmarshal: %v", err)
+			}
+			err := migrateDocument("test", doc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if cerr := checkVersion([]byte(tt.doc)); (cerr != nil) != tt.wantErr {
+				t.Errorf("checkVersion: got error %v, want error %v", cerr, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// documents without a version are left as they are
+			if got, _ := doc[versionKey].(int); got != tt.want {
+				t.Errorf("got version %v, want %d", doc[versionKey], tt.want)
+			}
+		})
+	}
+}
+
+func TestAlpineDataVersion(t *testing.T) {
+	if AlpineDataVersion != currentVersion() {
+		t.Errorf("AlpineDataVersion is %d, but there are migrations up to version %d", AlpineDataVersion, currentVersion())
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = []migration{
+		{"rename passwd to password", func(doc map[interface{}]interface{}) {
+			doc["password"] = doc["passwd"]
+			delete(doc, "passwd")
+		}},
+		{"add the minimal key", func(doc map[interface{}]interface{}) {
+			doc["minimal"] = true
+		}},
+	}
+	tests := []struct {
+		name string
+		doc  map[interface{}]interface{}
+		want map[interface{}]interface{}
+	}{
+		{
+			"version 1",
+			map[interface{}]interface{}{"passwd": "secret"},
+			map[interface{}]interface{}{versionKey: 3, "password": "secret", "minimal": true},
+		},
+		{
+			"version 2",
+			map[interface{}]interface{}{versionKey: 2, "passwd": "secret"},
+			map[interface{}]interface{}{versionKey: 3, "passwd": "secret", "minimal": true},
+		},
+		{
+			"current version",
+			map[interface{}]interface{}{versionKey: 3, "passwd": "secret"},
+			map[interface{}]interface{}{versionKey: 3, "passwd": "secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := migrateDocument("test", tt.doc); err != nil {
+				t.Fatalf("migrateDocument: %v", err)
+			}
+			if !reflect.DeepEqual(tt.doc, tt.want) {
+				t.Errorf("got %v, want %v", tt.doc, tt.want)
+			}
+		})
+	}
+	if _, err := documentVersion(map[interface{}]interface{}{versionKey: 4}); err == nil {
+		t.Error("version 4 is supported")
+	}
+}
@@ -0,0 +1,269 @@
+package lift
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Module is a provisioning step of lift. Modules run in the order in which
+// they are registered, which can be changed in the `modules` block of the
+// alpine-data. With `modules.parallel`, the modules that implement
+// ConcurrentModule run at the same time as the modules they don't depend on.
+type Module interface {
+	// Name returns the name of the module, as used in the `modules` and
+	// `frequency` blocks
+	Name() string
+	// Applies returns true if the module applies to the alpine-data;
+	// modules that don't apply are not run (nor recorded)
+	Applies(l *Lift) bool
+	// Run executes the module
+	Run(l *Lift) error
+}
+
+// DescribedModule is implemented by modules that have a description,
+// which is logged and recorded instead of their name
+type DescribedModule interface {
+	Description() string
+}
+
+// ConcurrentModule is implemented by modules that can run at the same time
+// as other modules, once the modules they depend on are done. Modules that
+// don't implement it, or aren't Concurrent, run on their own: after all
+// modules before them, and before all modules after them.
+type ConcurrentModule interface {
+	// Concurrent returns true if the module can run concurrently
+	Concurrent() bool
+	// After returns the names of the modules that must be done before the
+	// module starts
+	After() []string
+}
+
+// builtinModule is a module of lift itself
+type builtinModule struct {
+	name        string
+	description string
+	applies     func(l *Lift) bool
+	run         func(l *Lift) error
+	// the modules it depends on
+	after []string
+	// runs on its own, e.g. as it runs arbitrary commands, or changes what
+	// the other modules depend on (like the proxy environment, or the apk
+	// world, which the modules installing packages add to)
+	serial bool
+}
+
+func (m *builtinModule) Name() string        { return m.name }
+func (m *builtinModule) Description() string { return m.description }
+func (m *builtinModule) Run(l *Lift) error   { return m.run(l) }
+func (m *builtinModule) Concurrent() bool    { return !m.serial }
+func (m *builtinModule) After() []string     { return m.after }
+
+func (m *builtinModule) Applies(l *Lift) bool {
+	return m.applies == nil || m.applies(l)
+}
+
+// returns true if the alpine-data has network settings
+func hasNetwork(l *Lift) bool {
+	return l.Data.Network != nil
+}
+
+// the blocks of the alpine-data that configure a module, if that's not (only)
+// the block with the name of the module; nested blocks are separated by dots
+var moduleBlocks = map[string][]string{
+	"password":             {"password", "root"},
+	"hostname":             {"network.hostname", "network.fqdn", "network.manage_etc_hosts", "network.hosts"},
+	"interfaces":           {"network.interfaces"},
+	"dns":                  {"network.resolv_conf"},
+	"proxy":                {"network.proxy"},
+	"ntp":                  {"network.ntp"},
+	"user_files":           {"users"},
+	"user_ssh_keys":        {"users"},
+	"write_files_deferred": {"write_files"},
+	"test_mail":            {"mta"},
+}
+
+// registeredModules are all modules, in the order in which they run
+var registeredModules = []Module{
+	&builtinModule{name: "bootcmd", description: "Executing early boot commands", serial: true, run: func(l *Lift) error { return l.runCommands("bootcmd", l.Data.BootCMD) }},
+	&builtinModule{name: "ca_certs", description: "Installing CA certificates", serial: true, run: (*Lift).caCertsSetup},
+	&builtinModule{name: "password", description: "Set root password", run: (*Lift).rootPasswdSetup},
+	&builtinModule{name: "resize_rootfs", description: "Resize root filesystem", applies: isLive, run: (*Lift).resizeRootFS},
+	&builtinModule{name: "scratch_disk", description: "Executing setup-disk", applies: isLive, after: []string{"resize_rootfs"}, run: (*Lift).scratchDiskSetup},
+	&builtinModule{name: "raid", description: "Setup RAID arrays", applies: isLive, after: []string{"scratch_disk"}, run: (*Lift).raidSetup},
+	&builtinModule{name: "disks", description: "Add additional disks", applies: isLive, after: []string{"raid"}, run: (*Lift).diskSetup},
+	&builtinModule{name: "modules", description: "Setup kernel modules", run: (*Lift).modulesSetup},
+	&builtinModule{name: "sysctl", description: "Setup kernel parameters", after: []string{"modules"}, run: (*Lift).sysctlSetup},
+	&builtinModule{name: "hostname", description: "Setting Hostname", applies: hasNetwork, run: (*Lift).setHostname},
+	&builtinModule{name: "interfaces", description: "Setup Network Interfaces", applies: hasNetwork, after: []string{"hostname", "sysctl"}, run: (*Lift).networkSetup},
+	&builtinModule{name: "dns", description: "Setup DNS", applies: hasNetwork, after: []string{"interfaces"}, run: (*Lift).dnsSetup},
+	&builtinModule{name: "proxy", description: "Setup Up Network Proxy", applies: hasNetwork, after: []string{"dns", "ca_certs"}, serial: true, run: (*Lift).proxySetup},
+	&builtinModule{name: "ntp", description: "Setup NTP", applies: hasNetwork, after: []string{"proxy"}, run: (*Lift).ntpSetup},
+	&builtinModule{name: "syslog", description: "Setup syslog", after: []string{"proxy"}, run: (*Lift).syslogSetup},
+	&builtinModule{name: "iscsi", description: "Setup iSCSI targets", applies: func(l *Lift) bool { return l.Data.ISCSI != nil }, after: []string{"disks", "proxy"}, run: (*Lift).iscsiSetup},
+	&builtinModule{name: "lvm", description: "Setup LVM volumes", applies: isLive, after: []string{"disks", "iscsi"}, run: (*Lift).lvmSetup},
+	&builtinModule{name: "swap", description: "Setup swap", after: []string{"lvm"}, run: (*Lift).swapSetup},
+	&builtinModule{name: "mounts", description: "Add additional mounts", after: []string{"swap"}, run: (*Lift).mountsSetup},
+	&builtinModule{name: "nfs", description: "Mounting NFS exports", after: []string{"mounts", "proxy"}, run: (*Lift).nfsSetup},
+	&builtinModule{name: "write_files", description: "Writing files", after: []string{"mounts", "proxy"}, run: func(l *Lift) error { return l.createFiles(false) }},
+	&builtinModule{name: "packages", description: "Setup APK and Packages", after: []string{"mounts", "proxy"}, serial: true, run: (*Lift).setupAPK},
+	&builtinModule{name: "timezone", description: "Setup timezone", after: []string{"packages"}, run: (*Lift).timezoneSetup},
+	&builtinModule{name: "locale", description: "Setup locale", after: []string{"packages"}, run: (*Lift).localeSetup},
+	&builtinModule{name: "keymap", description: "Setup keymap", after: []string{"packages"}, run: (*Lift).keymapSetup},
+	&builtinModule{name: "consolefont", description: "Setup console font", after: []string{"packages"}, run: (*Lift).consoleFontSetup},
+	&builtinModule{name: "wireguard", description: "Setup WireGuard", after: []string{"packages"}, run: (*Lift).wireguardSetup},
+	&builtinModule{name: "firewall", description: "Setup firewall", after: []string{"wireguard"}, run: (*Lift).firewallSetup},
+	&builtinModule{name: "ssh_keys", description: "Setup SSH host keys", after: []string{"packages"}, run: (*Lift).sshHostKeysSetup},
+	&builtinModule{name: "sshd", description: "Setup SSHD configuration", after: []string{"ssh_keys"}, run: (*Lift).sshdSetup},
+	&builtinModule{name: "groups", description: "Creating groups", after: []string{"packages", "password"}, run: (*Lift).groupsSetup},
+	&builtinModule{name: "users", description: "Creating Users", after: []string{"groups"}, run: (*Lift).usersSetup},
+	&builtinModule{name: "doas", description: "Setup doas", after: []string{"users"}, run: (*Lift).doasSetup},
+	&builtinModule{name: "user_files", description: "Writing user files", after: []string{"users"}, run: (*Lift).userFilesSetup},
+	&builtinModule{name: "user_ssh_keys", description: "Generating user SSH keys", after: []string{"users"}, run: (*Lift).userSSHKeysSetup},
+	&builtinModule{name: "docker", description: "Setup docker", after: []string{"users", "firewall"}, run: (*Lift).dockerSetup},
+	&builtinModule{name: "k3s", description: "Setup k3s", after: []string{"docker"}, run: (*Lift).k3sSetup},
+	&builtinModule{name: "dr_provision", description: "Installing dr-provision runner", applies: func(l *Lift) bool { return l.Data.DRP.configured() }, after: []string{"packages", "firewall"}, run: (*Lift).drpSetup},
+	&builtinModule{name: "agents", description: "Installing agents", after: []string{"users", "firewall"}, run: (*Lift).agentsSetup},
+	&builtinModule{name: "monitoring", description: "Setup monitoring", after: []string{"packages", "firewall", "docker"}, run: (*Lift).monitoringSetup},
+	&builtinModule{name: "certificates", description: "Installing certificates", after: []string{"users"}, run: (*Lift).certificatesSetup},
+	&builtinModule{name: "acme", description: "Obtaining ACME certificate", after: []string{"packages", "firewall"}, run: (*Lift).acmeSetup},
+	&builtinModule{name: "mta", description: "Setup MTA", after: []string{"packages"}, run: (*Lift).mtaSetup},
+	&builtinModule{name: "write_files_deferred", description: "Writing deferred files", serial: true, run: func(l *Lift) error { return l.createFiles(true) }},
+	&builtinModule{name: "motd", description: "Setting MOTD", run: (*Lift).setMOTD},
+	&builtinModule{name: "cron", description: "Setup cron jobs", run: (*Lift).cronSetup},
+	&builtinModule{name: "services", description: "Setup services", run: (*Lift).servicesSetup},
+	&builtinModule{name: "runcmd", description: "Executing post-install commands", serial: true, run: func(l *Lift) error { return l.runCommands("runcmd", l.Data.RunCMD) }},
+	&builtinModule{name: "test_mail", description: "Sending test mail", applies: func(l *Lift) bool { return isLive(l) && l.Data.MTA != nil && l.Data.MTA.TestMail != "" }, after: []string{"mta"}, serial: true, run: (*Lift).sendTestMail},
+}
+
+// RegisterModule adds a module, to run after the named module; or after
+// all modules if after is empty. Module names must be unique.
+func RegisterModule(m Module, after string) error {
+	pos := -1
+	if after == "" {
+		pos = len(registeredModules)
+	}
+	for i, rm := range registeredModules {
+		if rm.Name() == m.Name() {
+			return fmt.Errorf("module %s is already registered", m.Name())
+		}
+		if rm.Name() == after {
+			pos = i + 1
+		}
+	}
+	if pos < 0 {
+		return fmt.Errorf("unknown module %s", after)
+	}
+	registeredModules = append(registeredModules[:pos], append([]Module{m}, registeredModules[pos:]...)...)
+	return nil
+}
+
+// ModuleNames returns the names of all registered modules, in the order in
+// which they run by default
+func ModuleNames() []string {
+	names := make([]string, 0, len(registeredModules))
+	for _, m := range registeredModules {
+		names = append(names, m.Name())
+	}
+	return names
+}
+
+// returns the registered module with the name, or nil
+func findModule(name string) Module {
+	for _, m := range registeredModules {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// returns the description of a module, or its name
+func moduleDescription(m Module) string {
+	if dm, ok := m.(DescribedModule); ok && dm.Description() != "" {
+		return dm.Description()
+	}
+	return m.Name()
+}
+
+// returns the modules in the order in which they run; the modules listed
+// in `modules.order` run in that order, taking the positions these modules
+// have by default
+func (l *Lift) orderedModules() []Module {
+	modules := make([]Module, len(registeredModules))
+	copy(modules, registeredModules)
+
+	var ordered []Module
+	for _, name := range l.Data.Modules.Order {
+		for _, m := range modules {
+			if m.Name() == name {
+				ordered = append(ordered, m)
+				break
+			}
+		}
+	}
+	for i, m := range modules {
+		if len(ordered) > 0 && stringInSlice(m.Name(), l.Data.Modules.Order) {
+			modules[i], ordered = ordered[0], ordered[1:]
+		}
+	}
+	return modules
+}
+
+// returns true if the module is selected to run; by the Modules of the
+// Lift and the `modules` block of the alpine-data
+func (l *Lift) moduleEnabled(name string) bool {
+	if len(l.Modules) > 0 && !stringInSlice(name, l.Modules) {
+		return false
+	}
+	if (l.Strict || l.Data.Minimal) && !l.moduleConfigured(name) {
+		return false
+	}
+	if len(l.Data.Modules.Enable) > 0 && !stringInSlice(name, l.Data.Modules.Enable) {
+		return false
+	}
+	return !stringInSlice(name, l.Data.Modules.Disable)
+}
+
+// returns true if the alpine-data has a (non-empty) block of the module.
+// Modules that have no block, e.g. registered by programs, are always
+// configured.
+func (l *Lift) moduleConfigured(name string) bool {
+	blocks, ok := moduleBlocks[name]
+	if !ok {
+		blocks = []string{name}
+	}
+	known := false
+	for _, block := range blocks {
+		f, ok := blockValue(reflect.ValueOf(l.Data), strings.Split(block, "."))
+		known = known || ok
+		if ok && !f.IsZero() {
+			return true
+		}
+	}
+	return !known
+}
+
+// returns the value of a (nested) block of a struct, by the yaml keys of
+// the path to it. A block in a nil block is zero.
+func blockValue(v reflect.Value, path []string) (reflect.Value, bool) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v = reflect.Zero(v.Type().Elem())
+		} else {
+			v = v.Elem()
+		}
+	}
+	if len(path) == 0 {
+		return v, true
+	}
+	if v.Kind() != reflect.Struct {
+		return v, false
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] == path[0] {
+			return blockValue(v.Field(i), path[1:])
+		}
+	}
+	return v, false
+}
@@ -0,0 +1,35 @@
+package lift
+
+import "testing"
+
+func TestModuleConfigured(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   *AlpineData
+		module string
+		want   bool
+	}{
+		{"hostname", &AlpineData{Network: &NetworkSettings{HostName: "web1"}}, "hostname", true},
+		{"hostname only", &AlpineData{Network: &NetworkSettings{HostName: "web1"}}, "interfaces", false},
+		{"hostname only, dns", &AlpineData{Network: &NetworkSettings{HostName: "web1"}}, "dns", false},
+		{"hostname only, ntp", &AlpineData{Network: &NetworkSettings{HostName: "web1"}}, "ntp", false},
+		{"hostname only, proxy", &AlpineData{Network: &NetworkSettings{HostName: "web1"}}, "proxy", false},
+		{"hosts", &AlpineData{Network: &NetworkSettings{ManageEtcHosts: true}}, "hostname", true},
+		{"interfaces", &AlpineData{Network: &NetworkSettings{InterfaceOpts: NetworkInterfaces{Raw: "auto lo"}}}, "interfaces", true},
+		{"empty resolv_conf", &AlpineData{Network: &NetworkSettings{ResolvConf: &ResolvConfiguration{}}}, "dns", false},
+		{"proxy", &AlpineData{Network: &NetworkSettings{Proxy: ProxyConfig{HTTP: "http://proxy:3128"}}}, "proxy", true},
+		{"no network", &AlpineData{}, "hostname", false},
+		{"root password", &AlpineData{RootPasswd: "secret"}, "password", true},
+		{"users", &AlpineData{Users: []User{{Name: "deploy"}}}, "user_files", true},
+		{"no users", &AlpineData{}, "users", false},
+		{"registered module", &AlpineData{}, "program", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Lift{Data: tt.data}
+			if got := l.moduleConfigured(tt.module); got != tt.want {
+				t.Errorf("moduleConfigured(%q) = %v, want %v", tt.module, got, tt.want)
+			}
+		})
+	}
+}
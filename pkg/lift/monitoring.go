@@ -0,0 +1,85 @@
+package lift
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	nodeExporterConfFile = "/etc/conf.d/node-exporter"
+	cadvisorBin          = "/usr/bin/cadvisor"
+	// the ports the exporters listen on, by default
+	defaultNodeExporterPort = 9100
+	defaultCAdvisorPort     = 8080
+)
+
+// installs node_exporter, and cadvisor when enabled, as agents (from the
+// packages), and opens their ports in the firewall
+func (l *Lift) monitoringSetup() error {
+	mc := l.Data.Monitoring
+	if mc == nil {
+		return nil
+	}
+	port := mc.Port
+	if port == 0 {
+		port = defaultNodeExporterPort
+	}
+	args := []string{"--web.listen-address=" + net.JoinHostPort(mc.ListenAddress, strconv.Itoa(port))}
+	for _, c := range mc.Collectors {
+		args = append(args, "--collector."+c)
+	}
+	for _, c := range mc.DisabledCollectors {
+		args = append(args, "--no-collector."+c)
+	}
+	// the service of the package reads its arguments from its conf.d file
+	agents := []Agent{{
+		Name:     "node-exporter",
+		Packages: []string{"prometheus-node-exporter"},
+		Config: []WriteFile{{
+			Path:    nodeExporterConfFile,
+			Content: fmt.Sprintf("# generated by lift\nARGS=%s\n", shellQuote(strings.Join(args, " "))),
+		}},
+		Service: AgentService{Enabled: true},
+	}}
+	var ports []int
+	if !isLoopback(mc.ListenAddress) {
+		ports = append(ports, port)
+	}
+
+	if ca := mc.CAdvisor; ca.Enabled {
+		caPort := ca.Port
+		if caPort == 0 {
+			caPort = defaultCAdvisorPort
+		}
+		caArgs := fmt.Sprintf("-port=%d", caPort)
+		if ca.ListenAddress != "" {
+			caArgs = fmt.Sprintf("-listen_ip=%s %s", ca.ListenAddress, caArgs)
+		}
+		agents = append(agents, Agent{
+			Name:     "cadvisor",
+			Packages: []string{"cadvisor"},
+			Service:  AgentService{Enabled: true, Command: cadvisorBin, Args: caArgs},
+		})
+		if !isLoopback(ca.ListenAddress) {
+			ports = append(ports, caPort)
+		}
+	}
+
+	for _, a := range agents {
+		if err := l.agentSetup(a); err != nil {
+			return fmt.Errorf("Error installing %s: %s", a.Name, err)
+		}
+	}
+	if mc.OpenFirewall != nil && !*mc.OpenFirewall {
+		return nil
+	}
+	return l.openFirewallPorts("lift-monitoring", "Prometheus exporters", ports)
+}
+
+// returns true if an address only accepts local connections
+func isLoopback(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
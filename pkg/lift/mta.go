@@ -0,0 +1,222 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ssmtpConfFile = "/etc/ssmtp/ssmtp.conf"
+	msmtpConfFile = "/etc/msmtprc"
+	aliasesFile   = "/etc/aliases"
+	sendmailFile  = "/usr/sbin/sendmail"
+	// the group that may read the password of the mail server
+	mailGroup = "mail"
+)
+
+// the data of the msmtp and busybox sendmail templates
+type mtaData struct {
+	*MTAConfiguration
+	HostName string
+	Host     string
+	Port     string
+	Aliases  []mailAlias
+}
+
+// a local name, and the addresses its mail is forwarded to
+type mailAlias struct {
+	Name       string
+	Recipients []string
+}
+
+// mtaSetup installs and configures the MTA backend: ssmtp, msmtp or busybox
+// sendmail
+func (l *Lift) mtaSetup() error {
+	if l.Data.MTA == nil {
+		logger.Debug("No MTA configured")
+		return nil
+	}
+	switch l.Data.MTA.Backend {
+	case "", "ssmtp":
+		return l.ssmtpSetup()
+	case "msmtp":
+		return l.msmtpSetup()
+	case "busybox":
+		return l.busyboxSendmailSetup()
+	}
+	return fmt.Errorf("Unknown MTA backend: %s", l.Data.MTA.Backend)
+}
+
+// installs and configures ssmtp
+func (l *Lift) ssmtpSetup() error {
+	logger.Debug("apk add ssmtp")
+	cmd := apkCommand("add", "ssmtp")
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	logger.Debug("Generating ssmtp.conf")
+	ssmtp, err := generateFileFromTemplate(*ssmtpConf, l.Data)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("Copying ssmtp.conf to %s", ssmtpConfFile)
+	cmd = exec.Command("mv", ssmtp, ssmtpConfFile)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// installs and configures msmtp, with the aliases in /etc/aliases, and
+// links sendmail to it
+func (l *Lift) msmtpSetup() error {
+	logger.Debug("apk add msmtp")
+	if err := apkCommand("add", "msmtp").Run(); err != nil {
+		return fmt.Errorf("Error installing msmtp: %s", err)
+	}
+
+	logger.Debug("Generating msmtprc")
+	conf, err := generateFileFromTemplate(*msmtpConf, l.mtaData())
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Copying msmtprc to %s", msmtpConfFile)
+	if err = exec.Command("mv", conf, msmtpConfFile).Run(); err != nil {
+		return err
+	}
+	if err = mailFilePerm(msmtpConfFile, 0644, l.Data.MTA.Password != ""); err != nil {
+		return err
+	}
+
+	if err = writeAliases(mailAliases(l.Data.MTA)); err != nil {
+		return err
+	}
+	return linkSendmail("/usr/bin/msmtp")
+}
+
+// installs a sendmail script that sends mail with the sendmail applet of
+// busybox, which has no configuration file of its own
+func (l *Lift) busyboxSendmailSetup() error {
+	// busybox connects with TLS through openssl
+	if l.Data.MTA.UseTLS || l.Data.MTA.UseSTARTTLS {
+		logger.Debug("apk add openssl")
+		if err := apkCommand("add", "openssl").Run(); err != nil {
+			return fmt.Errorf("Error installing openssl: %s", err)
+		}
+	}
+
+	if err := writeAliases(mailAliases(l.Data.MTA)); err != nil {
+		return err
+	}
+	logger.Debug("Generating sendmail script")
+	script, err := generateFileFromTemplate(*busyboxSendmail, l.mtaData())
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(sendmailFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logger.Debugf("Copying sendmail script to %s", sendmailFile)
+	if err = exec.Command("mv", script, sendmailFile).Run(); err != nil {
+		return err
+	}
+	return mailFilePerm(sendmailFile, 0755, l.Data.MTA.Password != "")
+}
+
+// sets the permissions of a file of the MTA, which every user needs to send
+// mail. When it contains the password of the server, it's only readable by
+// root and the mail group instead.
+func mailFilePerm(path string, perm os.FileMode, secret bool) error {
+	if !secret {
+		return os.Chmod(path, perm)
+	}
+	g, err := user.LookupGroup(mailGroup)
+	if err != nil {
+		return fmt.Errorf("Error looking up group %s: %s", mailGroup, err)
+	}
+	gid, _ := strconv.Atoi(g.Gid)
+	if err = os.Chown(path, 0, gid); err != nil {
+		return fmt.Errorf("Error changing group of %s: %s", path, err)
+	}
+	return os.Chmod(path, perm&^0007)
+}
+
+// returns the aliases, sorted by name, including the root alias
+func mailAliases(mc *MTAConfiguration) []mailAlias {
+	var aliases []mailAlias
+	if _, ok := mc.Aliases["root"]; !ok && mc.Root != "" {
+		aliases = append(aliases, mailAlias{Name: "root", Recipients: []string{mc.Root}})
+	}
+	for name, recipients := range mc.Aliases {
+		aliases = append(aliases, mailAlias{Name: name, Recipients: recipients})
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Name < aliases[j].Name })
+	return aliases
+}
+
+// writes the aliases to /etc/aliases; without aliases only when there is no
+// such file yet, since msmtp fails without it
+func writeAliases(aliases []mailAlias) error {
+	if _, err := os.Stat(aliasesFile); len(aliases) == 0 && err == nil {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("# generated by lift\n")
+	for _, a := range aliases {
+		fmt.Fprintf(&b, "%s: %s\n", a.Name, strings.Join(a.Recipients, ", "))
+	}
+	logger.Debugf("Writing %s", aliasesFile)
+	return ioutil.WriteFile(aliasesFile, []byte(b.String()), 0644)
+}
+
+// sends a test mail to the test_mail address, so lift fails when the mail
+// can't be delivered to the server, rather than the mail being lost
+func (l *Lift) sendTestMail() error {
+	to := l.Data.MTA.TestMail
+	host := l.Data.Network.fqdn()
+	msg := fmt.Sprintf("To: %s\nSubject: Test mail from %s\n\nThis mail was sent by lift, after provisioning %s.\n", to, host, host)
+	logger.WithField("to", to).Info("Sending test mail")
+	cmd := exec.Command(sendmailFile, to)
+	cmd.Stdin = strings.NewReader(msg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error sending test mail to %s: %s: %s", to, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// replaces sendmail (e.g. the busybox applet) with a link to the MTA
+func linkSendmail(target string) error {
+	if dest, err := os.Readlink(sendmailFile); err == nil && dest == target {
+		return nil
+	}
+	if err := os.Remove(sendmailFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logger.Debugf("Linking %s to %s", sendmailFile, target)
+	return os.Symlink(target, sendmailFile)
+}
+
+// returns the data of the MTA templates, with the host and port of the
+// server; the port is 465 with TLS, and 25 otherwise, by default
+func (l *Lift) mtaData() mtaData {
+	mc := l.Data.MTA
+	data := mtaData{MTAConfiguration: mc, HostName: l.Data.Network.fqdn(), Aliases: mailAliases(mc)}
+	var err error
+	if data.Host, data.Port, err = net.SplitHostPort(mc.Server); err != nil {
+		data.Host, data.Port = mc.Server, "25"
+		if mc.UseTLS {
+			data.Port = "465"
+		}
+	}
+	return data
+}
@@ -0,0 +1,45 @@
+package lift
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMailAliases(t *testing.T) {
+	tests := []struct {
+		name string
+		mc   *MTAConfiguration
+		want []mailAlias
+	}{
+		{"none", &MTAConfiguration{}, nil},
+		{"root only", &MTAConfiguration{Root: "admin@example.com"}, []mailAlias{
+			{Name: "root", Recipients: []string{"admin@example.com"}},
+		}},
+		{
+			"sorted with root",
+			&MTAConfiguration{Root: "admin@example.com", Aliases: map[string]MultiString{
+				"postmaster": {"root"},
+				"backup":     {"ops@example.com", "dev@example.com"},
+			}},
+			[]mailAlias{
+				{Name: "backup", Recipients: []string{"ops@example.com", "dev@example.com"}},
+				{Name: "postmaster", Recipients: []string{"root"}},
+				{Name: "root", Recipients: []string{"admin@example.com"}},
+			},
+		},
+		{
+			"root alias overrides root",
+			&MTAConfiguration{Root: "admin@example.com", Aliases: map[string]MultiString{
+				"root": {"ops@example.com"},
+			}},
+			[]mailAlias{{Name: "root", Recipients: []string{"ops@example.com"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mailAliases(tt.mc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
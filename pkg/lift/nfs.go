@@ -0,0 +1,89 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+const (
+	autofsMasterFile = "/etc/auto.master"
+	autofsMapFile    = "/etc/auto.lift"
+)
+
+// installs nfs-utils, enables the services NFS needs, and mounts the NFS
+// exports; on boot (in fstab), or on access with autofs
+func (l *Lift) nfsSetup() error {
+	if len(l.Data.NFS) == 0 {
+		return nil
+	}
+	logger.Debug("Installing nfs-utils package")
+	if err := apkCommand("add", "--no-cache", "nfs-utils", "rpcbind").Run(); err != nil {
+		return fmt.Errorf("Error installing nfs-utils: %s", err)
+	}
+	// NFSv3 needs rpcbind, and rpc.statd for locking
+	services := []string{"netmount"}
+	for _, m := range l.Data.NFS {
+		if !strings.HasPrefix(m.Version, "4") {
+			services = []string{"rpcbind", "rpc.statd", "netmount"}
+			break
+		}
+	}
+	for _, service := range services {
+		logger.WithField("service", service).Debug("Enabling NFS service")
+		if err := exec.Command("rc-update", "add", service, defaultRunlevel).Run(); err != nil {
+			return fmt.Errorf("Error enabling %s: %s", service, err)
+		}
+		if service == "netmount" {
+			continue
+		}
+		if err := doService(service, START); err != nil {
+			return fmt.Errorf("Error starting %s: %s", service, err)
+		}
+	}
+
+	var automounts []string
+	for _, m := range l.Data.NFS {
+		source := m.Server + ":" + m.Export
+		opts := m.Options
+		if m.Version != "" && !strings.Contains(opts, "vers=") {
+			opts = strings.Trim("vers="+m.Version+","+opts, ",")
+		}
+		if m.Automount {
+			automounts = append(automounts, fmt.Sprintf("%s\t-fstype=nfs%s\t%s\n", m.Target, strings.TrimRight(","+opts, ","), source))
+			continue
+		}
+		if err := mountFilesystem(Mount{Source: source, Target: m.Target, Type: "nfs", MountOptions: strings.Trim(opts+",_netdev", ",")}); err != nil {
+			return err
+		}
+	}
+	if len(automounts) == 0 {
+		return nil
+	}
+	return autofsSetup(automounts)
+}
+
+// installs autofs with a direct map of the automounts, enables it and
+// (re)starts it
+func autofsSetup(automounts []string) error {
+	logger.Debug("Installing autofs package")
+	if err := apkCommand("add", "--no-cache", "autofs").Run(); err != nil {
+		return fmt.Errorf("Error installing autofs: %s", err)
+	}
+	logger.WithField("file", autofsMapFile).Debug("Writing autofs map")
+	if err := ioutil.WriteFile(autofsMapFile, []byte("# generated by lift\n"+strings.Join(automounts, "")), 0644); err != nil {
+		return err
+	}
+	master := fmt.Sprintf("/-\t%s\n", autofsMapFile)
+	if existing, err := ioutil.ReadFile(autofsMasterFile); err != nil || !strings.Contains(string(existing), master) {
+		logger.Debugf("Adding %s to %s", autofsMapFile, autofsMasterFile)
+		if err = appendToFile(autofsMasterFile, master); err != nil {
+			return err
+		}
+	}
+	if err := exec.Command("rc-update", "add", "autofs", defaultRunlevel).Run(); err != nil {
+		return fmt.Errorf("Error enabling autofs: %s", err)
+	}
+	return doService("autofs", RESTART)
+}
@@ -0,0 +1,225 @@
+package lift
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	configDriveLabel = "config-2"
+	configDriveDir   = "openstack/latest"
+)
+
+// fetches alpine-data from an OpenStack config-drive (ISO or vfat) labeled
+// `config-2`. The user_data is the alpine-data; the hostname, public keys
+// and network configuration (network_data.json) are provided as
+// vendor-data, so the alpine-data can override them.
+type configDriveDatasource struct {
+	vendorData []byte
+}
+
+func (d *configDriveDatasource) Name() string { return "openstack" }
+
+func (d *configDriveDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	var data []byte
+	var meta configDriveMetadata
+	var network *configDriveNetwork
+	err := withVolume(configDriveLabel, func(mnt string) error {
+		dir := filepath.Join(mnt, configDriveDir)
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "meta_data.json"))
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(raw, &meta); err != nil {
+			return fmt.Errorf("Error parsing meta_data.json: %s", err)
+		}
+		if raw, err = ioutil.ReadFile(filepath.Join(dir, "network_data.json")); err == nil {
+			network = &configDriveNetwork{}
+			if err = json.Unmarshal(raw, network); err != nil {
+				return fmt.Errorf("Error parsing network_data.json: %s", err)
+			}
+		}
+		// the instance can be configured by the metadata alone
+		if data, err = ioutil.ReadFile(filepath.Join(dir, "user_data")); err != nil {
+			logger.Debug("No user_data on config-drive")
+			data = []byte{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md := &InstanceMetadata{
+		InstanceID:       meta.UUID,
+		AvailabilityZone: meta.AvailabilityZone,
+		Hostname:         meta.Hostname,
+	}
+	if d.vendorData, err = meta.alpineData(network); err != nil {
+		return nil, nil, err
+	}
+	return data, md, nil
+}
+
+// VendorData returns the alpine-data generated from the config-drive metadata
+func (d *configDriveDatasource) VendorData(l *Lift) ([]byte, error) {
+	return d.vendorData, nil
+}
+
+// configDriveMetadata is the relevant part of meta_data.json
+type configDriveMetadata struct {
+	UUID             string            `json:"uuid"`
+	Hostname         string            `json:"hostname"`
+	AvailabilityZone string            `json:"availability_zone"`
+	PublicKeys       map[string]string `json:"public_keys"`
+}
+
+// configDriveNetwork is the network configuration in network_data.json
+type configDriveNetwork struct {
+	Links []struct {
+		ID         string   `json:"id"`
+		Name       string   `json:"name"`
+		Type       string   `json:"type"`
+		MAC        string   `json:"ethernet_mac_address"`
+		MTU        int      `json:"mtu"`
+		VLANID     int      `json:"vlan_id"`
+		VLANLink   string   `json:"vlan_link"`
+		BondLinks  []string `json:"bond_links"`
+		BondMode   string   `json:"bond_mode"`
+		BondMIIMon int      `json:"bond_miimon"`
+	} `json:"links"`
+	Networks []struct {
+		Type        string   `json:"type"`
+		Link        string   `json:"link"`
+		IPAddress   string   `json:"ip_address"`
+		Netmask     string   `json:"netmask"`
+		Nameservers []string `json:"dns_nameservers"`
+		Routes      []struct {
+			Network string `json:"network"`
+			Netmask string `json:"netmask"`
+			Gateway string `json:"gateway"`
+		} `json:"routes"`
+	} `json:"networks"`
+	Services []struct {
+		Type    string `json:"type"`
+		Address string `json:"address"`
+	} `json:"services"`
+}
+
+// returns the alpine-data for the hostname, public keys and network
+// configuration of the instance
+func (m configDriveMetadata) alpineData(network *configDriveNetwork) ([]byte, error) {
+	names := make([]string, 0, len(m.PublicKeys))
+	for name := range m.PublicKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var keys []string
+	for _, name := range names {
+		keys = append(keys, m.PublicKeys[name])
+	}
+	pc := platformConfig{Hostname: m.Hostname, Keys: keys}
+	if network != nil {
+		pc.Interfaces, pc.Nameservers = network.interfaces()
+	}
+	return pc.alpineData()
+}
+
+// maps the links and networks to interface specifications, and returns them
+// with the nameservers
+func (n *configDriveNetwork) interfaces() ([]interface{}, []interface{}) {
+	macs := interfacesByMAC()
+	specs := make(map[string]map[interface{}]interface{})
+	for _, link := range n.Links {
+		spec := map[interface{}]interface{}{}
+		switch link.Type {
+		case "vlan":
+			spec["vlan"] = link.VLANID
+		case "bond":
+			var slaves []interface{}
+			for _, id := range link.BondLinks {
+				slaves = append(slaves, n.linkName(id, macs))
+			}
+			bond := map[interface{}]interface{}{"slaves": slaves}
+			if link.BondMode != "" {
+				bond["mode"] = link.BondMode
+			}
+			if link.BondMIIMon > 0 {
+				bond["miimon"] = link.BondMIIMon
+			}
+			spec["bond"] = bond
+		}
+		spec["name"] = n.linkName(link.ID, macs)
+		if link.MTU > 0 {
+			spec["mtu"] = link.MTU
+		}
+		specs[link.ID] = spec
+	}
+
+	var ifaces, nameservers []interface{}
+	seen := make(map[string]bool)
+	for _, nw := range n.Networks {
+		spec, ok := specs[nw.Link]
+		if !ok {
+			logger.WithField("link", nw.Link).Warn("Ignoring network of unknown link")
+			continue
+		}
+		switch nw.Type {
+		case "ipv4_dhcp", "dhcp4":
+			spec["dhcp"] = true
+		case "ipv4", "ipv6":
+			var gateway string
+			for _, r := range nw.Routes {
+				if r.Network == "0.0.0.0" || r.Network == "::" {
+					gateway = r.Gateway
+				}
+			}
+			setStaticAddress(spec, nw.IPAddress, nw.Netmask, gateway)
+		case "ipv6_dhcp", "ipv6_dhcpv6-stateful", "ipv6_dhcpv6-stateless":
+			spec["ipv6"] = map[interface{}]interface{}{"mode": "dhcp"}
+		case "ipv6_slaac":
+			spec["ipv6"] = map[interface{}]interface{}{"mode": "slaac"}
+		default:
+			logger.WithField("type", nw.Type).Warn("Ignoring network of unsupported type")
+			continue
+		}
+		for _, ns := range nw.Nameservers {
+			nameservers = append(nameservers, ns)
+		}
+		if !seen[nw.Link] {
+			seen[nw.Link] = true
+			ifaces = append(ifaces, spec)
+		}
+	}
+	for _, s := range n.Services {
+		if s.Type == "dns" && !containsValue(nameservers, s.Address) {
+			nameservers = append(nameservers, s.Address)
+		}
+	}
+	return ifaces, nameservers
+}
+
+// returns the interface name of a link; the interface with its MAC address,
+// or the name of the link. Vlans are named after the link they are on.
+func (n *configDriveNetwork) linkName(id string, macs map[string]string) string {
+	for _, link := range n.Links {
+		if link.ID != id {
+			continue
+		}
+		if link.Type == "vlan" {
+			return n.linkName(link.VLANLink, macs)
+		}
+		if name, ok := macs[strings.ToLower(link.MAC)]; ok && link.Type != "bond" {
+			return name
+		}
+		if link.Name != "" {
+			return link.Name
+		}
+		return link.ID
+	}
+	return id
+}
@@ -0,0 +1,84 @@
+package lift
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	phoneHomeRetries = 10
+	phoneHomeTimeout = 10 * time.Second
+)
+
+// PhoneHomeReport is the payload POSTed to the phone_home url
+type PhoneHomeReport struct {
+	InstanceID  string            `json:"instance_id"`
+	Hostname    string            `json:"hostname"`
+	FQDN        string            `json:"fqdn"`
+	Datasource  string            `json:"datasource"`
+	Status      string            `json:"status"`
+	Error       string            `json:"error,omitempty"`
+	SSHHostKeys map[string]string `json:"ssh_host_keys"`
+	SSHUserKeys map[string]string `json:"ssh_user_keys,omitempty"`
+	Passwords   map[string]string `json:"passwords,omitempty"`
+	Modules     []ModuleResult    `json:"modules"`
+}
+
+// reports the outcome of provisioning to the phone_home url, if configured
+func (l *Lift) phoneHome(result error) error {
+	if l.Data.PhoneHome == nil || l.Data.PhoneHome.URL == "" {
+		return nil
+	}
+	vars := l.templateVars()
+	report := PhoneHomeReport{
+		InstanceID:  l.Metadata.InstanceID,
+		Hostname:    vars.Hostname,
+		FQDN:        vars.FQDN,
+		Datasource:  l.Metadata.Datasource,
+		Status:      "success",
+		SSHHostKeys: sshHostPublicKeys(),
+		SSHUserKeys: l.userSSHPublicKeys(),
+		Passwords:   l.passwords,
+		Modules:     l.Results,
+	}
+	if result != nil {
+		report.Status = "failed"
+		report.Error = result.Error()
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	for k, v := range l.Data.PhoneHome.Headers {
+		headers.Set(k, v)
+	}
+	retries := l.Data.PhoneHome.Retries
+	if retries == 0 {
+		retries = phoneHomeRetries
+	}
+	logger.WithField("url", l.Data.PhoneHome.URL).Info("Phoning home")
+	_, err = requestWithRetry("POST", l.Data.PhoneHome.URL, headers, body, retries, phoneHomeTimeout)
+	return err
+}
+
+// returns the public SSH host keys by type
+func sshHostPublicKeys() map[string]string {
+	keys := make(map[string]string)
+	files, _ := filepath.Glob(filepath.Join(sshDir, "ssh_host_*_key.pub"))
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		t := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "ssh_host_"), "_key.pub")
+		keys[t] = strings.TrimSpace(string(data))
+	}
+	return keys
+}
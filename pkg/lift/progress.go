@@ -0,0 +1,142 @@
+package lift
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the console progress is printed to when enabled with the
+	// lift.progress kernel boot parameter
+	defaultProgressDevice = "/dev/console"
+)
+
+// progress prints a concise line for every provisioning step, and a summary
+// at the end, for operators watching the (VGA or serial) console
+type progress struct {
+	w     io.Writer
+	total int
+	n     int
+	// modules can run in parallel
+	mu sync.Mutex
+}
+
+// OpenProgress opens the device or file to print progress to; "-" is the
+// standard output and "" the console
+func OpenProgress(path string) (io.Writer, error) {
+	switch path {
+	case "-":
+		return os.Stdout, nil
+	case "":
+		path = defaultProgressDevice
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+}
+
+// returns the writer for the progress, setting it up from the lift.progress
+// (or alpine-lift-progress) kernel boot parameter when it's not set
+func (l *Lift) progressOutput() io.Writer {
+	if l.Progress != nil {
+		return l.Progress
+	}
+	dev, err := getKernelBootParam("lift.progress")
+	if err == nil && dev == "" {
+		dev, err = getKernelBootParam("alpine-lift-progress")
+	}
+	if err != nil || dev == "" {
+		return nil
+	}
+	// the value is the device, or e.g. 1 for the console
+	if !strings.HasPrefix(dev, "/") {
+		dev = ""
+	}
+	w, err := OpenProgress(dev)
+	if err != nil {
+		logger.Debugf("Unable to print progress: %v", err)
+		return nil
+	}
+	l.Progress = w
+	return w
+}
+
+func (p *progress) printf(format string, args ...interface{}) {
+	if p.w == nil {
+		return
+	}
+	fmt.Fprintf(p.w, "lift: "+format+"\n", args...)
+}
+
+// prints the start of the next step, and returns its number
+func (p *progress) start(description string) int {
+	step := p.next()
+	p.printf("[%s] %s ...", p.counter(step), description)
+	return step
+}
+
+// prints the outcome of a step
+func (p *progress) finish(step int, description string, err error, d time.Duration) {
+	if err != nil {
+		p.printf("[%s] %s FAILED after %s: %v", p.counter(step), description, formatDuration(d), err)
+	} else {
+		p.printf("[%s] %s ok (%s)", p.counter(step), description, formatDuration(d))
+	}
+}
+
+// prints a step that's skipped, as it's done already
+func (p *progress) skip(description string) {
+	p.printf("[%s] %s skipped (done)", p.counter(p.next()), description)
+}
+
+// returns the number of the next step
+func (p *progress) next() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n++
+	return p.n
+}
+
+func (p *progress) counter(step int) string {
+	return fmt.Sprintf("%*d/%d", len(fmt.Sprint(p.total)), step, p.total)
+}
+
+// prints the summary of the results
+func (p *progress) summary(results []ModuleResult, err error, d time.Duration) {
+	var ok, skipped int
+	var failed []string
+	for _, r := range results {
+		switch r.Status {
+		case "ok":
+			ok++
+		case "skipped":
+			skipped++
+		default:
+			failed = append(failed, r.Name)
+		}
+	}
+	status := "done"
+	if err != nil {
+		status = "FAILED"
+	}
+	summary := fmt.Sprintf("%s in %s: %d ok, %d skipped, %d failed", status, formatDuration(d), ok, skipped, len(failed))
+	if len(failed) > 0 {
+		summary += " (" + strings.Join(failed, ", ") + ")"
+	}
+	p.printf("%s", summary)
+}
+
+// formats a duration with a precision that suits its length, e.g. 850ms,
+// 12.3s or 2m5s
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
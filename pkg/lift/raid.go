@@ -0,0 +1,134 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mdadmConfFile = "/etc/mdadm.conf"
+)
+
+var (
+	// the kernel modules of the RAID levels
+	raidModule = map[string]string{
+		"0":  "raid0",
+		"1":  "raid1",
+		"4":  "raid456",
+		"5":  "raid456",
+		"6":  "raid456",
+		"10": "raid10",
+	}
+)
+
+// creates the md RAID arrays, or assembles them when their devices are
+// members of an array already, and adds them to mdadm.conf so they are
+// assembled on boot
+func (l *Lift) raidSetup() error {
+	if len(l.Data.RAID) == 0 {
+		return nil
+	}
+	logger.Debug("Installing mdadm package")
+	if err := apkCommand("add", "--no-cache", "mdadm").Run(); err != nil {
+		return fmt.Errorf("Error installing mdadm: %s", err)
+	}
+	// a selector never selects a device that's configured by its path, or
+	// by an earlier selector
+	selected := make(map[string]bool)
+	for _, array := range l.Data.RAID {
+		for _, dev := range append(append([]string{}, array.Devices...), array.Spares...) {
+			selected[dev] = true
+		}
+	}
+	for _, array := range l.Data.RAID {
+		// the members of an active array are in use, and can't be selected
+		_, err := os.Stat(raidDevice(array.Name))
+		if err != nil {
+			if array.Devices, err = resolveDevices(array.Devices, selected); err != nil {
+				return fmt.Errorf("Error selecting devices of RAID array %s: %s", array.Name, err)
+			}
+			if array.Spares, err = resolveDevices(array.Spares, selected); err != nil {
+				return fmt.Errorf("Error selecting spares of RAID array %s: %s", array.Name, err)
+			}
+		}
+		if err = setupRAIDArray(array); err != nil {
+			return fmt.Errorf("Error setting up RAID array %s: %s", array.Name, err)
+		}
+	}
+	if err := exec.Command("rc-update", "add", "mdadm-raid", "boot").Run(); err != nil {
+		return fmt.Errorf("Error enabling mdadm-raid: %s", err)
+	}
+	return nil
+}
+
+// creates or assembles an array, and adds it to mdadm.conf
+func setupRAIDArray(array RAIDArray) error {
+	dev := raidDevice(array.Name)
+	entry := logger.WithFields(log.Fields{"array": dev, "level": array.Level})
+	module, ok := raidModule[array.Level]
+	if !ok {
+		return fmt.Errorf("unknown RAID level %q", array.Level)
+	}
+	_ = exec.Command("modprobe", module).Run()
+
+	if _, err := os.Stat(dev); err == nil {
+		entry.Debug("RAID array is active already")
+	} else if len(array.Devices) == 0 {
+		return fmt.Errorf("no devices given")
+	} else if exec.Command("mdadm", "--examine", array.Devices[0]).Run() == nil {
+		entry.Info("Assembling RAID array")
+		args := append([]string{"--assemble", dev}, array.Devices...)
+		if out, err := exec.Command("mdadm", append(args, array.Spares...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+	} else {
+		for _, member := range append(append([]string{}, array.Devices...), array.Spares...) {
+			if err := checkDeviceWipe(member, array.Wipe, "add to a RAID array"); err != nil {
+				return err
+			}
+		}
+		entry.Info("Creating RAID array")
+		args := []string{"--create", dev, "--metadata=1.2", "--name=" + array.Name,
+			"--level=" + array.Level, fmt.Sprintf("--raid-devices=%d", len(array.Devices))}
+		// without --run mdadm refuses devices that look like they're in use
+		if array.Wipe {
+			args = append(args, "--run")
+		}
+		if len(array.Spares) > 0 {
+			args = append(args, fmt.Sprintf("--spare-devices=%d", len(array.Spares)))
+		}
+		args = append(append(args, array.Devices...), array.Spares...)
+		entry.Debugf("mdadm %s", strings.Join(args, " "))
+		if out, err := exec.Command("mdadm", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	out, err := exec.Command("mdadm", "--detail", "--brief", dev).Output()
+	if err != nil {
+		return fmt.Errorf("Error reading details of %s: %s", dev, err)
+	}
+	line := strings.TrimSpace(string(out))
+	// the array is identified by its uuid
+	uuid := line
+	for _, field := range strings.Fields(line) {
+		if strings.HasPrefix(field, "UUID=") {
+			uuid = field
+		}
+	}
+	if existing, err := ioutil.ReadFile(mdadmConfFile); err == nil && strings.Contains(string(existing), uuid) {
+		return nil
+	}
+	entry.Debugf("Adding array to %s", mdadmConfFile)
+	return appendToFile(mdadmConfFile, line+"\n")
+}
+
+// returns the device of an array
+func raidDevice(name string) string {
+	return "/dev/md/" + name
+}
@@ -0,0 +1,138 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+)
+
+var (
+	// the alternate root filesystem lift is provisioning, if any
+	altRoot string
+
+	// filesystems of the running system that are made available in the
+	// alternate root, for e.g. apk and package scripts
+	rootBindMounts = []string{"/dev", "/proc", "/sys"}
+)
+
+// returns true if lift is provisioning an alternate root filesystem (e.g.
+// an image being built) instead of the running system. Changes to the
+// running kernel (hostname, sysctl, kernel modules, mounts, swap) and
+// services are skipped then; they take effect when the image boots.
+func inAltRoot() bool {
+	return altRoot != ""
+}
+
+// returns true if lift is provisioning the running system
+func isLive(l *Lift) bool {
+	return !inAltRoot()
+}
+
+// changes the root directory of the process to root, so the modules
+// provision that root filesystem. /dev, /proc and /sys are bind mounted in
+// the root, and the resolv.conf of the running system is copied into it
+// (while lift runs) when it has none. The returned function changes back to
+// the original root and working directory, and unmounts what was mounted.
+func enterRoot(root string) (func() error, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("Error accessing root %s: %s", root, err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("Root %s is not a directory", root)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	var mounted []string
+	unmount := func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(mounted[i], syscall.MNT_DETACH); err != nil {
+				logger.Warnf("Error unmounting %s: %v", mounted[i], err)
+			}
+		}
+	}
+	for _, dir := range rootBindMounts {
+		target := filepath.Join(root, dir)
+		if ok, err := mount.Mounted(target); err != nil || ok {
+			continue
+		}
+		if err = os.MkdirAll(target, 0755); err != nil {
+			unmount()
+			return nil, err
+		}
+		logger.WithField("target", target).Debugf("Bind mounting %s", dir)
+		if err = mount.ForceMount(dir, target, "none", "bind"); err != nil {
+			unmount()
+			return nil, fmt.Errorf("Error mounting %s on %s: %s", dir, target, err)
+		}
+		mounted = append(mounted, target)
+	}
+	// the copy is only for the build, the image gets its own resolv.conf
+	resolvConf := filepath.Join(root, "etc", "resolv.conf")
+	var hostResolvConf []byte
+	if _, err := os.Lstat(resolvConf); os.IsNotExist(err) {
+		if data, err := ioutil.ReadFile("/etc/resolv.conf"); err == nil {
+			logger.WithField("file", resolvConf).Debug("Copying resolv.conf into root")
+			if ioutil.WriteFile(resolvConf, data, 0644) == nil {
+				hostResolvConf = data
+			}
+		}
+	}
+	removeResolvConf := func() {
+		if hostResolvConf == nil {
+			return
+		}
+		// unless lift wrote one for the image (dns)
+		if data, err := ioutil.ReadFile(resolvConf); err == nil && bytes.Equal(data, hostResolvConf) {
+			logger.WithField("file", resolvConf).Debug("Removing resolv.conf copied into root")
+			if err = os.Remove(resolvConf); err != nil {
+				logger.Warnf("Error removing %s: %v", resolvConf, err)
+			}
+		}
+	}
+
+	// the original root is kept open to return to it
+	orig, err := os.Open("/")
+	if err != nil {
+		removeResolvConf()
+		unmount()
+		return nil, err
+	}
+	logger.WithField("root", root).Debug("Entering root filesystem")
+	if err = syscall.Chroot(root); err != nil {
+		orig.Close()
+		removeResolvConf()
+		unmount()
+		return nil, fmt.Errorf("Error entering root %s: %s", root, err)
+	}
+	altRoot = root
+	leave := func() error {
+		defer orig.Close()
+		logger.WithField("root", root).Debug("Leaving root filesystem")
+		if err := syscall.Fchdir(int(orig.Fd())); err != nil {
+			return fmt.Errorf("Error leaving root %s: %s", root, err)
+		}
+		if err := syscall.Chroot("."); err != nil {
+			return fmt.Errorf("Error leaving root %s: %s", root, err)
+		}
+		altRoot = ""
+		removeResolvConf()
+		unmount()
+		return os.Chdir(wd)
+	}
+	if err = os.Chdir("/"); err != nil {
+		_ = leave()
+		return nil, err
+	}
+	return leave, nil
+}
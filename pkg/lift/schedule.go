@@ -0,0 +1,144 @@
+package lift
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// returns true if the module can run at the same time as other modules
+func isConcurrent(m Module) bool {
+	cm, ok := m.(ConcurrentModule)
+	return ok && cm.Concurrent()
+}
+
+// returns the names of the modules a module depends on; the ones it
+// declares and the ones added in `modules.after`
+func (l *Lift) moduleAfter(m Module) []string {
+	var after []string
+	if cm, ok := m.(ConcurrentModule); ok {
+		after = append(after, cm.After()...)
+	}
+	return append(after, l.Data.Modules.After[m.Name()]...)
+}
+
+// returns, for each of the modules to run, the positions of the modules it
+// waits for. A module waits for the modules it depends on (or, when these
+// don't run, the modules they depend on), and for the last module before it
+// that runs on its own; which waits for all modules before it. Only modules
+// before it are waited for, so the order of the modules is kept and there
+// can't be a cycle.
+func (l *Lift) moduleDependencies(modules []Module) [][]int {
+	pos := make(map[string]int, len(modules))
+	for i, m := range modules {
+		pos[m.Name()] = i
+	}
+	deps := make([][]int, len(modules))
+	serial := -1
+	for i, m := range modules {
+		if !isConcurrent(m) {
+			for j := serial; j < i; j++ {
+				if j >= 0 {
+					deps[i] = append(deps[i], j)
+				}
+			}
+			serial = i
+			continue
+		}
+		if serial >= 0 {
+			deps[i] = append(deps[i], serial)
+		}
+		seen := map[string]bool{m.Name(): true}
+		pending := l.moduleAfter(m)
+		for len(pending) > 0 {
+			name := pending[0]
+			pending = pending[1:]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if j, ok := pos[name]; ok {
+				if j < i {
+					deps[i] = append(deps[i], j)
+				}
+			} else if dm := findModule(name); dm != nil {
+				pending = append(pending, l.moduleAfter(dm)...)
+			}
+		}
+	}
+	return deps
+}
+
+// runs the modules, at most parallel at the same time, each as soon as the
+// modules it waits for are done. With parallel 1 they run one by one, in
+// order. After a module failed, or a signal was received on interrupt, no
+// more modules are started, and the (first) error is returned once the
+// running modules are done.
+func (l *Lift) runModules(modules []Module, parallel int, interrupt chan os.Signal) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	deps := l.moduleDependencies(modules)
+	started := make([]bool, len(modules))
+	done := make([]bool, len(modules))
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result)
+	running := 0
+	var err error
+	for {
+		for i, m := range modules {
+			if err != nil || running >= parallel {
+				break
+			}
+			if started[i] || !allDone(deps[i], done) {
+				continue
+			}
+			started[i] = true
+			running++
+			go func(i int, m Module) {
+				results <- result{i, l.runModule(m.Name(), moduleDescription(m), func() (err error) {
+					// a module that panics fails, so lift still cleans up
+					// after it (e.g. leaves the alternate root)
+					defer func() {
+						if r := recover(); r != nil {
+							err = fmt.Errorf("panic: %v", r)
+						}
+					}()
+					return m.Run(l)
+				})}
+			}(i, m)
+		}
+		if running == 0 {
+			return err
+		}
+		select {
+		case r := <-results:
+			running--
+			done[r.i] = true
+			if r.err != nil && err == nil {
+				err = r.err
+			}
+		case sig := <-interrupt:
+			logger.Warnf("Received %s, waiting for the running modules to finish", sig)
+			if err == nil {
+				err = fmt.Errorf("interrupted by %s", sig)
+			}
+			// another signal isn't waited on
+			signal.Stop(interrupt)
+			interrupt = nil
+		}
+	}
+}
+
+// returns true if all modules at the positions are done
+func allDone(positions []int, done []bool) bool {
+	for _, i := range positions {
+		if !done[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,366 @@
+package lift
+
+import (
+	"bytes"
+	jsonenc "encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	vaultPrefix  = "vault:"
+	vaultTimeout = 30 * time.Second
+	sopsKey      = "sops"
+
+	ageHeader      = "age-encryption.org/v1"
+	ageArmorHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageSecretKey   = "AGE-SECRET-KEY-"
+	ageTPMPrefix   = "tpm:"
+	// the age key file used when no key is given, e.g. baked into the image
+	ageKeyFile = "/etc/lift/age.key"
+)
+
+// SecretOptions specifies how the secrets referenced by the alpine-data are
+// resolved. VaultAddr and VaultToken are used for `vault:<path>#<key>`
+// values, AgeKey to decrypt age encrypted documents and values, and
+// documents encrypted with sops. AgeKey is an age secret key, `tpm:<handle>`
+// for a key sealed in the TPM, or the path of a key file (by default
+// /etc/lift/age.key). Zero values are taken from the kernel boot parameters
+// (lift.vault_addr, lift.vault_token and lift.age_key) or the VAULT_ADDR,
+// VAULT_TOKEN and SOPS_AGE_KEY_FILE environment variables.
+type SecretOptions struct {
+	VaultAddr  string
+	VaultToken string
+	AgeKey     string
+}
+
+// returns the secret options, completed from the kernel boot parameters
+// and environment
+func (l *Lift) secretOptions() SecretOptions {
+	o := l.Secrets
+	for _, opt := range []struct {
+		value      *string
+		param, env string
+	}{
+		{&o.VaultAddr, "lift.vault_addr", "VAULT_ADDR"},
+		{&o.VaultToken, "lift.vault_token", "VAULT_TOKEN"},
+		{&o.AgeKey, "lift.age_key", "SOPS_AGE_KEY_FILE"},
+	} {
+		if *opt.value == "" {
+			*opt.value, _ = getKernelBootParam(opt.param)
+		}
+		if *opt.value == "" {
+			*opt.value = os.Getenv(opt.env)
+		}
+	}
+	return o
+}
+
+// returns true if data is a document encrypted with sops, which has the
+// sops metadata (with the MAC of the values) in its `sops` key
+func isSops(data []byte) bool {
+	doc := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	_, ok := mapValue(doc[sopsKey])["mac"]
+	return ok
+}
+
+// decrypts a sops encrypted document with the sops binary, using the age
+// key or Vault (transit) token of the secret options. The document isn't
+// parsed first, since its MAC covers the values in their original order.
+func (l *Lift) decryptSops(data []byte) ([]byte, error) {
+	if _, err := exec.LookPath("sops"); err != nil {
+		if err = apkCommand("add", "--no-cache", "sops").Run(); err != nil {
+			return nil, errors.New("sops is needed to decrypt the alpine-data, and could not be installed")
+		}
+	}
+	format := "yaml"
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		format = "json"
+	}
+	o := l.secretOptions()
+	env := os.Environ()
+	// the document may be encrypted with other keys (e.g. Vault transit)
+	if key, err := l.ageKey(); err == nil {
+		env = append(env, "SOPS_AGE_KEY="+string(key))
+	} else {
+		logger.Debugf("No age key for sops: %v", err)
+	}
+	if o.VaultAddr != "" {
+		env = append(env, "VAULT_ADDR="+o.VaultAddr, "VAULT_TOKEN="+o.VaultToken)
+	}
+
+	cmd := exec.Command("sops", "--decrypt", "--input-type", format, "--output-type", format, "/dev/stdin")
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting with sops: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// returns true if data is encrypted with age, binary or ASCII armored
+func isAge(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return bytes.HasPrefix(data, []byte(ageHeader)) || bytes.HasPrefix(data, []byte(ageArmorHeader))
+}
+
+// returns the age secret key(s) to decrypt with, reading them once
+func (l *Lift) ageKey() ([]byte, error) {
+	if l.ageIdentities != nil {
+		return l.ageIdentities, nil
+	}
+	key := l.secretOptions().AgeKey
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(key, ageSecretKey):
+		data = []byte(key)
+	case strings.HasPrefix(key, ageTPMPrefix):
+		handle := strings.TrimPrefix(key, ageTPMPrefix)
+		if _, err = exec.LookPath("tpm2_unseal"); err != nil {
+			_ = apkCommand("add", "--no-cache", "tpm2-tools").Run()
+		}
+		logger.WithField("handle", handle).Debug("Unsealing age key from TPM")
+		if data, err = exec.Command("tpm2_unseal", "-c", handle).Output(); err != nil {
+			return nil, fmt.Errorf("Error unsealing age key from TPM handle %s: %s", handle, err)
+		}
+	default:
+		if key == "" {
+			key = ageKeyFile
+		}
+		if data, err = ioutil.ReadFile(key); err != nil {
+			return nil, fmt.Errorf("Error reading age key: %s", err)
+		}
+	}
+	if !bytes.Contains(data, []byte(ageSecretKey)) {
+		return nil, errors.New("no age secret key found")
+	}
+	l.ageIdentities = bytes.TrimSpace(data)
+	return l.ageIdentities, nil
+}
+
+// decrypts age encrypted data with the age binary. The key is passed
+// through a pipe, so it's never written to disk.
+func (l *Lift) decryptAge(data []byte) ([]byte, error) {
+	key, err := l.ageKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = exec.LookPath("age"); err != nil {
+		if err = apkCommand("add", "--no-cache", "age").Run(); err != nil {
+			return nil, errors.New("age is needed to decrypt the alpine-data, and could not be installed")
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	go func() {
+		_, _ = w.Write(append(key, '\n'))
+		w.Close()
+	}()
+
+	cmd := exec.Command("age", "--decrypt", "-i", "/dev/fd/3")
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting with age: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// decrypts data if it is encrypted with age
+func (l *Lift) maybeDecryptAge(data []byte) ([]byte, error) {
+	if !isAge(data) {
+		return data, nil
+	}
+	logger.Info("Decrypting age encrypted alpine-data")
+	return l.decryptAge(data)
+}
+
+// replaces the secret values of the alpine-data: `vault:<path>#<key>`
+// references with the secrets they reference (e.g.
+// `vault:secret/alpine/root#password` with the password field of the
+// secret/alpine/root secret), and age encrypted (ASCII armored) values
+// with their plaintext. Every Vault secret is read once.
+func (l *Lift) resolveSecrets(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte(vaultPrefix)) && !bytes.Contains(data, []byte(ageArmorHeader)) {
+		return data, nil
+	}
+	doc := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	r := &secretResolver{
+		lift:  l,
+		vault: &vaultClient{options: l.secretOptions(), secrets: make(map[string]map[string]interface{})},
+	}
+	resolved, err := r.resolveRefs(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	if r.vaultCount == 0 && r.ageCount == 0 {
+		return data, nil
+	}
+	logger.WithFields(log.Fields{"vault": r.vaultCount, "age": r.ageCount}).Info("Resolved secrets")
+	return yaml.Marshal(resolved)
+}
+
+// secretResolver resolves the secret values of a document
+type secretResolver struct {
+	lift       *Lift
+	vault      *vaultClient
+	vaultCount int
+	ageCount   int
+}
+
+// returns a yaml value with its secrets resolved; path is the (dotted)
+// path of the value, for errors
+func (r *secretResolver) resolveRefs(v interface{}, path string) (interface{}, error) {
+	switch n := v.(type) {
+	case map[interface{}]interface{}:
+		for k, val := range n {
+			p := fmt.Sprintf("%v", k)
+			if path != "" {
+				p = path + "." + p
+			}
+			resolved, err := r.resolveRefs(val, p)
+			if err != nil {
+				return nil, err
+			}
+			n[k] = resolved
+		}
+	case []interface{}:
+		for i, val := range n {
+			resolved, err := r.resolveRefs(val, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			n[i] = resolved
+		}
+	case string:
+		switch {
+		case strings.HasPrefix(n, vaultPrefix):
+			s, err := r.vault.resolve(strings.TrimPrefix(n, vaultPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+			r.vaultCount++
+			return s, nil
+		case strings.HasPrefix(strings.TrimSpace(n), ageArmorHeader):
+			plain, err := r.lift.decryptAge([]byte(n))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+			r.ageCount++
+			return string(plain), nil
+		}
+	}
+	return v, nil
+}
+
+// vaultClient reads secrets from the HashiCorp Vault HTTP API
+type vaultClient struct {
+	options SecretOptions
+	secrets map[string]map[string]interface{}
+}
+
+// returns the value of a `<path>#<key>` secret reference
+func (c *vaultClient) resolve(ref string) (string, error) {
+	kv := strings.SplitN(ref, "#", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return "", fmt.Errorf("invalid secret reference %s%s, expected %s<path>#<key>", vaultPrefix, ref, vaultPrefix)
+	}
+	path, key := strings.Trim(kv[0], "/"), kv[1]
+	secret, ok := c.secrets[path]
+	if !ok {
+		var err error
+		if secret, err = c.read(path); err != nil {
+			return "", fmt.Errorf("Error reading secret %s from Vault: %s", path, err)
+		}
+		c.secrets[path] = secret
+	}
+	value, ok := secret[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", path, key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprintf("%v", value), nil
+}
+
+// reads a secret. With the KV version 2 secrets engine the secret is read
+// from <mount>/data/<path>, as the Vault CLI does, unless the path already
+// contains it.
+func (c *vaultClient) read(path string) (map[string]interface{}, error) {
+	if c.options.VaultAddr == "" {
+		return nil, errors.New("no Vault address (lift.vault_addr) given")
+	}
+	if c.options.VaultToken == "" {
+		return nil, errors.New("no Vault token (lift.vault_token) given")
+	}
+	body, status, err := c.get(path)
+	if err == nil && status == http.StatusNotFound {
+		if p := strings.SplitN(path, "/", 2); len(p) == 2 && !strings.HasPrefix(p[1], "data/") {
+			body, status, err = c.get(p[0] + "/data/" + p[1])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = jsonenc.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	// KV version 2 nests the secret, next to its metadata
+	if nested, ok := resp.Data["data"].(map[string]interface{}); ok {
+		if _, ok = resp.Data["metadata"]; ok {
+			return nested, nil
+		}
+	}
+	return resp.Data, nil
+}
+
+// executes a GET request for a path of the Vault API
+func (c *vaultClient) get(path string) ([]byte, int, error) {
+	url := strings.TrimRight(c.options.VaultAddr, "/") + "/v1/" + path
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", c.options.VaultToken)
+	logger.WithField("url", url).Debug("Reading secret from Vault")
+	resp, err := httpClient(vaultTimeout).Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, resp.StatusCode, err
+}
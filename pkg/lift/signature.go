@@ -0,0 +1,180 @@
+package lift
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// the public key used when none is given, e.g. baked into the image
+	signingKeyFile  = "/etc/lift/signing.pub"
+	signatureSuffix = ".sig"
+	pgpKeyHeader    = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+)
+
+// SignatureOptions specifies how the alpine-data is authenticated. When a
+// public key is available, the alpine-data (and the vendor-data and
+// includes downloaded over http) must have a valid detached signature, or
+// nothing is applied. Key is the path of the public key (PEM encoded
+// Ed25519, ECDSA or RSA, or an OpenPGP key), or the base64 encoded DER of a
+// PEM key; by default /etc/lift/signing.pub if that exists. SignatureURL is
+// the url or path of the signature of the alpine-data; by default the url
+// of the alpine-data with a .sig suffix. Zero values are taken from the
+// lift.signing_key and lift.signature_url kernel boot parameters.
+type SignatureOptions struct {
+	Key          string
+	SignatureURL string
+}
+
+// returns the public key to verify signatures with, or nil if signatures
+// aren't verified
+func (l *Lift) signingKey() ([]byte, error) {
+	if l.signingKeyData != nil {
+		return l.signingKeyData, nil
+	}
+	key := l.Signature.Key
+	if key == "" {
+		key, _ = getKernelBootParam("lift.signing_key")
+	}
+	var data []byte
+	var err error
+	switch {
+	case key == "":
+		if data, err = ioutil.ReadFile(signingKeyFile); os.IsNotExist(err) {
+			return nil, nil
+		}
+	case filepath.IsAbs(key) || strings.HasPrefix(key, "."):
+		data, err = ioutil.ReadFile(key)
+	default:
+		var der []byte
+		if der, err = base64.StdEncoding.DecodeString(key); err == nil {
+			data = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading signing key: %s", err)
+	}
+	l.signingKeyData = data
+	return data, nil
+}
+
+// verifies the detached signature of a document fetched from source (a url
+// or path), unless no signing key is available. The signature is the given
+// one (e.g. read by the datasource), or fetched from signatureURL or else
+// <source>.sig.
+func (l *Lift) verifySignature(what string, data []byte, source, signatureURL string, signature []byte) error {
+	key, err := l.signingKey()
+	if err != nil || key == nil {
+		return err
+	}
+	if signature == nil {
+		if signatureURL == "" && source != "" {
+			signatureURL = source + signatureSuffix
+		}
+		if signatureURL == "" {
+			return fmt.Errorf("Error verifying %s: no signature available", what)
+		}
+		if isURL(signatureURL) {
+			signature, err = l.fetchPolicy().download(signatureURL, l.contentHeaders(signatureURL))
+		} else {
+			signature, err = ioutil.ReadFile(signatureURL)
+		}
+		if err != nil {
+			return fmt.Errorf("Error fetching signature of %s: %s", what, err)
+		}
+	}
+
+	if bytes.Contains(key, []byte(pgpKeyHeader)) {
+		err = verifyPGP(key, data, signature)
+	} else {
+		err = verifyPublicKey(key, data, signature)
+	}
+	if err != nil {
+		return fmt.Errorf("Error verifying signature of %s: %s", what, err)
+	}
+	logger.WithField("source", source).Infof("Verified signature of %s", what)
+	return nil
+}
+
+// verifies a signature with a PEM encoded public key; an Ed25519 signature,
+// or an ECDSA or RSA (PKCS #1 v1.5) signature of the SHA-256 digest, as
+// created by `openssl pkeyutl -sign -rawin` and `openssl dgst -sha256
+// -sign`. The signature may be base64 encoded.
+func verifyPublicKey(key, data, signature []byte) error {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return errors.New("no PEM encoded public key found")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if decoded, err := decodeBase64(signature); err == nil {
+		signature = decoded
+	}
+	digest := sha256.Sum256(data)
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, signature) {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil
+}
+
+// verifies a detached OpenPGP signature (binary or ASCII armored) with gpg,
+// in a temporary keyring that only contains the given key
+func verifyPGP(key, data, signature []byte) error {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		if err = apkCommand("add", "--no-cache", "gnupg").Run(); err != nil {
+			return errors.New("gpg is needed to verify the signature, and could not be installed")
+		}
+	}
+	home, err := ioutil.TempDir("", "lift-gpg-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+	files := map[string][]byte{"key": key, "data": data, "data.sig": signature}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(home, name), content, 0600); err != nil {
+			return err
+		}
+	}
+
+	gpg := func(args ...string) error {
+		cmd := exec.Command("gpg", append([]string{"--batch", "--homedir", home}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if err = gpg("--import", filepath.Join(home, "key")); err != nil {
+		return fmt.Errorf("Error importing key: %s", err)
+	}
+	return gpg("--verify", filepath.Join(home, "data.sig"), filepath.Join(home, "data"))
+}
@@ -0,0 +1,133 @@
+package lift
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	dmiSerialFile = "/sys/class/dmi/id/product_serial"
+	dmiEntriesDir = "/sys/firmware/dmi/entries"
+
+	smbiosVendorDataTimeout = 30 * time.Second
+)
+
+// fetches alpine-data from the url (or inline base64 alpine-data) in the
+// SMBIOS OEM strings or system serial, as set by e.g. qemu's `-smbios`.
+// Recognized settings are `lift.data_url=<url>` (or `alpine-data=<url>`),
+// `lift.data=<base64>`, and the NoCloud style `s=<url>` (or
+// `seedfrom=<url>`), `i=<instance-id>` and `h=<hostname>`. The system
+// serial may contain multiple settings separated by `;`, e.g.
+// `ds=nocloud;s=http://10.0.0.1/seed/`.
+type smbiosDatasource struct {
+	vendorDataURL string
+}
+
+func (d *smbiosDatasource) Name() string { return "smbios" }
+
+func (d *smbiosDatasource) Fetch(l *Lift) ([]byte, *InstanceMetadata, error) {
+	settings := smbiosSettings()
+	if len(settings) == 0 {
+		return nil, nil, errors.New("no alpine-data settings in SMBIOS")
+	}
+	md := &InstanceMetadata{
+		InstanceID: firstSetting(settings, "i", "instance-id"),
+		Hostname:   firstSetting(settings, "h", "local-hostname"),
+	}
+
+	if inline := settings["lift.data"]; inline != "" {
+		data, err := decodeBase64([]byte(inline))
+		return data, md, err
+	}
+
+	dataURL := firstSetting(settings, "lift.data_url", "alpine-data")
+	if seed := firstSetting(settings, "s", "seedfrom"); dataURL == "" && seed != "" {
+		dataURL = seed + "user-data"
+		d.vendorDataURL = seed + "vendor-data"
+	}
+	if dataURL == "" {
+		return nil, nil, errors.New("no alpine-data url in SMBIOS")
+	}
+	logger.WithField("url", dataURL).Info("downloading alpine-data file")
+	data, err := l.fetchPolicy().download(dataURL, l.RequestHeaders)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.DataURL = dataURL
+	return data, md, nil
+}
+
+// VendorData returns the vendor-data from the NoCloud style seed url, if
+// present
+func (d *smbiosDatasource) VendorData(l *Lift) ([]byte, error) {
+	if d.vendorDataURL == "" {
+		return nil, nil
+	}
+	data, err := downloadFileWithRetry(d.vendorDataURL, l.contentHeaders(d.vendorDataURL), 0, smbiosVendorDataTimeout)
+	if err != nil {
+		// vendor-data is optional
+		logger.WithField("url", d.vendorDataURL).Debugf("No vendor-data: %v", err)
+		return nil, nil
+	}
+	return data, nil
+}
+
+// returns the `key=value` settings from the SMBIOS OEM strings (type 11)
+// and system serial
+func smbiosSettings() map[string]string {
+	settings := make(map[string]string)
+	add := func(s string) {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			settings[kv[0]] = kv[1]
+		}
+	}
+
+	if serial, err := ioutil.ReadFile(dmiSerialFile); err == nil {
+		for _, s := range strings.Split(strings.TrimSpace(string(serial)), ";") {
+			add(s)
+		}
+	}
+	entries, _ := filepath.Glob(filepath.Join(dmiEntriesDir, "11-*", "raw"))
+	for _, entry := range entries {
+		raw, err := ioutil.ReadFile(entry)
+		if err != nil {
+			logger.Debugf("Error reading %s: %v", entry, err)
+			continue
+		}
+		for _, s := range dmiStrings(raw) {
+			add(s)
+		}
+	}
+	return settings
+}
+
+// returns the strings of a raw SMBIOS structure; the NUL terminated strings
+// following the formatted area, whose length is in the header
+func dmiStrings(raw []byte) []string {
+	if len(raw) < 2 || int(raw[1]) > len(raw) {
+		return nil
+	}
+	var strs []string
+	for _, s := range bytes.Split(raw[raw[1]:], []byte{0}) {
+		if len(s) == 0 {
+			break
+		}
+		strs = append(strs, string(s))
+	}
+	return strs
+}
+
+// returns the value of the first of the keys that is set
+func firstSetting(settings map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := settings[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package lift
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stateDir = "/var/lib/lift"
+	// StatusFile contains the status of the last lift run
+	StatusFile = stateDir + "/status.json"
+)
+
+// Status is the status of a lift run, with the result of each
+// provisioning step
+type Status struct {
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	InstanceID string         `json:"instance_id,omitempty"`
+	Datasource string         `json:"datasource,omitempty"`
+	Started    time.Time      `json:"started"`
+	Finished   *time.Time     `json:"finished,omitempty"`
+	Modules    []ModuleResult `json:"modules"`
+}
+
+// Status returns the status of a finished run, with the given result
+func (l *Lift) Status(result error) *Status {
+	return l.status(result, true)
+}
+
+// returns the status of the run, which is still running unless finished
+func (l *Lift) status(result error, finished bool) *Status {
+	status := &Status{
+		Status:     "running",
+		InstanceID: l.Metadata.InstanceID,
+		Datasource: l.Metadata.Datasource,
+		Started:    l.started,
+		Modules:    l.Results,
+	}
+	if finished {
+		now := time.Now()
+		status.Finished = &now
+		status.Status = "success"
+		if result != nil {
+			status.Status = "failed"
+			status.Error = result.Error()
+		}
+	}
+	return status
+}
+
+// writes the status file. While running, the status is updated after every
+// provisioning step, so the progress of a half-provisioned machine is known.
+func (l *Lift) writeStatus(result error, finished bool) error {
+	// the status of the build doesn't belong in the image
+	if inAltRoot() {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.status(result, finished), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(StatusFile), 0755); err != nil {
+		return err
+	}
+	// write atomically, so a reader never sees a partial file
+	tmp := StatusFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, StatusFile)
+}
+
+// ReadStatus reads the status of the last lift run from a status file
+func ReadStatus(path string) (*Status, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{}
+	if err = json.Unmarshal(data, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,135 @@
+package lift
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	syslogConfFile    = "/etc/conf.d/syslog"
+	rsyslogConfFile   = "/etc/rsyslog.d/lift.conf"
+	logrotateConfFile = "/etc/logrotate.d/rsyslog"
+	defaultSyslogPort = 514
+)
+
+// the syslog settings, as used by the templates
+type syslogSettings struct {
+	Remote []SyslogRemote
+	SizeKB int
+	Rotate int
+}
+
+// configures the syslog daemon, busybox syslogd or rsyslog, to forward the
+// logs to the remote hosts and rotate them, and switches to that daemon
+func (l *Lift) syslogSetup() error {
+	if l.Data.Syslog == nil {
+		return nil
+	}
+	settings, err := newSyslogSettings(l.Data.Syslog)
+	if err != nil {
+		return err
+	}
+	switch daemon := l.Data.Syslog.Daemon; daemon {
+	case "", "busybox":
+		for _, r := range settings.Remote {
+			if r.Protocol != "udp" {
+				return fmt.Errorf("busybox syslogd only forwards over udp, use rsyslog for %s", r.Host)
+			}
+		}
+		if err = installSyslogConf(syslogConf, settings, syslogConfFile); err != nil {
+			return err
+		}
+		return switchSyslog("rsyslog", "syslog")
+	case "rsyslog":
+		logger.Debug("Installing rsyslog and logrotate")
+		if err = apkCommand("add", "rsyslog", "logrotate").Run(); err != nil {
+			return fmt.Errorf("Error installing rsyslog: %s", err)
+		}
+		if err = os.MkdirAll("/etc/rsyslog.d", 0755); err != nil {
+			return err
+		}
+		if err = installSyslogConf(rsyslogConf, settings, rsyslogConfFile); err != nil {
+			return err
+		}
+		if err = installSyslogConf(logrotateConf, settings, logrotateConfFile); err != nil {
+			return err
+		}
+		return switchSyslog("syslog", "rsyslog")
+	default:
+		return fmt.Errorf("Unknown syslog daemon: %s", daemon)
+	}
+}
+
+// returns the syslog settings, with the defaults of the remote hosts
+func newSyslogSettings(c *SyslogConfig) (syslogSettings, error) {
+	settings := syslogSettings{Rotate: c.Rotate}
+	for _, r := range c.Remote {
+		if r.Port == 0 {
+			r.Port = defaultSyslogPort
+		}
+		r.Protocol = strings.ToLower(r.Protocol)
+		if r.Protocol == "" {
+			r.Protocol = "udp"
+		}
+		settings.Remote = append(settings.Remote, r)
+	}
+	if c.RotateSize != "" {
+		kb, err := parseLogSize(c.RotateSize)
+		if err != nil {
+			return settings, err
+		}
+		settings.SizeKB = kb
+	}
+	return settings, nil
+}
+
+// parses a log file size (e.g. 512K, 10M or a number of KiB) and returns it
+// in KiB
+func parseLogSize(size string) (int, error) {
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B"), "I")
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		s = strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		s, mult = strings.TrimSuffix(s, "M"), 1024
+	case strings.HasSuffix(s, "G"):
+		s, mult = strings.TrimSuffix(s, "G"), 1024*1024
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid log size: %s", size)
+	}
+	return n * mult, nil
+}
+
+// renders a syslog configuration template to dest
+func installSyslogConf(t *template.Template, settings syslogSettings, dest string) error {
+	conf, err := generateFileFromTemplate(*t, settings)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Copying syslog configuration to %s", dest)
+	if err = exec.Command("mv", conf, dest).Run(); err != nil {
+		return err
+	}
+	return os.Chmod(dest, 0644)
+}
+
+// replaces the syslog service from with the service to in the boot runlevel,
+// and restarts the logging
+func switchSyslog(from, to string) error {
+	if _, err := os.Stat("/etc/init.d/" + from); err == nil {
+		_ = exec.Command("rc-update", "del", from, "boot").Run()
+		_ = doService(from, STOP)
+	}
+	if err := exec.Command("rc-update", "add", to, "boot").Run(); err != nil {
+		return fmt.Errorf("Error enabling %s: %s", to, err)
+	}
+	logger.Debugf("Restart %s", to)
+	return doService(to, RESTART)
+}
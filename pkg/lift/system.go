@@ -0,0 +1,199 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRunlevel = "default"
+	sysctlFile      = "/etc/sysctl.d/99-lift.conf"
+	modulesFile     = "/etc/modules-load.d/lift.conf"
+	modprobeFile    = "/etc/modprobe.d/lift.conf"
+	crontabsDir     = "/etc/crontabs"
+	periodicDir     = "/etc/periodic"
+)
+
+var (
+	periodicIntervals = []string{"15min", "hourly", "daily", "weekly", "monthly"}
+)
+
+// enables/disables services at their runlevel and brings them into the
+// requested state
+func (l *Lift) servicesSetup() error {
+	for _, sv := range l.Data.Services {
+		if sv.Name == "" {
+			continue
+		}
+		runlevel := sv.Runlevel
+		if runlevel == "" {
+			runlevel = defaultRunlevel
+		}
+		entry := logger.WithFields(log.Fields{"service": sv.Name, "runlevel": runlevel})
+		if sv.Enabled != nil {
+			action := "del"
+			if *sv.Enabled {
+				action = "add"
+			}
+			entry.Debugf("Executing rc-update %s", action)
+			if out, err := exec.Command("rc-update", action, sv.Name, runlevel).CombinedOutput(); err != nil {
+				return fmt.Errorf("Error executing rc-update %s %s: %s: %s", action, sv.Name, err, strings.TrimSpace(string(out)))
+			}
+		}
+		var action string
+		switch sv.State {
+		case "":
+			continue
+		case "started":
+			action = START
+		case "stopped":
+			action = STOP
+		case "restarted":
+			action = RESTART
+		default:
+			return fmt.Errorf("Unknown state %s for service %s", sv.State, sv.Name)
+		}
+		entry.Debugf("Executing service %s", action)
+		if err := doService(sv.Name, action); err != nil {
+			return fmt.Errorf("Error executing service %s %s: %s", sv.Name, action, err)
+		}
+	}
+	return nil
+}
+
+// writes the kernel parameters to a sysctl.d file, so they persist across
+// reboots, and applies them immediately
+func (l *Lift) sysctlSetup() error {
+	if len(l.Data.Sysctl) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(l.Data.Sysctl))
+	for k := range l.Data.Sysctl {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var conf strings.Builder
+	for _, k := range keys {
+		conf.WriteString(fmt.Sprintf("%s = %s\n", k, l.Data.Sysctl[k]))
+	}
+	logger.WithField("file", sysctlFile).Debug("Writing sysctl configuration")
+	if err := ioutil.WriteFile(sysctlFile, []byte(conf.String()), 0644); err != nil {
+		return fmt.Errorf("Error writing %s: %s", sysctlFile, err)
+	}
+	if inAltRoot() {
+		return nil
+	}
+	if out, err := exec.Command("sysctl", "-p", sysctlFile).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error applying sysctl settings: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// configures kernel modules to be loaded on boot (with their parameters),
+// and loads them immediately
+func (l *Lift) modulesSetup() error {
+	if len(l.Data.Modules.Kernel) == 0 {
+		return nil
+	}
+	var modules, options strings.Builder
+	for _, m := range l.Data.Modules.Kernel {
+		modules.WriteString(m.Name + "\n")
+		if m.Options != "" {
+			options.WriteString(fmt.Sprintf("options %s %s\n", m.Name, m.Options))
+		}
+	}
+	files := map[string]string{modulesFile: modules.String()}
+	if options.Len() > 0 {
+		files[modprobeFile] = options.String()
+	}
+	for path, content := range files {
+		logger.WithField("file", path).Debug("Writing kernel module configuration")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %s", path, err)
+		}
+	}
+	// the modules service loads /etc/modules-load.d on boot
+	if err := exec.Command("rc-update", "add", "modules", "boot").Run(); err != nil {
+		logger.Debugf("Error adding modules service to boot runlevel: %v", err)
+	}
+	if inAltRoot() {
+		return nil
+	}
+	for _, m := range l.Data.Modules.Kernel {
+		logger.WithField("module", m.Name).Debug("Executing modprobe")
+		if out, err := exec.Command("modprobe", m.Name).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error loading kernel module %s: %s: %s", m.Name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// adds the crontab entries and installs the periodic scripts, then
+// (re)starts crond so the changes are picked up
+func (l *Lift) cronSetup() error {
+	if l.Data.Cron == nil {
+		return nil
+	}
+	for _, job := range l.Data.Cron.Jobs {
+		if err := addCrontabEntry(job); err != nil {
+			return err
+		}
+	}
+	for interval, scripts := range l.Data.Cron.Periodic {
+		if !stringInSlice(interval, periodicIntervals) {
+			return fmt.Errorf("Unknown periodic interval %s", interval)
+		}
+		for _, script := range scripts {
+			// run-parts skips files with a dot in their name
+			if script.Name == "" || strings.ContainsAny(script.Name, "./") {
+				return fmt.Errorf("Invalid periodic script name: %q", script.Name)
+			}
+			path := filepath.Join(periodicDir, interval, script.Name)
+			logger.WithField("file", path).Debug("Installing periodic script")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path, []byte(script.Content), 0755); err != nil {
+				return fmt.Errorf("Error writing %s: %s", path, err)
+			}
+		}
+	}
+	return enableCrond()
+}
+
+// adds a job to the crontab of its user (by default root), unless it's
+// there already
+func addCrontabEntry(job CronJob) error {
+	user := job.User
+	if user == "" {
+		user = "root"
+	}
+	entry := fmt.Sprintf("%s\t%s", job.Schedule, job.Command)
+	crontab := filepath.Join(crontabsDir, user)
+	if existing, err := ioutil.ReadFile(crontab); err == nil && strings.Contains(string(existing), entry) {
+		return nil
+	}
+	logger.WithFields(log.Fields{"user": user, "schedule": job.Schedule}).Debug("Adding crontab entry")
+	if err := appendFile(crontab, []byte(entry+"\n"), 0600); err != nil {
+		return fmt.Errorf("Error adding crontab entry for %s: %s", user, err)
+	}
+	return nil
+}
+
+// enables crond, and restarts it to read the crontabs
+func enableCrond() error {
+	if err := exec.Command("rc-update", "add", "crond", defaultRunlevel).Run(); err != nil {
+		logger.Debugf("Error adding crond to default runlevel: %v", err)
+	}
+	return doService("crond", RESTART)
+}
@@ -2,20 +2,24 @@ package lift
 
 import (
 	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
 	"strings"
 	"text/template"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	answerFileTemplate = `KEYMAPOPTS="{{ .Keymap }}"
+	answerFileTemplate = `KEYMAPOPTS="{{ keymap .Keymap }}"
 	{{ $h := split .Network.HostName "." -}}
 	HOSTNAMEOPTS="-n {{ index $h 0 }}"
-	INTERFACESOPTS="{{ .Network.InterfaceOpts }}"
+	INTERFACESOPTS="{{ .Network.InterfaceOpts.Raw }}"
 	DNSOPTS="-d {{ .Network.ResolvConf.Domain }} {{range .Network.ResolvConf.NameServers}}{{.}}{{end}}"
 	TIMEZONEOPTS="-z {{ .TimeZone }}"
-	PROXYOPTS="{{ .Network.Proxy }}"
+	PROXYOPTS="{{ .Network.Proxy.HTTP }}"
 	APKREPOSOPTS="-1"
 	SSHDOPTS="-c openssh"
 	NTPOPTS="-c none"
@@ -24,12 +28,24 @@ const (
 	APKCACHEOPTS="none"
 `
 
+	drpcliConfTemplate = `# dr-provision runner configuration, generated by lift
+RS_ENDPOINT={{ quote .Endpoint }}
+{{- if .Token }}
+RS_TOKEN={{ quote .Token }}
+{{- end }}
+RS_UUID={{ quote .UUID }}
+`
+
 	drpcliServiceTemplate = `#!/sbin/openrc-run
   
 	name=drpcli
 	pidfile="/run/${name}.pid"
 	runfile="/run/openrc/started/${name}"
 	logfile="/var/log/drpcli.log"
+
+	# the endpoint, token and machine uuid
+	[ -f /etc/drpcli ] && . /etc/drpcli
+	export RS_ENDPOINT RS_TOKEN RS_UUID
 	
 	depend() {
 			need net
@@ -45,11 +61,11 @@ const (
 			if [ ! -f $logfile ] ; then
 				touch $logfile || return 1
 			fi
-			/usr/local/bin/drpcli -E {{ .DRP.Endpoint }} machines update {{ .DRP.UUID }} '{"Runnable":true}' >> $logfile
+			/usr/local/bin/drpcli machines update "$RS_UUID" '{"Runnable":true}' >> $logfile 2>&1
 	}
 	
 	stop_pre() {
-			/usr/local/bin/drpcli -E {{ .DRP.Endpoint }} machines update {{ .DRP.UUID }} '{"Runnable":false}' >> $logfile
+			/usr/local/bin/drpcli machines update "$RS_UUID" '{"Runnable":false}' >> $logfile 2>&1
 	}
 	
 	start() {
@@ -64,7 +80,7 @@ const (
 			--progress                   \
 			--exec /usr/local/bin/drpcli \
 			--                           \
-			-E {{ .DRP.Endpoint }} machines processjobs {{ .DRP.UUID }} >> $logfile
+			machines processjobs "$RS_UUID" >> $logfile
 		eend $?
 	}
 	
@@ -75,7 +91,138 @@ const (
 		eend 0
 	}`
 
-	repositoriesTemplate = "{{ range . }}{{ . }}\n{{ end }}"
+	interfacesTemplate = `auto lo
+iface lo inet loopback
+{{ range $iface := .InterfaceOpts.Specs }}
+auto {{ .Device }}
+{{- if .HasIPv4 }}
+iface {{ .Device }} inet {{ if .DHCP }}dhcp{{ else }}static{{ end }}
+{{- if and .DHCP $.HostName }}
+	hostname {{ index (split $.HostName ".") 0 }}
+{{- end }}
+{{- if .Address }}
+	address {{ .Address }}
+{{- end }}
+{{- if .Netmask }}
+	netmask {{ .Netmask }}
+{{- end }}
+{{- if .Gateway }}
+	gateway {{ .Gateway }}
+{{- end }}
+{{- if .MTU }}
+	mtu {{ .MTU }}
+{{- end }}
+{{- if .VLAN }}
+	vlan-raw-device {{ .Name }}
+{{- end }}
+{{- with .Bridge }}
+	bridge-ports {{ join .Ports " " }}
+	bridge-stp {{ if .STP }}on{{ else }}off{{ end }}
+{{- end }}
+{{- with .Bond }}
+	bond-slaves {{ join .Slaves " " }}
+{{- if .Mode }}
+	bond-mode {{ .Mode }}
+{{- end }}
+{{- if .MIIMon }}
+	bond-miimon {{ .MIIMon }}
+{{- end }}
+{{- if .Primary }}
+	bond-primary {{ .Primary }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- with .IPv6 }}
+iface {{ $iface.Device }} inet6 {{ .Method }}
+{{- if .Address }}
+	address {{ .Address }}
+{{- end }}
+{{- if .Netmask }}
+	netmask {{ .Netmask }}
+{{- end }}
+{{- if .Gateway }}
+	gateway {{ .Gateway }}
+{{- end }}
+{{- end }}
+{{ end }}`
+
+	hostsTemplate = `127.0.0.1	localhost localhost.localdomain
+::1		localhost localhost.localdomain
+127.0.1.1	{{ if ne .FQDN .Hostname }}{{ .FQDN }} {{ end }}{{ .Hostname }}
+{{ range $ip, $names := .Hosts }}{{ $ip }}	{{ join $names " " }}
+{{ end }}`
+
+	proxyTemplate = `{{ with .HTTP }}export http_proxy="{{ . }}"
+export HTTP_PROXY="{{ . }}"
+export ftp_proxy="{{ . }}"
+{{ end }}{{ with .HTTPSProxy }}export https_proxy="{{ . }}"
+export HTTPS_PROXY="{{ . }}"
+{{ end }}{{ with .NoProxy }}export no_proxy="{{ join . "," }}"
+export NO_PROXY="{{ join . "," }}"
+{{ end }}`
+
+	wireguardTemplate = `[Interface]
+PrivateKey = {{ .PrivateKey }}
+{{- range .Address }}
+Address = {{ . }}
+{{- end }}
+{{- if .ListenPort }}
+ListenPort = {{ .ListenPort }}
+{{- end }}
+{{- if .MTU }}
+MTU = {{ .MTU }}
+{{- end }}
+{{ range .Peers }}
+[Peer]
+PublicKey = {{ .PublicKey }}
+{{- if .PresharedKey }}
+PresharedKey = {{ .PresharedKey }}
+{{- end }}
+{{- if .Endpoint }}
+Endpoint = {{ .Endpoint }}
+{{- end }}
+{{- if .AllowedIPs }}
+AllowedIPs = {{ join .AllowedIPs ", " }}
+{{- end }}
+{{- if .PersistentKeepalive }}
+PersistentKeepalive = {{ .PersistentKeepalive }}
+{{- end }}
+{{ end }}`
+
+	wgQuickServiceTemplate = `#!/sbin/openrc-run
+
+description="WireGuard interface ${RC_SVCNAME#*.}"
+command=/usr/bin/wg-quick
+
+depend() {
+	need net
+	use dns
+}
+
+start() {
+	ebegin "Starting WireGuard interface ${RC_SVCNAME#*.}"
+	$command up "${RC_SVCNAME#*.}"
+	eend $?
+}
+
+stop() {
+	ebegin "Stopping WireGuard interface ${RC_SVCNAME#*.}"
+	$command down "${RC_SVCNAME#*.}"
+	eend $?
+}
+`
+
+	zramTemplate = `load_on_start=yes
+unload_on_stop=yes
+num_devices=1
+type0=swap
+size0={{ .SizeMiB }}
+{{ if .Algorithm }}algo0={{ .Algorithm }}{{ end }}
+`
+
+	repositoriesTemplate = `{{ range .Repositories }}{{ . }}
+{{ end }}{{ range $tag, $repos := .TaggedRepositories }}{{ range $repos }}@{{ $tag }} {{ . }}
+{{ end }}{{ end }}`
 
 	chronyTemplate = `{{ if .Network.NTP.Pools }}
 {{ range .Network.NTP.Pools }}
@@ -92,6 +239,137 @@ initstepslew 10 {{ index .Network.NTP.Servers 0 }}
 driftfile /var/lib/chrony/chrony.drift
 rtcsync`
 
+	openntpdTemplate = `{{ range .Network.NTP.Pools }}servers {{ . }}
+{{ end }}{{ range .Network.NTP.Servers }}server {{ . }}
+{{ end }}`
+
+	busyboxNTPTemplate = `NTPD_OPTS="-N{{ range .Network.NTP.Pools }} -p {{ . }}{{ end }}{{ range .Network.NTP.Servers }} -p {{ . }}{{ end }}"
+`
+
+	openrcUnitTemplate = `#!/sbin/openrc-run
+{{- if .Unit }}
+# converted from the systemd unit {{ .Unit }} by lift
+{{- else }}
+# generated by lift
+{{- end }}
+
+description="{{ .Description }}"
+{{- with .Directory }}
+directory="{{ . }}"
+{{- end }}
+{{- range .Environment }}
+export {{ . }}
+{{- end }}
+{{- if .Oneshot }}
+
+start() {
+	ebegin "Starting ${RC_SVCNAME}"
+{{- range .Commands }}
+	{{ . }} || { eend $?; return 1; }
+{{- end }}
+	eend 0
+}
+{{- else }}
+command="{{ .Command }}"
+command_args="{{ .Args }}"
+command_background=true
+pidfile="/run/${RC_SVCNAME}.pid"
+{{- with .User }}
+command_user="{{ . }}"
+{{- end }}
+{{- end }}
+
+depend() {
+	{{ if .NeedNet }}need{{ else }}use{{ end }} net
+}
+`
+
+	motdScriptTemplate = `# dynamic MOTD, installed by lift; shows the current system facts at login
+[ -t 1 ] || return 0
+. /etc/os-release 2>/dev/null
+printf '\n  %s (%s)\n\n' "$(hostname -f 2>/dev/null || hostname)" "${PRETTY_NAME:-Alpine Linux}"
+printf '  Kernel:       %s %s\n' "$(uname -r)" "$(uname -m)"
+printf '  Addresses:    %s\n' "$(ip -o addr show scope global 2>/dev/null | awk '{ split($4, a, "/"); printf "%s ", a[1] }')"
+printf '  Uptime:       %s\n' "$(uptime | sed 's/^.* up *//; s/, *[0-9]* user.*//; s/, *load.*//')"
+printf '  Load:         %s\n' "$(cut -d ' ' -f 1-3 /proc/loadavg)"
+printf '  Memory:       %s\n' "$(free -m | awk '/^Mem:/ { printf "%d of %d MiB used", $3, $2 }')"
+printf '  Provisioned:  %s\n\n' '{{ .Provisioned }}'
+`
+
+	dhcpHookTemplate = `#!/bin/sh
+# installed by lift: records DHCP option {{ .Option }} (the alpine-data url), for
+# the dhcp datasource of lift
+case "${1:-bound}" in
+bound|renew) ;;
+*) exit 0 ;;
+esac
+value="$opt{{ .Option }}"
+[ -n "$value" ] && [ -n "$interface" ] || exit 0
+mkdir -p {{ .Dir }}
+printf '%s\n' "$value" > "{{ .Dir }}/$interface"
+`
+
+	syslogTemplate = `# set by lift
+SYSLOGD_OPTS="-t{{ if .Remote }} -L{{ range .Remote }} -R {{ .Address }}{{ end }}{{ end }}{{ with .SizeKB }} -s {{ . }}{{ end }}{{ with .Rotate }} -b {{ . }}{{ end }}"
+`
+
+	rsyslogTemplate = `# forwarding, set by lift
+{{- range .Remote }}
+*.* action(type="omfwd" target="{{ .Host }}" port="{{ .Port }}" protocol="{{ .Protocol }}"
+           queue.type="LinkedList" queue.size="10000" action.resumeRetryCount="-1")
+{{- end }}
+`
+
+	logrotateTemplate = `# set by lift
+/var/log/messages {
+	missingok
+	notifempty
+	compress
+	delaycompress
+{{- with .SizeKB }}
+	size {{ . }}k
+{{- end }}
+{{- with .Rotate }}
+	rotate {{ . }}
+{{- end }}
+	postrotate
+		/etc/init.d/rsyslog --ifstarted reload >/dev/null
+	endscript
+}
+`
+
+	rootLockTemplate = `#!/bin/sh
+# installed by lift: locks the root password after the first boot
+boot_id="$(cat {{ .BootIDFile }})"
+if [ ! -s {{ .BootFile }} ]; then
+	echo "$boot_id" > {{ .BootFile }}
+	exit 0
+fi
+[ "$boot_id" = "$(cat {{ .BootFile }})" ] && exit 0
+passwd -l root >/dev/null
+rm -f {{ .BootFile }} "$0"
+`
+
+	acmeScriptTemplate = `#!/bin/sh
+# installed by lift: obtains the certificate for {{ index .Domains 0 }}, or renews it
+# when it expires within {{ .RenewDays }} days, and reloads the services using it
+if [ "$1" = reload ]; then
+{{- range .Reload }}
+	rc-service --ifstarted {{ quote . }} reload
+{{- end }}
+	exit 0
+fi
+{{- if .Credentials }}
+set -a
+. {{ quote .Credentials }}
+set +a
+{{- end }}
+if [ -f {{ quote .Certificate }} ]; then
+	exec lego {{ .Args }} renew --days {{ .RenewDays }} --renew-hook "$0 reload"
+fi
+exec lego {{ .Args }} run --run-hook "$0 reload"
+`
+
 	ssmtpTemplate = `hostname={{ .Network.HostName }}
 {{ if .MTA.Root }}root={{ .MTA.Root }}{{ end }}
 {{ if .MTA.Server }}mailhub={{ .MTA.Server }}{{ end }}
@@ -102,23 +380,102 @@ rtcsync`
 {{ if .MTA.AuthMethod }}AuthMethod={{ upper .MTA.AuthMethod }}{{ end }}
 {{ if .MTA.RewriteDomain }}rewriteDomain={{ .MTA.RewriteDomain }}{{ end }}
 {{ if .MTA.FromLineOverride }}FromLineOverride=Yes{{ end }}
+`
+
+	msmtpTemplate = `# generated by lift
+defaults
+syslog LOG_MAIL
+aliases /etc/aliases
+{{- if or .UseTLS .UseSTARTTLS }}
+tls on
+tls_trust_file /etc/ssl/certs/ca-certificates.crt
+{{- if .UseTLS }}
+tls_starttls off
+{{- end }}
+{{- end }}
+
+account default
+host {{ .Host }}
+port {{ .Port }}
+{{- if .AuthMethod }}
+auth {{ lower .AuthMethod }}
+{{- else if .User }}
+auth on
+{{- end }}
+{{- if .User }}
+user {{ .User }}
+password {{ printf "%q" .Password }}
+{{- end }}
+from %U@{{ if .RewriteDomain }}{{ .RewriteDomain }}{{ else }}{{ .HostName }}{{ end }}
+`
+
+	busyboxSendmailTemplate = `#!/bin/sh
+# generated by lift: sends mail with busybox sendmail
+{{- if .Aliases }}
+for arg; do
+	shift
+	case "$arg" in
+{{- range .Aliases }}
+	{{ .Name }}|{{ .Name }}@localhost|{{ .Name }}@{{ $.HostName }}) set -- "$@"{{ range .Recipients }} {{ quote . }}{{ end }} ;;
+{{- end }}
+	*) set -- "$@" "$arg" ;;
+	esac
+done
+{{- end }}
+exec busybox sendmail
+{{- if .UseTLS }} -H {{ quote (printf "exec openssl s_client -quiet -connect %s:%s" .Host .Port) }}
+{{- else if .UseSTARTTLS }} -H {{ quote (printf "exec openssl s_client -quiet -starttls smtp -connect %s:%s" .Host .Port) }}
+{{- else }} -S {{ quote (printf "%s:%s" .Host .Port) }}
+{{- end }}
+{{- if .User }} -au{{ quote .User }} -ap{{ quote .Password }}
+{{- if .AuthMethod }} -am{{ upper .AuthMethod }}{{ end }}
+{{- end }}
+{{- if .RewriteDomain }} -f "$(id -un)@{{ .RewriteDomain }}"{{ end }} "$@"
 `
 )
 
 var (
 	tplFuncMap                                              = make(template.FuncMap)
 	answerFile, drpcliInit, repoFile, chronyConf, ssmtpConf *template.Template
+	msmtpConf, busyboxSendmail                              *template.Template
+	interfaces, zramConf, hostsConf, proxyConf              *template.Template
+	openntpdConf, busyboxNTPConf, wireguardConf             *template.Template
+	openrcUnit, motdScript, dhcpHook                        *template.Template
+	syslogConf, rsyslogConf, logrotateConf, rootLock        *template.Template
+	drpcliConf, acmeScript                                  *template.Template
 )
 
 func init() {
 	// Initialise parser functions
 	tplFuncMap["split"] = Split
 	tplFuncMap["upper"] = Upper
+	tplFuncMap["lower"] = Lower
+	tplFuncMap["join"] = Join
+	tplFuncMap["quote"] = shellQuote
+	tplFuncMap["keymap"] = keymapOpts
 	answerFile = template.Must(template.New("answerfile").Funcs(tplFuncMap).Parse(answerFileTemplate))
 	drpcliInit = template.Must(template.New("drpcli").Funcs(tplFuncMap).Parse(drpcliServiceTemplate))
+	drpcliConf = template.Must(template.New("drpcli-conf").Funcs(tplFuncMap).Parse(drpcliConfTemplate))
+	acmeScript = template.Must(template.New("acme-script").Funcs(tplFuncMap).Parse(acmeScriptTemplate))
 	repoFile = template.Must(template.New("repositories").Funcs(tplFuncMap).Parse(repositoriesTemplate))
 	chronyConf = template.Must(template.New("chrony").Funcs(tplFuncMap).Parse(chronyTemplate))
 	ssmtpConf = template.Must(template.New("ssmtp").Funcs(tplFuncMap).Parse(ssmtpTemplate))
+	msmtpConf = template.Must(template.New("msmtp").Funcs(tplFuncMap).Parse(msmtpTemplate))
+	busyboxSendmail = template.Must(template.New("busybox-sendmail").Funcs(tplFuncMap).Parse(busyboxSendmailTemplate))
+	interfaces = template.Must(template.New("interfaces").Funcs(tplFuncMap).Parse(interfacesTemplate))
+	zramConf = template.Must(template.New("zram").Funcs(tplFuncMap).Parse(zramTemplate))
+	hostsConf = template.Must(template.New("hosts").Funcs(tplFuncMap).Parse(hostsTemplate))
+	proxyConf = template.Must(template.New("proxy").Funcs(tplFuncMap).Parse(proxyTemplate))
+	openntpdConf = template.Must(template.New("openntpd").Funcs(tplFuncMap).Parse(openntpdTemplate))
+	busyboxNTPConf = template.Must(template.New("busybox-ntpd").Funcs(tplFuncMap).Parse(busyboxNTPTemplate))
+	wireguardConf = template.Must(template.New("wireguard").Funcs(tplFuncMap).Parse(wireguardTemplate))
+	openrcUnit = template.Must(template.New("openrc-unit").Funcs(tplFuncMap).Parse(openrcUnitTemplate))
+	motdScript = template.Must(template.New("motd-script").Funcs(tplFuncMap).Parse(motdScriptTemplate))
+	dhcpHook = template.Must(template.New("dhcp-hook").Funcs(tplFuncMap).Parse(dhcpHookTemplate))
+	syslogConf = template.Must(template.New("syslog").Funcs(tplFuncMap).Parse(syslogTemplate))
+	rsyslogConf = template.Must(template.New("rsyslog").Funcs(tplFuncMap).Parse(rsyslogTemplate))
+	logrotateConf = template.Must(template.New("logrotate").Funcs(tplFuncMap).Parse(logrotateTemplate))
+	rootLock = template.Must(template.New("root-lock").Funcs(tplFuncMap).Parse(rootLockTemplate))
 }
 
 // This function takes a template and data struct, executes (parses) the template
@@ -138,7 +495,7 @@ func generateFileFromTemplate(t template.Template, data interface{}) (string, er
 		return "", err
 	}
 
-	log.WithFields(log.Fields{
+	logger.WithFields(log.Fields{
 		"template": t.Name(),
 		"file":     tmpfile.Name(),
 	}).Debug("parsed template to file")
@@ -156,3 +513,88 @@ func Split(s string, d string) []string {
 func Upper(s string) string {
 	return strings.ToUpper(s)
 }
+
+// Lower is a parser function that can be used from inside the template
+func Lower(s string) string {
+	return strings.ToLower(s)
+}
+
+// Join is a parser function that can be used from inside the template
+func Join(s []string, sep string) string {
+	return strings.Join(s, sep)
+}
+
+// TemplateVars contains the variables available when rendering templated
+// user content (write_files, motd and interfaces)
+type TemplateVars struct {
+	Hostname      string
+	FQDN          string
+	IPv4          []string
+	IPv6          []string
+	AlpineVersion string
+	Kernel        string
+	Arch          string
+	CPUs          int
+	Provisioned   string
+	Metadata      *InstanceMetadata
+	Data          *AlpineData
+}
+
+// returns the variables for rendering templated user content
+func (l *Lift) templateVars() TemplateVars {
+	vars := TemplateVars{
+		Arch:     runtime.GOARCH,
+		CPUs:     runtime.NumCPU(),
+		Metadata: l.Metadata,
+		Data:     l.Data,
+	}
+	started := l.started
+	if started.IsZero() {
+		started = time.Now()
+	}
+	vars.Provisioned = started.Format("2006-01-02 15:04:05 MST")
+	if release, err := ioutil.ReadFile(alpineReleaseFile); err == nil {
+		vars.AlpineVersion = strings.TrimSpace(string(release))
+	}
+	if release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		vars.Kernel = strings.TrimSpace(string(release))
+	}
+	// the Alpine name of the architecture, e.g. x86_64 instead of amd64
+	if arch, err := ioutil.ReadFile(apkArchFile); err == nil {
+		vars.Arch = strings.TrimSpace(string(arch))
+	}
+	if l.Data.Network != nil && l.Data.Network.fqdn() != "" {
+		vars.FQDN = l.Data.Network.fqdn()
+	} else if h, err := os.Hostname(); err == nil {
+		vars.FQDN = h
+	}
+	vars.Hostname = strings.Split(vars.FQDN, ".")[0]
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				vars.IPv4 = append(vars.IPv4, ipnet.IP.String())
+			} else {
+				vars.IPv6 = append(vars.IPv6, ipnet.IP.String())
+			}
+		}
+	}
+	return vars
+}
+
+// renders user provided content as a template, with the instance variables
+func (l *Lift) renderTemplate(name, content string) (string, error) {
+	t, err := template.New(name).Funcs(tplFuncMap).Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err = t.Execute(&b, l.templateVars()); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,71 @@
+package lift
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	// TLS configuration used for all of lift's downloads, by its transport
+	tlsConfig = &tls.Config{}
+)
+
+// TLSOptions specifies the TLS configuration for downloading alpine-data
+// and other content over https. CACert is the path or url of an additional
+// CA bundle, ClientCert and ClientKey the paths of a client certificate
+// and key for mutual TLS.
+type TLSOptions struct {
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	Insecure   bool
+}
+
+// configures the TLS options for all downloads
+func (o TLSOptions) configure() error {
+	if o.Insecure {
+		logger.Warn("TLS certificate verification is disabled")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if o.CACert != "" {
+		var bundle []byte
+		var err error
+		if strings.HasPrefix(o.CACert, "https://") || strings.HasPrefix(o.CACert, "http://") {
+			logger.WithField("url", o.CACert).Debug("Downloading CA bundle")
+			bundle, err = downloadFile(o.CACert, nil)
+		} else {
+			bundle, err = ioutil.ReadFile(o.CACert)
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading CA bundle %s: %s", o.CACert, err)
+		}
+		if !trustPEM(bundle) {
+			return errors.New("No valid PEM certificate found in CA bundle " + o.CACert)
+		}
+	}
+	if o.ClientCert != "" || o.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// adds the PEM encoded certificates to the CAs trusted by lift (besides
+// the system CAs). Returns false if no certificate could be parsed.
+func trustPEM(data []byte) bool {
+	if tlsConfig.RootCAs == nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig.RootCAs.AppendCertsFromPEM(data)
+}
@@ -0,0 +1,26 @@
+package lift
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestTLSOptionsConfigure(t *testing.T) {
+	reset := func() {
+		tlsConfig = &tls.Config{}
+		transport = newTransport()
+	}
+	reset()
+	defer reset()
+
+	if err := (TLSOptions{Insecure: true}).configure(); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if !httpClient(0).Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify {
+		t.Error("lift's transport verifies certificates")
+	}
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil && c.InsecureSkipVerify {
+		t.Error("http.DefaultTransport doesn't verify certificates")
+	}
+}
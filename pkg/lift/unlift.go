@@ -0,0 +1,149 @@
+package lift
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	// UnLiftNone leaves lift in place
+	UnLiftNone = "none"
+	// UnLiftBinary removes the lift binary; the default, as it has always been
+	UnLiftBinary = "binary"
+	// UnLiftService additionally removes the lift service
+	UnLiftService = "service"
+	// UnLiftData additionally shreds the local alpine-data and the other files
+	// with secrets
+	UnLiftData = "data"
+	// UnLiftAll additionally removes the state and configuration of lift
+	UnLiftAll = "all"
+
+	liftService = "lift"
+	liftConfDir = "/etc/lift"
+)
+
+// the unlift levels, each removing more than the previous one
+var unliftLevels = []string{UnLiftNone, UnLiftBinary, UnLiftService, UnLiftData, UnLiftAll}
+
+// UnLiftLevel specifies what lift removes when it's done, one of the UnLift
+// levels. As boolean, true is UnLiftBinary and false UnLiftNone.
+type UnLiftLevel string
+
+// UnmarshalYAML is a custom unmarshalling function for the unlift level,
+// which is either the name of the level or a boolean
+func (ul *UnLiftLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*ul = UnLiftNone
+		if enabled {
+			*ul = UnLiftBinary
+		}
+		return nil
+	}
+	var level string
+	if err := unmarshal(&level); err != nil {
+		return err
+	}
+	*ul = UnLiftLevel(level)
+	return nil
+}
+
+// returns the position of the level in the unlift levels, or -1 if it's
+// unknown
+func (ul UnLiftLevel) index() int {
+	for i, level := range unliftLevels {
+		if level == string(ul) {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns true if the level removes at least as much as level
+func (ul UnLiftLevel) includes(level string) bool {
+	return ul.index() >= UnLiftLevel(level).index()
+}
+
+// removes lift from the system as far as the unlift level says, after a
+// successful run
+func (l *Lift) unlift() error {
+	level := l.Data.UnLift
+	if level == "" {
+		level = UnLiftBinary
+	}
+	if level.index() < 0 {
+		return fmt.Errorf("Unknown unlift level: %s", level)
+	}
+	if level.includes(UnLiftService) {
+		logger.Info("Removing lift service")
+		_ = exec.Command("rc-update", "-a", "del", liftService).Run()
+		for _, f := range []string{"/etc/init.d/" + liftService, "/etc/conf.d/" + liftService} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if level.includes(UnLiftData) {
+		logger.Info("Shredding local alpine-data and secrets")
+		files := []string{localDataFile, localDataFile + signatureSuffix, vendorDataFile,
+			vendorDataFile + signatureSuffix, headersFile, ageKeyFile, passwordsFile}
+		scripts, _ := filepath.Glob(filepath.Join(scriptsDir, "*"))
+		for _, f := range append(files, scripts...) {
+			if err := shredFile(f); err != nil {
+				return fmt.Errorf("Error shredding %s: %s", f, err)
+			}
+		}
+	}
+	if level.includes(UnLiftBinary) {
+		logger.Info("Removing lift binary from the system")
+		binPath, err := os.Readlink("/proc/self/exe")
+		if err != nil {
+			return err
+		}
+		logger.WithField("path", binPath).Debug("os.Remove")
+		if err = os.Remove(binPath); err != nil {
+			return err
+		}
+	}
+	if level.includes(UnLiftAll) {
+		logger.Info("Removing lift state and configuration")
+		for _, dir := range []string{stateDir, liftConfDir} {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overwrites a regular file with random data before removing it, so its
+// content can't be recovered from the disk (on filesystems that overwrite
+// in place)
+func shredFile(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode().IsRegular() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(f, rand.Reader, fi.Size())
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	logger.WithField("file", path).Debugf("Shredded %d bytes", fi.Size())
+	return os.Remove(path)
+}
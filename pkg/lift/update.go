@@ -0,0 +1,81 @@
+package lift
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// the release binary of a lift version
+	liftReleaseURL = "https://github.com/bjwschaap/alpine-lift/releases/download/%s/lift"
+	// set for the updated binary, so it doesn't update again
+	liftUpdatedEnv = "LIFT_UPDATED"
+)
+
+// replaces the running lift binary by the one specified by lift_update and
+// executes it, before any module runs. The new binary is verified with the
+// sha256 checksum and/or the signature (with the signing key of the
+// alpine-data); an update that can't be verified is refused.
+func (l *Lift) selfUpdate() error {
+	// the updated binary doesn't update again; the variable isn't passed on
+	// to the commands it runs
+	updated := os.Getenv(liftUpdatedEnv)
+	os.Unsetenv(liftUpdatedEnv)
+	u := l.Data.LiftUpdate
+	if u == nil || (u.URL == "" && u.Version == "") || updated != "" {
+		return nil
+	}
+	version := u.Version
+	if version != "" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if version != "" && version == l.Version {
+		logger.Debugf("lift %s is up to date", version)
+		return nil
+	}
+	binURL := u.URL
+	if binURL == "" {
+		binURL = fmt.Sprintf(liftReleaseURL, version)
+	}
+
+	key, err := l.signingKey()
+	if err != nil {
+		return err
+	}
+	if u.SHA256 == "" && key == nil {
+		return errors.New("Refusing to update lift without a sha256 checksum or signing key to verify it")
+	}
+	logger.WithField("url", binURL).Info("Updating lift")
+	data, err := l.fetchPolicy().download(binURL, l.contentHeaders(binURL))
+	if err != nil {
+		return fmt.Errorf("Error downloading lift: %s", err)
+	}
+	if err = verifyChecksum(data, u.SHA256, ""); err != nil {
+		return fmt.Errorf("Error verifying %s: %s", binURL, err)
+	}
+	if err = l.verifySignature("lift binary", data, binURL, u.SignatureURL, nil); err != nil {
+		return err
+	}
+
+	binPath, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	// rename the new binary over the running one, so it's replaced atomically
+	tmp := filepath.Join(filepath.Dir(binPath), ".lift-update")
+	if err = ioutil.WriteFile(tmp, data, 0755); err != nil {
+		return fmt.Errorf("Error writing %s: %s", tmp, err)
+	}
+	if err = os.Rename(tmp, binPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Error replacing %s: %s", binPath, err)
+	}
+	logger.WithField("path", binPath).Info("Updated lift, restarting")
+	env := append(os.Environ(), liftUpdatedEnv+"="+binURL)
+	return syscall.Exec(binPath, os.Args, env)
+}
@@ -0,0 +1,211 @@
+package lift
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	scriptsDir = stateDir + "/scripts"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	// content types of multipart parts containing alpine-data
+	yamlContentTypes = []string{"text/cloud-config", "text/x-alpine-data", "text/yaml", "text/x-yaml", "application/yaml", "application/x-yaml"}
+	// content types of multipart parts containing shell scripts
+	scriptContentTypes = []string{"text/x-shellscript", "text/x-sh", "application/x-sh"}
+)
+
+// Script is a shell script part of the alpine-data, executed like runcmd
+type Script struct {
+	Name    string
+	Content []byte
+}
+
+// decodes raw alpine-data as provided by a datasource. Gzip compressed data
+// is decompressed, a MIME multipart payload is split into its YAML parts
+// (merged in order) and its shell script parts, a plain shell script
+// (starting with #!) is returned as a script, and cloud-config is
+// translated.
+func decodeAlpineData(data []byte) ([]byte, []Script, error) {
+	data, err := maybeGunzip(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error decompressing alpine-data: %s", err)
+	}
+	switch {
+	case isMultipart(data):
+		return decodeMultipart(data)
+	case bytes.HasPrefix(data, []byte("#!")):
+		return nil, []Script{{Name: "part-001", Content: data}}, nil
+	case isCloudConfig(data):
+		data, err = fromCloudConfig(data)
+		return data, nil, err
+	case isIgnition(data):
+		data, err = fromIgnition(data)
+		return data, nil, err
+	}
+	return data, nil, nil
+}
+
+// decompresses data if it is gzip compressed
+func maybeGunzip(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	return gunzip(data)
+}
+
+// returns true if data starts with MIME headers
+func isMultipart(data []byte) bool {
+	head := data
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	lower := strings.ToLower(string(head))
+	return strings.HasPrefix(lower, "content-type:") || strings.HasPrefix(lower, "mime-version:")
+}
+
+func decodeMultipart(data []byte) ([]byte, []Script, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing MIME alpine-data: %s", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing MIME alpine-data: %s", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		// a single part message
+		body, err := decodePart(msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return collectParts(nil, nil, mediaType, "", body)
+	}
+
+	var doc []byte
+	var scripts []Script
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for i := 1; ; i++ {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error parsing MIME alpine-data: %s", err)
+		}
+		body, err := decodePart(part.Header.Get("Content-Transfer-Encoding"), part)
+		if err != nil {
+			return nil, nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		name := part.FileName()
+		if name == "" {
+			name = fmt.Sprintf("part-%03d", i)
+		}
+		if doc, scripts, err = collectParts(doc, scripts, partType, name, body); err != nil {
+			return nil, nil, err
+		}
+	}
+	return doc, scripts, nil
+}
+
+// decodes the body of a part, according to its transfer encoding. Quoted
+// printable bodies are already decoded by the multipart reader.
+func decodePart(encoding string, body io.Reader) ([]byte, error) {
+	if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding MIME part: %s", err)
+	}
+	return maybeGunzip(data)
+}
+
+// adds the body of a part to the YAML document or the scripts, depending on
+// its content type. Parts of other types are ignored.
+func collectParts(doc []byte, scripts []Script, mediaType, name string, body []byte) ([]byte, []Script, error) {
+	if mediaType == "" || mediaType == "text/plain" {
+		// guess the type of untyped parts
+		mediaType = "text/yaml"
+		if bytes.HasPrefix(body, []byte("#!")) {
+			mediaType = "text/x-shellscript"
+		}
+	}
+	switch {
+	case stringInSlice(mediaType, yamlContentTypes):
+		if isCloudConfig(body) {
+			var err error
+			if body, err = fromCloudConfig(body); err != nil {
+				return nil, nil, err
+			}
+		}
+		if doc == nil {
+			return body, scripts, nil
+		}
+		merged, err := mergeDocuments(doc, body)
+		return merged, scripts, err
+	case stringInSlice(mediaType, scriptContentTypes):
+		if name == "" {
+			name = fmt.Sprintf("part-%03d", len(scripts)+1)
+		}
+		return doc, append(scripts, Script{Name: name, Content: body}), nil
+	}
+	logger.WithField("type", mediaType).Warnf("Ignoring MIME part %s of unsupported type", name)
+	return doc, scripts, nil
+}
+
+// deep merges YAML document src onto dst. The top-level merge annotation of
+// src is kept, so it still applies when merging onto vendor-data.
+func mergeDocuments(dst, src []byte) ([]byte, error) {
+	d := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(dst, &d); err != nil {
+		return nil, err
+	}
+	s := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(src, &s); err != nil {
+		return nil, err
+	}
+	merged := mergeMaps(d, s, MergeDeep)
+	if a, ok := s[mergeKey]; ok {
+		merged[mergeKey] = a
+	}
+	return yaml.Marshal(merged)
+}
+
+// writes the scripts to the scripts directory (in root, if set), and
+// returns the commands executing them
+func writeScripts(root string, scripts []Script) ([]Command, error) {
+	if len(scripts) == 0 {
+		return nil, nil
+	}
+	dir := filepath.Join(root, scriptsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating %s: %s", dir, err)
+	}
+	var cmds []Command
+	for i, s := range scripts {
+		// the commands run in the root; parts may have the same name, so
+		// the name is prefixed with the position of the part
+		path := filepath.Join(scriptsDir, fmt.Sprintf("%03d-%s", i+1, filepath.Base(s.Name)))
+		if err := ioutil.WriteFile(filepath.Join(root, path), s.Content, 0700); err != nil {
+			return nil, fmt.Errorf("Error writing script %s: %s", path, err)
+		}
+		cmds = append(cmds, Command{Cmd: MultiString{path}})
+	}
+	return cmds, nil
+}
@@ -0,0 +1,284 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// provisions the dotfiles and files of the users in their home directories,
+// owned by the users, once the users exist
+func (l *Lift) userFilesSetup() error {
+	for _, u := range l.Data.Users {
+		if u.Dotfiles == "" && len(u.Files) == 0 {
+			continue
+		}
+		account, err := user.Lookup(u.Name)
+		if err != nil {
+			return fmt.Errorf("Error looking up user %s: %s", u.Name, err)
+		}
+		uid, _ := strconv.Atoi(account.Uid)
+		gid, _ := strconv.Atoi(account.Gid)
+		home := account.HomeDir
+		entry := logger.WithField("user", u.Name)
+
+		if u.Dotfiles != "" {
+			entry.Infof("Installing dotfiles from %s", u.Dotfiles)
+			if err = installDotfiles(u.Dotfiles, home, uid, gid); err != nil {
+				return fmt.Errorf("Error installing dotfiles of %s: %s", u.Name, err)
+			}
+		}
+		for _, wf := range u.Files {
+			path, err := userFilePath(wf.Path, home)
+			if err != nil {
+				return fmt.Errorf("Error writing %s for %s: %s", wf.Path, u.Name, err)
+			}
+			wf.Path = path
+			if wf.Owner == "" {
+				wf.Owner = fmt.Sprintf("%d:%d", uid, gid)
+			}
+			if err = mkdirOwned(filepath.Dir(wf.Path), home, uid, gid); err != nil {
+				return err
+			}
+			// the files are written as root, so links the user created must
+			// not lead out of the home directory
+			if err = checkInHome(wf.Path, home); err != nil {
+				return fmt.Errorf("Error writing %s for %s: %s", wf.Path, u.Name, err)
+			}
+			if err = l.writeFile(wf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// returns the cleaned path of a file of a user, relative to the home
+// directory unless absolute; it must be in the home directory
+func userFilePath(path, home string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(home, path)
+	}
+	path = filepath.Clean(path)
+	if !inDir(path, filepath.Clean(home)) {
+		return "", fmt.Errorf("not in %s", home)
+	}
+	return path, nil
+}
+
+// returns true if path is in dir (both clean), and not dir itself
+func inDir(path, dir string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// returns an error if the directory of path, with its links resolved, isn't
+// in the home directory, or path is a link
+func checkInHome(path, home string) error {
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if realHome, err := filepath.EvalSymlinks(home); err == nil {
+		home = realHome
+	}
+	if dir != home && !inDir(dir, home) {
+		return fmt.Errorf("%s leads out of %s", filepath.Dir(path), home)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a link", path)
+	}
+	return nil
+}
+
+// creates the directories up to dir in the home directory that don't exist
+// yet, owned by the user
+func mkdirOwned(dir, home string, uid, gid int) error {
+	if dir == home || !strings.HasPrefix(dir, home+"/") {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := mkdirOwned(filepath.Dir(dir), home, uid, gid); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating %s: %s", dir, err)
+	}
+	return os.Chown(dir, uid, gid)
+}
+
+// clones a dotfiles git repository and copies its files (without .git) into
+// the home directory, owned by the user. A ref can be given as the url
+// fragment, e.g. https://github.com/me/dotfiles.git#main.
+func installDotfiles(repo, home string, uid, gid int) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		logger.Debug("apk add git")
+		if err = apkCommand("add", "--no-cache", "git").Run(); err != nil {
+			return fmt.Errorf("git could not be installed: %s", err)
+		}
+	}
+	tmp, err := ioutil.TempDir("", "lift-dotfiles-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	args := []string{"clone", "--depth", "1"}
+	if i := strings.LastIndex(repo, "#"); i > 0 {
+		args = append(args, "--branch", repo[i+1:])
+		repo = repo[:i]
+	}
+	if out, err := exec.Command("git", append(args, repo, tmp)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err = os.RemoveAll(filepath.Join(tmp, ".git")); err != nil {
+		return err
+	}
+	return filepath.Walk(tmp, func(src string, fi os.FileInfo, err error) error {
+		if err != nil || src == tmp {
+			return err
+		}
+		rel, _ := filepath.Rel(tmp, src)
+		dest := filepath.Join(home, rel)
+		if err = copyDotfile(src, dest, fi, home); err != nil {
+			return fmt.Errorf("Error copying %s: %s", dest, err)
+		}
+		return os.Lchown(dest, uid, gid)
+	})
+}
+
+// copies a file, directory or link of a dotfiles repository to dest,
+// without following links: existing links are replaced, and links in the
+// repository must point into the home directory
+func copyDotfile(src, dest string, fi os.FileInfo, home string) error {
+	existing, err := os.Lstat(dest)
+	if err == nil && existing.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(dest); err != nil {
+			return err
+		}
+		existing = nil
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		resolved := target
+		if !filepath.IsAbs(resolved) {
+			resolved = filepath.Join(filepath.Dir(dest), resolved)
+		}
+		if !inDir(filepath.Clean(resolved), filepath.Clean(home)) {
+			return fmt.Errorf("link to %s is not in %s", target, home)
+		}
+		if existing != nil {
+			if err = os.RemoveAll(dest); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(target, dest)
+	case fi.IsDir():
+		if existing != nil && existing.IsDir() {
+			return nil
+		}
+		return os.Mkdir(dest, fi.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if err = os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(dest, data, fi.Mode().Perm())
+}
+
+// generates the SSH keypairs of the users that ask for one, unless they
+// already have a key of that type. Like the SSH host keys, they aren't
+// generated in an alternate root, as every system needs its own keys.
+func (l *Lift) userSSHKeysSetup() error {
+	for _, u := range l.Data.Users {
+		if !u.GenerateSSHKey.Enabled {
+			continue
+		}
+		if inAltRoot() {
+			logger.WithField("user", u.Name).Debug("Not generating ssh key in alternate root")
+			continue
+		}
+		account, err := user.Lookup(u.Name)
+		if err != nil {
+			return fmt.Errorf("Error looking up user %s: %s", u.Name, err)
+		}
+		uid, _ := strconv.Atoi(account.Uid)
+		gid, _ := strconv.Atoi(account.Gid)
+		keyType := userKeyType(u.GenerateSSHKey)
+		key := filepath.Join(account.HomeDir, ".ssh", "id_"+keyType)
+		if _, err = os.Stat(key); err == nil {
+			continue
+		}
+
+		if _, err = exec.LookPath("ssh-keygen"); err != nil {
+			logger.Debug("apk add openssh-keygen")
+			if err = apkCommand("add", "--no-cache", "openssh-keygen").Run(); err != nil {
+				return fmt.Errorf("Error installing openssh-keygen: %s", err)
+			}
+		}
+		if err = mkdirOwned(filepath.Dir(key), account.HomeDir, uid, gid); err != nil {
+			return err
+		}
+		if err = os.Chmod(filepath.Dir(key), 0700); err != nil {
+			return err
+		}
+		hostname, _ := os.Hostname()
+		args := []string{"-q", "-N", "", "-t", keyType, "-C", u.Name + "@" + hostname, "-f", key}
+		if u.GenerateSSHKey.Bits > 0 {
+			args = append(args, "-b", strconv.Itoa(u.GenerateSSHKey.Bits))
+		}
+		logger.WithField("user", u.Name).Infof("Generating %s ssh key", keyType)
+		if out, err := exec.Command("ssh-keygen", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error generating ssh key of %s: %s: %s", u.Name, err, strings.TrimSpace(string(out)))
+		}
+		for _, f := range []string{key, key + ".pub"} {
+			if err = os.Chown(f, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// returns the type of the SSH key to generate
+func userKeyType(kg SSHKeyGen) string {
+	if kg.Type == "" {
+		return "ed25519"
+	}
+	return strings.ToLower(kg.Type)
+}
+
+// returns the generated public SSH keys of the users that are to be
+// included in the phone_home report, by user name
+func (l *Lift) userSSHPublicKeys() map[string]string {
+	keys := make(map[string]string)
+	for _, u := range l.Data.Users {
+		if !u.GenerateSSHKey.Enabled || !u.GenerateSSHKey.PhoneHome {
+			continue
+		}
+		account, err := user.Lookup(u.Name)
+		if err != nil {
+			continue
+		}
+		key := filepath.Join(account.HomeDir, ".ssh", "id_"+userKeyType(u.GenerateSSHKey)+".pub")
+		if data, err := ioutil.ReadFile(key); err == nil {
+			keys[u.Name] = strings.TrimSpace(string(data))
+		}
+	}
+	return keys
+}
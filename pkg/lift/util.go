@@ -2,14 +2,48 @@ package lift
 
 import (
 	"bytes"
+	"compress/gzip"
+	crand "crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	sudoersDir   = "/etc/sudoers.d"
+	doasDir      = "/etc/doas.d"
+	doasConfFile = doasDir + "/lift.conf"
+	shadowFile   = "/etc/shadow"
+	passwdFile   = "/etc/passwd"
+
+	// plaintext root passwords must be at least this long
+	minPasswordLength = 8
+	// the password of root or a user that's generated, and reported once
+	randomPassword = "RANDOM"
+	// the length of generated passwords
+	generatedPasswordLength = 24
+	// where generated passwords are written when there's no console
+	passwordsFile = liftConfDir + "/passwords"
+
+	githubKeysURL  = "https://github.com/%s.keys"
+	sshKeysRetries = 3
+	sshKeysTimeout = 10 * time.Second
+)
 
-	log "github.com/sirupsen/logrus"
+var (
+	passwdHashRegex = regexp.MustCompile(`^\$(1|2[abxy]?|5|6|y|gy|7)\$`)
+	// passwords that are refused for root, unless allowed explicitly
+	weakPasswords = []string{"password", "passw0rd", "changeme", "12345678", "123456789", "qwertyuiop",
+		"iloveyou", "alpinelinux"}
 )
 
 // Constants for service states
@@ -38,25 +72,50 @@ func parseConfigFile(path, sep string, kv map[string]string) error {
 // Terribly inefficient way to find keys and replace them with
 // our own value... Refactor at a later point in time...
 // sep defines the separator (typically " ", ":" or "=")
-// This function uses exact (case-sensitive) match on purpose.
+// This function uses exact (case-sensitive) match of the key on purpose.
+// Keys that are not found are added before the first `Match` block (if
+// any), so they don't end up in a conditional block of sshd_config.
 func findReplace(conf []byte, sep string, kv map[string]string) []byte {
 	lines := strings.Split(string(conf), "\n")
-	for k, v := range kv {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := kv[k]
 		found := false
+		insertAt := len(lines)
 		for i, l := range lines {
-			if !strings.HasPrefix(l, "#") && strings.Contains(l, k) {
+			if strings.HasPrefix(l, "Match ") && insertAt == len(lines) {
+				insertAt = i
+			}
+			if !strings.HasPrefix(l, "#") && configKey(l, sep) == k {
 				lines[i] = fmt.Sprintf("%s%s%s", k, sep, v)
 				found = true
 			}
 		}
 		if !found {
-			lines = append(lines, fmt.Sprintf("%s%s%s", k, sep, v))
+			line := fmt.Sprintf("%s%s%s", k, sep, v)
+			lines = append(lines[:insertAt], append([]string{line}, lines[insertAt:]...)...)
 		}
 	}
 	out := strings.Join(lines, "\n")
 	return []byte(out)
 }
 
+// returns the key of a config line (the part before the separator)
+func configKey(line, sep string) string {
+	line = strings.TrimSpace(line)
+	if sep == " " {
+		if f := strings.Fields(line); len(f) > 0 {
+			return f[0]
+		}
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(line, sep, 2)[0])
+}
+
 // this function takes a path to a file, and tries to
 // open it, creating it if it doesn't exist.
 // Don't forget to close the file!!
@@ -87,13 +146,268 @@ func openOrCreate(path string) (*os.File, error) {
 	return file, nil
 }
 
+// decodes file content with the given encoding: base64 (b64), gzip (gz),
+// or gzip compressed and base64 encoded (gzip+b64). Content without
+// encoding is returned as-is.
+func decodeContent(data []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", "text/plain":
+		return data, nil
+	case "b64", "base64":
+		return decodeBase64(data)
+	case "gz", "gzip":
+		return gunzip(data)
+	case "gz+b64", "gzip+b64", "gz+base64", "gzip+base64":
+		decoded, err := decodeBase64(data)
+		if err != nil {
+			return nil, err
+		}
+		return gunzip(decoded)
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// decodes base64 data, ignoring whitespace (e.g. line breaks in yaml)
+func decodeBase64(data []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+}
+
+// decompresses gzip data
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// appends a string to a file, creating the file if it doesn't exist
+func appendToFile(path, s string) error {
+	file, err := openOrCreate(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(s)
+	return err
+}
+
+// appends data to a file, creating it with the given permissions
+// if it doesn't exist
+func appendFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	return err
+}
+
+// adds an entry to a table like fstab or crypttab, in which an entry is
+// identified by its field at index. An existing entry with the same key is
+// replaced, so running again doesn't add the entry twice.
+func setTableEntry(path string, index int, entry string) error {
+	key := strings.Fields(entry)[index]
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return appendToFile(path, entry)
+	} else if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	found := false
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) <= index || strings.HasPrefix(fields[0], "#") || fields[index] != key {
+			continue
+		}
+		if found {
+			lines[i] = ""
+			continue
+		}
+		found = true
+		if strings.Join(fields, " ") == strings.Join(strings.Fields(entry), " ") {
+			lines[i] = line
+		} else {
+			lines[i] = entry
+		}
+	}
+	if !found {
+		return appendToFile(path, entry)
+	}
+	updated := strings.Join(lines, "")
+	if updated == string(data) {
+		return nil
+	}
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	return writeFileAtomic(path, []byte(updated), perm, "")
+}
+
+// writes a file by renaming a temporary file in the same directory, which
+// already has the permissions and owner; so the file is never readable by
+// others, nor incomplete
+func writeFileAtomic(path string, data []byte, perm os.FileMode, owner string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if owner != "" {
+		if out, err := exec.Command("chown", owner, tmp.Name()).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error changing owner of %s to %s: %s: %s", path, owner, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// converts values unmarshalled from yaml into values that can be marshalled
+// to json, since yaml maps are unmarshalled as map[interface{}]interface{}
+func jsonCompatible(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = jsonCompatible(v)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = jsonCompatible(v)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, v := range t {
+			l[i] = jsonCompatible(v)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+// creates the groups. Errors are logged only.
+func (l *Lift) groupsSetup() error {
+	for _, grp := range l.Data.Groups {
+		logger.Infof("Creating group %s", grp.Name)
+		if err := createOSGroup(grp); err != nil {
+			logger.Debugf("Error creating group %s: %v", grp.Name, err)
+		}
+	}
+	return nil
+}
+
+// creates the users, and adds the members of the groups once the users
+// exist. Errors are logged only.
+func (l *Lift) usersSetup() error {
+	for _, user := range l.Data.Users {
+		logger.Infof("Creating user %s", user.Name)
+		generated := user.Password == randomPassword
+		if generated {
+			passwd, err := l.generatePassword(user.Name)
+			if err != nil {
+				return err
+			}
+			user.Password = passwd
+		}
+		if err := createOSUser(user); err != nil {
+			logger.Debugf("Error creating user %s: %v", user.Name, err)
+		} else if generated {
+			l.reportPassword(user.Name, user.Password)
+		}
+	}
+
+	logger.Info("Adding group members")
+	for _, grp := range l.Data.Groups {
+		for _, m := range grp.Members {
+			if err := exec.Command("addgroup", m, grp.Name).Run(); err != nil {
+				logger.Debugf("Error adding %s to %s: %v", m, grp.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// returns true if the string is in the list
+func stringInSlice(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 // interact with openrc to start, stop, restart or reload a service
 func doService(name string, action string) error {
+	if inAltRoot() {
+		logger.WithField("service", name).Debugf("Not executing service %s in alternate root", action)
+		return nil
+	}
 	cmd := exec.Command("service", name, action)
 	err := cmd.Run()
 	return err
 }
 
+// resolves `gh:<username>` and http(s) url entries in a list of ssh
+// keys into the actual keys. Literal keys are returned as-is.
+func resolveSSHKeys(entries []string) []string {
+	var keys []string
+	for _, e := range entries {
+		url := ""
+		switch {
+		case strings.HasPrefix(e, "gh:"):
+			url = fmt.Sprintf(githubKeysURL, strings.TrimPrefix(e, "gh:"))
+		case strings.HasPrefix(e, "https://"), strings.HasPrefix(e, "http://"):
+			url = e
+		default:
+			keys = append(keys, e)
+			continue
+		}
+		logger.WithField("url", url).Debug("Fetching ssh keys")
+		data, err := downloadFileWithRetry(url, nil, sshKeysRetries, sshKeysTimeout)
+		if err != nil {
+			logger.Warnf("Error fetching ssh keys for %s: %v", e, err)
+			continue
+		}
+		for _, k := range strings.Split(string(data), "\n") {
+			if k = strings.TrimSpace(k); k != "" && !strings.HasPrefix(k, "#") {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// Creates an OS group
+func createOSGroup(g Group) error {
+	args := []string{g.Name}
+	if g.GID > 0 {
+		args = append([]string{"-g", strconv.Itoa(g.GID)}, args...)
+	}
+	if g.System {
+		args = append([]string{"-S"}, args...)
+	}
+	return exec.Command("addgroup", args...).Run()
+}
+
 // Creates an OS user
 func createOSUser(u User) error {
 	args := []string{u.Name}
@@ -113,7 +427,7 @@ func createOSUser(u User) error {
 	if u.System {
 		args = append([]string{"-S"}, args...)
 	}
-	if u.Password != "" {
+	if u.Password != "" && !isPasswordHash(u.Password) {
 		input = []byte(fmt.Sprintf("%s\n%s\n", u.Password, u.Password))
 	} else {
 		args = append([]string{"-D"}, args...)
@@ -128,7 +442,7 @@ func createOSUser(u User) error {
 	}
 	err := cmd.Run()
 	if err != nil {
-		log.Debugf("Error creating user %s: %s", u.Name, err)
+		logger.Debugf("Error creating user %s: %s", u.Name, err)
 	}
 
 	if u.Groups != nil && len(u.Groups) > 0 {
@@ -136,12 +450,13 @@ func createOSUser(u User) error {
 			cmd := exec.Command("adduser", u.Name, g)
 			err = cmd.Run()
 			if err != nil {
-				log.Debugf("Error adding %s to %s: %s", u.Name, g, err)
+				logger.Debugf("Error adding %s to %s: %s", u.Name, g, err)
 			}
 		}
 	}
 
 	if u.SSHAuthorizedKeys != nil && len(u.SSHAuthorizedKeys) > 0 {
+		keys := resolveSSHKeys(u.SSHAuthorizedKeys)
 		cmd := exec.Command("grep", u.Name, "/etc/passwd")
 		var b bytes.Buffer
 		cmd.Stdout = &b
@@ -151,18 +466,199 @@ func createOSUser(u User) error {
 		authKeysFile := fmt.Sprintf("%s/authorized_keys", sshDir)
 		file, err := openOrCreate(authKeysFile)
 		if err != nil {
-			log.Debugf("Error while opening %s: %v", authKeysFile, err)
+			logger.Debugf("Error while opening %s: %v", authKeysFile, err)
 		}
 		defer file.Close()
-		_, err = file.WriteString(fmt.Sprintln(strings.Join(u.SSHAuthorizedKeys, "\n")))
+		_, err = file.WriteString(fmt.Sprintln(strings.Join(keys, "\n")))
 		if err != nil {
-			log.Debugf("Error writing keys in %s: %v", authKeysFile, err)
+			logger.Debugf("Error writing keys in %s: %v", authKeysFile, err)
+		}
+	}
+
+	if len(u.Sudo) > 0 {
+		if err = writeSudoRules(u); err != nil {
+			logger.Debugf("Error writing sudo rules for %s: %v", u.Name, err)
+		}
+	}
+
+	if len(u.Doas) > 0 {
+		if err = writeDoasRules(u); err != nil {
+			logger.Debugf("Error writing doas rules for %s: %v", u.Name, err)
 		}
 	}
 
-	// finally unlock
-	cmd = exec.Command("passwd", "-u", u.Name)
+	if isPasswordHash(u.Password) {
+		if err = setPasswordHash(u.Name, u.Password); err != nil {
+			logger.Debugf("Error setting password hash for %s: %v", u.Name, err)
+		}
+	}
+
+	if u.Expire {
+		if err = expirePassword(u.Name); err != nil {
+			logger.Debugf("Error expiring password of %s: %v", u.Name, err)
+		}
+	}
+
+	// finally lock or unlock
+	if u.LockPasswd {
+		cmd = exec.Command("passwd", "-l", u.Name)
+	} else {
+		cmd = exec.Command("passwd", "-u", u.Name)
+	}
 	_ = cmd.Run()
 
 	return nil
 }
+
+// returns true if the password is a crypt(3) hash (MD5, bcrypt,
+// SHA-256, SHA-512 or yescrypt) instead of a plaintext password
+func isPasswordHash(passwd string) bool {
+	return passwdHashRegex.MatchString(passwd)
+}
+
+// sets an already hashed password for a user
+func setPasswordHash(user, hash string) error {
+	cmd := exec.Command("chpasswd", "-e")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s\n", user, hash))
+	return cmd.Run()
+}
+
+// forces a password change on next login, by setting the date of the
+// last password change in /etc/shadow to 0
+func expirePassword(user string) error {
+	shadow, err := ioutil.ReadFile(shadowFile)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(shadow), "\n")
+	found := false
+	for i, l := range lines {
+		fields := strings.Split(l, ":")
+		if len(fields) > 2 && fields[0] == user {
+			fields[2] = "0"
+			lines[i] = strings.Join(fields, ":")
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("user %s not found in %s", user, shadowFile)
+	}
+	return ioutil.WriteFile(shadowFile, []byte(strings.Join(lines, "\n")), 0640)
+}
+
+// installs sudo and writes the sudo rules of the user to /etc/sudoers.d/<user>.
+// The rules are validated with visudo before they're put into place.
+func writeSudoRules(u User) error {
+	if err := apkCommand("add", "sudo").Run(); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, r := range u.Sudo {
+		fmt.Fprintf(&b, "%s %s\n", u.Name, r)
+	}
+	return installValidated(filepath.Join(sudoersDir, sudoersFileName(u.Name)), b.String(), 0440, "visudo", "-cf")
+}
+
+// returns the name of the sudoers.d file of a user. sudo skips the files
+// whose name contains a `.` or ends with `~`, so these are replaced by `_`.
+func sudoersFileName(user string) string {
+	name := strings.Replace(user, ".", "_", -1)
+	if strings.HasSuffix(name, "~") {
+		name = strings.TrimSuffix(name, "~") + "_"
+	}
+	return name
+}
+
+// installs doas and writes the doas rules of the user to /etc/doas.d/<user>.conf.
+// The rules are validated with doas -C before they're put into place.
+func writeDoasRules(u User) error {
+	if err := apkCommand("add", "doas").Run(); err != nil {
+		return err
+	}
+	rules := fmt.Sprintln(strings.Join(u.Doas, "\n"))
+	return installValidated(filepath.Join(doasDir, u.Name+".conf"), rules, 0400, "doas", "-C")
+}
+
+// installs doas and writes the doas rules of the groups, and the additional
+// rules, to /etc/doas.d/lift.conf, validated with doas -C
+func (l *Lift) doasSetup() error {
+	if l.Data.Doas == nil || (len(l.Data.Doas.Groups) == 0 && len(l.Data.Doas.Rules) == 0) {
+		return nil
+	}
+	logger.Debug("Installing doas")
+	if err := apkCommand("add", "doas").Run(); err != nil {
+		return fmt.Errorf("Error installing doas: %s", err)
+	}
+	var rules []string
+	for _, g := range l.Data.Doas.Groups {
+		rules = append(rules, g.rule())
+	}
+	rules = append(rules, l.Data.Doas.Rules...)
+	logger.Infof("Writing doas rules to %s", doasConfFile)
+	return installValidated(doasConfFile, fmt.Sprintln(strings.Join(rules, "\n")), 0400, "doas", "-C")
+}
+
+// returns the doas rule permitting the group
+func (g DoasGroup) rule() string {
+	rule := []string{"permit"}
+	if g.Persist {
+		rule = append(rule, "persist")
+	}
+	if g.NoPass {
+		rule = append(rule, "nopass")
+	}
+	if g.KeepEnv {
+		rule = append(rule, "keepenv")
+	}
+	rule = append(rule, ":"+g.Name)
+	if g.As != "" {
+		rule = append(rule, "as", g.As)
+	}
+	if g.Cmd != "" {
+		rule = append(rule, "cmd", g.Cmd)
+	}
+	return strings.Join(rule, " ")
+}
+
+// writes content to a temporary file, validates it with the given command
+// (which gets the file path as last argument), and then moves it into place
+func installValidated(path, content string, perm os.FileMode, validate ...string) error {
+	tmpfile, err := ioutil.TempFile("", "lift-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.WriteString(content); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	tmpfile.Close()
+	if err = os.Chmod(tmpfile.Name(), perm); err != nil {
+		return err
+	}
+
+	args := append(validate[1:], tmpfile.Name())
+	if out, err := exec.Command(validate[0], args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("invalid %s: %s", path, strings.TrimSpace(string(out)))
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return exec.Command("mv", tmpfile.Name(), path).Run()
+}
+
+// returns a random string of letters and digits, read from crypto/rand
+func randomString(n int) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(letters)))
+	for i := range b {
+		r, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = letters[r.Int64()]
+	}
+	return string(b), nil
+}
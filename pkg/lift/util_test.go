@@ -0,0 +1,22 @@
+package lift
+
+import "testing"
+
+func TestSudoersFileName(t *testing.T) {
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"deploy", "deploy"},
+		{"john.doe", "john_doe"},
+		{"a.b.c", "a_b_c"},
+		{"backup~", "backup_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			if got := sudoersFileName(tt.user); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,727 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	cronScheduleRegex = regexp.MustCompile(`^(@(reboot|yearly|annually|monthly|weekly|daily|midnight|hourly)|\S+\s+\S+\s+\S+\s+\S+\s+\S+)$`)
+	serviceNameRegex  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	collectorRegex    = regexp.MustCompile(`^[a-z][a-z0-9_.]*$`)
+	compressRegex     = regexp.MustCompile(`^[a-z0-9]+([:-][0-9]+)?$`)
+	aliasRegex        = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+	localeRegex       = regexp.MustCompile(`^[A-Za-z]{2,3}(_[A-Z]{2})?(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$|^C(\.UTF-8)?$|^POSIX$`)
+)
+
+// ValidationError is an error in the alpine-data, at the given path
+// (e.g. `users[1].name`)
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// LoadAlpineData reads alpine-data from a file, or downloads it from a
+// http(s) url
+func LoadAlpineData(source string, headers http.Header) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return downloadFileWithRetry(source, headers, 0, 30*time.Second)
+	}
+	return ioutil.ReadFile(source)
+}
+
+// Validate strictly parses alpine-data (the YAML parts of gzip or MIME
+// multipart alpine-data), rejecting unknown keys and values of the wrong
+// type, and then checks the values for required fields and valid ports,
+// device paths, permissions etc. All errors found are returned.
+func Validate(data []byte) []error {
+	data, _, err := decodeAlpineData(data)
+	if err != nil {
+		return []error{err}
+	}
+	if err = checkVersion(data); err != nil {
+		return []error{err}
+	}
+	ad := InitAlpineData()
+	v := &validator{}
+	if err := yaml.UnmarshalStrict(data, ad); err != nil {
+		te, ok := err.(*yaml.TypeError)
+		if !ok {
+			// a syntax error, nothing was decoded
+			return []error{err}
+		}
+		// type errors contain all errors with their line number, the
+		// rest of the data is decoded nevertheless
+		for _, e := range te.Errors {
+			// merge annotations are allowed in any map
+			if strings.Contains(e, "field "+mergeKey+" not found") {
+				continue
+			}
+			v.errs = append(v.errs, fmt.Errorf("%s", e))
+		}
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err == nil {
+		v.mergeAnnotations("", doc)
+	}
+	v.validate(ad)
+	return v.errs
+}
+
+// returns the errors of the keys that are not part of the alpine-data
+// specification, with their line numbers; e.g. "line 1: field pasword not
+// found in type lift.AlpineData"
+func unknownKeys(data []byte) []string {
+	te, ok := yaml.UnmarshalStrict(data, InitAlpineData()).(*yaml.TypeError)
+	if !ok {
+		return nil
+	}
+	var unknown []string
+	for _, e := range te.Errors {
+		// merge annotations are allowed in any map
+		if strings.Contains(e, " not found in type ") && !strings.Contains(e, "field "+mergeKey+" not found") {
+			unknown = append(unknown, e)
+		}
+	}
+	return unknown
+}
+
+// validator collects validation errors
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) required(path, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.errorf(path, "is required")
+	}
+}
+
+func (v *validator) port(path string, port int) {
+	if port < 0 || port > 65535 {
+		v.errorf(path, "invalid port %d", port)
+	}
+}
+
+func (v *validator) device(path, dev string) {
+	if dev != "" && !strings.HasPrefix(dev, "/dev/") {
+		v.errorf(path, "invalid device %q, must be a path in /dev", dev)
+	}
+}
+
+// a path in /dev, or a selector of a disk
+func (v *validator) diskDevice(path, dev string) {
+	if !isDeviceSelector(dev) {
+		v.device(path, dev)
+	} else if _, err := parseDeviceSelector(dev); err != nil {
+		v.errorf(path, "%s", err)
+	}
+}
+
+func (v *validator) absPath(path, p string) {
+	if p != "" && !filepath.IsAbs(p) {
+		v.errorf(path, "must be an absolute path, got %q", p)
+	}
+}
+
+func (v *validator) size(path, size string) {
+	if size == "" {
+		return
+	}
+	if _, err := parseSize(size, 0); err != nil {
+		v.errorf(path, "invalid size %q", size)
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	if value != "" && !stringInSlice(value, allowed) {
+		v.errorf(path, "invalid value %q, must be one of %s", value, strings.Join(allowed, ", "))
+	}
+}
+
+func (v *validator) fileContent(path string, wf WriteFile) {
+	if wf.Permissions != "" {
+		if _, err := strconv.ParseUint(wf.Permissions, 8, 32); err != nil {
+			v.errorf(path+".permissions", "invalid octal permissions %q", wf.Permissions)
+		}
+	}
+	v.oneOf(path+".encoding", strings.ToLower(wf.Encoding), "text/plain", "b64", "base64", "gz", "gzip",
+		"gz+b64", "gzip+b64", "gz+base64", "gzip+base64")
+}
+
+func (v *validator) mergeAnnotations(path string, node interface{}) {
+	strategies := []string{MergeDeep, MergeReplace, MergeAppend, MergeUniqueAppend}
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		for k, val := range n {
+			p := fmt.Sprintf("%v", k)
+			if path != "" {
+				p = path + "." + p
+			}
+			if k != mergeKey {
+				v.mergeAnnotations(p, val)
+				continue
+			}
+			switch a := val.(type) {
+			case string:
+				v.oneOf(p, a, strategies...)
+			case map[interface{}]interface{}:
+				for key, strategy := range a {
+					s, _ := strategy.(string)
+					v.oneOf(fmt.Sprintf("%s.%v", p, key), s, strategies...)
+				}
+			default:
+				v.errorf(p, "must be a strategy or a map of keys to strategies")
+			}
+		}
+	case []interface{}:
+		for i, val := range n {
+			v.mergeAnnotations(fmt.Sprintf("%s[%d]", path, i), val)
+		}
+	}
+}
+
+func (v *validator) commands(path string, cmds []Command) {
+	for i, c := range cmds {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if len(c.Cmd) == 0 {
+			v.errorf(p+".cmd", "is required")
+		}
+		v.oneOf(p+".frequency", c.Frequency, FrequencyAlways, FrequencyOnce, FrequencyPerInstance)
+		if c.Timeout != "" {
+			if _, err := time.ParseDuration(c.Timeout); err != nil {
+				v.errorf(p+".timeout", "invalid duration %q", c.Timeout)
+			}
+		}
+	}
+}
+
+func (v *validator) filesystem(path string, fs Filesystem) {
+	if fs.MountPoint != "" && fs.FileSystemType == "" {
+		v.errorf(path+".filesystem", "is required with mountpoint")
+	}
+	v.absPath(path+".mountpoint", fs.MountPoint)
+	fsType := strings.ToLower(fs.FileSystemType)
+	if fs.Compress != "" && fsType != "btrfs" && fsType != "zfs" {
+		v.errorf(path+".compress", "is only supported by btrfs and zfs")
+	} else if fs.Compress != "" && !compressRegex.MatchString(fs.Compress) {
+		v.errorf(path+".compress", "invalid compression %q", fs.Compress)
+	}
+	if len(fs.Subvolumes) > 0 && fsType != "btrfs" {
+		v.errorf(path+".subvolumes", "are only supported by btrfs")
+	}
+	for i, sv := range fs.Subvolumes {
+		p := fmt.Sprintf("%s.subvolumes[%d]", path, i)
+		v.required(p+".name", sv.Name)
+		v.absPath(p+".mountpoint", sv.MountPoint)
+	}
+	if fsType == "zfs" {
+		v.required(path+".pool", fs.Pool)
+	} else if fs.Pool != "" || len(fs.Datasets) > 0 {
+		v.errorf(path+".pool", "pools and datasets are only supported by zfs")
+	}
+	for i, ds := range fs.Datasets {
+		p := fmt.Sprintf("%s.datasets[%d]", path, i)
+		v.required(p+".name", ds.Name)
+		v.absPath(p+".mountpoint", ds.MountPoint)
+	}
+}
+
+func (v *validator) validate(ad *AlpineData) {
+	for name, freq := range ad.Frequency {
+		v.oneOf("frequency."+name, freq, FrequencyAlways, FrequencyOnce, FrequencyPerInstance)
+	}
+	v.device("scratch_disk", ad.ScratchDisk)
+	v.oneOf("unlift", string(ad.UnLift), unliftLevels...)
+	if u := ad.LiftUpdate; u != nil && u.URL != "" && !isURL(u.URL) {
+		v.errorf("lift_update.url", "invalid url %q", u.URL)
+	}
+	if r := ad.Root; r == nil || !r.AllowWeakPassword {
+		if ad.RootPasswd != "" && isWeakPassword(ad.RootPasswd) {
+			v.errorf("password", "weak root password, set root.allow_weak_password to allow it")
+		}
+		if r != nil && r.Password != "" && isWeakPassword(r.Password) {
+			v.errorf("root.password", "weak root password, set root.allow_weak_password to allow it")
+		}
+	}
+	if ad.Root != nil {
+		v.absPath("root.shell", ad.Root.Shell)
+	}
+	if ad.Locale != "" && !localeRegex.MatchString(ad.Locale) {
+		v.errorf("locale", "invalid locale %q", ad.Locale)
+	}
+	if ad.TimeZone != "" {
+		if _, err := os.Stat(zoneinfoDir); err == nil {
+			// only where the zoneinfo database is installed
+			if err = checkTimezone(ad.TimeZone); err != nil {
+				v.errorf("timezone", "%s", err)
+			}
+		} else if strings.HasPrefix(ad.TimeZone, "/") || strings.Contains(ad.TimeZone, "..") {
+			v.errorf("timezone", "invalid timezone %q", ad.TimeZone)
+		}
+	}
+	if fields := strings.Fields(ad.Keymap); len(fields) > 2 || strings.ContainsAny(ad.Keymap, "/\"'") {
+		v.errorf("keymap", "invalid keymap %q, expected \"<layout> [<variant>]\"", ad.Keymap)
+	} else if _, err := os.Stat(keymapsDir); err == nil && len(fields) > 0 {
+		// only where the keymaps are installed, e.g. on the target system
+		if _, err = keymapFile(parseKeymap(ad.Keymap)); err != nil {
+			v.errorf("keymap", "%s", err)
+		}
+	}
+	if strings.ContainsAny(ad.ConsoleFont, "/ \t\"'") {
+		v.errorf("consolefont", "invalid console font %q", ad.ConsoleFont)
+	}
+	v.commands("bootcmd", ad.BootCMD)
+	v.commands("runcmd", ad.RunCMD)
+
+	if n := ad.Network; n != nil {
+		for i, iface := range n.InterfaceOpts.Specs {
+			p := fmt.Sprintf("network.interfaces[%d]", i)
+			v.required(p+".name", iface.Name)
+			if iface.MTU < 0 {
+				v.errorf(p+".mtu", "invalid mtu %d", iface.MTU)
+			}
+			if iface.VLAN < 0 || iface.VLAN > 4094 {
+				v.errorf(p+".vlan", "invalid vlan id %d", iface.VLAN)
+			}
+			if iface.IPv6 != nil {
+				if _, ok := ipv6Methods[strings.ToLower(iface.IPv6.Mode)]; !ok && iface.IPv6.Mode != "" {
+					v.errorf(p+".ipv6.mode", "invalid value %q, must be one of static, slaac (auto), dhcp (dhcpv6)", iface.IPv6.Mode)
+				}
+			}
+		}
+		if n.NTP != nil {
+			v.oneOf("network.ntp.daemon", n.NTP.Daemon, "chrony", "openntpd", "busybox")
+		}
+	}
+
+	if mc := ad.MTA; mc != nil {
+		v.oneOf("mta.backend", mc.Backend, "ssmtp", "msmtp", "busybox")
+		if mc.Backend == "msmtp" || mc.Backend == "busybox" {
+			v.required("mta.server", mc.Server)
+		}
+		if mc.Backend == "busybox" {
+			v.oneOf("mta.authmethod", strings.ToUpper(mc.AuthMethod), "PLAIN", "LOGIN")
+		}
+		// ssmtp only forwards the mail for root
+		if len(mc.Aliases) > 0 && (mc.Backend == "" || mc.Backend == "ssmtp") {
+			v.errorf("mta.aliases", "not supported by ssmtp, use msmtp or busybox")
+		}
+		for _, a := range mailAliases(mc) {
+			if !aliasRegex.MatchString(a.Name) {
+				v.errorf("mta.aliases", "invalid alias %q", a.Name)
+			}
+			if len(a.Recipients) == 0 {
+				v.errorf("mta.aliases."+a.Name, "is required")
+			}
+		}
+	}
+
+	if sl := ad.Syslog; sl != nil {
+		v.oneOf("syslog.daemon", sl.Daemon, "busybox", "rsyslog")
+		for i, r := range sl.Remote {
+			p := fmt.Sprintf("syslog.remote[%d]", i)
+			v.required(p+".host", r.Host)
+			v.port(p+".port", r.Port)
+			v.oneOf(p+".protocol", strings.ToLower(r.Protocol), "udp", "tcp")
+			if strings.EqualFold(r.Protocol, "tcp") && sl.Daemon != "rsyslog" {
+				v.errorf(p+".protocol", "busybox syslogd only forwards over udp, use rsyslog")
+			}
+		}
+		if sl.RotateSize != "" {
+			if _, err := parseLogSize(sl.RotateSize); err != nil {
+				v.errorf("syslog.rotate_size", "%s", err)
+			}
+		}
+		if sl.Rotate < 0 {
+			v.errorf("syslog.rotate", "must not be negative")
+		}
+	}
+
+	if ad.SSHDConfig != nil {
+		v.port("sshd.port", ad.SSHDConfig.Port)
+		if ad.SSHDConfig.MaxAuthTries < 0 {
+			v.errorf("sshd.max_auth_tries", "must not be negative")
+		}
+	}
+
+	for i, g := range ad.Groups {
+		v.required(fmt.Sprintf("groups[%d].name", i), g.Name)
+	}
+	if ad.Doas != nil {
+		for i, g := range ad.Doas.Groups {
+			p := fmt.Sprintf("doas.groups[%d]", i)
+			v.required(p+".name", g.Name)
+			if g.Persist && g.NoPass {
+				v.errorf(p, "persist and nopass are mutually exclusive")
+			}
+		}
+		for i, r := range ad.Doas.Rules {
+			if f := strings.Fields(r); len(f) == 0 || (f[0] != "permit" && f[0] != "deny") {
+				v.errorf(fmt.Sprintf("doas.rules[%d]", i), "invalid rule %q, must start with permit or deny", r)
+			}
+		}
+	}
+	for i, u := range ad.Users {
+		v.required(fmt.Sprintf("users[%d].name", i), u.Name)
+		if kg := u.GenerateSSHKey; kg.Enabled {
+			p := fmt.Sprintf("users[%d].generate_ssh_key", i)
+			v.oneOf(p+".type", strings.ToLower(kg.Type), "ed25519", "ecdsa", "rsa")
+			if kg.Bits < 0 {
+				v.errorf(p+".bits", "must not be negative")
+			}
+		}
+		for j, f := range u.Files {
+			p := fmt.Sprintf("users[%d].files[%d]", i, j)
+			v.required(p+".path", f.Path)
+			home := u.HomeDir
+			if home == "" {
+				home = "/home/" + u.Name
+			}
+			if _, err := userFilePath(f.Path, home); f.Path != "" && err != nil {
+				v.errorf(p+".path", "must be in the home directory, got %q", f.Path)
+			}
+			v.fileContent(p, f)
+		}
+	}
+
+	for i, wf := range ad.WriteFiles {
+		p := fmt.Sprintf("write_files[%d]", i)
+		v.required(p+".path", wf.Path)
+		v.absPath(p+".path", wf.Path)
+		v.fileContent(p, wf)
+	}
+	agents := make(map[string]bool)
+	for i, a := range ad.Agents {
+		p := fmt.Sprintf("agents[%d]", i)
+		v.required(p+".name", a.Name)
+		if a.Name != "" && !serviceNameRegex.MatchString(a.Name) {
+			v.errorf(p+".name", "invalid name %q", a.Name)
+		} else if agents[a.Name] {
+			v.errorf(p+".name", "duplicate agent %q", a.Name)
+		}
+		agents[a.Name] = true
+		if a.URL != "" {
+			if !isURL(a.URL) {
+				v.errorf(p+".url", "invalid url %q", a.URL)
+			}
+			v.required(p+".sha256", a.SHA256)
+		}
+		if a.Path != "" {
+			v.absPath(p+".path", a.Path)
+		}
+		for j, wf := range a.Config {
+			fp := fmt.Sprintf("%s.config[%d]", p, j)
+			v.required(fp+".path", wf.Path)
+			v.absPath(fp+".path", wf.Path)
+			v.fileContent(fp, wf)
+		}
+		if s := a.Service; s.Enabled {
+			if s.Name != "" && !serviceNameRegex.MatchString(s.Name) {
+				v.errorf(p+".service.name", "invalid name %q", s.Name)
+			}
+			if s.Command == "" && a.URL == "" && len(a.Packages) == 0 {
+				v.errorf(p+".service.command", "is required without url or packages")
+			}
+		}
+	}
+	if mc := ad.Monitoring; mc != nil {
+		v.port("monitoring.port", mc.Port)
+		if mc.ListenAddress != "" && net.ParseIP(mc.ListenAddress) == nil {
+			v.errorf("monitoring.listen_address", "invalid address %q", mc.ListenAddress)
+		}
+		for i, c := range mc.Collectors {
+			if !collectorRegex.MatchString(c) {
+				v.errorf(fmt.Sprintf("monitoring.collectors[%d]", i), "invalid collector %q", c)
+			} else if stringInSlice(c, mc.DisabledCollectors) {
+				v.errorf(fmt.Sprintf("monitoring.collectors[%d]", i), "collector %q is also disabled", c)
+			}
+		}
+		for i, c := range mc.DisabledCollectors {
+			if !collectorRegex.MatchString(c) {
+				v.errorf(fmt.Sprintf("monitoring.disabled_collectors[%d]", i), "invalid collector %q", c)
+			}
+		}
+		if ca := mc.CAdvisor; ca.Enabled {
+			v.port("monitoring.cadvisor.port", ca.Port)
+			if ca.ListenAddress != "" && net.ParseIP(ca.ListenAddress) == nil {
+				v.errorf("monitoring.cadvisor.listen_address", "invalid address %q", ca.ListenAddress)
+			}
+		}
+	}
+	certificates := make(map[string]bool)
+	for i, c := range ad.Certificates {
+		p := fmt.Sprintf("certificates[%d]", i)
+		v.required(p+".name", c.Name)
+		if c.Name != "" && !serviceNameRegex.MatchString(c.Name) {
+			v.errorf(p+".name", "invalid name %q", c.Name)
+		} else if certificates[c.Name] {
+			v.errorf(p+".name", "duplicate certificate %q", c.Name)
+		}
+		certificates[c.Name] = true
+		v.required(p+".cert", c.Cert)
+		v.required(p+".key", c.Key)
+		// secrets are only resolved when lift runs
+		if isPEM(c.Cert) && isPEM(c.Key) && (c.Chain == "" || isPEM(c.Chain)) {
+			if err := checkCertificate(c.Cert, c.Key, c.Chain); err != nil {
+				v.errorf(p, "%s", err)
+			}
+		}
+		if c.CertPath != "" {
+			v.absPath(p+".cert_path", c.CertPath)
+		}
+		if c.KeyPath != "" {
+			v.absPath(p+".key_path", c.KeyPath)
+		}
+		if c.ChainPath != "" {
+			v.absPath(p+".chain_path", c.ChainPath)
+		}
+		for j, s := range c.Reload {
+			if !serviceNameRegex.MatchString(s) {
+				v.errorf(fmt.Sprintf("%s.reload[%d]", p, j), "invalid service %q", s)
+			}
+		}
+	}
+	if ac := ad.ACME; ac != nil {
+		if len(ac.Domains) == 0 {
+			v.errorf("acme.domains", "is required")
+		}
+		for i, d := range ac.Domains {
+			p := fmt.Sprintf("acme.domains[%d]", i)
+			v.required(p, d)
+			if strings.HasPrefix(d, "*.") && ac.Challenge != "dns" {
+				v.errorf(p, "wildcard domain %q requires the dns challenge", d)
+			}
+		}
+		v.required("acme.email", ac.Email)
+		if ac.Server != "" && !isURL(ac.Server) {
+			v.errorf("acme.server", "invalid url %q", ac.Server)
+		}
+		v.oneOf("acme.challenge", ac.Challenge, "http", "dns")
+		if ac.Challenge == "dns" {
+			v.required("acme.provider", ac.Provider)
+		}
+		if ac.Webroot != "" {
+			v.absPath("acme.webroot", ac.Webroot)
+		}
+		if ac.RenewDays < 0 {
+			v.errorf("acme.renew_days", "must not be negative")
+		}
+		if ac.RenewSchedule != "" && !cronScheduleRegex.MatchString(strings.TrimSpace(ac.RenewSchedule)) {
+			v.errorf("acme.renew_schedule", "invalid schedule %q", ac.RenewSchedule)
+		}
+		for i, s := range ac.Reload {
+			if !serviceNameRegex.MatchString(s) {
+				v.errorf(fmt.Sprintf("acme.reload[%d]", i), "invalid service %q", s)
+			}
+		}
+	}
+	if d := ad.DRP; d.configured() {
+		v.required("dr_provision.endpoint", d.Endpoint)
+		v.required("dr_provision.uuid", d.UUID)
+		if d.RegisterTimeout != "" {
+			if _, err := time.ParseDuration(d.RegisterTimeout); err != nil {
+				v.errorf("dr_provision.register_timeout", "invalid duration %q", d.RegisterTimeout)
+			}
+		}
+	}
+	if d := ad.Downloads; d != nil {
+		if d.Parallel < 0 {
+			v.errorf("downloads.parallel", "must not be negative")
+		}
+		if d.Retries < -1 {
+			v.errorf("downloads.retries", "must be -1 (no retries) or more")
+		}
+		if d.Budget != "" {
+			if _, err := time.ParseDuration(d.Budget); err != nil {
+				v.errorf("downloads.budget", "invalid duration %q", d.Budget)
+			}
+		}
+	}
+
+	arrays := make(map[string]bool)
+	for i, a := range ad.RAID {
+		p := fmt.Sprintf("raid[%d]", i)
+		v.required(p+".name", a.Name)
+		if a.Name != "" && !serviceNameRegex.MatchString(a.Name) {
+			v.errorf(p+".name", "invalid name %q", a.Name)
+		} else if arrays[a.Name] {
+			v.errorf(p+".name", "duplicate array %q", a.Name)
+		}
+		arrays[a.Name] = true
+		v.required(p+".level", a.Level)
+		v.oneOf(p+".level", a.Level, "0", "1", "4", "5", "6", "10")
+		minDevices := map[string]int{"4": 3, "5": 3, "6": 4}[a.Level]
+		if minDevices == 0 {
+			minDevices = 2
+		}
+		if _, ok := raidModule[a.Level]; ok && len(a.Devices) < minDevices {
+			v.errorf(p+".devices", "RAID level %s needs at least %d devices", a.Level, minDevices)
+		}
+		for j, dev := range a.Devices {
+			v.diskDevice(fmt.Sprintf("%s.devices[%d]", p, j), dev)
+		}
+		for j, dev := range a.Spares {
+			v.diskDevice(fmt.Sprintf("%s.spares[%d]", p, j), dev)
+		}
+	}
+	for i, d := range ad.Disks {
+		p := fmt.Sprintf("disks[%d]", i)
+		v.required(p+".device", d.Device)
+		if isISCSIDevice(d.Device) {
+			if ad.ISCSI == nil {
+				v.errorf(p+".device", "iSCSI device %q requires the iscsi block", d.Device)
+			}
+		} else {
+			v.diskDevice(p+".device", d.Device)
+		}
+		if _, err := partitionTable(d.PartitionTable); err != nil {
+			v.errorf(p+".partition_table", "%s", err)
+		}
+		v.filesystem(p, d.Filesystem)
+		for j, part := range d.Partitions {
+			pp := fmt.Sprintf("%s.partitions[%d]", p, j)
+			v.size(pp+".size", part.Size)
+			v.filesystem(pp, part.Filesystem)
+		}
+	}
+	if ic := ad.ISCSI; ic != nil {
+		if ic.InitiatorName != "" && !strings.HasPrefix(ic.InitiatorName, "iqn.") && !strings.HasPrefix(ic.InitiatorName, "eui.") {
+			v.errorf("iscsi.initiator_name", "invalid initiator name %q", ic.InitiatorName)
+		}
+		for i, t := range ic.Targets {
+			p := fmt.Sprintf("iscsi.targets[%d]", i)
+			v.required(p+".portal", t.Portal)
+			if c := t.CHAP; c != nil {
+				v.required(p+".chap.username", c.Username)
+				v.required(p+".chap.password", c.Password)
+				if c.MutualUsername != "" {
+					v.required(p+".chap.mutual_password", c.MutualPassword)
+				}
+			}
+		}
+	}
+	if ad.LVM != nil {
+		for i, vg := range ad.LVM.VolumeGroups {
+			p := fmt.Sprintf("lvm.volume_groups[%d]", i)
+			v.required(p+".name", vg.Name)
+			for j, pv := range vg.PhysicalVolumes {
+				v.diskDevice(fmt.Sprintf("%s.physical_volumes[%d]", p, j), pv)
+			}
+			for j, lv := range vg.LogicalVolumes {
+				lp := fmt.Sprintf("%s.logical_volumes[%d]", p, j)
+				v.required(lp+".name", lv.Name)
+				v.filesystem(lp, lv.Filesystem)
+			}
+		}
+	}
+	if ad.Swap != nil {
+		v.device("swap.device", ad.Swap.Device)
+		v.absPath("swap.file", ad.Swap.File)
+	}
+	for i, m := range ad.Mounts {
+		p := fmt.Sprintf("mounts[%d]", i)
+		v.required(p+".source", m.Source)
+		v.required(p+".target", m.Target)
+		v.absPath(p+".target", m.Target)
+	}
+	for i, m := range ad.NFS {
+		p := fmt.Sprintf("nfs[%d]", i)
+		v.required(p+".server", m.Server)
+		v.required(p+".export", m.Export)
+		v.absPath(p+".export", m.Export)
+		v.required(p+".target", m.Target)
+		v.absPath(p+".target", m.Target)
+		v.oneOf(p+".version", m.Version, "3", "4", "4.0", "4.1", "4.2")
+	}
+
+	for i, sv := range ad.Services {
+		p := fmt.Sprintf("services[%d]", i)
+		v.required(p+".name", sv.Name)
+		v.oneOf(p+".state", sv.State, "started", "stopped", "restarted")
+	}
+	for i, m := range ad.Modules.Kernel {
+		v.required(fmt.Sprintf("modules.kernel[%d].name", i), m.Name)
+	}
+	names := ModuleNames()
+	for i, name := range ad.Modules.Enable {
+		v.oneOf(fmt.Sprintf("modules.enable[%d]", i), name, names...)
+	}
+	for i, name := range ad.Modules.Disable {
+		v.oneOf(fmt.Sprintf("modules.disable[%d]", i), name, names...)
+	}
+	ordered := make(map[string]bool)
+	for i, name := range ad.Modules.Order {
+		p := fmt.Sprintf("modules.order[%d]", i)
+		v.oneOf(p, name, names...)
+		if ordered[name] {
+			v.errorf(p, "duplicate module %q", name)
+		}
+		ordered[name] = true
+	}
+	if ad.Modules.Parallel < 0 {
+		v.errorf("modules.parallel", "must not be negative")
+	}
+	for name, after := range ad.Modules.After {
+		v.oneOf("modules.after", name, names...)
+		for i, dep := range after {
+			v.oneOf(fmt.Sprintf("modules.after.%s[%d]", name, i), dep, names...)
+		}
+	}
+	if ad.Cron != nil {
+		for i, job := range ad.Cron.Jobs {
+			p := fmt.Sprintf("cron.jobs[%d]", i)
+			if !cronScheduleRegex.MatchString(strings.TrimSpace(job.Schedule)) {
+				v.errorf(p+".schedule", "invalid schedule %q", job.Schedule)
+			}
+			v.required(p+".command", job.Command)
+		}
+		for interval := range ad.Cron.Periodic {
+			v.oneOf("cron.periodic."+interval, interval, periodicIntervals...)
+		}
+	}
+	if ad.WireGuard != nil {
+		for i, wg := range ad.WireGuard.Interfaces {
+			p := fmt.Sprintf("wireguard.interfaces[%d]", i)
+			v.required(p+".name", wg.Name)
+			v.port(p+".listen_port", wg.ListenPort)
+			for j, peer := range wg.Peers {
+				v.required(fmt.Sprintf("%s.peers[%d].public_key", p, j), peer.PublicKey)
+			}
+		}
+	}
+	if ad.Firewall != nil {
+		v.oneOf("firewall.backend", ad.Firewall.Backend, "awall", "nftables")
+	}
+	if ad.K3S != nil {
+		v.oneOf("k3s.role", ad.K3S.Role, "server", "agent")
+		if ad.K3S.Role == "agent" {
+			v.required("k3s.server", ad.K3S.Server)
+			v.required("k3s.token", ad.K3S.Token)
+		}
+		if ad.K3S.InstallURL != "" {
+			v.required("k3s.install_sha256", ad.K3S.InstallSHA256)
+		}
+	}
+	if ad.PhoneHome != nil {
+		v.required("phone_home.url", ad.PhoneHome.URL)
+	}
+}
@@ -0,0 +1,36 @@
+package lift
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"known keys", "password: secret\nnetwork:\n  hostname: alpine\n", nil},
+		{"unknown key", "pasword: secret\n", []string{"line 1: field pasword not found in type lift.AlpineData"}},
+		{
+			"nested unknown key",
+			"network:\n  hostname: alpine\n  domain: example.com\n",
+			[]string{"line 3: field domain not found in type lift.NetworkSettings"},
+		},
+		{
+			"merge annotations",
+			"users:\n  - name: alpine\n    " + mergeKey + ": append\n",
+			nil,
+		},
+		{"type errors", "network:\n  hostname: [alpine]\n", nil},
+		{"syntax error", "network: [\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unknownKeys([]byte(tt.data)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
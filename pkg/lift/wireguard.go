@@ -0,0 +1,99 @@
+package lift
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	wireguardDir       = "/etc/wireguard"
+	wgQuickServiceFile = "/etc/init.d/wg-quick"
+)
+
+// installs wireguard-tools, writes the configuration of the WireGuard
+// interfaces and enables and starts a wg-quick service for each of them
+func (l *Lift) wireguardSetup() error {
+	if l.Data.WireGuard == nil || len(l.Data.WireGuard.Interfaces) == 0 {
+		return nil
+	}
+	logger.Debug("Installing wireguard-tools")
+	if err := apkCommand("add", "wireguard-tools").Run(); err != nil {
+		return fmt.Errorf("Error installing wireguard-tools: %s", err)
+	}
+	if err := os.MkdirAll(wireguardDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(wgQuickServiceFile, []byte(wgQuickServiceTemplate), 0755); err != nil {
+		return err
+	}
+
+	for _, wg := range l.Data.WireGuard.Interfaces {
+		if wg.Name == "" {
+			return errors.New("WireGuard interface without name")
+		}
+		entry := logger.WithField("interface", wg.Name)
+		var err error
+		if wg.PrivateKey, err = wireguardPrivateKey(wg); err != nil {
+			return fmt.Errorf("Error getting private key of %s: %s", wg.Name, err)
+		}
+		if pub, err := wireguardPublicKey(wg.PrivateKey); err == nil {
+			entry.Infof("WireGuard public key: %s", pub)
+		}
+
+		conf, err := generateFileFromTemplate(*wireguardConf, wg)
+		if err != nil {
+			return err
+		}
+		confFile := filepath.Join(wireguardDir, wg.Name+".conf")
+		entry.Debugf("Copying WireGuard configuration to %s", confFile)
+		if err = exec.Command("mv", conf, confFile).Run(); err != nil {
+			return err
+		}
+		if err = os.Chmod(confFile, 0600); err != nil {
+			return err
+		}
+
+		service := "wg-quick." + wg.Name
+		if err = os.Symlink(filepath.Base(wgQuickServiceFile), filepath.Join(filepath.Dir(wgQuickServiceFile), service)); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err = exec.Command("rc-update", "add", service, defaultRunlevel).Run(); err != nil {
+			return fmt.Errorf("Error enabling %s: %s", service, err)
+		}
+		entry.Debugf("Starting %s", service)
+		if err = doService(service, START); err != nil {
+			return fmt.Errorf("Error starting %s: %s", service, err)
+		}
+	}
+	return nil
+}
+
+// returns the private key of the interface, downloading or generating
+// it when it's not given inline
+func wireguardPrivateKey(wg WireGuardInterface) (string, error) {
+	if wg.PrivateKey != "" {
+		return strings.TrimSpace(wg.PrivateKey), nil
+	}
+	if wg.PrivateKeyURL != "" {
+		logger.WithField("url", wg.PrivateKeyURL).Debug("Downloading WireGuard private key")
+		key, err := downloadFile(wg.PrivateKeyURL, nil)
+		return strings.TrimSpace(string(key)), err
+	}
+	logger.WithField("interface", wg.Name).Debug("Generating WireGuard private key")
+	key, err := exec.Command("wg", "genkey").Output()
+	return strings.TrimSpace(string(key)), err
+}
+
+// derives the public key from a private key
+func wireguardPublicKey(privateKey string) (string, error) {
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = bytes.NewBufferString(privateKey + "\n")
+	key, err := cmd.Output()
+	return strings.TrimSpace(string(key)), err
+}